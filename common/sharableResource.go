@@ -38,9 +38,128 @@ const (
 	ConfigKeyStoreFile = "filestore"
 	// config entry / key => "datastore" (app.toml)
 	ConfigKeyStoreData = "datastore"
+	// config entry / key => "sqlitestore" (app.toml)
+	ConfigKeyStoreSqlite = "sqlitestore"
+	// config entry / key => "boltstore" (app.toml)
+	ConfigKeyStoreBolt = "boltstore"
+	// config entry / key => "influxstore" (app.toml)
+	ConfigKeyStoreInflux = "influxstore"
+	// config entry / key => "memorystore" (app.toml)
+	ConfigKeyStoreMemory = "memorystore"
 
 	// config entry / key => "repo" (app.toml)
 	ConfigKeyRepo = "repo"
+	// config entry / key => "type" (app.toml); under [datastore], the datastore implementation (e.g. "elasticsearch")
+	ConfigKeyStoreDataType = "type"
+	// config entry / key => "hosts" (app.toml); under [datastore], e.g. [ "http://localhost:9200" ]
+	ConfigKeyStoreDataHosts = "hosts"
+	// config entry / key => "username" and "password" (app.toml); under [datastore] / [influxstore], basic authentication (optional)
+	ConfigKeyStoreDataUsername = "username"
+	ConfigKeyStoreDataPassword = "password"
+	// config entry / key => "index_pattern" (app.toml); under [datastore], date based index name
+	// e.g. "{module}_yyyy.mm" => stock_aastocks_2019.07 (the trx_date in UTC)
+	ConfigKeyStoreDataIndexPattern = "index_pattern"
+	// config entry / key => "template" (app.toml); under [datastore], name of the index template installed
+	ConfigKeyStoreDataTemplate = "template"
+	// config entry / key => "refresh" (app.toml); under [datastore], refresh policy of the writes ("false", "true" or "wait_for")
+	ConfigKeyStoreDataRefresh = "refresh"
+	// config entry / key => "timeout" (app.toml); under [datastore] / [influxstore], timeout (e.g. "10s") of a request
+	ConfigKeyStoreDataTimeout = "timeout"
+	// config entry / key => "retry_max" and "retry_backoff" (app.toml); under [datastore],
+	// max number of retries on 429 (too many requests) and the initial backoff (e.g. "500ms", doubled per retry)
+	ConfigKeyStoreDataRetryMax = "retry_max"
+	ConfigKeyStoreDataRetryBackoff = "retry_backoff"
+	// config entry / key => "partition" (app.toml); under [filestore], one of "none", "daily" or "monthly"
+	ConfigKeyStoreFilePartition = "partition"
+	// config entry / key => "compression" (app.toml); under [filestore], one of "none" or "gzip"
+	ConfigKeyStoreFileCompression = "compression"
+	// config entry / key => "compression_interval" (app.toml); how often (e.g. "1h") closed segments are compressed, "0" disables the background compression
+	ConfigKeyStoreFileCompressionInterval = "compression_interval"
+	// config entry / key => "lock_wait" (app.toml); under [filestore], interval (e.g. "50ms") between 2 attempts to acquire the file lock
+	ConfigKeyStoreFileLockWait = "lock_wait"
+	// config entry / key => "lock_timeout" (app.toml); under [filestore], max time (e.g. "5s") to acquire the file lock
+	ConfigKeyStoreFileLockTimeout = "lock_timeout"
+	// config entry / key => "sync" (app.toml); under [filestore], one of "none", "always" (fsync per write) or "group" (group commit)
+	ConfigKeyStoreFileSync = "sync"
+	// config entry / key => "sync_interval" (app.toml); under [filestore], interval (e.g. "20ms") between 2 group commits
+	ConfigKeyStoreFileSyncInterval = "sync_interval"
+	// config entry / key => "recovery" (app.toml); under [filestore], scan for partial / corrupt lines on startup (default true)
+	ConfigKeyStoreFileRecovery = "recovery"
+	// config entry / key => "natural_key" (app.toml); under [filestore] / [datastore] or [xxxstore.{stock_module}],
+	// fields identifying a record (default [ "stock_id", "trx_date" ])
+	ConfigKeyStoreNaturalKey = "natural_key"
+	// config entry / key => "duplicate_policy" (app.toml); under [filestore] / [datastore] or [xxxstore.{stock_module}],
+	// one of "replace", "skip" or "append"
+	ConfigKeyStoreDuplicatePolicy = "duplicate_policy"
+	// config entry / key => "path" (app.toml); under [sqlitestore] / [boltstore], the database file (env variables like {SB_DATA} are resolved)
+	ConfigKeyStorePath = "path"
+	// config entry / key => "busy_timeout" (app.toml); under [sqlitestore], max time (e.g. "5s") to wait for a locked database
+	ConfigKeyStoreSqliteBusyTimeout = "busy_timeout"
+	// config entry / key => "open_timeout" (app.toml); under [boltstore], max time (e.g. "5s") to wait for the database file lock
+	ConfigKeyStoreBoltOpenTimeout = "open_timeout"
+	// config entry / key => "url" (app.toml); under [influxstore], the write endpoint (e.g. "http://localhost:8086/write?db=stockbinator")
+	ConfigKeyStoreInfluxUrl = "url"
+	// config entry / key => "token" (app.toml); under [influxstore], api token sent as "Authorization: Token xxx" (optional)
+	ConfigKeyStoreInfluxToken = "token"
+	// config entry / key => "measurement" (app.toml); under [influxstore], measurement name (default is the stock module)
+	ConfigKeyStoreInfluxMeasurement = "measurement"
+	// config entry / key => "precision" (app.toml); under [influxstore], timestamp precision; one of "s", "ms", "us" or "ns"
+	ConfigKeyStoreInfluxPrecision = "precision"
+	// config entry / key => "batch_size" (app.toml); under [influxstore], number of lines per write request
+	ConfigKeyStoreInfluxBatchSize = "batch_size"
+	// config entry / key => "flush_interval" (app.toml); under [influxstore], interval (e.g. "1s") to write the pending lines, "0s" disables
+	ConfigKeyStoreInfluxFlushInterval = "flush_interval"
+	// config entry / key => "max_pending_lines" (app.toml); under [influxstore], max number of lines kept whilst the endpoint is failing
+	ConfigKeyStoreInfluxMaxPendingLines = "max_pending_lines"
+	// config entry / key => "max_size" (app.toml); under [memorystore], max number of records kept (0 means no limit), the oldest are evicted first
+	ConfigKeyStoreMemoryMaxSize = "max_size"
+	// config entry / key => "ttl" (app.toml); under [memorystore], how long (e.g. "10m") a record is kept ("0s" means forever)
+	ConfigKeyStoreMemoryTtl = "ttl"
+	// config entry / key => "backing" (app.toml); under [memorystore], key prefix of the store cached (e.g. "sqlitestore"),
+	// the memory store becomes a read-through cache in front of it
+	ConfigKeyStoreMemoryBacking = "backing"
+	// config entry / key => "storespool" (app.toml); the retry spool of the failed store writes
+	ConfigKeyStoreSpool = "storespool"
+	// config entry / key => "backoff" and "max_backoff" (app.toml); under [storespool], delay before the first retry
+	// (e.g. "30s") which doubles per failed attempt up to max_backoff
+	ConfigKeyStoreSpoolBackoff = "backoff"
+	ConfigKeyStoreSpoolMaxBackoff = "max_backoff"
+	// config entry / key => "retry_interval" (app.toml); under [storespool], how often the spool is checked for due entries
+	ConfigKeyStoreSpoolRetryInterval = "retry_interval"
+
+	// config entry / key => "schema" (app.toml); [schema.{stock_module}] declares the fields of the module's records
+	ConfigKeySchema = "schema"
+	// config entry / key => "fields" (app.toml); under [schema.{stock_module}], names of the fields declared,
+	// each field is described under [schema.{stock_module}.{field}]
+	ConfigKeySchemaFields = "fields"
+	// config entry / key => "allow_unknown_fields" (app.toml); under [schema.{stock_module}], accept undeclared fields
+	ConfigKeySchemaAllowUnknownFields = "allow_unknown_fields"
+	// config entry / key => "type", "required", "array" and "unit" (app.toml); under [schema.{stock_module}.{field}],
+	// type is one of string, integer, float, decimal, bool or date
+	ConfigKeySchemaType = "type"
+	ConfigKeySchemaRequired = "required"
+	ConfigKeySchemaArray = "array"
+	ConfigKeySchemaUnit = "unit"
+
+	// config entry / key => "retention" (app.toml); how long the records are kept, the most specific rule wins:
+	// [retention.{stock_module}.{store_type}] > [retention.{stock_module}] > [retention.{store_type}] > [retention]
+	ConfigKeyRetention = "retention"
+	// config entry / key => "keep_days" (app.toml); under the retention rules, records older than keep_days
+	// (by trx_date) are removed; 0 means forever
+	ConfigKeyRetentionKeepDays = "keep_days"
+	// config entry / key => "interval" (app.toml); under [retention], how often the retention rules are enforced (e.g. "1h")
+	ConfigKeyRetentionInterval = "interval"
+
+	// config entry / key => "cron" (app.toml)
+	ConfigKeyCron = "cron"
+	// config entry / key => "history_size" (app.toml); max number of job-run records kept in the cron history
+	ConfigKeyCronHistorySize = "history_size"
+	// config entry / key => "misfire_policy" (app.toml); under [cron] or [cron.{stock_module}]
+	ConfigKeyCronMisfirePolicy = "misfire_policy"
+	// config entry / key => "misfire_grace" (app.toml); how late (e.g. "5m") a job could still run on time
+	ConfigKeyCronMisfireGrace = "misfire_grace"
+	// config entry / key => "misfire_max_backfill" (app.toml); max number of missed days to look back
+	ConfigKeyCronMisfireMaxBackfill = "misfire_max_backfill"
 
 	// default logger config file -> logger.toml
 	ConfigFileLoggerToml = "logger.toml"
@@ -55,12 +174,107 @@ const (
 	// store -> filestore's default file name if not provided
 	StoreDefaultDateFilename = "default.data"
 	StoreKeyDefaultDateFilename = "filestore.default.filename"
+	// filestore partition schemes; "none" writes into 1 file whilst "daily" / "monthly" write into segment files
+	// under a {stock_module}/{symbol} directory tree (e.g. stock_aastocks/700_tencent/2019-07-03.data)
+	StorePartitionNone = "none"
+	StorePartitionDaily = "daily"
+	StorePartitionMonthly = "monthly"
+	// file extension of a filestore segment
+	StoreSegmentFileExtension = ".data"
+	// filestore compression schemes for closed segments (segments whose period has ended)
+	StoreCompressionNone = "none"
+	StoreCompressionGzip = "gzip"
+	// file extension appended to a compressed segment (e.g. 2019-07-03.data.gz)
+	StoreCompressedFileExtension = ".gz"
+	// default interval (minutes) between 2 background compression runs
+	StoreDefaultCompressionIntervalMinutes = 60
+	// filename of the advisory lock file (under the segment directory for a partitioned filestore;
+	// otherwise appended to the filestore's filename)
+	StoreLockFileExtension = ".lock"
+	// default interval (millis) between 2 attempts to acquire the file lock
+	StoreDefaultLockWaitMillis = 50
+	// default max time (millis) to acquire the file lock
+	StoreDefaultLockTimeoutMillis = 5000
+	// filestore sync (fsync) modes; "group" fsyncs the pending writes together every sync interval
+	// and the writers wait for that group commit
+	StoreSyncNone = "none"
+	StoreSyncAlways = "always"
+	StoreSyncGroup = "group"
+	// default interval (millis) between 2 group commits
+	StoreDefaultSyncIntervalMillis = 20
+	// max number of segments whose natural key index is kept in memory (the least recently written are dropped)
+	StoreFilestoreMaxSegmentIndexes = 16
+	// file extension appended to a segment for its quarantined (partial / corrupt) lines
+	StoreQuarantineFileExtension = ".quarantine"
+	// how a store handles a record whose natural key already exists; "replace" the existing record,
+	// "skip" the new record or "append" anyway (duplicates allowed)
+	StoreDuplicatePolicyReplace = "replace"
+	StoreDuplicatePolicySkip = "skip"
+	StoreDuplicatePolicyAppend = "append"
+
+	// datastore implementations
+	StoreDataTypeElasticsearch = "elasticsearch"
+	// elasticsearch defaults
+	StoreDefaultElasticsearchHost = "http://localhost:9200"
+	StoreDefaultElasticsearchIndexPattern = "{module}_yyyy.mm"
+	StoreDefaultElasticsearchTemplate = "stockbinator"
+	StoreDefaultElasticsearchRefresh = "false"
+	StoreDefaultElasticsearchTimeoutSeconds = 10
+	StoreDefaultElasticsearchRetryMax = 3
+	StoreDefaultElasticsearchRetryBackoffMillis = 500
+	// max number of hits per search request (page)
+	StoreDefaultElasticsearchPageSize = 500
+	// sqlitestore defaults; the database file is created under the working directory if no path given
+	StoreDefaultSqliteFilename = "stockbinator.db"
+	StoreDefaultSqliteBusyTimeoutMillis = 5000
+	// boltstore defaults; the database file is created under the working directory if no path given
+	StoreDefaultBoltFilename = "stockbinator.bolt"
+	StoreDefaultBoltOpenTimeoutMillis = 5000
+	// max number of records read per (short) read transaction when iterating
+	StoreDefaultBoltPageSize = 500
+	// influxstore defaults
+	StoreDefaultInfluxUrl = "http://localhost:8086/write?db=stockbinator"
+	StoreDefaultInfluxPrecision = "s"
+	StoreDefaultInfluxBatchSize = 500
+	StoreDefaultInfluxFlushIntervalMillis = 1000
+	StoreDefaultInfluxTimeoutSeconds = 10
+	// max number of pending lines kept whilst the endpoint is failing; the oldest lines are dropped beyond
+	StoreDefaultInfluxMaxPendingLines = 100000
+	// storespool defaults; the spool file lives under [filestore] repo if no path given
+	StoreSpoolFilename = "store.spool"
+	StoreSpoolDefaultBackoffSeconds = 30
+	StoreSpoolDefaultMaxBackoffSeconds = 3600
+	StoreSpoolDefaultRetryIntervalSeconds = 30
+	// store migration -> prefix of the checkpoint file (under [filestore] repo)
+	StoreMigrationCheckpointPrefix = "migration"
+	// store retention -> defaults of the interval between runs and the max number of runs kept in the report
+	StoreRetentionDefaultIntervalSeconds = 3600
+	StoreRetentionHistorySize = 100
+
+	// cron -> job-run history's filename
+	CronHistoryFilename = "cron.history"
+	// cron -> default max number of job-run records kept in the history
+	CronHistoryDefaultSize = 10000
+	// cron -> the history file is compacted once it holds more than this ratio x the max number of records
+	CronHistoryCompactionRatio = 1.5
+
+	// cron -> misfire policies; what to do with the job-runs missed during a downtime
+	// skip => run only if still within the grace period, missed runs are skipped
+	CronMisfirePolicySkip = "skip"
+	// run_once => run once (even late), missed runs are skipped
+	CronMisfirePolicyRunOnce = "run_once"
+	// cron -> default grace period (in minutes) for a late job-run
+	CronMisfireDefaultGraceMinutes = 5
+	// cron -> default max number of missed days to look back
+	CronMisfireDefaultMaxBackfill = 30
 
 	// common file status
 	FileStatusAvailable    = 200
 	FileStatusNotAvailable = 404
 	FileStatusLocked       = 401
 	FileStatusUnknown      = 500
+	// the record was not written on purpose, e.g. its natural key already exists under the "skip" duplicate policy
+	FileStatusSkipped      = 208
 
 	// filename for the file-logger (for the "Info" method)
 	LoggerFileInfoKeyFilename = "filename"
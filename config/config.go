@@ -16,9 +16,12 @@
 package config
 
 import (
+	"Stockbinator/common"
 	"Stockbinator/util"
+	"errors"
 	"fmt"
 	"github.com/micro/go-config"
+	"sort"
 )
 
 
@@ -74,6 +77,10 @@ func (s *StructConfig) LoadConfigs() (err error) {
 	if err != nil {
 		return
 	}
+	err = s.ValidateAppConf()
+	if err != nil {
+		return
+	}
 	// 2b) load stock module conf
 	err = s.loadStockModuleConf()
 
@@ -86,6 +93,47 @@ func (s *StructConfig) loadAppConf() (err error) {
 	return
 }
 
+// validate the application's config(s); values which could never take effect are rejected
+// (e.g. a cron misfire policy other than "skip" or "run_once" under [cron] or [cron.{stock_module}])
+func (s *StructConfig) ValidateAppConf() (err error) {
+	if s.AppConfig == nil {
+		return
+	}
+	cronSections, isSection := s.AppConfig.Map()[common.ConfigKeyCron].(map[string]interface{})
+	if !isSection {
+		return
+	}
+	sections := map[string]map[string]interface{}{ common.ConfigKeyCron: cronSections }
+	sectionNames := []string{ common.ConfigKeyCron }
+	for key, value := range cronSections {
+		if moduleSection, isSection := value.(map[string]interface{}); isSection {
+			sectionName := fmt.Sprintf("%v.%v", common.ConfigKeyCron, key)
+			sections[sectionName] = moduleSection
+			sectionNames = append(sectionNames, sectionName)
+		}
+	}
+	sort.Strings(sectionNames)
+	for _, sectionName := range sectionNames {
+		section := sections[sectionName]
+		policy, found := section[common.ConfigKeyCronMisfirePolicy]
+		if !found {
+			continue
+		}
+		switch policy {
+		case common.CronMisfirePolicySkip, common.CronMisfirePolicyRunOnce:
+		case "run_all":
+			err = errors.New(fmt.Sprintf("misfire policy [%v] under [%v] is not supported; no crawler could backfill past dates, use [%v] or [%v] instead",
+				policy, sectionName, common.CronMisfirePolicySkip, common.CronMisfirePolicyRunOnce))
+			return
+		default:
+			err = errors.New(fmt.Sprintf("unknown misfire policy [%v] under [%v]; use [%v] or [%v] instead",
+				policy, sectionName, common.CronMisfirePolicySkip, common.CronMisfirePolicyRunOnce))
+			return
+		}
+	}
+	return
+}
+
 
 type StructStockModuleConfig struct {
 	// stock module's name (might be redundant in this case)
@@ -24,8 +24,8 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -42,6 +42,9 @@ const (
 type StructAAStocksCrawler struct {
 	// inject the stock module config rules (map)
 	StockModuleConfig map[string]config.StructStockModuleConfig
+	// the clock telling the current time (util.SystemClock by default); guarded by clockLock
+	clock     util.IClock
+	clockLock sync.Mutex
 }
 
 // constructor for Generic Crawler
@@ -50,15 +53,32 @@ func NewStructAAStocksCrawler(config map[string]config.StructStockModuleConfig)
 	if config != nil {
 		pCrawler.StockModuleConfig = config
 	}
+	pCrawler.clock = util.SystemClock
 	return
 }
 
+// inject the clock telling the current time (e.g. a util.StructFakeClock for testing); nil means util.SystemClock
+func (s *StructAAStocksCrawler) SetClock(clock util.IClock) {
+	s.clockLock.Lock()
+	defer s.clockLock.Unlock()
+	s.clock = util.GetClock(clock)
+}
+
+func (s *StructAAStocksCrawler) getClock() util.IClock {
+	s.clockLock.Lock()
+	defer s.clockLock.Unlock()
+	return util.GetClock(s.clock)
+}
+
 func (s *StructAAStocksCrawler) Crawl(moduleKey string, storeList []store.IStore) (err error) {
 	names := strings.Split(moduleKey, ".")
 	if names != nil && len(names) == 2 {
 		stockModuleConfig := s.StockModuleConfig[names[0]]
+		// the same clock for the whole crawl even if another one is injected meanwhile
+		clock := s.getClock()
+		now := clock.Now()
 		// SKIP weekend (use local locale time, no need UTC)
-		if util.IsWeekend(time.Now()) {
+		if util.IsWeekend(now) {
 			logger.GetLogger().SetPrefix(fmt.Sprintf("%v%v", moduleCrawlerAAStocks, "crawl")).Printf("%v, %v\n", "skipped as today is weekend", moduleKey)
 			logger.GetLogger(common.LoggerTypeFileLogger).SetPrefix(fmt.Sprintf("%v%v", moduleCrawlerAAStocks, "crawl")).Printf("%v, %v\n", "skipped as today is weekend", moduleKey)
 			return
@@ -66,12 +86,11 @@ func (s *StructAAStocksCrawler) Crawl(moduleKey string, storeList []store.IStore
 		// SKIP holiday
 		// get "current" year's holidays (of coz) add a method to extract the right holiday config
 		holidayRules := s.StockModuleConfig[names[0]].Holidays
-		holidaySlice, err2 := util.GetCurrentYearHolidays(&holidayRules)
+		holidaySlice, err2 := util.GetCurrentYearHolidays(&holidayRules, clock)
 		if err2 != nil {
 			err = err2
 			return
 		}
-		now := time.Now()
 		isHoliday, err2 := util.IsHoliday(&now, nil, holidaySlice)
 		if isHoliday {
 			logger.GetLogger().SetPrefix(fmt.Sprintf("%v%v", moduleCrawlerAAStocks, "crawl")).Printf("%v, %v\n", "skipped as today is a holiday", moduleKey)
@@ -99,7 +118,8 @@ func (s *StructAAStocksCrawler) Crawl(moduleKey string, storeList []store.IStore
 		}
 		// save the scrapped value into a STORE (e.g. file-store or elasticsearch-store)
 		storeMap := make(map[string]store.StructStoreValue)
-		fVal, err2 := strconv.ParseFloat(valPrice, 64)
+		// prices are exact decimals (e.g. 330.000); floats would introduce binary rounding
+		decPrice, err2 := store.ParseDecimal(valPrice)
 		if err2 != nil {
 			err = err2
 			return
@@ -107,7 +127,7 @@ func (s *StructAAStocksCrawler) Crawl(moduleKey string, storeList []store.IStore
 		// utc, truncated to hour level
 		now =now.In(time.UTC).Truncate(time.Hour)
 		storeMap[aastocksKeyPrice] = *store.NewStructStoreValue(
-			aastocksKeyPrice, fVal, store.TypeFloat, false, false)
+			aastocksKeyPrice, decPrice, store.TypeDecimal, false, false)
 		storeMap[aastocksKeyPriceFluctuation] = *store.NewStructStoreValue(
 			aastocksKeyPriceFluctuation, valPriceFluctuations, store.TypeString, false, false)
 		storeMap[aastocksKeyVolume] = *store.NewStructStoreValue(
@@ -117,17 +137,21 @@ func (s *StructAAStocksCrawler) Crawl(moduleKey string, storeList []store.IStore
 		storeMap[aastocksKeyTrxDate] = *store.NewStructStoreValue(
 			aastocksKeyTrxDate, now, store.TypeDate, false, false)
 
+		// every store is attempted even if an earlier one failed; the failures are reported together
+		failures := make([]string, 0)
 		for _, iStore := range storeList {
 			resp, err2 := iStore.Persist(storeMap)
 			if err2 != nil {
-				err = err2
-				return
-			}
-			if resp.Code != store.CodeSuccess {
-				err = errors.New(fmt.Sprintf("(%v) - %v", resp.Code, resp.Message))
-				return
+				failures = append(failures, fmt.Sprintf("[%v] %v", describeStore(iStore), err2))
+			} else if resp.Code != store.CodeSuccess {
+				failures = append(failures, fmt.Sprintf("[%v] (%v) - %v", describeStore(iStore), resp.Code, resp.Message))
 			}
 		}	// end -- for (all store persist operation)
+		if len(failures) > 0 {
+			err = errors.New(fmt.Sprintf("persist failed on %v of %v store(s) => %v",
+				len(failures), len(storeList), strings.Join(failures, "; ")))
+			return
+		}
 
 	} else {
 		err = errors.New("invalid moduleKey, it should be [STOCKS_MODULE_NAME][STOCK_CODE_UNDER_THE_MODULE]")
@@ -135,6 +159,14 @@ func (s *StructAAStocksCrawler) Crawl(moduleKey string, storeList []store.IStore
 	return
 }
 
+// name of the store for the error messages; the store key if known (e.g. a store.StructSpoolingStore)
+func describeStore(iStore store.IStore) string {
+	if iKeyedStore, isKeyed := iStore.(interface{ GetStoreKey() string }); isKeyed {
+		return iKeyedStore.GetStoreKey()
+	}
+	return strings.TrimPrefix(fmt.Sprintf("%T", iStore), "*")
+}
+
 func (s *StructAAStocksCrawler) crawlForMetrics(content string) (price, priceFluctuations, trxAmount string, err error) {
 	//fmt.Println(content)
 	pFeedList := make([]structAAStocksFeed, 1)
@@ -18,6 +18,7 @@ package crawler
 import (
 	"Stockbinator/config"
 	"Stockbinator/store"
+	"Stockbinator/util"
 	"strings"
 )
 
@@ -26,6 +27,11 @@ type InterfaceCrawler interface {
 	Crawl(moduleKey string, storeList []store.IStore) (err error)
 }
 
+// optional interface for crawlers telling the current time through an injected clock (e.g. to skip weekends)
+type InterfaceClockAwareCrawler interface {
+	SetClock(clock util.IClock)
+}
+
 // * ************************************* *
 // * cache for Interface-crawler instances *
 // * ************************************* *
@@ -48,7 +54,9 @@ func getCrawlerByCacheKey(key string) (pCrawler InterfaceCrawler) {
 // * crawler-factory related *
 // * *********************** *
 
-func GetCrawler(key string, config map[string]config.StructStockModuleConfig) (pCrawler InterfaceCrawler) {
+// return the crawler for the given key (cached); the optional clock (util.SystemClock if none) is injected into
+// the crawler on every call, hence a cached crawler always follows the caller's clock
+func GetCrawler(key string, config map[string]config.StructStockModuleConfig, clock ...util.IClock) (pCrawler InterfaceCrawler) {
 	pCrawler = getCrawlerByCacheKey(key)
 	if pCrawler == nil {
 		// try to create an instance if the key is recognizable
@@ -58,10 +66,12 @@ func GetCrawler(key string, config map[string]config.StructStockModuleConfig) (p
 		}
 		// TODO: add other crawler implementations
 	}
+	if pClockAwareCrawler, isClockAware := pCrawler.(InterfaceClockAwareCrawler); isClockAware {
+		pClockAwareCrawler.SetClock(util.GetClock(clock...))
+	}
 	return
 }
 
-
 // * *************************** *
 // * constants (internal private *
 // * *************************** *
@@ -20,11 +20,21 @@ import (
 	"fmt"
 	"github.com/daviddengcn/go-colortext"
 	"github.com/daviddengcn/go-colortext/fmt"
+	"os"
 )
 
 const moduleMain = "main."
 
 func main() {
+	// e.g. "stockbinator migrate -source filestore -target sqlitestore -module stock_aastocks"
+	if len(os.Args) > 1 && os.Args[1] == server.CommandMigrate {
+		err := server.RunMigrateCommand(os.Args[2:])
+		if err != nil {
+			logInfo("migrate", fmt.Sprintf("exception!!!! => %v", err))
+			os.Exit(1)
+		}
+		return
+	}
 	pSvr := new(server.Server)
 	err := pSvr.Start()
 	if err != nil {
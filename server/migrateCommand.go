@@ -0,0 +1,103 @@
+/*
+ *  Copyright Project - Stockbinator, Author - quoeamaster, (C) 2019
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+package server
+
+import (
+	"Stockbinator/config"
+	"Stockbinator/store"
+	"Stockbinator/util"
+	"Stockbinator/webservice"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// name of the command copying the records from one store to another
+const CommandMigrate = "migrate"
+
+// run the migrate command (without starting the server), e.g.
+//	stockbinator migrate -source filestore -target sqlitestore -module stock_aastocks -symbols 700_tencent,1299_aia \
+//		-from 2019-07-01T00:00:00+08:00
+// running the same command again continues an interrupted migration
+func RunMigrateCommand(args []string) (err error) {
+	pFlagSet := flag.NewFlagSet(CommandMigrate, flag.ContinueOnError)
+	pSource := pFlagSet.String("source", "", "key prefix of the source store (e.g. filestore)")
+	pTarget := pFlagSet.String("target", "", "key prefix of the target store (e.g. sqlitestore)")
+	pModule := pFlagSet.String("module", "", "the stock module (e.g. stock_aastocks)")
+	pSymbols := pFlagSet.String("symbols", "", "comma separated symbols (all the symbols of the module if empty)")
+	pFrom := pFlagSet.String("from", "", "copy the records on or after the date (e.g. 2019-07-01T00:00:00+08:00)")
+	pTo := pFlagSet.String("to", "", "copy the records on or before the date (e.g. 2019-07-31T23:59:59+08:00)")
+	err = pFlagSet.Parse(args)
+	if err != nil {
+		return
+	}
+	request := store.StructStoreMigrationRequest{ Source: *pSource, Target: *pTarget, Module: *pModule }
+	for _, symbol := range strings.Split(*pSymbols, ",") {
+		symbol = strings.TrimSpace(symbol)
+		if !util.IsEmptyString(symbol) {
+			request.Symbols = append(request.Symbols, symbol)
+		}
+	}
+	request.From, err = parseMigrateDateFlag("from", *pFrom)
+	if err != nil {
+		return
+	}
+	request.To, err = parseMigrateDateFlag("to", *pTo)
+	if err != nil {
+		return
+	}
+
+	pCfg, err := config.NewStructConfig()
+	if err != nil {
+		return
+	}
+	pMigration, err := webservice.NewStructStoreService(pCfg).NewMigration(request)
+	if err != nil {
+		return
+	}
+	pMigration.SetProgressListener(func(progress store.StructStoreMigrationProgress) {
+		fmt.Printf("[%v] %v => read %v, written %v, skipped %v, failed %v\n", CommandMigrate, progress.Status,
+			progress.Read, progress.Written, progress.Skipped, progress.Failed)
+	})
+	progress, err := pMigration.Run()
+	for _, symbolProgress := range progress.Symbols {
+		verification := fmt.Sprintf("source %v, target %v, verified %v",
+			symbolProgress.SourceCount, symbolProgress.TargetCount, symbolProgress.Verified)
+		if !util.IsEmptyString(symbolProgress.VerifyError) {
+			verification = fmt.Sprintf("not verified => %v", symbolProgress.VerifyError)
+		}
+		fmt.Printf("[%v] %v => read %v, written %v, skipped %v, failed %v, %v\n", CommandMigrate, symbolProgress.Symbol,
+			symbolProgress.Read, symbolProgress.Written, symbolProgress.Skipped, symbolProgress.Failed, verification)
+		if !util.IsEmptyString(symbolProgress.LastError) {
+			fmt.Printf("[%v] %v => last error: %v\n", CommandMigrate, symbolProgress.Symbol, symbolProgress.LastError)
+		}
+	}
+	return
+}
+
+// parse the date flag; empty value means no bound (zero time)
+func parseMigrateDateFlag(name, value string) (date time.Time, err error) {
+	if util.IsEmptyString(value) {
+		return
+	}
+	date, err = time.Parse(util.CommonDateFormat, value)
+	if err != nil {
+		err = errors.New(fmt.Sprintf("invalid -%v [%v], expected format is [2019-07-03T16:10:00+08:00]", name, value))
+	}
+	return
+}
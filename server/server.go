@@ -19,6 +19,7 @@ import (
 	"Stockbinator/common"
 	"Stockbinator/config"
 	"Stockbinator/logger"
+	"Stockbinator/store"
 	"Stockbinator/webservice"
 	"errors"
 	"fmt"
@@ -39,6 +40,8 @@ type Server struct {
 	pCfg *config.StructConfig
 	// Cron service
 	pCronSrv *webservice.StructCron
+	// Store service
+	pStoreSrv *webservice.StructStoreService
 	// channel
 	signalChannel chan os.Signal
 }
@@ -129,6 +132,8 @@ func (s *Server) Start() (err error) {
 	if err != nil {
 		return
 	}
+	// enforce the store retention rules periodically
+	s.pStoreSrv.StartRetention()
 
 	// start signal listener
 	err = s.startSignalListener()
@@ -184,6 +189,9 @@ func (s *Server) loadWebServices() (err error) {
 	// load CronService module
 	s.pCronSrv = webservice.NewStructCron(s.pCfg)
 	restful.DefaultContainer.Add(s.pCronSrv.CreateWebservice())
+	// load StoreService module
+	s.pStoreSrv = webservice.NewStructStoreService(s.pCfg)
+	restful.DefaultContainer.Add(s.pStoreSrv.CreateWebservice())
 
 	return
 }
@@ -213,6 +221,17 @@ func (s *Server) Stop() (err error) {
 	if err != nil {
 		panic(err)
 	}
+	logger.GetLogger().SetPrefix("server.Stop").Println("Stopping store retention now...")
+	logger.GetLogger(common.LoggerTypeFileLogger).SetPrefix("server.Stop").Println("Stopping store retention now...")
+	s.pStoreSrv.StopRetention()
+	logger.GetLogger().SetPrefix("server.Stop").Println("Stopping stores now (writing the pending records)...")
+	logger.GetLogger(common.LoggerTypeFileLogger).SetPrefix("server.Stop").Println("Stopping stores now (writing the pending records)...")
+	err2 := store.CloseCachedStores()
+	if err2 != nil {
+		// the pending records are lost, log down the error and carry on stopping
+		logger.GetLogger().SetPrefix("server.Stop").Println(err2.Error())
+		logger.GetLogger(common.LoggerTypeFileLogger).SetPrefix("server.Stop").Println(err2.Error())
+	}
 
 	logger.GetLogger().SetPrefix("server.Stop").Println("Stopping logger-service now...")
 	logger.GetLogger(common.LoggerTypeFileLogger).SetPrefix("server.Stop").Println("Stopping logger-service now...")
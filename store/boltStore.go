@@ -0,0 +1,697 @@
+/*
+ *  Copyright Project - Stockbinator, Author - quoeamaster, (C) 2019
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+// bolt store - implements interface IStore on an embedded B+tree key-value store (bbolt).
+// All stores configured with the same [boltstore] path share 1 database file; records are kept under
+// bucket {stock_module} -> nested bucket {stock_id} keyed by {trx_date}{sequence} (16 bytes, big endian)
+// hence the records of a symbol are sorted chronologically and a trx_date range is a cheap cursor scan.
+// Values are the json encoded records (see EncodeStoreRecord).
+package store
+
+import (
+	"Stockbinator/common"
+	"Stockbinator/util"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/micro/go-config"
+	"go.etcd.io/bbolt"
+	"strings"
+	"sync"
+	"time"
+)
+
+type StructBoltStore struct {
+	// storing the application level settings
+	AppConfig config.Config
+	// the store's name; {stock_module}.{symbol} (e.g. stock_aastocks.700_tencent)
+	Name string
+
+	// the stock module (also the top level bucket) and symbol (stock_id) of this store
+	module string
+	symbol string
+	// the resolved database file path
+	path string
+
+	pDB        *bbolt.DB
+	naturalKey StructNaturalKey
+	// schema of the module's records (nil means any record is accepted)
+	schema *StructStoreSchema
+	lock   sync.Mutex
+}
+
+// opened databases by path; bbolt locks the database file, hence it could ONLY be opened once per process
+var boltDatabases = make(map[string]*bbolt.DB)
+var boltDatabasesLock sync.Mutex
+
+// creator / ctor method; name is the {stock_module}.{symbol} of the store
+func NewStructBoltStore(config config.Config, name string) (pStore *StructBoltStore) {
+	pStore = new(StructBoltStore)
+	pStore.AppConfig = config
+	pStore.Name = name
+	parts := strings.SplitN(name, ".", 2)
+	pStore.module = parts[0]
+	if len(parts) > 1 {
+		pStore.symbol = parts[1]
+	}
+	err := pStore.init()
+	if err != nil {
+		// log down the error but try to proceed
+		fmt.Println(err)
+	}
+	return
+}
+
+func (s *StructBoltStore) init() (err error) {
+	path := common.StoreDefaultBoltFilename
+	openTimeout := time.Millisecond * common.StoreDefaultBoltOpenTimeoutMillis
+	if s.AppConfig != nil {
+		path = s.AppConfig.Get(common.ConfigKeyStoreBolt, common.ConfigKeyStorePath).String(path)
+		openTimeout = s.AppConfig.Get(common.ConfigKeyStoreBolt, common.ConfigKeyStoreBoltOpenTimeout).Duration(openTimeout)
+	}
+	s.path, err = util.ReplaceEnvVarInPath(path)
+	if err != nil {
+		return
+	}
+	s.naturalKey, err = GetNaturalKeyFromConfig(s.AppConfig, common.ConfigKeyStoreBolt, s.module)
+	if err != nil {
+		return
+	}
+	s.schema, err = GetSchemaFromConfig(s.AppConfig, s.module)
+	if err != nil {
+		return
+	}
+	boltDatabasesLock.Lock()
+	defer boltDatabasesLock.Unlock()
+	s.pDB = boltDatabases[s.path]
+	if s.pDB == nil {
+		s.pDB, err = bbolt.Open(s.path, 0666, &bbolt.Options{Timeout: openTimeout})
+		if err != nil {
+			err = errors.New(fmt.Sprintf("could not open bolt database [%v] => %v", s.path, err))
+			return
+		}
+		boltDatabases[s.path] = s.pDB
+	}
+	return
+}
+
+// save the record under the bucket of its stock_id (the store's symbol if not available); trx_date is mandatory
+func (s *StructBoltStore) Persist(data map[string]StructStoreValue) (response StructStoreResponse, err error) {
+	response = s.newStructStoreResponse(CodeSuccess, "", common.FileStatusAvailable)
+	// records not matching the module's schema are rejected
+	data, err = s.schema.Conform(data)
+	record := GetRecordWithFieldKeys(data)
+	trxDate, isDate := toStoreDate(record[StoreKeyTrxDate].Value)
+	if err == nil && !isDate {
+		err = errors.New(fmt.Sprintf("field [%v] is mandatory and must be a date BUT got %v", StoreKeyTrxDate, record[StoreKeyTrxDate].Value))
+	}
+	if err == nil {
+		err = s.checkDatabase()
+	}
+	if err != nil {
+		s.handleCommonErrorForResponse(&response, err)
+		return
+	}
+	jsonValue, err := EncodeStoreRecord(record)
+	if err != nil {
+		s.handleCommonErrorForResponse(&response, err)
+		return
+	}
+	naturalKey := s.getNaturalKey()
+	isSkipped := false
+	err = s.pDB.Update(func(tx *bbolt.Tx) (err error) {
+		bucket, err := s.getSymbolBucket(tx, s.getRecordStockId(record), true)
+		if err != nil {
+			return
+		}
+		if _, isAvailable := BuildNaturalKeyId(record, naturalKey); isAvailable &&
+			strings.Compare(naturalKey.DuplicatePolicy, common.StoreDuplicatePolicyAppend) != 0 {
+			duplicateKeys, err := s.findNaturalKeyDuplicates(bucket, record, trxDate, naturalKey)
+			if err != nil {
+				return err
+			}
+			if len(duplicateKeys) > 0 && strings.Compare(naturalKey.DuplicatePolicy, common.StoreDuplicatePolicySkip) == 0 {
+				isSkipped = true
+				return nil
+			}
+			for _, duplicateKey := range duplicateKeys {
+				err = bucket.Delete(duplicateKey)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		sequence, err := bucket.NextSequence()
+		if err != nil {
+			return
+		}
+		err = bucket.Put(buildBoltKey(trxDate, sequence), []byte(jsonValue))
+		return
+	})
+	if err != nil {
+		s.handleCommonErrorForResponse(&response, err)
+		return
+	}
+	if isSkipped {
+		response.Message = "record with the same natural key already exists, skipped"
+		response.AdditionalCode = common.FileStatusSkipped
+	}
+	return
+}
+
+// read all records of the store's symbol as json lines (might be an issue when the content size is HUGE, use Iterate instead
+func (s *StructBoltStore) ReadAll() (response StructStoreResponse, content string, err error) {
+	response, iterator, err := s.Iterate()
+	if err != nil {
+		return
+	}
+	defer func() {
+		_ = iterator.Close()
+	}()
+	var bContent bytes.Buffer
+	for iterator.Next() {
+		jsonValue, err2 := EncodeStoreRecord(iterator.Record().Value.(map[string]StructStoreValue))
+		if err2 != nil {
+			err = err2
+			break
+		}
+		bContent.WriteString(jsonValue)
+		bContent.WriteString("\n")
+	}
+	if err == nil {
+		err = iterator.Err()
+	}
+	if err != nil {
+		s.handleCommonErrorForResponse(&response, err)
+		return
+	}
+	content = bContent.String()
+	return
+}
+
+// read the record associated by the KEY ({stock_id}|{trx_date}, see BuildRecordKey),
+// PARAMS (StructStoreReadParams or a map of filters) narrows down the matching records and the fields returned
+func (s *StructBoltStore) ReadByKey(key string, params interface{}) (response StructStoreResponse, value StructStoreValue, err error) {
+	response = s.newStructStoreResponse(CodeSuccess, "", common.FileStatusAvailable)
+	readParams, err := GetStoreReadParams(params)
+	if err == nil {
+		err = s.checkDatabase()
+	}
+	if err != nil {
+		s.handleCommonErrorForResponse(&response, err)
+		return
+	}
+	found := false
+	err = s.pDB.View(func(tx *bbolt.Tx) (err error) {
+		_, records, err := s.readByKey(tx, key)
+		for _, record := range records {
+			if IsRecordMatchingFilters(record, readParams.Filters) {
+				value = StructStoreValue{Key: key, Value: SelectRecordFields(record, readParams.Fields), IsObject: true}
+				found = true
+			}
+		}
+		return
+	})
+	if err == nil && !found {
+		err = errors.New(fmt.Sprintf("no record found for key [%v]", key))
+		s.handleCommonErrorForResponse(&response, err)
+		response.AdditionalCode = common.FileStatusNotAvailable
+		return
+	}
+	if err != nil {
+		s.handleCommonErrorForResponse(&response, err)
+	}
+	return
+}
+
+// query the records of the given stock (all symbols of the module if empty) whose trx_date falls within [from, to];
+// ONLY the keys within the range are visited
+func (s *StructBoltStore) Query(stockId string, from, to time.Time, fields []string, limit int) (response StructStoreResponse, records []StructStoreValue, err error) {
+	records = make([]StructStoreValue, 0)
+	response = s.newStructStoreResponse(CodeSuccess, "", common.FileStatusAvailable)
+	err = s.checkDatabase()
+	if err != nil {
+		s.handleCommonErrorForResponse(&response, err)
+		return
+	}
+	matchedRecords := make([]map[string]StructStoreValue, 0)
+	err = s.pDB.View(func(tx *bbolt.Tx) (err error) {
+		moduleBucket := tx.Bucket([]byte(s.module))
+		if moduleBucket == nil {
+			return
+		}
+		stockIds := []string{ stockId }
+		if util.IsEmptyString(stockId) {
+			stockIds = make([]string, 0)
+			err = moduleBucket.ForEach(func(k, v []byte) error {
+				// nested buckets have nil values
+				if v == nil {
+					stockIds = append(stockIds, string(k))
+				}
+				return nil
+			})
+		}
+		for _, bucketStockId := range stockIds {
+			if err != nil {
+				break
+			}
+			bucket := moduleBucket.Bucket([]byte(bucketStockId))
+			if bucket == nil {
+				continue
+			}
+			cursor := bucket.Cursor()
+			k, v := cursor.First()
+			if !from.IsZero() {
+				k, v = cursor.Seek(buildBoltKeyPrefix(from))
+			}
+			for ; k != nil; k, v = cursor.Next() {
+				if !to.IsZero() && bytes.Compare(k[:8], buildBoltKeyPrefix(to)) > 0 {
+					break
+				}
+				record, err2 := DecodeStoreRecord(string(v))
+				if err2 != nil {
+					err = err2
+					break
+				}
+				matchedRecords = append(matchedRecords, record)
+				if limit > 0 && len(stockIds) == 1 && len(matchedRecords) >= limit {
+					break
+				}
+			}
+		}
+		return
+	})
+	if err != nil {
+		s.handleCommonErrorForResponse(&response, err)
+		return
+	}
+	records = BuildQueryResult(matchedRecords, fields, limit)
+	return
+}
+
+// iterate the records of the store's symbol (chronological order) matching all the predicates;
+// the records are read page by page, each page within a short read transaction
+func (s *StructBoltStore) Iterate(predicates ...StoreRecordPredicate) (response StructStoreResponse, iterator IStoreIterator, err error) {
+	response = s.newStructStoreResponse(CodeSuccess, "", common.FileStatusAvailable)
+	err = s.checkDatabase()
+	if err != nil {
+		s.handleCommonErrorForResponse(&response, err)
+		return
+	}
+	iterator = &structBoltIterator{pStore: s, predicates: predicates}
+	return
+}
+
+// modify the record(s) associated with the key within a transaction; VALUE must be an object
+// (map[string]StructStoreValue) containing the fields to update. The record identity (stock_id and trx_date) could not be modified
+func (s *StructBoltStore) ModifyByKey(key string, value StructStoreValue) (response StructStoreResponse, err error) {
+	response = s.newStructStoreResponse(CodeSuccess, "", common.FileStatusAvailable)
+	fieldMap, isMap := value.Value.(map[string]StructStoreValue)
+	if !value.IsObject || !isMap {
+		err = errors.New(fmt.Sprintf("value for key [%v] must be an object of fields (map[string]StructStoreValue)", key))
+	}
+	if err == nil {
+		err = s.checkDatabase()
+	}
+	if err != nil {
+		s.handleCommonErrorForResponse(&response, err)
+		return
+	}
+	fieldMap = GetRecordWithFieldKeys(fieldMap)
+	isFound := true
+	err = s.pDB.Update(func(tx *bbolt.Tx) (err error) {
+		boltKeys, records, err := s.readByKey(tx, key)
+		if err != nil {
+			return
+		}
+		if len(records) == 0 {
+			isFound = false
+			return errors.New(fmt.Sprintf("no record found for key [%v]", key))
+		}
+		stockId, _, _ := ParseRecordKey(key)
+		bucket := tx.Bucket([]byte(s.module)).Bucket([]byte(stockId))
+		for i, record := range records {
+			for fieldName, fieldValue := range fieldMap {
+				if (strings.Compare(fieldName, StoreKeyStockId) == 0 || strings.Compare(fieldName, StoreKeyTrxDate) == 0) &&
+					!isStoreValueEqual(record[fieldName].Value, fieldValue.Value) {
+					return errors.New(fmt.Sprintf("field [%v] is part of the record key and could not be modified", fieldName))
+				}
+				record[fieldName] = fieldValue
+			}
+			jsonValue, err := EncodeStoreRecord(record)
+			if err != nil {
+				return err
+			}
+			err = bucket.Put(boltKeys[i], []byte(jsonValue))
+			if err != nil {
+				return err
+			}
+		}
+		return
+	})
+	if err != nil {
+		s.handleCommonErrorForResponse(&response, err)
+		if !isFound {
+			response.AdditionalCode = common.FileStatusNotAvailable
+		}
+	}
+	return
+}
+
+// remove the record(s) associated with the key within a transaction; the removed record is returned as an object
+func (s *StructBoltStore) RemoveByKey(key string) (response StructStoreResponse, valueRemoved StructStoreValue, err error) {
+	response = s.newStructStoreResponse(CodeSuccess, "", common.FileStatusAvailable)
+	err = s.checkDatabase()
+	if err != nil {
+		s.handleCommonErrorForResponse(&response, err)
+		return
+	}
+	isFound := true
+	err = s.pDB.Update(func(tx *bbolt.Tx) (err error) {
+		boltKeys, records, err := s.readByKey(tx, key)
+		if err != nil {
+			return
+		}
+		if len(records) == 0 {
+			isFound = false
+			return errors.New(fmt.Sprintf("no record found for key [%v]", key))
+		}
+		stockId, _, _ := ParseRecordKey(key)
+		bucket := tx.Bucket([]byte(s.module)).Bucket([]byte(stockId))
+		for i, boltKey := range boltKeys {
+			err = bucket.Delete(boltKey)
+			if err != nil {
+				return
+			}
+			valueRemoved = StructStoreValue{Key: key, Value: records[i], IsObject: true}
+		}
+		return
+	})
+	if err != nil {
+		valueRemoved = StructStoreValue{}
+		s.handleCommonErrorForResponse(&response, err)
+		if !isFound {
+			response.AdditionalCode = common.FileStatusNotAvailable
+		}
+	}
+	return
+}
+
+// remove all records of the store's symbol (drops its bucket), be careful~
+func (s *StructBoltStore) RemoveAll() (response StructStoreResponse, err error) {
+	response = s.newStructStoreResponse(CodeSuccess, "", common.FileStatusAvailable)
+	err = s.checkDatabase()
+	if err == nil {
+		err = s.pDB.Update(func(tx *bbolt.Tx) (err error) {
+			moduleBucket := tx.Bucket([]byte(s.module))
+			if moduleBucket == nil || moduleBucket.Bucket([]byte(s.symbol)) == nil {
+				return
+			}
+			err = moduleBucket.DeleteBucket([]byte(s.symbol))
+			return
+		})
+	}
+	if err != nil {
+		s.handleCommonErrorForResponse(&response, err)
+	}
+	return
+}
+
+// remove the records of the stock (empty means all stocks of the module) whose trx_date is before the given time;
+// the keys are ordered by trx_date, hence ONLY the records removed are visited
+func (s *StructBoltStore) RemoveBefore(stockId string, before time.Time) (response StructStoreResponse, removed int, err error) {
+	response = s.newStructStoreResponse(CodeSuccess, "", common.FileStatusAvailable)
+	err = s.checkDatabase()
+	if err == nil {
+		err = s.pDB.Update(func(tx *bbolt.Tx) (err error) {
+			moduleBucket := tx.Bucket([]byte(s.module))
+			if moduleBucket == nil {
+				return
+			}
+			stockIds := []string{ stockId }
+			if util.IsEmptyString(stockId) {
+				stockIds = make([]string, 0)
+				err = moduleBucket.ForEach(func(k, v []byte) error {
+					// nested buckets have nil values
+					if v == nil {
+						stockIds = append(stockIds, string(k))
+					}
+					return nil
+				})
+			}
+			beforePrefix := buildBoltKeyPrefix(before)
+			for _, bucketStockId := range stockIds {
+				if err != nil {
+					break
+				}
+				bucket := moduleBucket.Bucket([]byte(bucketStockId))
+				if bucket == nil {
+					continue
+				}
+				cursor := bucket.Cursor()
+				// deleting through the cursor moves it to the next key
+				for k, _ := cursor.First(); k != nil && bytes.Compare(k[:8], beforePrefix) < 0; k, _ = cursor.First() {
+					err = cursor.Delete()
+					if err != nil {
+						break
+					}
+					removed++
+				}
+			}
+			return
+		})
+	}
+	if err != nil {
+		removed = 0
+		s.handleCommonErrorForResponse(&response, err)
+	}
+	return
+}
+
+// set the natural key identifying a record and how Persist handles a record whose natural key already exists
+func (s *StructBoltStore) SetNaturalKey(naturalKey StructNaturalKey) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.naturalKey = naturalKey
+}
+
+func (s *StructBoltStore) getNaturalKey() StructNaturalKey {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.naturalKey
+}
+
+func (s *StructBoltStore) checkDatabase() (err error) {
+	if s.pDB == nil {
+		err = errors.New(fmt.Sprintf("bolt database [%v] is NOT available", s.path))
+	}
+	return
+}
+
+// the bucket of the record; its stock_id or the store's symbol
+func (s *StructBoltStore) getRecordStockId(record map[string]StructStoreValue) string {
+	if stockId, isString := record[StoreKeyStockId].Value.(string); isString && !util.IsEmptyString(stockId) {
+		return stockId
+	}
+	return s.symbol
+}
+
+// return the bucket {stock_module} -> {stock_id}; nil if not available and not creating (e.g. within a read transaction)
+func (s *StructBoltStore) getSymbolBucket(tx *bbolt.Tx, stockId string, isCreate bool) (bucket *bbolt.Bucket, err error) {
+	if !isCreate {
+		moduleBucket := tx.Bucket([]byte(s.module))
+		if moduleBucket != nil {
+			bucket = moduleBucket.Bucket([]byte(stockId))
+		}
+		return
+	}
+	moduleBucket, err := tx.CreateBucketIfNotExists([]byte(s.module))
+	if err != nil {
+		return
+	}
+	bucket, err = moduleBucket.CreateBucketIfNotExists([]byte(stockId))
+	return
+}
+
+// find the keys of the records sharing the natural key of the record; if the natural key contains trx_date
+// ONLY the keys of the same trx_date are visited, otherwise the whole bucket
+func (s *StructBoltStore) findNaturalKeyDuplicates(bucket *bbolt.Bucket, record map[string]StructStoreValue, trxDate time.Time, naturalKey StructNaturalKey) (duplicateKeys [][]byte, err error) {
+	cursor := bucket.Cursor()
+	k, v := cursor.First()
+	prefix := []byte(nil)
+	for _, field := range naturalKey.Fields {
+		if strings.Compare(field, StoreKeyTrxDate) == 0 {
+			prefix = buildBoltKeyPrefix(trxDate)
+			k, v = cursor.Seek(prefix)
+			break
+		}
+	}
+	for ; k != nil && (prefix == nil || bytes.HasPrefix(k, prefix)); k, v = cursor.Next() {
+		existingRecord, err2 := DecodeStoreRecord(string(v))
+		if err2 != nil {
+			err = err2
+			return
+		}
+		if IsSameNaturalKey(record, existingRecord, naturalKey) {
+			// keys are ONLY valid within the transaction and must not be modified whilst iterating, hence a copy
+			duplicateKeys = append(duplicateKeys, append([]byte{}, k...))
+		}
+	}
+	return
+}
+
+// read the records (and their bolt keys) of the key ({stock_id}|{trx_date})
+func (s *StructBoltStore) readByKey(tx *bbolt.Tx, key string) (boltKeys [][]byte, records []map[string]StructStoreValue, err error) {
+	stockId, trxDate, err := ParseRecordKey(key)
+	if err != nil {
+		return
+	}
+	bucket, err := s.getSymbolBucket(tx, stockId, false)
+	if err != nil || bucket == nil {
+		return
+	}
+	prefix := buildBoltKeyPrefix(trxDate)
+	cursor := bucket.Cursor()
+	for k, v := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = cursor.Next() {
+		record, err2 := DecodeStoreRecord(string(v))
+		if err2 != nil {
+			err = err2
+			return
+		}
+		boltKeys = append(boltKeys, append([]byte{}, k...))
+		records = append(records, record)
+	}
+	return
+}
+
+func (s *StructBoltStore) newStructStoreResponse(code int, message string, additionalCode int) (response StructStoreResponse) {
+	response.Code = code
+	response.Message = message
+	response.AdditionalCode = additionalCode
+	return
+}
+
+func (s *StructBoltStore) handleCommonErrorForResponse(pResponseStruct *StructStoreResponse, err error) {
+	if pResponseStruct != nil && err != nil {
+		pResponseStruct.Code = CodeFailure
+		pResponseStruct.Message = err.Error()
+		pResponseStruct.AdditionalCode = common.FileStatusUnknown
+	}
+}
+
+// the first 8 bytes of the bolt key; the trx_date (unix nano, UTC) with the sign bit flipped
+// so dates before 1970 are still sorted correctly
+func buildBoltKeyPrefix(trxDate time.Time) []byte {
+	prefix := make([]byte, 8)
+	binary.BigEndian.PutUint64(prefix, uint64(trxDate.UnixNano())^(1<<63))
+	return prefix
+}
+
+// bolt key; {trx_date}{sequence}, the sequence keeps records of the same trx_date apart
+func buildBoltKey(trxDate time.Time, sequence uint64) []byte {
+	boltKey := make([]byte, 16)
+	copy(boltKey, buildBoltKeyPrefix(trxDate))
+	binary.BigEndian.PutUint64(boltKey[8:], sequence)
+	return boltKey
+}
+
+// * ********* *
+// * iterator  *
+// * ********* *
+
+// iterator over the bucket of the store's symbol; every page is read within its own read transaction,
+// hence writes (even by the iterating goroutine) are never blocked by a long running iteration
+type structBoltIterator struct {
+	pStore     *StructBoltStore
+	predicates []StoreRecordPredicate
+
+	page        []map[string]StructStoreValue
+	pageIndex   int
+	lastKey     []byte
+	isExhausted bool
+
+	record StructStoreValue
+	err    error
+}
+
+func (i *structBoltIterator) Next() bool {
+	i.record = StructStoreValue{}
+	for i.err == nil {
+		if i.pageIndex >= len(i.page) {
+			if i.isExhausted {
+				return false
+			}
+			i.err = i.fetchPage()
+			if i.err != nil || len(i.page) == 0 {
+				return false
+			}
+		}
+		record := i.page[i.pageIndex]
+		i.pageIndex++
+		if IsRecordMatchingPredicates(record, i.predicates) {
+			i.record = NewRecordStoreValue(record)
+			return true
+		}
+	}
+	return false
+}
+
+// read the next page of records after the last key read
+func (i *structBoltIterator) fetchPage() (err error) {
+	i.page = make([]map[string]StructStoreValue, 0, common.StoreDefaultBoltPageSize)
+	i.pageIndex = 0
+	err = i.pStore.pDB.View(func(tx *bbolt.Tx) (err error) {
+		bucket, err := i.pStore.getSymbolBucket(tx, i.pStore.symbol, false)
+		if err != nil || bucket == nil {
+			return
+		}
+		cursor := bucket.Cursor()
+		k, v := cursor.First()
+		if i.lastKey != nil {
+			k, v = cursor.Seek(i.lastKey)
+			if k != nil && bytes.Equal(k, i.lastKey) {
+				k, v = cursor.Next()
+			}
+		}
+		for ; k != nil && len(i.page) < common.StoreDefaultBoltPageSize; k, v = cursor.Next() {
+			record, err := DecodeStoreRecord(string(v))
+			if err != nil {
+				return err
+			}
+			i.page = append(i.page, record)
+			i.lastKey = append([]byte{}, k...)
+		}
+		return
+	})
+	if len(i.page) < common.StoreDefaultBoltPageSize {
+		i.isExhausted = true
+	}
+	return
+}
+
+func (i *structBoltIterator) Record() StructStoreValue {
+	return i.record
+}
+
+func (i *structBoltIterator) Err() error {
+	return i.err
+}
+
+func (i *structBoltIterator) Close() error {
+	i.page = nil
+	i.isExhausted = true
+	return nil
+}
@@ -0,0 +1,910 @@
+/*
+ *  Copyright Project - Stockbinator, Author - quoeamaster, (C) 2019
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+// elasticsearch datastore - implements interface IStore.
+// Records are written through the bulk API into date based indices (e.g. stock_aastocks_2019.07,
+// based on the trx_date in UTC); an index template with the mapping of the stock fields is installed
+// before the first write. Requests rejected with 429 (too many requests) are retried with backoff.
+// The document id is built from the natural key, hence retried writes never create duplicates
+// (except for the "append" duplicate policy).
+package store
+
+import (
+	"Stockbinator/common"
+	"Stockbinator/util"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/micro/go-config"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+type StructElasticsearchStore struct {
+	// storing the application level settings
+	AppConfig config.Config
+	// the store's name; {stock_module}.{symbol} (e.g. stock_aastocks.700_tencent)
+	Name string
+
+	// the stock module and symbol (stock_id) of this store
+	module   string
+	symbol   string
+	hosts    []string
+	username string
+	password string
+
+	indexPattern string
+	template     string
+	refresh      string
+	retryMax     int
+	retryBackoff time.Duration
+
+	pClient *http.Client
+	// guarded by lock
+	naturalKey          StructNaturalKey
+	isTemplateInstalled bool
+	// schema of the module's records (nil means any record is accepted); also drives the index template
+	schema *StructStoreSchema
+	lock                sync.Mutex
+}
+
+// creator / ctor method; name is the {stock_module}.{symbol} of the store
+func NewStructElasticsearchStore(config config.Config, name string) (pStore *StructElasticsearchStore) {
+	pStore = new(StructElasticsearchStore)
+	pStore.AppConfig = config
+	pStore.Name = name
+	parts := strings.SplitN(name, ".", 2)
+	pStore.module = parts[0]
+	if len(parts) > 1 {
+		pStore.symbol = parts[1]
+	}
+	err := pStore.init()
+	if err != nil {
+		// log down the error but try to proceed
+		fmt.Println(err)
+	}
+	return
+}
+
+func (s *StructElasticsearchStore) init() (err error) {
+	s.hosts = []string{ common.StoreDefaultElasticsearchHost }
+	s.indexPattern = common.StoreDefaultElasticsearchIndexPattern
+	s.template = common.StoreDefaultElasticsearchTemplate
+	s.refresh = common.StoreDefaultElasticsearchRefresh
+	s.retryMax = common.StoreDefaultElasticsearchRetryMax
+	s.retryBackoff = time.Millisecond * common.StoreDefaultElasticsearchRetryBackoffMillis
+	timeout := time.Second * common.StoreDefaultElasticsearchTimeoutSeconds
+	if s.AppConfig != nil {
+		cfg := s.AppConfig
+		s.hosts = cfg.Get(common.ConfigKeyStoreData, common.ConfigKeyStoreDataHosts).StringSlice(s.hosts)
+		s.username = cfg.Get(common.ConfigKeyStoreData, common.ConfigKeyStoreDataUsername).String("")
+		s.password = cfg.Get(common.ConfigKeyStoreData, common.ConfigKeyStoreDataPassword).String("")
+		s.indexPattern = cfg.Get(common.ConfigKeyStoreData, common.ConfigKeyStoreDataIndexPattern).String(s.indexPattern)
+		s.template = cfg.Get(common.ConfigKeyStoreData, common.ConfigKeyStoreDataTemplate).String(s.template)
+		s.refresh = cfg.Get(common.ConfigKeyStoreData, common.ConfigKeyStoreDataRefresh).String(s.refresh)
+		s.retryMax = cfg.Get(common.ConfigKeyStoreData, common.ConfigKeyStoreDataRetryMax).Int(s.retryMax)
+		s.retryBackoff = cfg.Get(common.ConfigKeyStoreData, common.ConfigKeyStoreDataRetryBackoff).Duration(s.retryBackoff)
+		timeout = cfg.Get(common.ConfigKeyStoreData, common.ConfigKeyStoreDataTimeout).Duration(timeout)
+	}
+	for i, host := range s.hosts {
+		s.hosts[i] = strings.TrimSuffix(host, "/")
+	}
+	s.pClient = &http.Client{Timeout: timeout}
+	s.naturalKey, err = GetNaturalKeyFromConfig(s.AppConfig, common.ConfigKeyStoreData, s.module)
+	if err != nil {
+		return
+	}
+	s.schema, err = GetSchemaFromConfig(s.AppConfig, s.module)
+	return
+}
+
+// save the record into the index of its trx_date (through the bulk API)
+func (s *StructElasticsearchStore) Persist(data map[string]StructStoreValue) (response StructStoreResponse, err error) {
+	response, err = s.PersistBulk([]map[string]StructStoreValue{ data })
+	return
+}
+
+// save the records through 1 bulk request (items rejected with 429 are retried); records with an existing
+// natural key are replaced ("replace" policy) or skipped ("skip" policy)
+func (s *StructElasticsearchStore) PersistBulk(records []map[string]StructStoreValue) (response StructStoreResponse, err error) {
+	response = s.newStructStoreResponse(CodeSuccess, "", common.FileStatusAvailable)
+	naturalKey := s.getNaturalKey()
+	actions := make([]structBulkAction, 0, len(records))
+	for _, data := range records {
+		// records not matching the module's schema are rejected
+		data, err = s.schema.Conform(data)
+		if err != nil {
+			s.handleCommonErrorForResponse(&response, err)
+			return
+		}
+		record := GetRecordWithFieldKeys(data)
+		action := structBulkAction{Action: "index", Index: s.getIndexName(record)}
+		action.Source, err = EncodeStoreRecord(toElasticsearchRecord(record))
+		if err != nil {
+			s.handleCommonErrorForResponse(&response, err)
+			return
+		}
+		if id, isAvailable := BuildNaturalKeyId(record, naturalKey); isAvailable &&
+			strings.Compare(naturalKey.DuplicatePolicy, common.StoreDuplicatePolicyAppend) != 0 {
+			action.Id = id
+			if strings.Compare(naturalKey.DuplicatePolicy, common.StoreDuplicatePolicySkip) == 0 {
+				action.Action = "create"
+			}
+		}
+		actions = append(actions, action)
+	}
+	skipped, err := s.bulk(actions)
+	if err != nil {
+		s.handleCommonErrorForResponse(&response, err)
+		return
+	}
+	if skipped > 0 {
+		response.Message = fmt.Sprintf("%v record(s) with the same natural key already exist, skipped", skipped)
+		response.AdditionalCode = common.FileStatusSkipped
+	}
+	return
+}
+
+// read all records of the store's symbol as json lines (might be an issue when the content size is HUGE, use Iterate instead
+func (s *StructElasticsearchStore) ReadAll() (response StructStoreResponse, content string, err error) {
+	response, iterator, err := s.Iterate()
+	if err != nil {
+		return
+	}
+	defer func() {
+		_ = iterator.Close()
+	}()
+	var bContent bytes.Buffer
+	for iterator.Next() {
+		jsonValue, err2 := EncodeStoreRecord(iterator.Record().Value.(map[string]StructStoreValue))
+		if err2 != nil {
+			err = err2
+			break
+		}
+		bContent.WriteString(jsonValue)
+		bContent.WriteString("\n")
+	}
+	if err == nil {
+		err = iterator.Err()
+	}
+	if err != nil {
+		s.handleCommonErrorForResponse(&response, err)
+		return
+	}
+	content = bContent.String()
+	return
+}
+
+// read the record associated by the KEY ({stock_id}|{trx_date}, see BuildRecordKey),
+// PARAMS (StructStoreReadParams or a map of filters) narrows down the matching records and the fields returned
+func (s *StructElasticsearchStore) ReadByKey(key string, params interface{}) (response StructStoreResponse, value StructStoreValue, err error) {
+	response = s.newStructStoreResponse(CodeSuccess, "", common.FileStatusAvailable)
+	readParams, err := GetStoreReadParams(params)
+	if err != nil {
+		s.handleCommonErrorForResponse(&response, err)
+		return
+	}
+	hits, err := s.searchByKey(key)
+	if err != nil {
+		s.handleCommonErrorForResponse(&response, err)
+		return
+	}
+	found := false
+	for _, hit := range hits {
+		if IsRecordMatchingFilters(hit.record, readParams.Filters) {
+			value = StructStoreValue{Key: key, Value: SelectRecordFields(hit.record, readParams.Fields), IsObject: true}
+			found = true
+		}
+	}
+	if !found {
+		err = errors.New(fmt.Sprintf("no record found for key [%v]", key))
+		s.handleCommonErrorForResponse(&response, err)
+		response.AdditionalCode = common.FileStatusNotAvailable
+	}
+	return
+}
+
+// query the records of the given stock whose trx_date falls within [from, to] (filtered by elasticsearch)
+func (s *StructElasticsearchStore) Query(stockId string, from, to time.Time, fields []string, limit int) (response StructStoreResponse, records []StructStoreValue, err error) {
+	records = make([]StructStoreValue, 0)
+	response = s.newStructStoreResponse(CodeSuccess, "", common.FileStatusAvailable)
+	pIterator := newStructElasticsearchIterator(s, s.buildSearchQuery(stockId, from, to), limit, nil)
+	defer func() {
+		_ = pIterator.Close()
+	}()
+	matchedRecords := make([]map[string]StructStoreValue, 0)
+	for pIterator.Next() {
+		matchedRecords = append(matchedRecords, pIterator.Record().Value.(map[string]StructStoreValue))
+	}
+	err = pIterator.Err()
+	if err != nil {
+		s.handleCommonErrorForResponse(&response, err)
+		return
+	}
+	records = BuildQueryResult(matchedRecords, fields, limit)
+	return
+}
+
+// iterate the records of the store's symbol (chronological order) matching all the predicates;
+// the records are fetched page by page (search_after)
+func (s *StructElasticsearchStore) Iterate(predicates ...StoreRecordPredicate) (response StructStoreResponse, iterator IStoreIterator, err error) {
+	response = s.newStructStoreResponse(CodeSuccess, "", common.FileStatusAvailable)
+	iterator = newStructElasticsearchIterator(s, s.buildSearchQuery(s.symbol, time.Time{}, time.Time{}), 0, predicates)
+	return
+}
+
+// modify the record(s) associated with the key; VALUE must be an object (map[string]StructStoreValue)
+// containing the fields to update. The record identity (stock_id and trx_date) could not be modified
+func (s *StructElasticsearchStore) ModifyByKey(key string, value StructStoreValue) (response StructStoreResponse, err error) {
+	response = s.newStructStoreResponse(CodeSuccess, "", common.FileStatusAvailable)
+	fieldMap, isMap := value.Value.(map[string]StructStoreValue)
+	if !value.IsObject || !isMap {
+		err = errors.New(fmt.Sprintf("value for key [%v] must be an object of fields (map[string]StructStoreValue)", key))
+		s.handleCommonErrorForResponse(&response, err)
+		return
+	}
+	hits, err := s.searchByKey(key)
+	if err == nil && len(hits) == 0 {
+		err = errors.New(fmt.Sprintf("no record found for key [%v]", key))
+		s.handleCommonErrorForResponse(&response, err)
+		response.AdditionalCode = common.FileStatusNotAvailable
+		return
+	}
+	actions := make([]structBulkAction, 0, len(hits))
+	for _, hit := range hits {
+		if err != nil {
+			break
+		}
+		for fieldName, fieldValue := range GetRecordWithFieldKeys(fieldMap) {
+			if (strings.Compare(fieldName, StoreKeyStockId) == 0 || strings.Compare(fieldName, StoreKeyTrxDate) == 0) &&
+				!isStoreValueEqual(hit.record[fieldName].Value, fieldValue.Value) {
+				err = errors.New(fmt.Sprintf("field [%v] is part of the record key and could not be modified", fieldName))
+				break
+			}
+			fieldValue.Key = ""
+			hit.record[fieldName] = fieldValue
+		}
+		action := structBulkAction{Action: "index", Index: hit.Index, Id: hit.Id}
+		if err == nil {
+			action.Source, err = EncodeStoreRecord(toElasticsearchRecord(hit.record))
+		}
+		actions = append(actions, action)
+	}
+	if err == nil {
+		_, err = s.bulk(actions)
+	}
+	if err != nil {
+		s.handleCommonErrorForResponse(&response, err)
+	}
+	return
+}
+
+// remove the record(s) associated with the key; the removed record is returned as an object
+func (s *StructElasticsearchStore) RemoveByKey(key string) (response StructStoreResponse, valueRemoved StructStoreValue, err error) {
+	response = s.newStructStoreResponse(CodeSuccess, "", common.FileStatusAvailable)
+	hits, err := s.searchByKey(key)
+	if err == nil && len(hits) == 0 {
+		err = errors.New(fmt.Sprintf("no record found for key [%v]", key))
+		s.handleCommonErrorForResponse(&response, err)
+		response.AdditionalCode = common.FileStatusNotAvailable
+		return
+	}
+	actions := make([]structBulkAction, 0, len(hits))
+	for _, hit := range hits {
+		actions = append(actions, structBulkAction{Action: "delete", Index: hit.Index, Id: hit.Id})
+		valueRemoved = StructStoreValue{Key: key, Value: hit.record, IsObject: true}
+	}
+	if err == nil {
+		_, err = s.bulk(actions)
+	}
+	if err != nil {
+		s.handleCommonErrorForResponse(&response, err)
+	}
+	return
+}
+
+// remove all records of the store's symbol (delete by query), be careful~
+func (s *StructElasticsearchStore) RemoveAll() (response StructStoreResponse, err error) {
+	response = s.newStructStoreResponse(CodeSuccess, "", common.FileStatusAvailable)
+	body, err := json.Marshal(map[string]interface{}{ "query": s.buildSearchQuery(s.symbol, time.Time{}, time.Time{}) })
+	if err != nil {
+		s.handleCommonErrorForResponse(&response, err)
+		return
+	}
+	path := fmt.Sprintf("/%v/_delete_by_query?conflicts=proceed&ignore_unavailable=true&allow_no_indices=true&refresh=%v",
+		s.getIndexWildcard(), s.getDeleteByQueryRefresh())
+	_, err = s.requestWithRetry(http.MethodPost, path, "application/json", body)
+	if err != nil {
+		s.handleCommonErrorForResponse(&response, err)
+	}
+	return
+}
+
+// remove the records of the stock (empty means all stocks) whose trx_date is before the given time (delete by query)
+func (s *StructElasticsearchStore) RemoveBefore(stockId string, before time.Time) (response StructStoreResponse, removed int, err error) {
+	response = s.newStructStoreResponse(CodeSuccess, "", common.FileStatusAvailable)
+	query := s.buildSearchQuery(stockId, time.Time{}, time.Time{})
+	filters := query["bool"].(map[string]interface{})["filter"].([]interface{})
+	query["bool"].(map[string]interface{})["filter"] = append(filters, map[string]interface{}{
+		"range": map[string]interface{}{ StoreKeyTrxDate: map[string]interface{}{ "lt": before.Format(util.CommonDateFormat) } },
+	})
+	body, err := json.Marshal(map[string]interface{}{ "query": query })
+	if err != nil {
+		s.handleCommonErrorForResponse(&response, err)
+		return
+	}
+	path := fmt.Sprintf("/%v/_delete_by_query?conflicts=proceed&ignore_unavailable=true&allow_no_indices=true&refresh=%v",
+		s.getIndexWildcard(), s.getDeleteByQueryRefresh())
+	bResponse, err := s.requestWithRetry(http.MethodPost, path, "application/json", body)
+	if err == nil {
+		result := struct{ Deleted int `json:"deleted"` }{}
+		err = json.Unmarshal(bResponse, &result)
+		removed = result.Deleted
+	}
+	if err != nil {
+		s.handleCommonErrorForResponse(&response, err)
+	}
+	return
+}
+
+// set the natural key identifying a record (the document id) and how Persist handles a record whose natural key already exists
+func (s *StructElasticsearchStore) SetNaturalKey(naturalKey StructNaturalKey) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.naturalKey = naturalKey
+}
+
+func (s *StructElasticsearchStore) getNaturalKey() StructNaturalKey {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.naturalKey
+}
+
+func (s *StructElasticsearchStore) newStructStoreResponse(code int, message string, additionalCode int) (response StructStoreResponse) {
+	response.Code = code
+	response.Message = message
+	response.AdditionalCode = additionalCode
+	return
+}
+
+func (s *StructElasticsearchStore) handleCommonErrorForResponse(pResponseStruct *StructStoreResponse, err error) {
+	if pResponseStruct != nil && err != nil {
+		pResponseStruct.Code = CodeFailure
+		pResponseStruct.Message = err.Error()
+		pResponseStruct.AdditionalCode = common.FileStatusUnknown
+	}
+}
+
+// * ******************** *
+// * index and templates  *
+// * ******************** *
+
+// return the index of the record based on its trx_date (UTC); the current time if not available
+func (s *StructElasticsearchStore) getIndexName(record map[string]StructStoreValue) string {
+	trxDate, isDate := toStoreDate(record[StoreKeyTrxDate].Value)
+	if !isDate {
+		trxDate = time.Now()
+	}
+	pattern := strings.Replace(s.indexPattern, "{module}", s.module, -1)
+	return strings.ToLower(util.PrepareTimebasedPatternWithGivenTime(pattern, trxDate.UTC()))
+}
+
+// return the wildcard matching all indices of the index pattern (e.g. stock_aastocks_*.*)
+func (s *StructElasticsearchStore) getIndexWildcard() string {
+	wildcard := strings.Replace(s.indexPattern, "{module}", s.module, -1)
+	for _, token := range []string{ "yyyy", "yy", "mm", "dd" } {
+		wildcard = strings.Replace(wildcard, token, "*", -1)
+	}
+	return strings.ToLower(wildcard)
+}
+
+// install the index template (mapping of the stock fields) for the index pattern; once per store
+func (s *StructElasticsearchStore) ensureTemplate() (err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.isTemplateInstalled {
+		return
+	}
+	template := map[string]interface{}{
+		"index_patterns": []string{ s.getIndexWildcard() },
+		"template": map[string]interface{}{
+			"mappings": map[string]interface{}{
+				"dynamic_templates": []interface{}{
+					map[string]interface{}{
+						"strings_as_keywords": map[string]interface{}{
+							"match_mapping_type": "string",
+							"mapping":            map[string]interface{}{ "type": "keyword" },
+						},
+					},
+				},
+				"properties": s.getMappingProperties(),
+			},
+		},
+	}
+	body, err := json.Marshal(template)
+	if err != nil {
+		return
+	}
+	name := fmt.Sprintf("%v_%v", s.template, s.module)
+	_, err = s.requestWithRetry(http.MethodPut, "/_index_template/"+url.PathEscape(name), "application/json", body)
+	if err == nil {
+		s.isTemplateInstalled = true
+	}
+	return
+}
+
+// mapping of the fields; based on the module's schema if declared (units are kept as the fields' meta)
+func (s *StructElasticsearchStore) getMappingProperties() (properties map[string]interface{}) {
+	if s.schema == nil {
+		return map[string]interface{}{
+			StoreKeyStockId:     map[string]interface{}{ "type": "keyword" },
+			StoreKeyTrxDate:     map[string]interface{}{ "type": "date", "format": "date_time_no_millis||strict_date_optional_time" },
+			"price":             map[string]interface{}{ "type": "double" },
+			"price_fluctuation": map[string]interface{}{ "type": "keyword" },
+			"volume":            map[string]interface{}{ "type": "keyword" },
+		}
+	}
+	properties = make(map[string]interface{})
+	for _, field := range s.schema.Fields {
+		mapping := map[string]interface{}{}
+		switch field.Type {
+		case TypeInteger:
+			mapping["type"] = "long"
+		case TypeFloat, TypeDecimal:
+			// decimals are kept as strings in the _source (exact) and indexed as double (coerced); see toElasticsearchRecord
+			mapping["type"] = "double"
+		case TypeBool:
+			mapping["type"] = "boolean"
+		case TypeDate:
+			mapping["type"] = "date"
+			mapping["format"] = "date_time_no_millis||strict_date_optional_time"
+		default:
+			mapping["type"] = "keyword"
+		}
+		if !util.IsEmptyString(field.Unit) {
+			mapping["meta"] = map[string]interface{}{ "unit": field.Unit }
+		}
+		properties[field.Name] = mapping
+	}
+	return
+}
+
+// the record with its decimals as plain strings (e.g. "330.000") instead of the decimal objects of
+// EncodeStoreRecord; the double mapping coerces such strings whilst the _source keeps the exact value
+func toElasticsearchRecord(record map[string]StructStoreValue) (esRecord map[string]StructStoreValue) {
+	esRecord = make(map[string]StructStoreValue, len(record))
+	for fieldName, value := range record {
+		esRecord[fieldName] = toElasticsearchValue(value)
+	}
+	return
+}
+
+func toElasticsearchValue(value StructStoreValue) (esValue StructStoreValue) {
+	esValue = value
+	if isNilValue(value.Value) {
+		return
+	}
+	switch {
+	case value.IsObject:
+		if fieldMap, isMap := value.Value.(map[string]StructStoreValue); isMap {
+			esValue.Value = toElasticsearchRecord(fieldMap)
+		}
+	case value.IsArray:
+		elements, isElements := value.Value.([]StructStoreValue)
+		if !isElements {
+			if value.Type != TypeDecimal {
+				return
+			}
+			reflectValue := reflect.ValueOf(value.Value)
+			if reflectValue.Kind() != reflect.Slice && reflectValue.Kind() != reflect.Array {
+				return
+			}
+			elements = make([]StructStoreValue, reflectValue.Len())
+			for i := range elements {
+				elements[i] = StructStoreValue{ Value: reflectValue.Index(i).Interface(), Type: TypeDecimal }
+			}
+		}
+		esElements := make([]StructStoreValue, len(elements))
+		for i, element := range elements {
+			esElements[i] = toElasticsearchValue(element)
+		}
+		esValue.Value = esElements
+		if value.Type == TypeDecimal {
+			esValue.Type = TypeString
+		}
+	case value.Type == TypeDecimal:
+		if decimal, isDecimal := toDecimal(value.Value); isDecimal {
+			esValue.Value = decimal.String()
+			esValue.Type = TypeString
+		}
+	}
+	return
+}
+
+// decode the _source of a hit; the decimal fields of the schema are parsed back from their strings
+// (hence without a schema, decimals are returned as strings)
+func (s *StructElasticsearchStore) decodeSource(source string) (record map[string]StructStoreValue, err error) {
+	record, err = DecodeStoreRecord(source)
+	if err != nil || s.schema == nil {
+		return
+	}
+	for _, field := range s.schema.Fields {
+		value, found := record[field.Name]
+		if !found || field.Type != TypeDecimal || isNilValue(value.Value) {
+			continue
+		}
+		record[field.Name], err = parseElasticsearchDecimal(field, value)
+		if err != nil {
+			err = errors.New(fmt.Sprintf("field [%v] => %v", field.Name, err))
+			return
+		}
+	}
+	return
+}
+
+func parseElasticsearchDecimal(field StructSchemaField, value StructStoreValue) (decimalValue StructStoreValue, err error) {
+	decimalValue = value
+	if value.IsArray {
+		elements, isElements := value.Value.([]StructStoreValue)
+		if !isElements {
+			return
+		}
+		decimalElements := make([]StructStoreValue, len(elements))
+		for i, element := range elements {
+			decimalElements[i], err = parseElasticsearchDecimal(field, element)
+			if err != nil {
+				return
+			}
+		}
+		decimalValue.Value = decimalElements
+		decimalValue.Type = TypeDecimal
+		return
+	}
+	if sValue, isString := value.Value.(string); isString && value.Type == TypeString {
+		decimalValue.Value, err = ParseDecimal(sValue)
+		decimalValue.Type = TypeDecimal
+		return
+	}
+	// numbers (e.g. documents indexed by other clients) are converted as on write
+	if conformed, isConverted := conformSchemaValue(StructSchemaField{ Name: field.Name, Type: TypeDecimal }, value); isConverted {
+		decimalValue = conformed
+	}
+	return
+}
+
+// * ************** *
+// * bulk + search  *
+// * ************** *
+
+// an action of a bulk request
+type structBulkAction struct {
+	// index, create or delete
+	Action string
+	Index  string
+	// optional for index (auto generated id)
+	Id     string
+	Source string
+}
+
+// execute the bulk actions; items rejected with 429 are retried with backoff, conflicts (409) of
+// "create" actions are counted as skipped. Any other item failure is returned as an error
+func (s *StructElasticsearchStore) bulk(actions []structBulkAction) (skipped int, err error) {
+	if len(actions) == 0 {
+		return
+	}
+	err = s.ensureTemplate()
+	if err != nil {
+		return
+	}
+	backoff := s.retryBackoff
+	for attempt := 0; ; attempt++ {
+		var bBody bytes.Buffer
+		for _, action := range actions {
+			meta := map[string]string{ "_index": action.Index }
+			if !util.IsEmptyString(action.Id) {
+				meta["_id"] = action.Id
+			}
+			bMeta, _ := json.Marshal(map[string]interface{}{ action.Action: meta })
+			bBody.Write(bMeta)
+			bBody.WriteString("\n")
+			if strings.Compare(action.Action, "delete") != 0 {
+				bBody.WriteString(action.Source)
+				bBody.WriteString("\n")
+			}
+		}
+		bResponse, err2 := s.requestWithRetry(http.MethodPost, "/_bulk?refresh="+url.QueryEscape(s.refresh), "application/x-ndjson", bBody.Bytes())
+		if err2 != nil {
+			err = err2
+			return
+		}
+		bulkResponse := new(structBulkResponse)
+		err = json.Unmarshal(bResponse, bulkResponse)
+		if err != nil {
+			return
+		}
+		retryActions := make([]structBulkAction, 0)
+		for i, item := range bulkResponse.Items {
+			for _, result := range item {
+				switch {
+				case result.Status == http.StatusTooManyRequests && i < len(actions):
+					retryActions = append(retryActions, actions[i])
+				case result.Status == http.StatusConflict && strings.Compare(actions[i].Action, "create") == 0:
+					skipped++
+				case result.Status == http.StatusNotFound && strings.Compare(actions[i].Action, "delete") == 0:
+					// already removed
+				case result.Status >= 300:
+					if err == nil {
+						err = errors.New(fmt.Sprintf("bulk %v of [%v/%v] failed (%v) => %v",
+							actions[i].Action, actions[i].Index, actions[i].Id, result.Status, string(result.Error)))
+					}
+				}
+			}
+		}
+		if err != nil || len(retryActions) == 0 {
+			return
+		}
+		if attempt >= s.retryMax {
+			err = errors.New(fmt.Sprintf("%v bulk item(s) still rejected (429) after %v retries", len(retryActions), s.retryMax))
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+		actions = retryActions
+	}
+}
+
+type structBulkResponse struct {
+	Errors bool                                `json:"errors"`
+	Items  []map[string]structBulkItemResponse `json:"items"`
+}
+
+type structBulkItemResponse struct {
+	Status int             `json:"status"`
+	Error  json.RawMessage `json:"error"`
+}
+
+type structSearchResponse struct {
+	Hits struct {
+		Hits []structSearchHit `json:"hits"`
+	} `json:"hits"`
+}
+
+type structSearchHit struct {
+	Index  string          `json:"_index"`
+	Id     string          `json:"_id"`
+	Source json.RawMessage `json:"_source"`
+	Sort   []interface{}   `json:"sort"`
+
+	record map[string]StructStoreValue
+}
+
+// build the search query of the stock (empty means all) and the trx_date range (zero means unbounded)
+func (s *StructElasticsearchStore) buildSearchQuery(stockId string, from, to time.Time) map[string]interface{} {
+	filters := make([]interface{}, 0)
+	if !util.IsEmptyString(stockId) {
+		filters = append(filters, map[string]interface{}{ "term": map[string]interface{}{ StoreKeyStockId: stockId } })
+	}
+	if !from.IsZero() || !to.IsZero() {
+		dateRange := make(map[string]interface{})
+		if !from.IsZero() {
+			dateRange["gte"] = from.Format(util.CommonDateFormat)
+		}
+		if !to.IsZero() {
+			dateRange["lte"] = to.Format(util.CommonDateFormat)
+		}
+		filters = append(filters, map[string]interface{}{ "range": map[string]interface{}{ StoreKeyTrxDate: dateRange } })
+	}
+	return map[string]interface{}{ "bool": map[string]interface{}{ "filter": filters } }
+}
+
+// search a page of hits sorted by trx_date (then stock_id), after the given sort values (if any)
+func (s *StructElasticsearchStore) search(query map[string]interface{}, size int, searchAfter []interface{}) (hits []structSearchHit, err error) {
+	request := map[string]interface{}{
+		"query": query,
+		"size":  size,
+		"sort":  []interface{}{
+			map[string]interface{}{ StoreKeyTrxDate: "asc" },
+			map[string]interface{}{ StoreKeyStockId: "asc" },
+		},
+	}
+	if len(searchAfter) > 0 {
+		request["search_after"] = searchAfter
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return
+	}
+	bResponse, err := s.requestWithRetry(http.MethodPost,
+		fmt.Sprintf("/%v/_search?ignore_unavailable=true&allow_no_indices=true", s.getIndexWildcard()), "application/json", body)
+	if err != nil {
+		return
+	}
+	searchResponse := new(structSearchResponse)
+	err = json.Unmarshal(bResponse, searchResponse)
+	if err != nil {
+		return
+	}
+	hits = searchResponse.Hits.Hits
+	for i := range hits {
+		hits[i].record, err = s.decodeSource(string(hits[i].Source))
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// search the hits of the key ({stock_id}|{trx_date})
+func (s *StructElasticsearchStore) searchByKey(key string) (hits []structSearchHit, err error) {
+	stockId, trxDate, err := ParseRecordKey(key)
+	if err != nil {
+		return
+	}
+	allHits, err := s.search(s.buildSearchQuery(stockId, trxDate, trxDate), common.StoreDefaultElasticsearchPageSize, nil)
+	if err != nil {
+		return
+	}
+	hits = make([]structSearchHit, 0, len(allHits))
+	for _, hit := range allHits {
+		if isStoreValueEqual(hit.record[StoreKeyStockId].Value, stockId) && isStoreValueEqual(hit.record[StoreKeyTrxDate].Value, trxDate) {
+			hits = append(hits, hit)
+		}
+	}
+	return
+}
+
+func (s *StructElasticsearchStore) getDeleteByQueryRefresh() string {
+	// delete by query ONLY accepts true or false
+	if strings.Compare(s.refresh, "false") == 0 {
+		return "false"
+	}
+	return "true"
+}
+
+// send the request to the hosts (the next host is tried on connection errors); requests rejected with
+// 429 are retried with backoff. Non 2xx responses are returned as errors
+func (s *StructElasticsearchStore) requestWithRetry(method, path, contentType string, body []byte) (bResponse []byte, err error) {
+	backoff := s.retryBackoff
+	for attempt := 0; ; attempt++ {
+		status := 0
+		status, bResponse, err = s.request(method, path, contentType, body)
+		if err != nil {
+			return
+		}
+		if status == http.StatusTooManyRequests && attempt < s.retryMax {
+			time.Sleep(backoff)
+			backoff *= 2
+			continue
+		}
+		if status < 200 || status >= 300 {
+			err = errors.New(fmt.Sprintf("%v %v failed (%v) => %v", method, path, status, string(bResponse)))
+		}
+		return
+	}
+}
+
+func (s *StructElasticsearchStore) request(method, path, contentType string, body []byte) (status int, bResponse []byte, err error) {
+	if len(s.hosts) == 0 {
+		err = errors.New("no elasticsearch hosts configured")
+		return
+	}
+	for _, host := range s.hosts {
+		pRequest, err2 := http.NewRequest(method, host+path, bytes.NewReader(body))
+		if err2 != nil {
+			err = err2
+			return
+		}
+		pRequest.Header.Set("Content-Type", contentType)
+		if !util.IsEmptyString(s.username) {
+			pRequest.SetBasicAuth(s.username, s.password)
+		}
+		pResponse, err2 := s.pClient.Do(pRequest)
+		if err2 != nil {
+			// try the next host
+			err = err2
+			continue
+		}
+		bResponse, err = ioutil.ReadAll(pResponse.Body)
+		err2 = pResponse.Body.Close()
+		if err == nil {
+			err = err2
+		}
+		status = pResponse.StatusCode
+		return
+	}
+	return
+}
+
+// * ********* *
+// * iterator  *
+// * ********* *
+
+// iterator over the hits of a search; pages are fetched lazily through search_after
+type structElasticsearchIterator struct {
+	pStore     *StructElasticsearchStore
+	query      map[string]interface{}
+	predicates []StoreRecordPredicate
+	// max number of hits to return (0 means no limit)
+	limit int
+
+	page        []structSearchHit
+	pageIndex   int
+	searchAfter []interface{}
+	returned    int
+	isExhausted bool
+
+	record StructStoreValue
+	err    error
+}
+
+func newStructElasticsearchIterator(pStore *StructElasticsearchStore, query map[string]interface{}, limit int, predicates []StoreRecordPredicate) (pIterator *structElasticsearchIterator) {
+	pIterator = new(structElasticsearchIterator)
+	pIterator.pStore = pStore
+	pIterator.query = query
+	pIterator.limit = limit
+	pIterator.predicates = predicates
+	return
+}
+
+func (i *structElasticsearchIterator) Next() bool {
+	i.record = StructStoreValue{}
+	for i.err == nil && (i.limit <= 0 || i.returned < i.limit) {
+		if i.pageIndex >= len(i.page) {
+			if i.isExhausted {
+				return false
+			}
+			i.page, i.err = i.pStore.search(i.query, common.StoreDefaultElasticsearchPageSize, i.searchAfter)
+			i.pageIndex = 0
+			if i.err != nil {
+				return false
+			}
+			if len(i.page) < common.StoreDefaultElasticsearchPageSize {
+				i.isExhausted = true
+			}
+			if len(i.page) == 0 {
+				return false
+			}
+			i.searchAfter = i.page[len(i.page)-1].Sort
+		}
+		hit := i.page[i.pageIndex]
+		i.pageIndex++
+		if IsRecordMatchingPredicates(hit.record, i.predicates) {
+			i.record = NewRecordStoreValue(hit.record)
+			i.returned++
+			return true
+		}
+	}
+	return false
+}
+
+func (i *structElasticsearchIterator) Record() StructStoreValue {
+	return i.record
+}
+
+func (i *structElasticsearchIterator) Err() error {
+	return i.err
+}
+
+func (i *structElasticsearchIterator) Close() error {
+	i.page = nil
+	i.isExhausted = true
+	return nil
+}
@@ -14,11 +14,17 @@
  *  limitations under the License.
  */
 // basic filestore - implements interface IStore.
-// ONLY provide 3 functions and the rest functions are not implemented
+// Each record is stored as 1 line of json; records are identified by
+// the stock_id and trx_date fields (see BuildRecordKey).
 // functions implemented:
 // a. Persist
 // b. ReadAll
-// c. RemoveAll
+// c. ReadByKey
+// d. Query
+// e. Iterate
+// f. ModifyByKey (the file is re-written atomically)
+// g. RemoveByKey (the file is re-written atomically)
+// h. RemoveAll
 package store
 
 import (
@@ -30,8 +36,9 @@ import (
 	"github.com/micro/go-config"
 	"io/ioutil"
 	"os"
-	"reflect"
+	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -41,17 +48,49 @@ type StructFilestore struct {
 	// target file to operate with
 	Filename  string
 
-	// the actual filepath to store and load the data
+	// the actual filepath to store and load the data (non partitioned)
 	filepath string
+	// the repo path resolved
+	repo string
+	// partition scheme (common.StorePartitionXXX); daily or monthly partitions write into segment files
+	partition string
+	// compression scheme (common.StoreCompressionXXX) of the closed segments
+	compression string
+	// closed to stop the background compression (nil if not running) and closed by the compression loop once
+	// stopped; guarded by the compression lock
+	compressionStopChannel chan bool
+	compressionDoneChannel chan bool
+	compressionLock        sync.Mutex
+	// the clock telling which segments are closed (util.SystemClock unless injected on creation)
+	clock util.IClock
+	// serializes the writes (appends, rewrites and compression) on the segments within the process
+	segmentLock sync.Mutex
+	// interval between 2 attempts and max time to acquire the advisory file lock (across processes)
+	lockWait    time.Duration
+	lockTimeout time.Duration
+	// sync (fsync) mode (common.StoreSyncXXX) of the writes
+	syncMode        string
+	pGroupCommitter *structGroupCommitter
+	// report of the latest recovery scan
+	recoveryReport StructRecoveryReport
+	// natural key of the records; guarded by the segment lock
+	naturalKey StructNaturalKey
+	// segment filepath -> natural key index of the segment (see getSegmentIndex), in the order last written;
+	// guarded by the segment lock
+	segmentIndexes    map[string]*structSegmentIndex
+	segmentIndexOrder []string
+	// schema of the module's records (nil means any record is accepted)
+	schema *StructStoreSchema
 }
 
-// creator / ctor method
-func NewStructFilestore(config config.Config, filename string) (pStore *StructFilestore) {
+// creator / ctor method; the optional clock is used by the compression of the closed segments
+func NewStructFilestore(config config.Config, filename string, clock ...util.IClock) (pStore *StructFilestore) {
 	pStore = new(StructFilestore)
 	if config != nil {
 		pStore.AppConfig = config
 	}
 	pStore.Filename = filename
+	pStore.clock = util.GetClock(clock...)
 	// init and find the full filepath
 	err := pStore.init()
 	if err != nil {
@@ -62,94 +101,372 @@ func NewStructFilestore(config config.Config, filename string) (pStore *StructFi
 }
 
 
-// save all data into the store
+// save all data into the store; the record is appended as 1 json line to the file (segment of its trx_date)
 func (s *StructFilestore) Persist(data map[string]StructStoreValue) (response StructStoreResponse, err error) {
 	response = s.newStructStoreResponse(CodeSuccess, "", common.FileStatusAvailable)
-	pFile, err := os.OpenFile(s.filepath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0666)
-	// dtor
-	defer func() {
-		err2 := pFile.Close()
-		// do not shadow the original error
-		if err == nil && err2 != nil {
-			err = err2
-			s.handleCommonErrorForResponse(&response, err, common.FileStatusUnknown)
-			return
-		}
-	}()
+	// records not matching the module's schema are rejected
+	data, err = s.schema.Conform(data)
 	if err != nil {
 		s.handleCommonErrorForResponse(&response, err, common.FileStatusUnknown)
 		return
 	}
 	// write the values (json in 1 line)
-	// build json content by code...
 	jsonValue, err := s.toJson(data)
+	if err != nil {
+		s.handleCommonErrorForResponse(&response, err, common.FileStatusUnknown)
+		return
+	}
+	segmentFilepath := s.getSegmentFilepathByRecord(data)
+	isSkipped, err := s.persistRecord(segmentFilepath, GetRecordWithFieldKeys(data), jsonValue)
+	if err == nil && !isSkipped {
+		err = s.waitForGroupCommit(segmentFilepath)
+	}
+	if err != nil {
+		s.handleCommonErrorForResponse(&response, err, s.getFileStatusByError(err))
+		return
+	}
+	if isSkipped {
+		response.Message = "record with the same natural key already exists, skipped"
+		response.AdditionalCode = common.FileStatusSkipped
+	}
+	return
+}
+
+// set the natural key identifying a record and how Persist handles a record whose natural key already exists
+func (s *StructFilestore) SetNaturalKey(naturalKey StructNaturalKey) {
+	s.segmentLock.Lock()
+	defer s.segmentLock.Unlock()
+	s.naturalKey = naturalKey
+	// the indexes are built on the natural key's fields
+	s.dropSegmentIndexes()
+}
+
+// persist the record (json line) under the write lock; a record with the same natural key within the segment
+// is replaced or the record is skipped based on the duplicate policy. Duplicates are looked up in the segment's
+// natural key index, hence ONLY a duplicate reads (and re-writes) the file holding it
+func (s *StructFilestore) persistRecord(segmentFilepath string, record map[string]StructStoreValue, jsonValue string) (isSkipped bool, err error) {
+	unlock, err := s.lockForWrite()
 	if err != nil {
 		return
 	}
-	// write to file
-	_, err = pFile.WriteString(jsonValue)
+	defer unlock()
+
+	id, isAvailable := BuildNaturalKeyId(record, s.naturalKey)
+	if strings.Compare(s.naturalKey.DuplicatePolicy, common.StoreDuplicatePolicyAppend) == 0 || !isAvailable {
+		err = s.appendLine(segmentFilepath, jsonValue)
+		return
+	}
+	pIndex, err := s.getSegmentIndex(segmentFilepath)
 	if err != nil {
 		return
 	}
-	// goto the last byte's position for appending (might not be necessary now
-	//_, err = pFile.Seek(int64(len(jsonValue) + 1), 0)
-	//if err != nil {
-	//	return
-	//}
+	sourceFilepath, isDuplicated := pIndex.ids[id]
+	if !isDuplicated {
+		err = s.appendLine(segmentFilepath, jsonValue)
+	} else if strings.Compare(s.naturalKey.DuplicatePolicy, common.StoreDuplicatePolicySkip) == 0 {
+		isSkipped = true
+		return
+	} else {
+		err = s.replaceRecord(sourceFilepath, segmentFilepath, record, jsonValue)
+	}
+	if err != nil {
+		s.dropSegmentIndexes(segmentFilepath)
+		return
+	}
+	pIndex.ids[id] = segmentFilepath
+	s.refreshSegmentIndex(segmentFilepath, pIndex)
 	return
 }
 
-// read all contents from the store (might be an issue when the content size is HUGE
+// replace the record(s) of the same natural key in the file holding them (the plain or the compressed segment)
+// with the json line; the compressed segment stays compressed whilst the line goes to the plain segment
+// (as a late write). MUST be called under the write lock
+func (s *StructFilestore) replaceRecord(sourceFilepath string, segmentFilepath string, record map[string]StructStoreValue, jsonValue string) (err error) {
+	lines, err := s.readSegmentFileLines(sourceFilepath)
+	if err != nil {
+		return
+	}
+	remainingLines := make([]string, 0, len(lines)+1)
+	for _, line := range lines {
+		existingRecord, err2 := s.fromJson(line)
+		if err2 == nil && IsSameNaturalKey(existingRecord, record, s.naturalKey) {
+			continue
+		}
+		remainingLines = append(remainingLines, line)
+	}
+	if !isCompressedSegment(sourceFilepath) {
+		err = s.writeLines(sourceFilepath, append(remainingLines, strings.TrimSpace(jsonValue)))
+		return
+	}
+	// appended first; a crash in between leaves a duplicate rather than losing the record
+	err = s.appendLine(segmentFilepath, jsonValue)
+	if err != nil {
+		return
+	}
+	err = writeCompressedLines(sourceFilepath, remainingLines)
+	return
+}
+
+// read all contents from the store (might be an issue when the content size is HUGE, use Iterate instead;
+// for a partitioned filestore, the segments are concatenated in chronological order
 func (s *StructFilestore) ReadAll() (response StructStoreResponse, content string, err error) {
 	response = s.newStructStoreResponse(CodeSuccess, "", common.FileStatusAvailable)
-	pFile, err := os.OpenFile(s.filepath, os.O_RDONLY, 0666)
-	// dtor
-	defer func() {
-		err2 := pFile.Close()
-		// do not shadow the original error
-		if err == nil && err2 != nil {
+	segmentFilepaths, err := s.listSegmentFilepaths(time.Time{}, time.Time{})
+	if err != nil {
+		s.handleCommonErrorForResponse(&response, err, common.FileStatusUnknown)
+		return
+	}
+	var bContent bytes.Buffer
+	for _, segmentFilepath := range segmentFilepaths {
+		reader, err2 := openSegmentReader(segmentFilepath)
+		if err2 != nil {
+			err = err2
+			s.handleCommonErrorForResponse(&response, err, s.getFileStatusByError(err))
+			return
+		}
+		_, err = bContent.ReadFrom(reader)
+		err2 = reader.Close()
+		if err == nil {
 			err = err2
+		}
+		if err != nil {
 			s.handleCommonErrorForResponse(&response, err, common.FileStatusUnknown)
 			return
 		}
-	}()
+	}
+	content = bContent.String()
+	return
+}
+
+// read only the record associated by the KEY ({stock_id}|{trx_date}, see BuildRecordKey),
+// PARAMS (StructStoreReadParams or a map of filters) narrows down the matching records and the fields returned.
+// The value returned is an object (map[string]StructStoreValue); if more than 1 record matches, the latest one wins
+func (s *StructFilestore) ReadByKey(key string, params interface{}) (response StructStoreResponse, value StructStoreValue, err error) {
+	response = s.newStructStoreResponse(CodeSuccess, "", common.FileStatusAvailable)
+	readParams, err := GetStoreReadParams(params)
 	if err != nil {
 		s.handleCommonErrorForResponse(&response, err, common.FileStatusUnknown)
 		return
 	}
-	// read all contents
-	bContents, err := ioutil.ReadAll(pFile)
+	stockId, trxDate, err := ParseRecordKey(key)
 	if err != nil {
 		s.handleCommonErrorForResponse(&response, err, common.FileStatusUnknown)
 		return
 	}
-	content = string(bContents)
+	segmentFilepath := s.getSegmentFilepath(trxDate)
+	lines, err := s.readLines(segmentFilepath)
+	if err != nil {
+		s.handleCommonErrorForResponse(&response, err, s.getFileStatusByError(err))
+		return
+	}
+	found := false
+	for _, line := range lines {
+		record, matched := s.matchRecordLine(line, stockId, trxDate)
+		if !matched || !IsRecordMatchingFilters(record, readParams.Filters) {
+			continue
+		}
+		value = StructStoreValue{Key: key, Value: SelectRecordFields(record, readParams.Fields), IsObject: true}
+		found = true
+	}
+	if !found {
+		err = errors.New(fmt.Sprintf("no record found for key [%v]", key))
+		s.handleCommonErrorForResponse(&response, err, common.FileStatusNotAvailable)
+	}
 	return
 }
-// read only the content associated by the KEY, PARAMS contains additional information for the read operation
-func (s *StructFilestore) ReadByKey(key string, params interface{}) (response StructStoreResponse, value StructStoreValue, err error) {
-	// TODO: NON implemented (hence always return SUCCESS but empty value
-	response = s.newStructStoreResponse(CodeSuccess, "", common.FileStatusUnknown)
+
+// query the records of the given stock whose trx_date falls within [from, to]; ONLY the segments overlapping
+// the range are opened and iterated record by record, hence ONLY the matching records are kept in memory
+func (s *StructFilestore) Query(stockId string, from, to time.Time, fields []string, limit int) (response StructStoreResponse, records []StructStoreValue, err error) {
+	records = make([]StructStoreValue, 0)
+	response, iterator, err := s.iterateSegments(from, to, func(record map[string]StructStoreValue) bool {
+		return IsRecordInQueryRange(record, stockId, from, to)
+	})
+	if err != nil {
+		return
+	}
+	defer func() {
+		err2 := iterator.Close()
+		// do not shadow the original error
+		if err == nil && err2 != nil {
+			err = err2
+			s.handleCommonErrorForResponse(&response, err, common.FileStatusUnknown)
+		}
+	}()
+	matchedRecords := make([]map[string]StructStoreValue, 0)
+	for iterator.Next() {
+		matchedRecords = append(matchedRecords, iterator.Record().Value.(map[string]StructStoreValue))
+	}
+	err = iterator.Err()
+	if err != nil {
+		s.handleCommonErrorForResponse(&response, err, common.FileStatusUnknown)
+		return
+	}
+	records = BuildQueryResult(matchedRecords, fields, limit)
+	return
+}
+
+// iterate the records matching all the predicates; the file (segments) is read line by line and corrupted lines are skipped
+func (s *StructFilestore) Iterate(predicates ...StoreRecordPredicate) (response StructStoreResponse, iterator IStoreIterator, err error) {
+	return s.iterateSegments(time.Time{}, time.Time{}, predicates...)
+}
+
+// iterate the records of the segments overlapping [from, to] matching all the predicates
+func (s *StructFilestore) iterateSegments(from, to time.Time, predicates ...StoreRecordPredicate) (response StructStoreResponse, iterator IStoreIterator, err error) {
+	response = s.newStructStoreResponse(CodeSuccess, "", common.FileStatusAvailable)
+	segmentFilepaths, err := s.listSegmentFilepaths(from, to)
+	if err == nil && !s.isPartitioned() {
+		// the non partitioned file must exist
+		_, err = os.Stat(s.filepath)
+	}
+	if err != nil {
+		s.handleCommonErrorForResponse(&response, err, s.getFileStatusByError(err))
+		return
+	}
+	iterator = newStructFilestoreIterator(s, segmentFilepaths, predicates)
 	return
 }
 
-// modify the value associated with the key
+// modify the record associated with the key; VALUE must be an object (map[string]StructStoreValue)
+// containing the fields to update. The record identity (stock_id and trx_date) could not be modified
 func (s *StructFilestore) ModifyByKey(key string, value StructStoreValue) (response StructStoreResponse, err error) {
-	// TODO: NON implemented (hence always return SUCCESS but empty value
-	response = s.newStructStoreResponse(CodeSuccess, "", common.FileStatusUnknown)
+	response = s.newStructStoreResponse(CodeSuccess, "", common.FileStatusAvailable)
+	stockId, trxDate, err := ParseRecordKey(key)
+	if err != nil {
+		s.handleCommonErrorForResponse(&response, err, common.FileStatusUnknown)
+		return
+	}
+	fieldMap, isMap := value.Value.(map[string]StructStoreValue)
+	if !value.IsObject || !isMap {
+		err = errors.New(fmt.Sprintf("value for key [%v] must be an object of fields (map[string]StructStoreValue)", key))
+		s.handleCommonErrorForResponse(&response, err, common.FileStatusUnknown)
+		return
+	}
+	unlock, err := s.lockForWrite()
+	if err != nil {
+		s.handleCommonErrorForResponse(&response, err, s.getFileStatusByError(err))
+		return
+	}
+	defer unlock()
+
+	segmentFilepath := s.getSegmentFilepath(trxDate)
+	lines, err := s.readLines(segmentFilepath)
+	if err != nil {
+		s.handleCommonErrorForResponse(&response, err, s.getFileStatusByError(err))
+		return
+	}
+	found := false
+	for i, line := range lines {
+		record, matched := s.matchRecordLine(line, stockId, trxDate)
+		if !matched {
+			continue
+		}
+		for fieldName, fieldValue := range fieldMap {
+			if !util.IsEmptyString(fieldValue.Key) {
+				fieldName = fieldValue.Key
+			}
+			if (strings.Compare(fieldName, StoreKeyStockId) == 0 || strings.Compare(fieldName, StoreKeyTrxDate) == 0) &&
+				!isStoreValueEqual(record[fieldName].Value, fieldValue.Value) {
+				err = errors.New(fmt.Sprintf("field [%v] is part of the record key and could not be modified", fieldName))
+				s.handleCommonErrorForResponse(&response, err, common.FileStatusUnknown)
+				return
+			}
+			fieldValue.Key = ""
+			record[fieldName] = fieldValue
+		}
+		jsonValue, err2 := s.toJson(record)
+		if err2 != nil {
+			err = err2
+			s.handleCommonErrorForResponse(&response, err, common.FileStatusUnknown)
+			return
+		}
+		lines[i] = strings.TrimSpace(jsonValue)
+		found = true
+	}
+	if !found {
+		err = errors.New(fmt.Sprintf("no record found for key [%v]", key))
+		s.handleCommonErrorForResponse(&response, err, common.FileStatusNotAvailable)
+		return
+	}
+	err = s.rewriteLines(segmentFilepath, lines)
+	if err != nil {
+		s.handleCommonErrorForResponse(&response, err, common.FileStatusUnknown)
+	}
 	return
 }
 
-// remove value associated with the key
+// remove the record(s) associated with the key; the removed record is returned as an object
+// (map[string]StructStoreValue), if more than 1 record matches, the latest one is returned
 func (s *StructFilestore) RemoveByKey(key string) (response StructStoreResponse, valueRemoved StructStoreValue, err error) {
-	// TODO: NON implemented (hence always return SUCCESS but empty value
-	response = s.newStructStoreResponse(CodeSuccess, "", common.FileStatusUnknown)
+	response = s.newStructStoreResponse(CodeSuccess, "", common.FileStatusAvailable)
+	stockId, trxDate, err := ParseRecordKey(key)
+	if err != nil {
+		s.handleCommonErrorForResponse(&response, err, common.FileStatusUnknown)
+		return
+	}
+	unlock, err := s.lockForWrite()
+	if err != nil {
+		s.handleCommonErrorForResponse(&response, err, s.getFileStatusByError(err))
+		return
+	}
+	defer unlock()
+
+	segmentFilepath := s.getSegmentFilepath(trxDate)
+	lines, err := s.readLines(segmentFilepath)
+	if err != nil {
+		s.handleCommonErrorForResponse(&response, err, s.getFileStatusByError(err))
+		return
+	}
+	found := false
+	remainingLines := make([]string, 0, len(lines))
+	for _, line := range lines {
+		record, matched := s.matchRecordLine(line, stockId, trxDate)
+		if !matched {
+			remainingLines = append(remainingLines, line)
+			continue
+		}
+		valueRemoved = StructStoreValue{Key: key, Value: record, IsObject: true}
+		found = true
+	}
+	if !found {
+		err = errors.New(fmt.Sprintf("no record found for key [%v]", key))
+		s.handleCommonErrorForResponse(&response, err, common.FileStatusNotAvailable)
+		return
+	}
+	err = s.rewriteLines(segmentFilepath, remainingLines)
+	if err != nil {
+		s.handleCommonErrorForResponse(&response, err, common.FileStatusUnknown)
+	}
 	return
 }
+
 // remove all data in the store, be careful~ For file-store case, the file would not be removed,
-// ONLY contents would be truncated
+// ONLY contents would be truncated (segments of a partitioned filestore are removed though)
 func (s *StructFilestore) RemoveAll() (response StructStoreResponse, err error) {
 	response = s.newStructStoreResponse(CodeSuccess, "", common.FileStatusAvailable)
+	unlock, err := s.lockForWrite()
+	if err != nil {
+		s.handleCommonErrorForResponse(&response, err, s.getFileStatusByError(err))
+		return
+	}
+	defer unlock()
+	s.dropSegmentIndexes()
+
+	if s.isPartitioned() {
+		// segments are removed instead
+		segmentFilepaths, err2 := s.listSegmentFilepaths(time.Time{}, time.Time{})
+		for _, segmentFilepath := range segmentFilepaths {
+			if err2 != nil {
+				break
+			}
+			err2 = os.Remove(segmentFilepath)
+		}
+		if err2 != nil {
+			err = err2
+			s.handleCommonErrorForResponse(&response, err, common.FileStatusUnknown)
+		}
+		return
+	}
 
 	exists, err := util.IsFileExists(s.filepath)
 	if exists {
@@ -187,6 +504,82 @@ func (s *StructFilestore) RemoveAll() (response StructStoreResponse, err error)
 	return
 }
 
+// remove the records of the stock (empty means all stocks) whose trx_date is before the given time; only the
+// segments overlapping the period are visited and a segment left empty is removed (partitioned filestore).
+// Corrupted lines are kept (see Recover)
+func (s *StructFilestore) RemoveBefore(stockId string, before time.Time) (response StructStoreResponse, removed int, err error) {
+	response = s.newStructStoreResponse(CodeSuccess, "", common.FileStatusAvailable)
+	unlock, err := s.lockForWrite()
+	if err != nil {
+		s.handleCommonErrorForResponse(&response, err, s.getFileStatusByError(err))
+		return
+	}
+	defer unlock()
+
+	segmentFilepaths, err := s.listSegmentFilepaths(time.Time{}, before)
+	if err != nil {
+		s.handleCommonErrorForResponse(&response, err, s.getFileStatusByError(err))
+		return
+	}
+	visited := make(map[string]bool)
+	for _, segmentFilepath := range segmentFilepaths {
+		// the compressed and plain segment of the same period are read (and re-written) together
+		segmentFilepath = strings.TrimSuffix(segmentFilepath, common.StoreCompressedFileExtension)
+		if visited[segmentFilepath] {
+			continue
+		}
+		visited[segmentFilepath] = true
+		segmentRemoved, err2 := s.removeLinesBefore(segmentFilepath, stockId, before)
+		removed += segmentRemoved
+		if os.IsNotExist(err2) {
+			continue
+		}
+		if err2 != nil {
+			err = err2
+			s.handleCommonErrorForResponse(&response, err, common.FileStatusUnknown)
+			return
+		}
+	}
+	return
+}
+
+// remove the lines of the segment matching the stock (empty means all stocks) whose trx_date is before the given time
+func (s *StructFilestore) removeLinesBefore(segmentFilepath string, stockId string, before time.Time) (removed int, err error) {
+	lines, err := s.readLines(segmentFilepath)
+	if err != nil {
+		return
+	}
+	remainingLines := make([]string, 0, len(lines))
+	for _, line := range lines {
+		record, err2 := s.fromJson(line)
+		if err2 == nil && IsRecordInQueryRange(record, stockId, time.Time{}, before) {
+			trxDate, _ := toStoreDate(record[StoreKeyTrxDate].Value)
+			if trxDate.Before(before) {
+				removed++
+				continue
+			}
+		}
+		remainingLines = append(remainingLines, line)
+	}
+	if removed == 0 {
+		return
+	}
+	if len(remainingLines) == 0 && s.isPartitioned() {
+		for _, removingFilepath := range []string{ segmentFilepath, segmentFilepath + common.StoreCompressedFileExtension } {
+			err = os.Remove(removingFilepath)
+			if os.IsNotExist(err) {
+				err = nil
+			}
+			if err != nil {
+				return
+			}
+		}
+		return
+	}
+	err = s.rewriteLines(segmentFilepath, remainingLines)
+	return
+}
+
 func (s *StructFilestore) newStructStoreResponse(code int, message string, additionalCode int) (response StructStoreResponse) {
 	response = *new(StructStoreResponse)
 	response.Code = code
@@ -229,74 +622,169 @@ func (s *StructFilestore) init() (err error) {
 		} // end -- for (reverse loop on indices)
 	}
 	// append filename to the repo path resolved
+	s.repo = repo
 	s.filepath = fmt.Sprintf("%v%v", repo, s.Filename)
+
+	err2 := s.initPartition()
+	if err == nil {
+		err = err2
+	}
+	s.initLock()
+	s.naturalKey, err2 = GetNaturalKeyFromConfig(s.AppConfig, common.ConfigKeyStoreFile, strings.Split(s.Filename, ".")[0])
+	if err == nil {
+		err = err2
+	}
+	s.schema, err2 = GetSchemaFromConfig(s.AppConfig, strings.Split(s.Filename, ".")[0])
+	if err == nil {
+		err = err2
+	}
+	err2 = s.initSync()
+	if err == nil {
+		err = err2
+	}
+	// recover before compressing the segments
+	err2 = s.initRecovery()
+	if err == nil {
+		err = err2
+	}
+	err2 = s.initCompression()
+	if err == nil {
+		err = err2
+	}
 	return
 }
 
-// method to transform the given map into json value
-func (s *StructFilestore) toJson(pValueMap map[string]StructStoreValue) (jsonValue string, err error) {
+// read the non empty lines of the file (segment); for a compressed segment, lines of the
+// compressed segment come first followed by the lines of the plain segment (late writes)
+func (s *StructFilestore) readLines(segmentFilepath string) (lines []string, err error) {
+	lines = make([]string, 0)
+	found := false
+	for _, sourceFilepath := range []string{ segmentFilepath + common.StoreCompressedFileExtension, segmentFilepath } {
+		sourceLines, err2 := s.readSegmentFileLines(sourceFilepath)
+		if os.IsNotExist(err2) {
+			continue
+		}
+		if err2 != nil {
+			err = err2
+			return
+		}
+		found = true
+		lines = append(lines, sourceLines...)
+	}
+	if !found {
+		_, err = os.Stat(segmentFilepath)
+	}
+	return
+}
+
+// read the non empty lines of the file; either the plain or the compressed segment
+func (s *StructFilestore) readSegmentFileLines(sourceFilepath string) (lines []string, err error) {
+	lines = make([]string, 0)
+	reader, err := openSegmentReader(sourceFilepath)
+	if err != nil {
+		return
+	}
+	bContents, err := ioutil.ReadAll(reader)
+	err2 := reader.Close()
+	if err == nil {
+		err = err2
+	}
+	if err != nil {
+		return
+	}
+	for _, line := range strings.Split(string(bContents), "\n") {
+		if !util.IsEmptyString(strings.TrimSpace(line)) {
+			lines = append(lines, line)
+		}
+	}
+	return
+}
+
+// re-write the whole file (segment) with the given lines; the lines are written to a temp file
+// which then replaces the original file, hence readers never see a half written file
+func (s *StructFilestore) rewriteLines(segmentFilepath string, lines []string) (err error) {
+	err = s.writeLines(segmentFilepath, lines)
+	if err != nil {
+		return
+	}
+	// the lines of the compressed segment (if any) are re-written into the plain segment
+	err = os.Remove(segmentFilepath + common.StoreCompressedFileExtension)
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	return
+}
+
+// write the lines into a temp file which then replaces the plain file (the compressed segment is untouched)
+func (s *StructFilestore) writeLines(segmentFilepath string, lines []string) (err error) {
+	tmpFilepath := segmentFilepath + ".tmp"
+	pFile, err := os.OpenFile(tmpFilepath, os.O_TRUNC|os.O_WRONLY|os.O_CREATE, 0666)
+	if err != nil {
+		return
+	}
 	var bContent bytes.Buffer
+	for _, line := range lines {
+		bContent.WriteString(line)
+		bContent.WriteString("\n")
+	}
+	_, err = pFile.Write(bContent.Bytes())
+	if err == nil {
+		err = pFile.Sync()
+	}
+	err2 := pFile.Close()
+	if err == nil {
+		err = err2
+	}
+	if err != nil {
+		_ = os.Remove(tmpFilepath)
+		return
+	}
+	err = os.Rename(tmpFilepath, segmentFilepath)
+	if err != nil {
+		return
+	}
+	err = syncDirectory(filepath.Dir(segmentFilepath))
+	return
+}
+
+// parse the line and check whether it is the record of the given stock-id and trx-date;
+// corrupted lines never match
+func (s *StructFilestore) matchRecordLine(line string, stockId string, trxDate time.Time) (record map[string]StructStoreValue, matched bool) {
+	record, err := s.fromJson(line)
+	if err != nil {
+		return
+	}
+	matched = isStoreValueEqual(record[StoreKeyStockId].Value, stockId) &&
+		isStoreValueEqual(record[StoreKeyTrxDate].Value, trxDate)
+	return
+}
+
+func (s *StructFilestore) getFileStatusByError(err error) int {
+	if err == ErrFilestoreLocked {
+		return common.FileStatusLocked
+	}
+	if os.IsNotExist(err) {
+		return common.FileStatusNotAvailable
+	}
+	return common.FileStatusUnknown
+}
+
+// method to transform a json line back into a map of store-values (see DecodeStoreRecord)
+func (s *StructFilestore) fromJson(line string) (valueMap map[string]StructStoreValue, err error) {
+	return DecodeStoreRecord(line)
+}
+
+// method to transform the given map into json value (1 line ending with a line feed, see EncodeStoreRecord)
+func (s *StructFilestore) toJson(pValueMap map[string]StructStoreValue) (jsonValue string, err error) {
 	// default value is empty string
 	jsonValue = ""
 	if pValueMap != nil {
-		bContent.WriteString("{")
-		// loop all key-value pairs
-		for fieldName, storeValue := range pValueMap {
-			if !util.IsEmptyString(storeValue.Key) {
-				fieldName = storeValue.Key
-			}
-			bContent.WriteString(fmt.Sprintf("\"%v\": ", fieldName))
-			// handle array values
-			if storeValue.IsArray {
-				fmt.Println(reflect.TypeOf(storeValue))
-				err = errors.New("array type not YET implemented")
-			} else if storeValue.IsObject {
-				fmt.Println(reflect.TypeOf(storeValue))
-				err = errors.New("object type not YET implemented")
-			} else {
-				// normal singular field
-				switch storeValue.Type {
-				case TypeString:
-					bContent.WriteString(fmt.Sprintf("\"%v\", ", storeValue.Value.(string)))
-				case TypeInteger:
-					bContent.WriteString(fmt.Sprintf("%v, ", storeValue.Value.(int)))
-				case TypeFloat:
-					bContent.WriteString(fmt.Sprintf("%v, ", storeValue.Value.(float64)))
-				case TypeBool:
-					bContent.WriteString(fmt.Sprintf("%v, ", storeValue.Value.(bool)))
-				case TypeDate:
-					typeVal := reflect.TypeOf(storeValue.Value)
-					switch typeVal.String() {
-					case "string":
-						sDate := storeValue.Value.(string)
-						_, err2 := time.Parse(util.CommonDateFormat, sDate)
-						if err2 != nil {
-							err = err2
-							// invalid date format; hence parsing failed
-							return
-						}
-						bContent.WriteString(fmt.Sprintf("\"%v\", ", sDate))
-					case "time.Time":
-						if storeValue.Value == nil {
-							err = errors.New(fmt.Sprintf("field [%v] is configured to be a nil value", fieldName))
-							return
-						}
-						dDate := storeValue.Value.(time.Time)
-						sDate := dDate.Format(util.CommonDateFormat)
-						bContent.WriteString(fmt.Sprintf("\"%v\", ", sDate))
-					}
-				} // end -- switch (store.Type)
-			} // end -- if (singular, array OR object)
-		} // end -- for (k v pair for the fields to be jsonfy)
-		// remove the last "," if length of bContent is > 1
-		if bContent.Len() > 1 {
-			jsonValue = bContent.String()
-			jsonValue = jsonValue[0:len(jsonValue)-2]
-			jsonValue = fmt.Sprintf("%v }\n", jsonValue)
-		} else {
-			bContent.WriteString("}\n")
-			jsonValue = bContent.String()
-		} // end -- if (have real content or not)
+		jsonValue, err = EncodeStoreRecord(pValueMap)
+		if err != nil {
+			jsonValue = ""
+			return
+		}
+		jsonValue = fmt.Sprintf("%v\n", jsonValue)
 	}
 	return
 }
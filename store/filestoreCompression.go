@@ -0,0 +1,263 @@
+/*
+ *  Copyright Project - Stockbinator, Author - quoeamaster, (C) 2019
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+package store
+
+import (
+	"Stockbinator/common"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+func isCompressedSegment(segmentFilepath string) bool {
+	return strings.HasSuffix(segmentFilepath, common.StoreCompressedFileExtension)
+}
+
+// reader of a segment; compressed segments are decompressed transparently
+type structSegmentReader struct {
+	pFile   *os.File
+	pReader io.Reader
+}
+
+func (r *structSegmentReader) Read(p []byte) (int, error) {
+	return r.pReader.Read(p)
+}
+
+func (r *structSegmentReader) Close() (err error) {
+	if pGzipReader, isGzip := r.pReader.(*gzip.Reader); isGzip {
+		err = pGzipReader.Close()
+	}
+	err2 := r.pFile.Close()
+	if err == nil {
+		err = err2
+	}
+	return
+}
+
+// open the segment for reading; compressed (.gz) segments are decompressed on the fly
+func openSegmentReader(segmentFilepath string) (reader io.ReadCloser, err error) {
+	pFile, err := os.Open(segmentFilepath)
+	if err != nil {
+		return
+	}
+	pSegmentReader := &structSegmentReader{pFile: pFile, pReader: pFile}
+	if isCompressedSegment(segmentFilepath) {
+		pGzipReader, err2 := gzip.NewReader(pFile)
+		if err2 != nil {
+			_ = pFile.Close()
+			err = errors.New(fmt.Sprintf("could not decompress segment [%v] => %v", segmentFilepath, err2))
+			return
+		}
+		pSegmentReader.pReader = pGzipReader
+	}
+	reader = pSegmentReader
+	return
+}
+
+// validate the compression scheme and start the background compression if enabled;
+// unknown schemes fall back to common.StoreCompressionNone
+func (s *StructFilestore) initCompression() (err error) {
+	s.compression = common.StoreCompressionNone
+	interval := time.Minute * common.StoreDefaultCompressionIntervalMinutes
+	if s.AppConfig != nil {
+		s.compression = s.AppConfig.Get(common.ConfigKeyStoreFile, common.ConfigKeyStoreFileCompression).String(common.StoreCompressionNone)
+		interval = s.AppConfig.Get(common.ConfigKeyStoreFile, common.ConfigKeyStoreFileCompressionInterval).Duration(interval)
+	}
+	switch s.compression {
+	case common.StoreCompressionNone:
+	case common.StoreCompressionGzip:
+		if !s.isPartitioned() {
+			// ONLY segments could be closed
+			err = errors.New("filestore compression requires a daily or monthly partition, compression disabled")
+			s.compression = common.StoreCompressionNone
+			return
+		}
+		if interval > 0 {
+			s.compressionLock.Lock()
+			s.compressionStopChannel = make(chan bool)
+			s.compressionDoneChannel = make(chan bool)
+			go s.compressionLoop(s.compressionStopChannel, s.compressionDoneChannel, interval)
+			s.compressionLock.Unlock()
+		}
+	default:
+		err = errors.New(fmt.Sprintf("unknown filestore compression [%v], %v is used instead", s.compression, common.StoreCompressionNone))
+		s.compression = common.StoreCompressionNone
+	}
+	return
+}
+
+// stop the background compression (if running) and wait for a running compression to end; the closed
+// segments could still be compressed through CompressClosedSegments
+func (s *StructFilestore) StopCompression() {
+	s.compressionLock.Lock()
+	stopChannel, doneChannel := s.compressionStopChannel, s.compressionDoneChannel
+	s.compressionStopChannel, s.compressionDoneChannel = nil, nil
+	s.compressionLock.Unlock()
+	if stopChannel != nil {
+		close(stopChannel)
+		<-doneChannel
+	}
+}
+
+// compress the closed segments every interval (of the store's clock) until stopped
+func (s *StructFilestore) compressionLoop(stopChannel, doneChannel chan bool, interval time.Duration) {
+	defer close(doneChannel)
+	for {
+		_, err := s.CompressClosedSegments()
+		if err != nil {
+			logStoreError("filestore", "compressionLoop", fmt.Sprintf("could not compress the closed segments of filestore [%v] => %v", s.Filename, err))
+		}
+		select {
+		case <-stopChannel:
+			return
+		case <-s.clock.After(interval):
+		}
+	}
+}
+
+// compress the plain segments whose (UTC) period has ended; a plain segment written after its
+// period was compressed (late writes, ModifyByKey or RemoveByKey) is merged into the compressed segment.
+// Returns the filepaths of the compressed segments written
+func (s *StructFilestore) CompressClosedSegments() (compressedFilepaths []string, err error) {
+	compressedFilepaths = make([]string, 0)
+	if strings.Compare(s.compression, common.StoreCompressionGzip) != 0 {
+		return
+	}
+	segmentFilepaths, err := s.listSegmentFilepaths(time.Time{}, time.Time{})
+	if err != nil {
+		return
+	}
+	now := s.clock.Now()
+	for _, segmentFilepath := range segmentFilepaths {
+		if isCompressedSegment(segmentFilepath) {
+			continue
+		}
+		segmentStart, _ := s.parseSegmentName(filepath.Base(segmentFilepath))
+		if s.getSegmentEnd(segmentStart).After(now) {
+			// still open
+			continue
+		}
+		err = s.compressSegment(segmentFilepath)
+		if err != nil {
+			return
+		}
+		compressedFilepaths = append(compressedFilepaths, segmentFilepath+common.StoreCompressedFileExtension)
+	}
+	return
+}
+
+// compress the plain segment (merging the existing compressed segment if any) into a temp file which then
+// replaces the compressed segment; the plain segment is removed afterwards
+func (s *StructFilestore) compressSegment(segmentFilepath string) (err error) {
+	unlock, err := s.lockForWrite()
+	if err != nil {
+		return
+	}
+	defer unlock()
+
+	compressedFilepath := segmentFilepath + common.StoreCompressedFileExtension
+	tmpFilepath := compressedFilepath + ".tmp"
+	pTmpFile, err := os.OpenFile(tmpFilepath, os.O_TRUNC|os.O_WRONLY|os.O_CREATE, 0666)
+	if err != nil {
+		return
+	}
+	pGzipWriter := gzip.NewWriter(pTmpFile)
+	sourceFilepaths := []string{ compressedFilepath, segmentFilepath }
+	for _, sourceFilepath := range sourceFilepaths {
+		reader, err2 := openSegmentReader(sourceFilepath)
+		if os.IsNotExist(err2) {
+			continue
+		}
+		if err2 != nil {
+			err = err2
+			break
+		}
+		_, err = io.Copy(pGzipWriter, reader)
+		err2 = reader.Close()
+		if err == nil {
+			err = err2
+		}
+		if err != nil {
+			break
+		}
+	}
+	err2 := pGzipWriter.Close()
+	if err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = pTmpFile.Sync()
+	}
+	err2 = pTmpFile.Close()
+	if err == nil {
+		err = err2
+	}
+	if err != nil {
+		_ = os.Remove(tmpFilepath)
+		return
+	}
+	err = os.Rename(tmpFilepath, compressedFilepath)
+	if err != nil {
+		return
+	}
+	err = syncDirectory(filepath.Dir(compressedFilepath))
+	if err != nil {
+		return
+	}
+	err = os.Remove(segmentFilepath)
+	return
+}
+
+// write the lines into a temp file (compressed) which then replaces the compressed segment
+func writeCompressedLines(compressedFilepath string, lines []string) (err error) {
+	tmpFilepath := compressedFilepath + ".tmp"
+	pTmpFile, err := os.OpenFile(tmpFilepath, os.O_TRUNC|os.O_WRONLY|os.O_CREATE, 0666)
+	if err != nil {
+		return
+	}
+	pGzipWriter := gzip.NewWriter(pTmpFile)
+	for _, line := range lines {
+		if err == nil {
+			_, err = io.WriteString(pGzipWriter, line+"\n")
+		}
+	}
+	err2 := pGzipWriter.Close()
+	if err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = pTmpFile.Sync()
+	}
+	err2 = pTmpFile.Close()
+	if err == nil {
+		err = err2
+	}
+	if err != nil {
+		_ = os.Remove(tmpFilepath)
+		return
+	}
+	err = os.Rename(tmpFilepath, compressedFilepath)
+	if err != nil {
+		return
+	}
+	err = syncDirectory(filepath.Dir(compressedFilepath))
+	return
+}
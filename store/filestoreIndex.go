@@ -0,0 +1,189 @@
+/*
+ *  Copyright Project - Stockbinator, Author - quoeamaster, (C) 2019
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+package store
+
+import (
+	"Stockbinator/common"
+	"Stockbinator/util"
+	"bufio"
+	"io"
+	"os"
+	"strings"
+)
+
+// in-memory natural key index of a segment; Persist looks up the index instead of reading the whole segment
+type structSegmentIndex struct {
+	// natural key id -> the file holding the record (the plain or the compressed segment)
+	ids map[string]string
+	// the plain and compressed segment files as indexed (nil if not available). A file replaced (rewrites,
+	// compression) or shrunk since is indexed again; a file grown (appends, e.g. by another process)
+	// is indexed from its previous size onwards
+	plainInfo      os.FileInfo
+	compressedInfo os.FileInfo
+}
+
+// return the up-to-date natural key index of the segment (MUST be called under the write lock)
+func (s *StructFilestore) getSegmentIndex(segmentFilepath string) (pIndex *structSegmentIndex, err error) {
+	compressedFilepath := segmentFilepath + common.StoreCompressedFileExtension
+	plainInfo, err := statSegmentFile(segmentFilepath)
+	if err != nil {
+		return
+	}
+	compressedInfo, err := statSegmentFile(compressedFilepath)
+	if err != nil {
+		return
+	}
+	pIndex = s.segmentIndexes[segmentFilepath]
+	if pIndex != nil && isSameSegmentFile(pIndex.compressedInfo, compressedInfo) && isGrownSegmentFile(pIndex.plainInfo, plainInfo) {
+		offset := int64(0)
+		if pIndex.plainInfo != nil {
+			offset = pIndex.plainInfo.Size()
+		}
+		if plainInfo != nil && plainInfo.Size() > offset {
+			err = s.indexSegmentFile(pIndex, segmentFilepath, offset)
+		}
+	} else {
+		pIndex = &structSegmentIndex{ ids: make(map[string]string) }
+		for _, sourceFilepath := range []string{ compressedFilepath, segmentFilepath } {
+			if err == nil {
+				err = s.indexSegmentFile(pIndex, sourceFilepath, 0)
+			}
+		}
+	}
+	if err != nil {
+		s.dropSegmentIndexes(segmentFilepath)
+		pIndex = nil
+		return
+	}
+	pIndex.plainInfo = plainInfo
+	pIndex.compressedInfo = compressedInfo
+	s.putSegmentIndex(segmentFilepath, pIndex)
+	return
+}
+
+// index the records of the file (the plain or the compressed segment) from the offset onwards;
+// corrupted lines and records missing the natural key fields are not indexed
+func (s *StructFilestore) indexSegmentFile(pIndex *structSegmentIndex, sourceFilepath string, offset int64) (err error) {
+	reader, err := openSegmentReader(sourceFilepath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return
+	}
+	defer func() {
+		err2 := reader.Close()
+		if err == nil {
+			err = err2
+		}
+	}()
+	if offset > 0 {
+		// ONLY plain segments grow, hence the file is read directly
+		_, err = reader.(*structSegmentReader).pFile.Seek(offset, io.SeekStart)
+		if err != nil {
+			return
+		}
+	}
+	pReader := bufio.NewReader(reader)
+	for {
+		line, err2 := pReader.ReadString('\n')
+		if !util.IsEmptyString(strings.TrimSpace(line)) {
+			if record, err3 := s.fromJson(line); err3 == nil {
+				if id, isAvailable := BuildNaturalKeyId(record, s.naturalKey); isAvailable {
+					pIndex.ids[id] = sourceFilepath
+				}
+			}
+		}
+		if err2 == io.EOF {
+			return
+		}
+		if err2 != nil {
+			err = err2
+			return
+		}
+	}
+}
+
+// refresh the file infos of the index after the segment is written (MUST be called under the write lock)
+func (s *StructFilestore) refreshSegmentIndex(segmentFilepath string, pIndex *structSegmentIndex) {
+	plainInfo, err := statSegmentFile(segmentFilepath)
+	compressedInfo, err2 := statSegmentFile(segmentFilepath + common.StoreCompressedFileExtension)
+	if err != nil || err2 != nil {
+		s.dropSegmentIndexes(segmentFilepath)
+		return
+	}
+	pIndex.plainInfo = plainInfo
+	pIndex.compressedInfo = compressedInfo
+}
+
+// keep the index of the segment; the indexes of the least recently written segments are dropped
+// beyond common.StoreFilestoreMaxSegmentIndexes
+func (s *StructFilestore) putSegmentIndex(segmentFilepath string, pIndex *structSegmentIndex) {
+	if s.segmentIndexes == nil {
+		s.segmentIndexes = make(map[string]*structSegmentIndex)
+	}
+	s.dropSegmentIndexes(segmentFilepath)
+	s.segmentIndexes[segmentFilepath] = pIndex
+	s.segmentIndexOrder = append(s.segmentIndexOrder, segmentFilepath)
+	for len(s.segmentIndexOrder) > common.StoreFilestoreMaxSegmentIndexes {
+		delete(s.segmentIndexes, s.segmentIndexOrder[0])
+		s.segmentIndexOrder = s.segmentIndexOrder[1:]
+	}
+}
+
+// drop the indexes of the given segments (all segments if none given); MUST be called under the segment lock
+func (s *StructFilestore) dropSegmentIndexes(segmentFilepaths ...string) {
+	if len(segmentFilepaths) == 0 {
+		s.segmentIndexes = nil
+		s.segmentIndexOrder = nil
+		return
+	}
+	for _, segmentFilepath := range segmentFilepaths {
+		delete(s.segmentIndexes, segmentFilepath)
+		for i, indexedFilepath := range s.segmentIndexOrder {
+			if strings.Compare(indexedFilepath, segmentFilepath) == 0 {
+				s.segmentIndexOrder = append(s.segmentIndexOrder[:i], s.segmentIndexOrder[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// stat the file; nil if not available
+func statSegmentFile(sourceFilepath string) (fileInfo os.FileInfo, err error) {
+	fileInfo, err = os.Stat(sourceFilepath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return
+}
+
+// is it the same file (not replaced) with the same size and modification time?
+func isSameSegmentFile(fileInfo, otherFileInfo os.FileInfo) bool {
+	if fileInfo == nil || otherFileInfo == nil {
+		return fileInfo == nil && otherFileInfo == nil
+	}
+	return os.SameFile(fileInfo, otherFileInfo) && fileInfo.Size() == otherFileInfo.Size() &&
+		fileInfo.ModTime().Equal(otherFileInfo.ModTime())
+}
+
+// is the file (current) the indexed file (previous) with lines appended only? A file created since counts too
+func isGrownSegmentFile(previous, current os.FileInfo) bool {
+	if previous == nil {
+		return true
+	}
+	return current != nil && os.SameFile(previous, current) && current.Size() >= previous.Size()
+}
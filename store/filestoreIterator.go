@@ -0,0 +1,145 @@
+/*
+ *  Copyright Project - Stockbinator, Author - quoeamaster, (C) 2019
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+package store
+
+import (
+	"Stockbinator/common"
+	"bufio"
+	"io"
+	"os"
+	"strings"
+)
+
+// max size of a line (record) in the file
+const fileStoreMaxLineSize = 1024 * 1024
+
+// iterator over the records of a filestore; the segment files are opened one after another
+// and ONLY 1 line is decoded at a time
+type structFilestoreIterator struct {
+	pStore           *StructFilestore
+	segmentFilepaths []string
+	predicates       []StoreRecordPredicate
+
+	// index of the next segment to open
+	segmentIndex int
+	reader       io.ReadCloser
+	pScanner     *bufio.Scanner
+
+	record   StructStoreValue
+	err      error
+	isClosed bool
+}
+
+func newStructFilestoreIterator(pStore *StructFilestore, segmentFilepaths []string, predicates []StoreRecordPredicate) (pIterator *structFilestoreIterator) {
+	pIterator = new(structFilestoreIterator)
+	pIterator.pStore = pStore
+	pIterator.segmentFilepaths = segmentFilepaths
+	pIterator.predicates = predicates
+	return
+}
+
+func (i *structFilestoreIterator) Next() bool {
+	i.record = StructStoreValue{}
+	if i.err != nil || i.isClosed {
+		return false
+	}
+	for {
+		if i.pScanner == nil && !i.openNextSegment() {
+			return false
+		}
+		for i.pScanner.Scan() {
+			line := strings.TrimSpace(i.pScanner.Text())
+			if len(line) == 0 {
+				continue
+			}
+			record, err := i.pStore.fromJson(line)
+			// corrupted lines are skipped
+			if err != nil || !IsRecordMatchingPredicates(record, i.predicates) {
+				continue
+			}
+			i.record = NewRecordStoreValue(record)
+			return true
+		}
+		i.err = i.pScanner.Err()
+		err := i.closeSegment()
+		if i.err == nil {
+			i.err = err
+		}
+		if i.err != nil {
+			return false
+		}
+	}
+}
+
+func (i *structFilestoreIterator) Record() StructStoreValue {
+	return i.record
+}
+
+func (i *structFilestoreIterator) Err() error {
+	return i.err
+}
+
+func (i *structFilestoreIterator) Close() (err error) {
+	i.isClosed = true
+	return i.closeSegment()
+}
+
+// open the next segment; false if no more segments (or the segment could not be opened, check err)
+func (i *structFilestoreIterator) openNextSegment() bool {
+	if i.segmentIndex >= len(i.segmentFilepaths) {
+		return false
+	}
+	segmentFilepath := i.segmentFilepaths[i.segmentIndex]
+	i.segmentIndex++
+	reader, err := openSegmentReader(segmentFilepath)
+	if os.IsNotExist(err) && i.pStore.isPartitioned() {
+		// the segment was compressed (or removed) after listing; read its compressed segment instead (if not yet listed)
+		compressedFilepath := segmentFilepath + common.StoreCompressedFileExtension
+		if isCompressedSegment(segmentFilepath) || i.isListed(compressedFilepath) {
+			return i.openNextSegment()
+		}
+		reader, err = openSegmentReader(compressedFilepath)
+		if os.IsNotExist(err) {
+			return i.openNextSegment()
+		}
+	}
+	if err != nil {
+		i.err = err
+		return false
+	}
+	i.reader = reader
+	i.pScanner = bufio.NewScanner(reader)
+	i.pScanner.Buffer(make([]byte, 0, 64*1024), fileStoreMaxLineSize)
+	return true
+}
+
+func (i *structFilestoreIterator) isListed(segmentFilepath string) bool {
+	for _, listedFilepath := range i.segmentFilepaths {
+		if strings.Compare(listedFilepath, segmentFilepath) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (i *structFilestoreIterator) closeSegment() (err error) {
+	if i.reader != nil {
+		err = i.reader.Close()
+		i.reader = nil
+	}
+	i.pScanner = nil
+	return
+}
@@ -0,0 +1,116 @@
+/*
+ *  Copyright Project - Stockbinator, Author - quoeamaster, (C) 2019
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+package store
+
+import (
+	"Stockbinator/common"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// error returned when the file lock could not be acquired within the lock timeout
+var ErrFilestoreLocked = errors.New("filestore is locked by another process")
+
+// advisory (cross-process) lock held on the filestore's lock file
+type structFileLock struct {
+	pFile *os.File
+}
+
+// release the lock; closing the lock file releases the lock as well
+func (l *structFileLock) release() (err error) {
+	err = unlockFile(l.pFile)
+	err2 := l.pFile.Close()
+	if err == nil {
+		err = err2
+	}
+	return
+}
+
+// read the lock wait and timeout from the config
+func (s *StructFilestore) initLock() {
+	s.lockWait = time.Millisecond * common.StoreDefaultLockWaitMillis
+	s.lockTimeout = time.Millisecond * common.StoreDefaultLockTimeoutMillis
+	if s.AppConfig != nil {
+		s.lockWait = s.AppConfig.Get(common.ConfigKeyStoreFile, common.ConfigKeyStoreFileLockWait).Duration(s.lockWait)
+		s.lockTimeout = s.AppConfig.Get(common.ConfigKeyStoreFile, common.ConfigKeyStoreFileLockTimeout).Duration(s.lockTimeout)
+	}
+	if s.lockWait <= 0 {
+		s.lockWait = time.Millisecond * common.StoreDefaultLockWaitMillis
+	}
+}
+
+// return the lock file; 1 lock file per filestore (per segment directory if partitioned)
+func (s *StructFilestore) getLockFilepath() string {
+	if s.isPartitioned() {
+		return filepath.Join(s.getSegmentDirectory(), common.StoreLockFileExtension)
+	}
+	return s.filepath + common.StoreLockFileExtension
+}
+
+// lock the filestore for a write (append, rewrite, compression or removal); writes within the process are
+// serialized by the segment lock whilst writes across processes by the advisory file lock.
+// ErrFilestoreLocked is returned if the file lock could not be acquired within the lock timeout
+func (s *StructFilestore) lockForWrite() (unlock func(), err error) {
+	s.segmentLock.Lock()
+	pLock, err := s.acquireFileLock()
+	if err != nil {
+		s.segmentLock.Unlock()
+		return
+	}
+	unlock = func() {
+		err := pLock.release()
+		if err != nil {
+			logStoreError("filestore", "lockForWrite", fmt.Sprintf("could not release the lock of filestore [%v] => %v", s.Filename, err))
+		}
+		s.segmentLock.Unlock()
+	}
+	return
+}
+
+// acquire the advisory file lock; retry every lock-wait until the lock-timeout
+func (s *StructFilestore) acquireFileLock() (pLock *structFileLock, err error) {
+	lockFilepath := s.getLockFilepath()
+	err = os.MkdirAll(filepath.Dir(lockFilepath), 0777)
+	if err != nil {
+		return
+	}
+	pFile, err := os.OpenFile(lockFilepath, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return
+	}
+	deadline := time.Now().Add(s.lockTimeout)
+	for {
+		isLocked, err2 := tryLockFile(pFile)
+		if err2 != nil {
+			_ = pFile.Close()
+			err = err2
+			return
+		}
+		if isLocked {
+			pLock = &structFileLock{pFile: pFile}
+			return
+		}
+		if !time.Now().Before(deadline) {
+			_ = pFile.Close()
+			err = ErrFilestoreLocked
+			return
+		}
+		time.Sleep(s.lockWait)
+	}
+}
@@ -0,0 +1,40 @@
+//go:build !windows
+// +build !windows
+
+/*
+ *  Copyright Project - Stockbinator, Author - quoeamaster, (C) 2019
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+package store
+
+import (
+	"os"
+	"syscall"
+)
+
+// try to acquire an exclusive advisory lock (flock) on the file without blocking;
+// false if the lock is held by others
+func tryLockFile(pFile *os.File) (isLocked bool, err error) {
+	err = syscall.Flock(int(pFile.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		err = nil
+		return
+	}
+	isLocked = err == nil
+	return
+}
+
+func unlockFile(pFile *os.File) error {
+	return syscall.Flock(int(pFile.Fd()), syscall.LOCK_UN)
+}
@@ -0,0 +1,34 @@
+//go:build windows
+// +build windows
+
+/*
+ *  Copyright Project - Stockbinator, Author - quoeamaster, (C) 2019
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+package store
+
+import (
+	"os"
+)
+
+// flock is not available on windows; the lock is always granted
+// (writes are still serialized within the process)
+func tryLockFile(pFile *os.File) (isLocked bool, err error) {
+	isLocked = true
+	return
+}
+
+func unlockFile(pFile *os.File) error {
+	return nil
+}
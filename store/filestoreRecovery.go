@@ -0,0 +1,209 @@
+/*
+ *  Copyright Project - Stockbinator, Author - quoeamaster, (C) 2019
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+package store
+
+import (
+	"Stockbinator/common"
+	"Stockbinator/util"
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+// structure describing a line moved out of a segment by the recovery scan
+type StructQuarantinedLine struct {
+	// the segment (file) the line was found in
+	Filepath string
+	// 1-based line number within the segment
+	LineNumber int
+	// the raw content of the line
+	Content string
+	// why the line was quarantined (e.g. partial line, invalid json)
+	Reason string
+	QuarantineTime time.Time
+}
+
+// structure describing the outcome of a recovery scan
+type StructRecoveryReport struct {
+	StartTime time.Time
+	EndTime   time.Time
+	// number of segments (files) and lines scanned
+	ScannedFiles int
+	ScannedLines int
+	// lines moved into the quarantine files
+	QuarantinedLines []StructQuarantinedLine
+	// segments re-written without the quarantined lines
+	RecoveredFiles []string
+	// error messages of segments which could not be scanned / recovered
+	Errors []string
+}
+
+// read the recovery flag from the config and run the recovery scan if enabled (default)
+func (s *StructFilestore) initRecovery() (err error) {
+	isRecoveryEnabled := true
+	if s.AppConfig != nil {
+		isRecoveryEnabled = s.AppConfig.Get(common.ConfigKeyStoreFile, common.ConfigKeyStoreFileRecovery).Bool(true)
+	}
+	if !isRecoveryEnabled {
+		return
+	}
+	report := s.Recover()
+	if len(report.QuarantinedLines) > 0 || len(report.Errors) > 0 {
+		logStoreError("filestore", "initRecovery", fmt.Sprintf("filestore [%v] recovery => %v line(s) quarantined in %v, errors: %v",
+			s.Filename, len(report.QuarantinedLines), report.RecoveredFiles, report.Errors))
+	}
+	return
+}
+
+// return the report of the latest recovery scan
+func (s *StructFilestore) GetRecoveryReport() StructRecoveryReport {
+	return s.recoveryReport
+}
+
+// scan the plain segments (compressed segments are always written atomically) for partial or corrupt lines;
+// such lines are appended to the segment's quarantine file ({segment}.quarantine) and the segment is
+// re-written atomically without them
+func (s *StructFilestore) Recover() (report StructRecoveryReport) {
+	report.StartTime = time.Now()
+	report.QuarantinedLines = make([]StructQuarantinedLine, 0)
+	report.RecoveredFiles = make([]string, 0)
+	report.Errors = make([]string, 0)
+	defer func() {
+		report.EndTime = time.Now()
+		s.recoveryReport = report
+	}()
+
+	segmentFilepaths, err := s.listSegmentFilepaths(time.Time{}, time.Time{})
+	if err != nil {
+		report.Errors = append(report.Errors, err.Error())
+		return
+	}
+	for _, segmentFilepath := range segmentFilepaths {
+		if isCompressedSegment(segmentFilepath) {
+			continue
+		}
+		quarantinedLines, scannedLines, err := s.recoverSegment(segmentFilepath)
+		if os.IsNotExist(err) {
+			continue
+		}
+		report.ScannedFiles++
+		report.ScannedLines += scannedLines
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("%v => %v", segmentFilepath, err))
+			continue
+		}
+		if len(quarantinedLines) > 0 {
+			report.QuarantinedLines = append(report.QuarantinedLines, quarantinedLines...)
+			report.RecoveredFiles = append(report.RecoveredFiles, segmentFilepath)
+		}
+	}
+	return
+}
+
+// scan and recover the segment under the write lock
+func (s *StructFilestore) recoverSegment(segmentFilepath string) (quarantinedLines []StructQuarantinedLine, scannedLines int, err error) {
+	// nothing to recover (and no lock file to create) for a missing segment
+	_, err = os.Stat(segmentFilepath)
+	if err != nil {
+		return
+	}
+	unlock, err := s.lockForWrite()
+	if err != nil {
+		return
+	}
+	defer unlock()
+
+	bContents, err := ioutil.ReadFile(segmentFilepath)
+	if err != nil {
+		return
+	}
+	contents := string(bContents)
+	rawLines := strings.Split(contents, "\n")
+	// the last element is either empty (file ending with a line feed) or a partial line
+	hasPartialLine := !strings.HasSuffix(contents, "\n") && len(contents) > 0
+
+	validLines := make([]string, 0, len(rawLines))
+	now := time.Now()
+	for i, line := range rawLines {
+		if util.IsEmptyString(strings.TrimSpace(line)) {
+			continue
+		}
+		scannedLines++
+		reason := ""
+		if _, err2 := DecodeStoreRecord(line); err2 != nil {
+			reason = fmt.Sprintf("invalid json => %v", err2)
+		}
+		if hasPartialLine && i == len(rawLines)-1 {
+			reason = "partial line (no line feed)"
+		}
+		if util.IsEmptyString(reason) {
+			validLines = append(validLines, line)
+			continue
+		}
+		quarantinedLines = append(quarantinedLines, StructQuarantinedLine{
+			Filepath:       segmentFilepath,
+			LineNumber:     i + 1,
+			Content:        line,
+			Reason:         reason,
+			QuarantineTime: now,
+		})
+	}
+	if len(quarantinedLines) == 0 {
+		return
+	}
+	// quarantine first; hence a crash in between would never lose a line
+	err = appendQuarantinedLines(segmentFilepath+common.StoreQuarantineFileExtension, quarantinedLines)
+	if err != nil {
+		return
+	}
+	// ONLY the scanned plain segment is repaired; the compressed segment (if any) holds the older lines
+	err = s.writeLines(segmentFilepath, validLines)
+	return
+}
+
+func appendQuarantinedLines(quarantineFilepath string, quarantinedLines []StructQuarantinedLine) (err error) {
+	pFile, err := os.OpenFile(quarantineFilepath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0666)
+	if err != nil {
+		return
+	}
+	pWriter := bufio.NewWriter(pFile)
+	for _, quarantinedLine := range quarantinedLines {
+		bLine, err2 := json.Marshal(quarantinedLine)
+		if err2 != nil {
+			err = err2
+			break
+		}
+		_, err = pWriter.Write(append(bLine, '\n'))
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = pWriter.Flush()
+	}
+	if err == nil {
+		err = pFile.Sync()
+	}
+	err2 := pFile.Close()
+	if err == nil {
+		err = err2
+	}
+	return
+}
@@ -0,0 +1,145 @@
+/*
+ *  Copyright Project - Stockbinator, Author - quoeamaster, (C) 2019
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+package store
+
+import (
+	"Stockbinator/common"
+	"Stockbinator/util"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// return the date layout of the segment filenames for the partition scheme
+func getSegmentDateLayout(partition string) (layout string) {
+	switch partition {
+	case common.StorePartitionDaily:
+		layout = "2006-01-02"
+	case common.StorePartitionMonthly:
+		layout = "2006-01"
+	}
+	return
+}
+
+func (s *StructFilestore) isPartitioned() bool {
+	return !util.IsEmptyString(getSegmentDateLayout(s.partition))
+}
+
+// return the directory of the segments; the filename's "." separated parts form the directory tree
+// (e.g. stock_aastocks.700_tencent => {repo}/stock_aastocks/700_tencent)
+func (s *StructFilestore) getSegmentDirectory() string {
+	return filepath.Join(s.repo, filepath.Join(strings.Split(s.Filename, ".")...))
+}
+
+// return the filepath storing the record of the given trx-date; segments are named after the UTC date,
+// hence the same record is found whatever the timezone offset of the given trx-date
+func (s *StructFilestore) getSegmentFilepath(trxDate time.Time) string {
+	if !s.isPartitioned() {
+		return s.filepath
+	}
+	return filepath.Join(s.getSegmentDirectory(), trxDate.UTC().Format(getSegmentDateLayout(s.partition))+common.StoreSegmentFileExtension)
+}
+
+// return the filepath storing the given record (based on its trx_date; the store clock's current time if not available)
+func (s *StructFilestore) getSegmentFilepathByRecord(record map[string]StructStoreValue) string {
+	trxDate, isDate := toStoreDate(record[StoreKeyTrxDate].Value)
+	if !isDate {
+		trxDate = s.clock.Now()
+	}
+	return s.getSegmentFilepath(trxDate)
+}
+
+// return the filepaths (chronological order) of the segments overlapping [from, to];
+// a zero from or to means unbounded. A compressed segment comes before the plain segment of the same period
+// (late writes after compression). For a non partitioned filestore, the one and only file is returned
+func (s *StructFilestore) listSegmentFilepaths(from, to time.Time) (filepaths []string, err error) {
+	if !s.isPartitioned() {
+		filepaths = []string{ s.filepath }
+		return
+	}
+	filepaths = make([]string, 0)
+	fileInfos, err := ioutil.ReadDir(s.getSegmentDirectory())
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	segmentStartDates := make(map[string]time.Time)
+	for _, fileInfo := range fileInfos {
+		segmentStart, isSegment := s.parseSegmentName(fileInfo.Name())
+		if fileInfo.IsDir() || !isSegment {
+			continue
+		}
+		// the segment's period is in UTC (as named); from and to could be in any timezone
+		if !to.IsZero() && segmentStart.After(to) {
+			continue
+		}
+		if !from.IsZero() && !s.getSegmentEnd(segmentStart).After(from) {
+			continue
+		}
+		segmentFilepath := filepath.Join(s.getSegmentDirectory(), fileInfo.Name())
+		filepaths = append(filepaths, segmentFilepath)
+		segmentStartDates[segmentFilepath] = segmentStart
+	}
+	sort.Slice(filepaths, func(i, j int) bool {
+		startI, startJ := segmentStartDates[filepaths[i]], segmentStartDates[filepaths[j]]
+		if startI.Equal(startJ) {
+			return isCompressedSegment(filepaths[i])
+		}
+		return startI.Before(startJ)
+	})
+	return
+}
+
+// parse the segment's filename (e.g. 2019-07-03.data or 2019-07-03.data.gz) into the (UTC) start of its period
+func (s *StructFilestore) parseSegmentName(name string) (segmentStart time.Time, isSegment bool) {
+	name = strings.TrimSuffix(name, common.StoreCompressedFileExtension)
+	if !strings.HasSuffix(name, common.StoreSegmentFileExtension) {
+		return
+	}
+	segmentStart, err := time.Parse(getSegmentDateLayout(s.partition), strings.TrimSuffix(name, common.StoreSegmentFileExtension))
+	isSegment = err == nil
+	return
+}
+
+// return the end (exclusive) of the segment's period
+func (s *StructFilestore) getSegmentEnd(segmentStart time.Time) time.Time {
+	if strings.Compare(s.partition, common.StorePartitionDaily) == 0 {
+		return segmentStart.AddDate(0, 0, 1)
+	}
+	return segmentStart.AddDate(0, 1, 0)
+}
+
+// validate the partition scheme; unknown schemes fall back to common.StorePartitionNone
+func (s *StructFilestore) initPartition() (err error) {
+	s.partition = common.StorePartitionNone
+	if s.AppConfig != nil {
+		s.partition = s.AppConfig.Get(common.ConfigKeyStoreFile, common.ConfigKeyStoreFilePartition).String(common.StorePartitionNone)
+	}
+	switch s.partition {
+	case common.StorePartitionNone, common.StorePartitionDaily, common.StorePartitionMonthly:
+	default:
+		err = errors.New(fmt.Sprintf("unknown filestore partition [%v], %v is used instead", s.partition, common.StorePartitionNone))
+		s.partition = common.StorePartitionNone
+	}
+	return
+}
@@ -0,0 +1,200 @@
+/*
+ *  Copyright Project - Stockbinator, Author - quoeamaster, (C) 2019
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+package store
+
+import (
+	"Stockbinator/common"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// batches the fsync of the pending writes; writers wait until the next group commit of their file
+type structGroupCommitter struct {
+	interval time.Duration
+	// filepath => channels of the writers waiting for the commit
+	pending   map[string][]chan error
+	isRunning bool
+
+	lock sync.Mutex
+}
+
+func newStructGroupCommitter(interval time.Duration) (pCommitter *structGroupCommitter) {
+	pCommitter = new(structGroupCommitter)
+	pCommitter.interval = interval
+	pCommitter.pending = make(map[string][]chan error)
+	return
+}
+
+// wait until the file is fsync-ed by the next group commit
+func (g *structGroupCommitter) commit(targetFilepath string) error {
+	channel := make(chan error, 1)
+	g.lock.Lock()
+	g.pending[targetFilepath] = append(g.pending[targetFilepath], channel)
+	if !g.isRunning {
+		g.isRunning = true
+		go g.commitLoop()
+	}
+	g.lock.Unlock()
+	return <-channel
+}
+
+// fsync the pending files every interval; the loop ends once there is nothing pending
+func (g *structGroupCommitter) commitLoop() {
+	for {
+		time.Sleep(g.interval)
+
+		g.lock.Lock()
+		pending := g.pending
+		if len(pending) == 0 {
+			g.isRunning = false
+			g.lock.Unlock()
+			return
+		}
+		g.pending = make(map[string][]chan error)
+		g.lock.Unlock()
+
+		for targetFilepath, channels := range pending {
+			err := syncFile(targetFilepath)
+			for _, channel := range channels {
+				channel <- err
+			}
+		}
+	}
+}
+
+// read the sync mode from the config; unknown modes fall back to common.StoreSyncNone
+func (s *StructFilestore) initSync() (err error) {
+	s.syncMode = common.StoreSyncNone
+	interval := time.Millisecond * common.StoreDefaultSyncIntervalMillis
+	if s.AppConfig != nil {
+		s.syncMode = s.AppConfig.Get(common.ConfigKeyStoreFile, common.ConfigKeyStoreFileSync).String(common.StoreSyncNone)
+		interval = s.AppConfig.Get(common.ConfigKeyStoreFile, common.ConfigKeyStoreFileSyncInterval).Duration(interval)
+	}
+	switch s.syncMode {
+	case common.StoreSyncNone, common.StoreSyncAlways:
+	case common.StoreSyncGroup:
+		if interval <= 0 {
+			interval = time.Millisecond * common.StoreDefaultSyncIntervalMillis
+		}
+		s.pGroupCommitter = newStructGroupCommitter(interval)
+	default:
+		err = errors.New(fmt.Sprintf("unknown filestore sync [%v], %v is used instead", s.syncMode, common.StoreSyncNone))
+		s.syncMode = common.StoreSyncNone
+	}
+	return
+}
+
+// append the line to the file (MUST be called under the write lock); the line is written with a single write and
+// starts on a new line even if the file ends with a partial line (e.g. after a crash).
+// For sync "always" the file is fsync-ed before returning, for "group" the caller waits for the group commit
+func (s *StructFilestore) appendLine(targetFilepath string, line string) (err error) {
+	if s.isPartitioned() {
+		err = os.MkdirAll(filepath.Dir(targetFilepath), 0777)
+		if err != nil {
+			return
+		}
+	}
+	_, err = os.Stat(targetFilepath)
+	isNewFile := os.IsNotExist(err)
+
+	pFile, err := os.OpenFile(targetFilepath, os.O_APPEND|os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return
+	}
+	// dtor
+	defer func() {
+		err2 := pFile.Close()
+		// do not shadow the original error
+		if err == nil && err2 != nil {
+			err = err2
+		}
+	}()
+	isPartialLine, err := isEndingWithPartialLine(pFile)
+	if err != nil {
+		return
+	}
+	if isPartialLine {
+		line = "\n" + line
+	}
+	if !strings.HasSuffix(line, "\n") {
+		line = line + "\n"
+	}
+	_, err = pFile.Write([]byte(line))
+	if err != nil {
+		return
+	}
+	if strings.Compare(s.syncMode, common.StoreSyncAlways) == 0 {
+		err = pFile.Sync()
+		if err == nil && isNewFile {
+			err = syncDirectory(filepath.Dir(targetFilepath))
+		}
+	}
+	return
+}
+
+// wait for the group commit of the file (ONLY for sync "group")
+func (s *StructFilestore) waitForGroupCommit(targetFilepath string) (err error) {
+	if s.pGroupCommitter != nil {
+		err = s.pGroupCommitter.commit(targetFilepath)
+	}
+	return
+}
+
+// check whether the file's last byte is not a line feed (non empty files ONLY)
+func isEndingWithPartialLine(pFile *os.File) (isPartialLine bool, err error) {
+	fileInfo, err := pFile.Stat()
+	if err != nil || fileInfo.Size() == 0 {
+		return
+	}
+	lastByte := make([]byte, 1)
+	_, err = pFile.ReadAt(lastByte, fileInfo.Size()-1)
+	if err == io.EOF {
+		err = nil
+	}
+	isPartialLine = lastByte[0] != '\n'
+	return
+}
+
+// fsync the file
+func syncFile(targetFilepath string) (err error) {
+	pFile, err := os.Open(targetFilepath)
+	if err != nil {
+		return
+	}
+	err = pFile.Sync()
+	err2 := pFile.Close()
+	if err == nil {
+		err = err2
+	}
+	return
+}
+
+// fsync the directory so that a created or renamed file survives a crash; not supported
+// on every platform (e.g. windows), hence failures are ignored
+func syncDirectory(directory string) (err error) {
+	pDirectory, err := os.Open(directory)
+	if err != nil {
+		return nil
+	}
+	_ = pDirectory.Sync()
+	return pDirectory.Close()
+}
@@ -0,0 +1,497 @@
+/*
+ *  Copyright Project - Stockbinator, Author - quoeamaster, (C) 2019
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+// influx store - implements interface IStore by writing the records as InfluxDB line protocol.
+// Every record becomes 1 point; measurement is the stock module (configurable), stock_id and module are tags,
+// the numeric fields (TypeInteger, TypeFloat and TypeDecimal) are fields and trx_date is the timestamp:
+//   stock_aastocks,module=stock_aastocks,stock_id=700_tencent price=330.2 1561943400
+// Lines are sent in batches (batch_size lines or every flush_interval, whichever comes first) to the write endpoint.
+// The store is write only; reading is done on the InfluxDB side (e.g. Grafana dashboards).
+package store
+
+import (
+	"Stockbinator/common"
+	"Stockbinator/util"
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/micro/go-config"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// returned by the read / modify operations of the influx store
+var ErrInfluxStoreWriteOnly = errors.New("influx store is write only, query InfluxDB instead")
+
+type StructInfluxStore struct {
+	// storing the application level settings
+	AppConfig config.Config
+	// the store's name; {stock_module}.{symbol} (e.g. stock_aastocks.700_tencent)
+	Name string
+
+	// the stock module and symbol (stock_id) of this store
+	module string
+	symbol string
+
+	writeUrl    string
+	token       string
+	username    string
+	password    string
+	measurement string
+	precision   string
+	batchSize   int
+	pClient     *http.Client
+
+	// lines not yet written; guarded by lock. Lines are numbered in the order persisted, firstPendingSeq being
+	// the number of the 1st pending line, hence the written lines are told apart from the dropped ones
+	pendingLines    []string
+	firstPendingSeq uint64
+	maxPendingLines int
+	// the records of the pending lines (same order), handed to droppedRecordsHandler when dropped
+	pendingRecords []map[string]StructStoreValue
+	// number of the oldest pending lines dropped (never written) as over maxPendingLines
+	droppedLineCount int
+	// called (if set) with the records of the dropped lines, e.g. to spool them for a retry
+	droppedRecordsHandler func(records []map[string]StructStoreValue, reason string)
+	// the error of the last write request, or of the lines dropped since
+	lastError error
+	// closed to stop the background flush (nil if not running) and closed by the flush loop once stopped;
+	// guarded by lock
+	flushStopChannel chan bool
+	flushDoneChannel chan bool
+	lock             sync.Mutex
+	// schema of the module's records (nil means any record is accepted)
+	schema *StructStoreSchema
+	// 1 write request at a time (keeps the lines in order)
+	flushLock sync.Mutex
+}
+
+// creator / ctor method; name is the {stock_module}.{symbol} of the store
+func NewStructInfluxStore(config config.Config, name string) (pStore *StructInfluxStore) {
+	pStore = new(StructInfluxStore)
+	pStore.AppConfig = config
+	pStore.Name = name
+	parts := strings.SplitN(name, ".", 2)
+	pStore.module = parts[0]
+	if len(parts) > 1 {
+		pStore.symbol = parts[1]
+	}
+	err := pStore.init()
+	if err != nil {
+		// log down the error but try to proceed
+		fmt.Println(err)
+	}
+	return
+}
+
+func (s *StructInfluxStore) init() (err error) {
+	writeUrl := common.StoreDefaultInfluxUrl
+	s.measurement = s.module
+	s.precision = common.StoreDefaultInfluxPrecision
+	s.batchSize = common.StoreDefaultInfluxBatchSize
+	timeout := time.Second * common.StoreDefaultInfluxTimeoutSeconds
+	flushInterval := time.Millisecond * common.StoreDefaultInfluxFlushIntervalMillis
+	s.maxPendingLines = common.StoreDefaultInfluxMaxPendingLines
+	if s.AppConfig != nil {
+		cfg := s.AppConfig
+		writeUrl = cfg.Get(common.ConfigKeyStoreInflux, common.ConfigKeyStoreInfluxUrl).String(writeUrl)
+		s.token = cfg.Get(common.ConfigKeyStoreInflux, common.ConfigKeyStoreInfluxToken).String("")
+		s.username = cfg.Get(common.ConfigKeyStoreInflux, common.ConfigKeyStoreDataUsername).String("")
+		s.password = cfg.Get(common.ConfigKeyStoreInflux, common.ConfigKeyStoreDataPassword).String("")
+		s.measurement = cfg.Get(common.ConfigKeyStoreInflux, common.ConfigKeyStoreInfluxMeasurement).String(s.measurement)
+		s.precision = cfg.Get(common.ConfigKeyStoreInflux, common.ConfigKeyStoreInfluxPrecision).String(s.precision)
+		s.batchSize = cfg.Get(common.ConfigKeyStoreInflux, common.ConfigKeyStoreInfluxBatchSize).Int(s.batchSize)
+		timeout = cfg.Get(common.ConfigKeyStoreInflux, common.ConfigKeyStoreDataTimeout).Duration(timeout)
+		flushInterval = cfg.Get(common.ConfigKeyStoreInflux, common.ConfigKeyStoreInfluxFlushInterval).Duration(flushInterval)
+		s.maxPendingLines = cfg.Get(common.ConfigKeyStoreInflux, common.ConfigKeyStoreInfluxMaxPendingLines).Int(s.maxPendingLines)
+	}
+	if s.batchSize <= 0 {
+		s.batchSize = 1
+	}
+	if s.maxPendingLines <= 0 {
+		s.maxPendingLines = common.StoreDefaultInfluxMaxPendingLines
+	}
+	s.pClient = &http.Client{Timeout: timeout}
+	s.pendingLines = make([]string, 0)
+	s.pendingRecords = make([]map[string]StructStoreValue, 0)
+
+	switch s.precision {
+	case "s", "ms", "u", "us", "ns":
+	default:
+		err = errors.New(fmt.Sprintf("unknown influx precision [%v], %v is used instead", s.precision, common.StoreDefaultInfluxPrecision))
+		s.precision = common.StoreDefaultInfluxPrecision
+	}
+	// the precision of the timestamps MUST be known by the endpoint
+	pUrl, err2 := url.Parse(writeUrl)
+	if err2 != nil {
+		err = err2
+		return
+	}
+	query := pUrl.Query()
+	if util.IsEmptyString(query.Get("precision")) {
+		query.Set("precision", s.precision)
+		pUrl.RawQuery = query.Encode()
+	}
+	s.writeUrl = pUrl.String()
+	s.schema, err2 = GetSchemaFromConfig(s.AppConfig, s.module)
+	if err2 != nil && err == nil {
+		err = err2
+	}
+
+	if flushInterval > 0 {
+		s.lock.Lock()
+		s.flushStopChannel = make(chan bool)
+		s.flushDoneChannel = make(chan bool)
+		go s.flushLoop(s.flushStopChannel, s.flushDoneChannel, flushInterval)
+		s.lock.Unlock()
+	}
+	return
+}
+
+// convert the record into a line and queue it; the pending lines are written once there are batch_size of them.
+// A record without numeric fields is skipped (a point needs at least 1 field)
+func (s *StructInfluxStore) Persist(data map[string]StructStoreValue) (response StructStoreResponse, err error) {
+	response = s.newStructStoreResponse(CodeSuccess, "", common.FileStatusAvailable)
+	// records not matching the module's schema are rejected
+	data, err = s.schema.Conform(data)
+	if err != nil {
+		s.handleCommonErrorForResponse(&response, err)
+		return
+	}
+	line, isAvailable, err := s.toLineProtocol(GetRecordWithFieldKeys(data))
+	if err != nil {
+		s.handleCommonErrorForResponse(&response, err)
+		return
+	}
+	if !isAvailable {
+		response.Message = "record without numeric fields, skipped"
+		response.AdditionalCode = common.FileStatusSkipped
+		return
+	}
+	s.lock.Lock()
+	s.pendingLines = append(s.pendingLines, line)
+	s.pendingRecords = append(s.pendingRecords, data)
+	var droppedRecords []map[string]StructStoreValue
+	var droppedError error
+	droppedRecordsHandler := s.droppedRecordsHandler
+	if len(s.pendingLines) > s.maxPendingLines {
+		droppedLines := len(s.pendingLines) - s.maxPendingLines
+		droppedRecords = s.pendingRecords[:droppedLines]
+		s.pendingLines = s.pendingLines[droppedLines:]
+		s.pendingRecords = s.pendingRecords[droppedLines:]
+		s.firstPendingSeq += uint64(droppedLines)
+		// the loss is told through GetDroppedLineCount and GetLastError (until a later write succeeds)
+		s.droppedLineCount += droppedLines
+		droppedError = errors.New(fmt.Sprintf("%v pending line(s) dropped as over max_pending_lines (%v), %v line(s) dropped so far",
+			droppedLines, s.maxPendingLines, s.droppedLineCount))
+		s.lastError = droppedError
+	}
+	isBatchFull := len(s.pendingLines) >= s.batchSize
+	s.lock.Unlock()
+	if len(droppedRecords) > 0 && droppedRecordsHandler != nil {
+		droppedRecordsHandler(droppedRecords, droppedError.Error())
+	}
+
+	if isBatchFull {
+		err = s.Flush()
+		if err != nil {
+			// the lines are kept and written again on the next flush
+			s.handleCommonErrorForResponse(&response, err)
+		}
+	}
+	return
+}
+
+// write all pending lines (batch_size lines per request); lines of a failed request are kept for the next flush
+func (s *StructInfluxStore) Flush() (err error) {
+	s.flushLock.Lock()
+	defer s.flushLock.Unlock()
+	for {
+		s.lock.Lock()
+		batch := s.pendingLines
+		if len(batch) > s.batchSize {
+			batch = batch[:s.batchSize]
+		}
+		batch = append([]string{}, batch...)
+		batchEndSeq := s.firstPendingSeq + uint64(len(batch))
+		s.lock.Unlock()
+		if len(batch) == 0 {
+			return
+		}
+		err = s.write(batch)
+
+		s.lock.Lock()
+		s.lastError = err
+		// whilst writing, Persist ONLY appends lines or drops the oldest ones (some of the batch or even later
+		// lines) when over the max; hence ONLY the lines of the batch still pending are removed
+		if err == nil && batchEndSeq > s.firstPendingSeq {
+			writtenLines := int(batchEndSeq - s.firstPendingSeq)
+			s.pendingLines = s.pendingLines[writtenLines:]
+			s.pendingRecords = s.pendingRecords[writtenLines:]
+			s.firstPendingSeq = batchEndSeq
+		}
+		s.lock.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// number of lines not yet written
+func (s *StructInfluxStore) GetPendingLineCount() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.pendingLines)
+}
+
+// the error of the last write request or of the pending lines dropped since (nil if the last write succeeded)
+func (s *StructInfluxStore) GetLastError() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.lastError
+}
+
+// number of the pending lines dropped (never written) as over max_pending_lines since the store was created
+func (s *StructInfluxStore) GetDroppedLineCount() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.droppedLineCount
+}
+
+// set the handler called with the records of the lines dropped from now on (nil to unset); the lines are ONLY
+// dropped once the writes keep failing (e.g. the background flush), hence the handler might spool the records
+func (s *StructInfluxStore) SetDroppedRecordsHandler(handler func(records []map[string]StructStoreValue, reason string)) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.droppedRecordsHandler = handler
+}
+
+func (s *StructInfluxStore) ReadAll() (response StructStoreResponse, content string, err error) {
+	err = ErrInfluxStoreWriteOnly
+	s.handleCommonErrorForResponse(&response, err)
+	return
+}
+
+func (s *StructInfluxStore) ReadByKey(key string, params interface{}) (response StructStoreResponse, value StructStoreValue, err error) {
+	err = ErrInfluxStoreWriteOnly
+	s.handleCommonErrorForResponse(&response, err)
+	return
+}
+
+func (s *StructInfluxStore) Query(stockId string, from, to time.Time, fields []string, limit int) (response StructStoreResponse, records []StructStoreValue, err error) {
+	records = make([]StructStoreValue, 0)
+	err = ErrInfluxStoreWriteOnly
+	s.handleCommonErrorForResponse(&response, err)
+	return
+}
+
+func (s *StructInfluxStore) Iterate(predicates ...StoreRecordPredicate) (response StructStoreResponse, iterator IStoreIterator, err error) {
+	err = ErrInfluxStoreWriteOnly
+	s.handleCommonErrorForResponse(&response, err)
+	return
+}
+
+func (s *StructInfluxStore) ModifyByKey(key string, value StructStoreValue) (response StructStoreResponse, err error) {
+	err = ErrInfluxStoreWriteOnly
+	s.handleCommonErrorForResponse(&response, err)
+	return
+}
+
+func (s *StructInfluxStore) RemoveByKey(key string) (response StructStoreResponse, valueRemoved StructStoreValue, err error) {
+	err = ErrInfluxStoreWriteOnly
+	s.handleCommonErrorForResponse(&response, err)
+	return
+}
+
+func (s *StructInfluxStore) RemoveAll() (response StructStoreResponse, err error) {
+	err = ErrInfluxStoreWriteOnly
+	s.handleCommonErrorForResponse(&response, err)
+	return
+}
+
+// not supported; the retention of the points is managed by the database's retention policy
+func (s *StructInfluxStore) RemoveBefore(stockId string, before time.Time) (response StructStoreResponse, removed int, err error) {
+	err = ErrInfluxStoreWriteOnly
+	s.handleCommonErrorForResponse(&response, err)
+	return
+}
+
+// no-op; a point is identified by its series (measurement + tags) and timestamp, a point written again replaces the existing one
+func (s *StructInfluxStore) SetNaturalKey(naturalKey StructNaturalKey) {
+}
+
+// convert the record into a line; isAvailable is false if the record has no numeric field
+func (s *StructInfluxStore) toLineProtocol(record map[string]StructStoreValue) (line string, isAvailable bool, err error) {
+	trxDate, isDate := toStoreDate(record[StoreKeyTrxDate].Value)
+	if !isDate {
+		err = errors.New(fmt.Sprintf("field [%v] is mandatory and must be a date BUT got %v", StoreKeyTrxDate, record[StoreKeyTrxDate].Value))
+		return
+	}
+	stockId := s.symbol
+	if value, isString := record[StoreKeyStockId].Value.(string); isString && !util.IsEmptyString(value) {
+		stockId = value
+	}
+	fieldNames := make([]string, 0, len(record))
+	for fieldName := range record {
+		fieldNames = append(fieldNames, fieldName)
+	}
+	sort.Strings(fieldNames)
+	fields := make([]string, 0, len(fieldNames))
+	for _, fieldName := range fieldNames {
+		fieldValue := record[fieldName]
+		if fieldValue.IsArray || fieldValue.IsObject || isNilValue(fieldValue.Value) {
+			continue
+		}
+		switch fieldValue.Type {
+		case TypeInteger:
+			if iValue, isInteger := toInt64(fieldValue.Value); isInteger {
+				fields = append(fields, fmt.Sprintf("%v=%vi", escapeInfluxKey(fieldName), iValue))
+			}
+		case TypeFloat:
+			// NaN and Inf are not supported by line protocol
+			if fValue, isFloat := toFloat64(fieldValue.Value); isFloat && !math.IsNaN(fValue) && !math.IsInf(fValue, 0) {
+				fields = append(fields, fmt.Sprintf("%v=%v", escapeInfluxKey(fieldName), strconv.FormatFloat(fValue, 'f', -1, 64)))
+			}
+		case TypeDecimal:
+			// a float field written with the exact digits
+			if dValue, isDecimal := toDecimal(fieldValue.Value); isDecimal {
+				fields = append(fields, fmt.Sprintf("%v=%v", escapeInfluxKey(fieldName), dValue.String()))
+			}
+		}
+	}
+	if len(fields) == 0 {
+		return
+	}
+	var bLine bytes.Buffer
+	bLine.WriteString(strings.NewReplacer(",", `\,`, " ", `\ `).Replace(s.measurement))
+	for _, tag := range [][]string{ { "module", s.module }, { StoreKeyStockId, stockId } } {
+		if !util.IsEmptyString(tag[1]) {
+			bLine.WriteString(fmt.Sprintf(",%v=%v", escapeInfluxKey(tag[0]), escapeInfluxKey(tag[1])))
+		}
+	}
+	bLine.WriteString(" ")
+	bLine.WriteString(strings.Join(fields, ","))
+	bLine.WriteString(" ")
+	bLine.WriteString(strconv.FormatInt(s.toTimestamp(trxDate), 10))
+	line = bLine.String()
+	isAvailable = true
+	return
+}
+
+// the trx_date in the configured precision
+func (s *StructInfluxStore) toTimestamp(trxDate time.Time) int64 {
+	switch s.precision {
+	case "ms":
+		return trxDate.UnixNano() / int64(time.Millisecond)
+	case "u", "us":
+		return trxDate.UnixNano() / int64(time.Microsecond)
+	case "ns":
+		return trxDate.UnixNano()
+	}
+	return trxDate.Unix()
+}
+
+// POST the lines to the write endpoint
+func (s *StructInfluxStore) write(lines []string) (err error) {
+	pRequest, err := http.NewRequest(http.MethodPost, s.writeUrl, strings.NewReader(strings.Join(lines, "\n")))
+	if err != nil {
+		return
+	}
+	pRequest.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if !util.IsEmptyString(s.token) {
+		pRequest.Header.Set("Authorization", "Token "+s.token)
+	} else if !util.IsEmptyString(s.username) {
+		pRequest.SetBasicAuth(s.username, s.password)
+	}
+	pResponse, err := s.pClient.Do(pRequest)
+	if err != nil {
+		return
+	}
+	bResponse, _ := ioutil.ReadAll(pResponse.Body)
+	_ = pResponse.Body.Close()
+	if pResponse.StatusCode < 200 || pResponse.StatusCode >= 300 {
+		err = errors.New(fmt.Sprintf("influx write of %v line(s) failed (%v) => %v", len(lines), pResponse.StatusCode, string(bResponse)))
+	}
+	return
+}
+
+// stop the background flush (if running) and wait for a running flush to end; the pending lines could
+// still be written through Flush
+func (s *StructInfluxStore) StopFlush() {
+	s.lock.Lock()
+	stopChannel, doneChannel := s.flushStopChannel, s.flushDoneChannel
+	s.flushStopChannel, s.flushDoneChannel = nil, nil
+	s.lock.Unlock()
+	if stopChannel != nil {
+		close(stopChannel)
+		<-doneChannel
+	}
+}
+
+// stop the background flush and write the pending lines (e.g. on shutdown)
+func (s *StructInfluxStore) Close() (err error) {
+	s.StopFlush()
+	err = s.Flush()
+	return
+}
+
+// write the pending lines every interval until stopped
+func (s *StructInfluxStore) flushLoop(stopChannel, doneChannel chan bool, interval time.Duration) {
+	defer close(doneChannel)
+	for {
+		select {
+		case <-stopChannel:
+			return
+		case <-time.After(interval):
+		}
+		// stopped whilst waiting
+		select {
+		case <-stopChannel:
+			return
+		default:
+		}
+		err := s.Flush()
+		if err != nil {
+			logStoreError("influxStore", "flushLoop", fmt.Sprintf("could not write the pending lines of influx store [%v] => %v", s.Name, err))
+		}
+	}
+}
+
+func (s *StructInfluxStore) newStructStoreResponse(code int, message string, additionalCode int) (response StructStoreResponse) {
+	response.Code = code
+	response.Message = message
+	response.AdditionalCode = additionalCode
+	return
+}
+
+func (s *StructInfluxStore) handleCommonErrorForResponse(pResponseStruct *StructStoreResponse, err error) {
+	if pResponseStruct != nil && err != nil {
+		pResponseStruct.Code = CodeFailure
+		pResponseStruct.Message = err.Error()
+		pResponseStruct.AdditionalCode = common.FileStatusUnknown
+	}
+}
+
+// escape a tag key, tag value or field key
+func escapeInfluxKey(key string) string {
+	return strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `).Replace(key)
+}
@@ -0,0 +1,606 @@
+/*
+ *  Copyright Project - Stockbinator, Author - quoeamaster, (C) 2019
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+// memory store - implements interface IStore by keeping the records in memory.
+// Useful as a test double (no files touched) and as a read-through cache in front of a slower store
+// (see SetBackingStore); an optional max size evicts the oldest records first and an optional ttl expires them.
+// All operations are safe for concurrent use.
+package store
+
+import (
+	"Stockbinator/common"
+	"Stockbinator/util"
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/micro/go-config"
+	"strings"
+	"sync"
+	"time"
+)
+
+type StructMemoryStore struct {
+	// storing the application level settings
+	AppConfig config.Config
+	// the store's name; {stock_module}.{symbol} (e.g. stock_aastocks.700_tencent)
+	Name string
+
+	// the stock module and symbol (stock_id) of this store; an empty symbol means all records
+	module string
+	symbol string
+
+	maxSize int
+	ttl     time.Duration
+	clock   util.IClock
+	// the store cached (optional); writes go to the backing store first
+	backing IStore
+
+	// entries in the order stored (removed entries are compacted lazily) plus the index by record key
+	entries    []*structMemoryEntry
+	index      map[string][]*structMemoryEntry
+	liveCount  int
+	hitCount   int
+	missCount  int
+	naturalKey StructNaturalKey
+	// schema of the module's records (nil means any record is accepted)
+	schema *StructStoreSchema
+	lock   sync.Mutex
+}
+
+type structMemoryEntry struct {
+	// {stock_id}|{trx_date}; empty if the record has no stock_id or trx_date
+	key       string
+	record    map[string]StructStoreValue
+	storedAt  time.Time
+	isRemoved bool
+}
+
+// creator / ctor method; name is the {stock_module}.{symbol} of the store, config could be nil (no limits).
+// An optional clock could be given for the ttl (e.g. util.StructFakeClock in tests)
+func NewStructMemoryStore(config config.Config, name string, clock ...util.IClock) (pStore *StructMemoryStore) {
+	pStore = new(StructMemoryStore)
+	pStore.AppConfig = config
+	pStore.Name = name
+	parts := strings.SplitN(name, ".", 2)
+	pStore.module = parts[0]
+	if len(parts) > 1 {
+		pStore.symbol = parts[1]
+	}
+	pStore.clock = util.GetClock(clock...)
+	pStore.entries = make([]*structMemoryEntry, 0)
+	pStore.index = make(map[string][]*structMemoryEntry)
+	err := pStore.init()
+	if err != nil {
+		// log down the error but try to proceed
+		fmt.Println(err)
+	}
+	return
+}
+
+func (s *StructMemoryStore) init() (err error) {
+	if s.AppConfig != nil {
+		s.maxSize = s.AppConfig.Get(common.ConfigKeyStoreMemory, common.ConfigKeyStoreMemoryMaxSize).Int(0)
+		s.ttl = s.AppConfig.Get(common.ConfigKeyStoreMemory, common.ConfigKeyStoreMemoryTtl).Duration(0)
+	}
+	s.naturalKey, err = GetNaturalKeyFromConfig(s.AppConfig, common.ConfigKeyStoreMemory, s.module)
+	if err != nil {
+		return
+	}
+	s.schema, err = GetSchemaFromConfig(s.AppConfig, s.module)
+	return
+}
+
+// set the max number of records kept (0 means no limit) and how long a record is kept (0 means forever)
+func (s *StructMemoryStore) SetLimits(maxSize int, ttl time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.maxSize = maxSize
+	s.ttl = ttl
+	s.purge()
+}
+
+// turn the memory store into a read-through cache of the backing store; writes go to the backing store
+// (the cached records are invalidated), ReadByKey is served from memory if available (loaded from the
+// backing store otherwise) whilst ReadAll, Query and Iterate are served by the backing store
+func (s *StructMemoryStore) SetBackingStore(backing IStore) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.backing = backing
+	s.removeEntries(func(entry *structMemoryEntry) bool { return true })
+}
+
+// number of records kept in memory
+func (s *StructMemoryStore) GetRecordCount() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.purge()
+	return s.liveCount
+}
+
+// number of ReadByKey served from memory (hits) and not (misses)
+func (s *StructMemoryStore) GetCacheStats() (hitCount, missCount int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.hitCount, s.missCount
+}
+
+func (s *StructMemoryStore) Persist(data map[string]StructStoreValue) (response StructStoreResponse, err error) {
+	response = s.newStructStoreResponse(CodeSuccess, "", common.FileStatusAvailable)
+	// records not matching the module's schema are rejected
+	data, err = s.schema.Conform(data)
+	if err != nil {
+		s.handleCommonErrorForResponse(&response, err)
+		return
+	}
+	record := GetRecordWithFieldKeys(data)
+	backing := s.getBackingStore()
+	if backing != nil {
+		response, err = backing.Persist(data)
+		if err == nil {
+			s.invalidate(getMemoryRecordKey(record))
+		}
+		return
+	}
+	// validate the record the same way as a json based store does
+	_, err = EncodeStoreRecord(record)
+	if err != nil {
+		s.handleCommonErrorForResponse(&response, err)
+		return
+	}
+	s.lock.Lock()
+	isSkipped := s.put(record)
+	s.lock.Unlock()
+	if isSkipped {
+		response.Message = "record with the same natural key already exists, skipped"
+		response.AdditionalCode = common.FileStatusSkipped
+	}
+	return
+}
+
+// read all records of the store's symbol as json lines (might be an issue when the content size is HUGE, use Iterate instead
+func (s *StructMemoryStore) ReadAll() (response StructStoreResponse, content string, err error) {
+	if backing := s.getBackingStore(); backing != nil {
+		return backing.ReadAll()
+	}
+	response = s.newStructStoreResponse(CodeSuccess, "", common.FileStatusAvailable)
+	var bContent bytes.Buffer
+	for _, record := range s.snapshot(nil) {
+		jsonValue, err2 := EncodeStoreRecord(record)
+		if err2 != nil {
+			err = err2
+			s.handleCommonErrorForResponse(&response, err)
+			return
+		}
+		bContent.WriteString(jsonValue)
+		bContent.WriteString("\n")
+	}
+	content = bContent.String()
+	return
+}
+
+// read the record associated by the KEY ({stock_id}|{trx_date}, see BuildRecordKey),
+// PARAMS (StructStoreReadParams or a map of filters) narrows down the matching records and the fields returned
+func (s *StructMemoryStore) ReadByKey(key string, params interface{}) (response StructStoreResponse, value StructStoreValue, err error) {
+	response = s.newStructStoreResponse(CodeSuccess, "", common.FileStatusAvailable)
+	readParams, err := GetStoreReadParams(params)
+	if err != nil {
+		s.handleCommonErrorForResponse(&response, err)
+		return
+	}
+	s.lock.Lock()
+	s.purge()
+	records := make([]map[string]StructStoreValue, 0)
+	for _, entry := range s.index[normalizeMemoryKey(key)] {
+		records = append(records, copyMemoryRecord(entry.record))
+	}
+	if len(records) > 0 {
+		s.hitCount++
+	} else {
+		s.missCount++
+	}
+	backing := s.backing
+	s.lock.Unlock()
+
+	if len(records) == 0 && backing != nil {
+		var loadedValue StructStoreValue
+		response, loadedValue, err = backing.ReadByKey(key, nil)
+		if err != nil {
+			return
+		}
+		if loadedRecord, isMap := loadedValue.Value.(map[string]StructStoreValue); isMap {
+			records = append(records, loadedRecord)
+			s.lock.Lock()
+			s.put(copyMemoryRecord(loadedRecord))
+			s.lock.Unlock()
+		}
+	}
+	found := false
+	for _, record := range records {
+		if IsRecordMatchingFilters(record, readParams.Filters) {
+			value = StructStoreValue{Key: key, Value: SelectRecordFields(record, readParams.Fields), IsObject: true}
+			found = true
+		}
+	}
+	if !found {
+		err = errors.New(fmt.Sprintf("no record found for key [%v]", key))
+		s.handleCommonErrorForResponse(&response, err)
+		response.AdditionalCode = common.FileStatusNotAvailable
+	}
+	return
+}
+
+// query the records of the given stock (all records if empty) whose trx_date falls within [from, to]
+func (s *StructMemoryStore) Query(stockId string, from, to time.Time, fields []string, limit int) (response StructStoreResponse, records []StructStoreValue, err error) {
+	if backing := s.getBackingStore(); backing != nil {
+		return backing.Query(stockId, from, to, fields, limit)
+	}
+	response = s.newStructStoreResponse(CodeSuccess, "", common.FileStatusAvailable)
+	s.lock.Lock()
+	s.purge()
+	matchedRecords := make([]map[string]StructStoreValue, 0)
+	for _, entry := range s.entries {
+		if !entry.isRemoved && IsRecordInQueryRange(entry.record, stockId, from, to) {
+			matchedRecords = append(matchedRecords, copyMemoryRecord(entry.record))
+		}
+	}
+	s.lock.Unlock()
+	records = BuildQueryResult(matchedRecords, fields, limit)
+	return
+}
+
+// iterate the records of the store's symbol (in the order stored) matching all the predicates;
+// the iterator works on a snapshot taken when Iterate is called
+func (s *StructMemoryStore) Iterate(predicates ...StoreRecordPredicate) (response StructStoreResponse, iterator IStoreIterator, err error) {
+	if backing := s.getBackingStore(); backing != nil {
+		return backing.Iterate(predicates...)
+	}
+	response = s.newStructStoreResponse(CodeSuccess, "", common.FileStatusAvailable)
+	iterator = &structMemoryIterator{records: s.snapshot(predicates)}
+	return
+}
+
+// modify the record(s) associated with the key; VALUE must be an object (map[string]StructStoreValue)
+// containing the fields to update. The record identity (stock_id and trx_date) could not be modified
+func (s *StructMemoryStore) ModifyByKey(key string, value StructStoreValue) (response StructStoreResponse, err error) {
+	if backing := s.getBackingStore(); backing != nil {
+		response, err = backing.ModifyByKey(key, value)
+		s.invalidate(key)
+		return
+	}
+	response = s.newStructStoreResponse(CodeSuccess, "", common.FileStatusAvailable)
+	fieldMap, isMap := value.Value.(map[string]StructStoreValue)
+	if !value.IsObject || !isMap {
+		err = errors.New(fmt.Sprintf("value for key [%v] must be an object of fields (map[string]StructStoreValue)", key))
+		s.handleCommonErrorForResponse(&response, err)
+		return
+	}
+	fieldMap = GetRecordWithFieldKeys(fieldMap)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.purge()
+	entries := s.index[normalizeMemoryKey(key)]
+	if len(entries) == 0 {
+		err = errors.New(fmt.Sprintf("no record found for key [%v]", key))
+		s.handleCommonErrorForResponse(&response, err)
+		response.AdditionalCode = common.FileStatusNotAvailable
+		return
+	}
+	for _, entry := range entries {
+		for fieldName, fieldValue := range fieldMap {
+			if (strings.Compare(fieldName, StoreKeyStockId) == 0 || strings.Compare(fieldName, StoreKeyTrxDate) == 0) &&
+				!isStoreValueEqual(entry.record[fieldName].Value, fieldValue.Value) {
+				err = errors.New(fmt.Sprintf("field [%v] is part of the record key and could not be modified", fieldName))
+				s.handleCommonErrorForResponse(&response, err)
+				return
+			}
+		}
+	}
+	for _, entry := range entries {
+		// copy on write; records handed out earlier are not affected
+		record := copyMemoryRecord(entry.record)
+		for fieldName, fieldValue := range fieldMap {
+			record[fieldName] = fieldValue
+		}
+		entry.record = record
+	}
+	return
+}
+
+// remove the record(s) associated with the key; the removed record is returned as an object
+func (s *StructMemoryStore) RemoveByKey(key string) (response StructStoreResponse, valueRemoved StructStoreValue, err error) {
+	if backing := s.getBackingStore(); backing != nil {
+		response, valueRemoved, err = backing.RemoveByKey(key)
+		s.invalidate(key)
+		return
+	}
+	response = s.newStructStoreResponse(CodeSuccess, "", common.FileStatusAvailable)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.purge()
+	normalizedKey := normalizeMemoryKey(key)
+	entries := s.index[normalizedKey]
+	if len(entries) == 0 {
+		err = errors.New(fmt.Sprintf("no record found for key [%v]", key))
+		s.handleCommonErrorForResponse(&response, err)
+		response.AdditionalCode = common.FileStatusNotAvailable
+		return
+	}
+	valueRemoved = StructStoreValue{Key: key, Value: entries[len(entries)-1].record, IsObject: true}
+	s.removeEntries(func(entry *structMemoryEntry) bool { return strings.Compare(entry.key, normalizedKey) == 0 })
+	return
+}
+
+// remove all records of the store's symbol (all records if no symbol), be careful~
+func (s *StructMemoryStore) RemoveAll() (response StructStoreResponse, err error) {
+	response = s.newStructStoreResponse(CodeSuccess, "", common.FileStatusAvailable)
+	backing := s.getBackingStore()
+	if backing != nil {
+		response, err = backing.RemoveAll()
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.removeEntries(s.isOfSymbol)
+	return
+}
+
+// remove the records of the stock (empty means all stocks of the store) whose trx_date is before the given time;
+// for a read-through cache the records are removed from the backing store (the count is the backing store's)
+func (s *StructMemoryStore) RemoveBefore(stockId string, before time.Time) (response StructStoreResponse, removed int, err error) {
+	response = s.newStructStoreResponse(CodeSuccess, "", common.FileStatusAvailable)
+	backing := s.getBackingStore()
+	if backing != nil {
+		response, removed, err = backing.RemoveBefore(stockId, before)
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	cachedRemoved := 0
+	s.removeEntries(func(entry *structMemoryEntry) bool {
+		trxDate, isDate := toStoreDate(entry.record[StoreKeyTrxDate].Value)
+		isMatching := s.isOfSymbol(entry) && isDate && trxDate.Before(before) &&
+			(util.IsEmptyString(stockId) || isStoreValueEqual(entry.record[StoreKeyStockId].Value, stockId))
+		if isMatching {
+			cachedRemoved++
+		}
+		return isMatching
+	})
+	if backing == nil {
+		removed = cachedRemoved
+	}
+	return
+}
+
+// set the natural key identifying a record and how Persist handles a record whose natural key already exists
+func (s *StructMemoryStore) SetNaturalKey(naturalKey StructNaturalKey) {
+	s.lock.Lock()
+	s.naturalKey = naturalKey
+	backing := s.backing
+	s.lock.Unlock()
+	if backing != nil {
+		backing.SetNaturalKey(naturalKey)
+	}
+}
+
+func (s *StructMemoryStore) getBackingStore() IStore {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.backing
+}
+
+// remove the cached records of the key
+func (s *StructMemoryStore) invalidate(key string) {
+	normalizedKey := normalizeMemoryKey(key)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.removeEntries(func(entry *structMemoryEntry) bool { return strings.Compare(entry.key, normalizedKey) == 0 })
+}
+
+// add the record (MUST be called under the lock); records with the same natural key are replaced
+// or the record is skipped (depends on the duplicate policy). The oldest records are evicted beyond the max size
+func (s *StructMemoryStore) put(record map[string]StructStoreValue) (isSkipped bool) {
+	s.purge()
+	if _, isAvailable := BuildNaturalKeyId(record, s.naturalKey); isAvailable &&
+		strings.Compare(s.naturalKey.DuplicatePolicy, common.StoreDuplicatePolicyAppend) != 0 {
+		isDuplicate := func(entry *structMemoryEntry) bool {
+			return IsSameNaturalKey(record, entry.record, s.naturalKey)
+		}
+		if strings.Compare(s.naturalKey.DuplicatePolicy, common.StoreDuplicatePolicySkip) == 0 {
+			for _, entry := range s.entries {
+				if !entry.isRemoved && isDuplicate(entry) {
+					isSkipped = true
+					return
+				}
+			}
+		} else {
+			s.removeEntries(isDuplicate)
+		}
+	}
+	entry := &structMemoryEntry{key: getMemoryRecordKey(record), record: record, storedAt: s.clock.Now()}
+	s.entries = append(s.entries, entry)
+	s.index[entry.key] = append(s.index[entry.key], entry)
+	s.liveCount++
+	for s.maxSize > 0 && s.liveCount > s.maxSize {
+		s.removeOldest()
+	}
+	s.compact()
+	return
+}
+
+// remove the expired records (MUST be called under the lock); records are stored in time order
+// hence the expired ones are all at the front
+func (s *StructMemoryStore) purge() {
+	if s.ttl > 0 {
+		now := s.clock.Now()
+		for _, entry := range s.entries {
+			if entry.isRemoved {
+				continue
+			}
+			if now.Sub(entry.storedAt) < s.ttl {
+				break
+			}
+			s.removeEntry(entry)
+		}
+	}
+	for s.maxSize > 0 && s.liveCount > s.maxSize {
+		s.removeOldest()
+	}
+	s.compact()
+}
+
+func (s *StructMemoryStore) removeOldest() {
+	for _, entry := range s.entries {
+		if !entry.isRemoved {
+			s.removeEntry(entry)
+			return
+		}
+	}
+}
+
+func (s *StructMemoryStore) removeEntries(isMatching func(entry *structMemoryEntry) bool) {
+	for _, entry := range s.entries {
+		if !entry.isRemoved && isMatching(entry) {
+			s.removeEntry(entry)
+		}
+	}
+	s.compact()
+}
+
+func (s *StructMemoryStore) removeEntry(entry *structMemoryEntry) {
+	entry.isRemoved = true
+	s.liveCount--
+	indexed := s.index[entry.key]
+	for i, indexedEntry := range indexed {
+		if indexedEntry == entry {
+			indexed = append(indexed[:i:i], indexed[i+1:]...)
+			break
+		}
+	}
+	if len(indexed) == 0 {
+		delete(s.index, entry.key)
+	} else {
+		s.index[entry.key] = indexed
+	}
+}
+
+// drop the removed entries once they outnumber the live ones
+func (s *StructMemoryStore) compact() {
+	if len(s.entries) <= 2*s.liveCount+16 {
+		return
+	}
+	entries := make([]*structMemoryEntry, 0, s.liveCount)
+	for _, entry := range s.entries {
+		if !entry.isRemoved {
+			entries = append(entries, entry)
+		}
+	}
+	s.entries = entries
+}
+
+func (s *StructMemoryStore) isOfSymbol(entry *structMemoryEntry) bool {
+	if util.IsEmptyString(s.symbol) {
+		return true
+	}
+	return isStoreValueEqual(entry.record[StoreKeyStockId].Value, s.symbol)
+}
+
+// copies of the records of the store's symbol matching all the predicates
+func (s *StructMemoryStore) snapshot(predicates []StoreRecordPredicate) (records []map[string]StructStoreValue) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.purge()
+	records = make([]map[string]StructStoreValue, 0, s.liveCount)
+	for _, entry := range s.entries {
+		if !entry.isRemoved && s.isOfSymbol(entry) && IsRecordMatchingPredicates(entry.record, predicates) {
+			records = append(records, copyMemoryRecord(entry.record))
+		}
+	}
+	return
+}
+
+func (s *StructMemoryStore) newStructStoreResponse(code int, message string, additionalCode int) (response StructStoreResponse) {
+	response.Code = code
+	response.Message = message
+	response.AdditionalCode = additionalCode
+	return
+}
+
+func (s *StructMemoryStore) handleCommonErrorForResponse(pResponseStruct *StructStoreResponse, err error) {
+	if pResponseStruct != nil && err != nil {
+		pResponseStruct.Code = CodeFailure
+		pResponseStruct.Message = err.Error()
+		pResponseStruct.AdditionalCode = common.FileStatusUnknown
+	}
+}
+
+// {stock_id}|{trx_date} of the record; empty if not available
+func getMemoryRecordKey(record map[string]StructStoreValue) string {
+	stockId, isString := record[StoreKeyStockId].Value.(string)
+	trxDate, isDate := toStoreDate(record[StoreKeyTrxDate].Value)
+	if !isString || !isDate {
+		return ""
+	}
+	return BuildRecordKey(stockId, trxDate.UTC())
+}
+
+// the key with its trx_date in UTC; the same record could be asked for with trx_date of any timezone
+func normalizeMemoryKey(key string) string {
+	stockId, trxDate, err := ParseRecordKey(key)
+	if err != nil {
+		return key
+	}
+	return BuildRecordKey(stockId, trxDate.UTC())
+}
+
+// shallow copy; the records kept are never modified in place, hence callers could not affect each other
+func copyMemoryRecord(record map[string]StructStoreValue) (copied map[string]StructStoreValue) {
+	copied = make(map[string]StructStoreValue, len(record))
+	for fieldName, fieldValue := range record {
+		copied[fieldName] = fieldValue
+	}
+	return
+}
+
+// * ********* *
+// * iterator  *
+// * ********* *
+
+// iterator over a snapshot of records
+type structMemoryIterator struct {
+	records []map[string]StructStoreValue
+	index   int
+	record  StructStoreValue
+}
+
+func (i *structMemoryIterator) Next() bool {
+	i.record = StructStoreValue{}
+	if i.index >= len(i.records) {
+		return false
+	}
+	i.record = NewRecordStoreValue(i.records[i.index])
+	i.index++
+	return true
+}
+
+func (i *structMemoryIterator) Record() StructStoreValue {
+	return i.record
+}
+
+func (i *structMemoryIterator) Err() error {
+	return nil
+}
+
+func (i *structMemoryIterator) Close() error {
+	i.records = nil
+	return nil
+}
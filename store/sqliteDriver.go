@@ -0,0 +1,23 @@
+//go:build sqlite
+// +build sqlite
+
+/*
+ *  Copyright Project - Stockbinator, Author - quoeamaster, (C) 2019
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+package store
+
+// the pure go sqlite driver is ONLY compiled in with the "sqlite" build tag (e.g. go build -tags sqlite);
+// it is ignored by dep (see Gopkg.toml), hence fetch it before building => go get modernc.org/sqlite
+import _ "modernc.org/sqlite"
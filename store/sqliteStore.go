@@ -0,0 +1,1019 @@
+/*
+ *  Copyright Project - Stockbinator, Author - quoeamaster, (C) 2019
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+// sqlite store - implements interface IStore.
+// All stores configured with the same [sqlitestore] path share 1 sqlite database file, each stock module
+// has its own table (e.g. stock_aastocks) and each field its own typed column; columns are added on demand
+// when a record brings a new field. The StructStoreValue type of every column is kept in the table
+// stockbinator_columns so the records could be read back with the same types. The driver is pure go (no cgo)
+// and ONLY compiled in with the "sqlite" build tag (see sqliteDriver.go).
+package store
+
+import (
+	"Stockbinator/common"
+	"Stockbinator/util"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/micro/go-config"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// name of the (pure go) sqlite driver registered to database/sql
+	sqliteDriverName = "sqlite"
+	// build tag compiling in the sqlite driver
+	sqliteBuildTag = "sqlite"
+	// trx_date (and any date) column format; fixed width UTC hence the text comparison is chronological
+	sqliteDateFormat = "2006-01-02T15:04:05Z"
+	// table keeping the StructStoreValue type of every column of every module table
+	sqliteColumnsTable = "stockbinator_columns"
+)
+
+type StructSqliteStore struct {
+	// storing the application level settings
+	AppConfig config.Config
+	// the store's name; {stock_module}.{symbol} (e.g. stock_aastocks.700_tencent)
+	Name string
+
+	// the stock module (also the table name) and symbol (stock_id) of this store
+	module string
+	symbol string
+	// the resolved database file path
+	path string
+
+	pDatabase  *structSqliteDatabase
+	naturalKey StructNaturalKey
+	// schema of the module's records (nil means any record is accepted); also drives the column types
+	schema *StructStoreSchema
+	lock   sync.Mutex
+}
+
+// creator / ctor method; name is the {stock_module}.{symbol} of the store
+func NewStructSqliteStore(config config.Config, name string) (pStore *StructSqliteStore) {
+	pStore = new(StructSqliteStore)
+	pStore.AppConfig = config
+	pStore.Name = name
+	parts := strings.SplitN(name, ".", 2)
+	pStore.module = parts[0]
+	if len(parts) > 1 {
+		pStore.symbol = parts[1]
+	}
+	err := pStore.init()
+	if err != nil {
+		// log down the error but try to proceed
+		fmt.Println(err)
+	}
+	return
+}
+
+func (s *StructSqliteStore) init() (err error) {
+	path := common.StoreDefaultSqliteFilename
+	busyTimeout := time.Millisecond * common.StoreDefaultSqliteBusyTimeoutMillis
+	if s.AppConfig != nil {
+		path = s.AppConfig.Get(common.ConfigKeyStoreSqlite, common.ConfigKeyStorePath).String(path)
+		busyTimeout = s.AppConfig.Get(common.ConfigKeyStoreSqlite, common.ConfigKeyStoreSqliteBusyTimeout).Duration(busyTimeout)
+	}
+	s.path, err = util.ReplaceEnvVarInPath(path)
+	if err != nil {
+		return
+	}
+	s.naturalKey, err = GetNaturalKeyFromConfig(s.AppConfig, common.ConfigKeyStoreSqlite, s.module)
+	if err != nil {
+		return
+	}
+	s.schema, err = GetSchemaFromConfig(s.AppConfig, s.module)
+	if err != nil {
+		return
+	}
+	s.pDatabase, err = openSqliteDatabase(s.path, busyTimeout)
+	if err != nil {
+		return
+	}
+	err = s.pDatabase.ensureTable(s.module)
+	return
+}
+
+// save the record into the module's table (adding columns for new fields if necessary)
+func (s *StructSqliteStore) Persist(data map[string]StructStoreValue) (response StructStoreResponse, err error) {
+	response = s.newStructStoreResponse(CodeSuccess, "", common.FileStatusAvailable)
+	err = s.checkDatabase()
+	if err != nil {
+		s.handleCommonErrorForResponse(&response, err)
+		return
+	}
+	data, err = s.schema.Conform(data)
+	if err != nil {
+		s.handleCommonErrorForResponse(&response, err)
+		return
+	}
+	// the declared fields get the column types of the schema instead of the types of the first values seen
+	err = s.pDatabase.ensureColumns(s.module, s.schema.GetTemplateRecord())
+	if err != nil {
+		s.handleCommonErrorForResponse(&response, err)
+		return
+	}
+	record := GetRecordWithFieldKeys(data)
+	err = s.pDatabase.ensureColumns(s.module, record)
+	if err != nil {
+		s.handleCommonErrorForResponse(&response, err)
+		return
+	}
+	isSkipped := false
+	err = s.pDatabase.write(func(tx *sql.Tx) (err error) {
+		isSkipped, err = s.persistRecord(tx, record)
+		return
+	})
+	if err != nil {
+		s.handleCommonErrorForResponse(&response, err)
+		return
+	}
+	if isSkipped {
+		response.Message = "record with the same natural key already exists, skipped"
+		response.AdditionalCode = common.FileStatusSkipped
+	}
+	return
+}
+
+// insert the record; records with the same natural key are replaced or the record is skipped (depends on the duplicate policy)
+func (s *StructSqliteStore) persistRecord(tx *sql.Tx, record map[string]StructStoreValue) (isSkipped bool, err error) {
+	naturalKey := s.getNaturalKey()
+	if _, isAvailable := BuildNaturalKeyId(record, naturalKey); isAvailable &&
+		strings.Compare(naturalKey.DuplicatePolicy, common.StoreDuplicatePolicyAppend) != 0 {
+		conditions := make([]string, 0, len(naturalKey.Fields))
+		args := make([]interface{}, 0, len(naturalKey.Fields))
+		for _, field := range naturalKey.Fields {
+			arg, err2 := toSqliteValue(record[field])
+			if err2 != nil {
+				err = err2
+				return
+			}
+			conditions = append(conditions, fmt.Sprintf("%v = ?", quoteSqliteIdentifier(field)))
+			args = append(args, arg)
+		}
+		where := strings.Join(conditions, " AND ")
+		if strings.Compare(naturalKey.DuplicatePolicy, common.StoreDuplicatePolicySkip) == 0 {
+			count := 0
+			err = tx.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %v WHERE %v", quoteSqliteIdentifier(s.module), where), args...).Scan(&count)
+			if err != nil || count > 0 {
+				isSkipped = count > 0
+				return
+			}
+		} else {
+			_, err = tx.Exec(fmt.Sprintf("DELETE FROM %v WHERE %v", quoteSqliteIdentifier(s.module), where), args...)
+			if err != nil {
+				return
+			}
+		}
+	}
+	columns := make([]string, 0, len(record))
+	placeholders := make([]string, 0, len(record))
+	args := make([]interface{}, 0, len(record))
+	for fieldName, fieldValue := range record {
+		arg, err2 := toSqliteValue(fieldValue)
+		if err2 != nil {
+			err = errors.New(fmt.Sprintf("field [%v] => %v", fieldName, err2))
+			return
+		}
+		columns = append(columns, quoteSqliteIdentifier(fieldName))
+		placeholders = append(placeholders, "?")
+		args = append(args, arg)
+	}
+	_, err = tx.Exec(fmt.Sprintf("INSERT INTO %v (%v) VALUES (%v)", quoteSqliteIdentifier(s.module),
+		strings.Join(columns, ", "), strings.Join(placeholders, ", ")), args...)
+	return
+}
+
+// read all records of the store's symbol as json lines (might be an issue when the content size is HUGE, use Iterate instead
+func (s *StructSqliteStore) ReadAll() (response StructStoreResponse, content string, err error) {
+	response, iterator, err := s.Iterate()
+	if err != nil {
+		return
+	}
+	defer func() {
+		_ = iterator.Close()
+	}()
+	var bContent bytes.Buffer
+	for iterator.Next() {
+		jsonValue, err2 := EncodeStoreRecord(iterator.Record().Value.(map[string]StructStoreValue))
+		if err2 != nil {
+			err = err2
+			break
+		}
+		bContent.WriteString(jsonValue)
+		bContent.WriteString("\n")
+	}
+	if err == nil {
+		err = iterator.Err()
+	}
+	if err != nil {
+		s.handleCommonErrorForResponse(&response, err)
+		return
+	}
+	content = bContent.String()
+	return
+}
+
+// read the record associated by the KEY ({stock_id}|{trx_date}, see BuildRecordKey),
+// PARAMS (StructStoreReadParams or a map of filters) narrows down the matching records and the fields returned
+func (s *StructSqliteStore) ReadByKey(key string, params interface{}) (response StructStoreResponse, value StructStoreValue, err error) {
+	response = s.newStructStoreResponse(CodeSuccess, "", common.FileStatusAvailable)
+	readParams, err := GetStoreReadParams(params)
+	if err == nil {
+		err = s.checkDatabase()
+	}
+	if err != nil {
+		s.handleCommonErrorForResponse(&response, err)
+		return
+	}
+	_, records, err := s.selectByKey(s.pDatabase.pDB, key)
+	if err != nil {
+		s.handleCommonErrorForResponse(&response, err)
+		return
+	}
+	found := false
+	for _, record := range records {
+		if IsRecordMatchingFilters(record, readParams.Filters) {
+			value = StructStoreValue{Key: key, Value: SelectRecordFields(record, readParams.Fields), IsObject: true}
+			found = true
+		}
+	}
+	if !found {
+		err = errors.New(fmt.Sprintf("no record found for key [%v]", key))
+		s.handleCommonErrorForResponse(&response, err)
+		response.AdditionalCode = common.FileStatusNotAvailable
+	}
+	return
+}
+
+// query the records of the given stock (of the module's table) whose trx_date falls within [from, to];
+// the filtering, ordering and limit are done by sqlite (indexed by stock_id + trx_date)
+func (s *StructSqliteStore) Query(stockId string, from, to time.Time, fields []string, limit int) (response StructStoreResponse, records []StructStoreValue, err error) {
+	records = make([]StructStoreValue, 0)
+	response = s.newStructStoreResponse(CodeSuccess, "", common.FileStatusAvailable)
+	err = s.checkDatabase()
+	if err != nil {
+		s.handleCommonErrorForResponse(&response, err)
+		return
+	}
+	columns := "*"
+	if len(fields) > 0 {
+		selectedColumns := []string{ quoteSqliteIdentifier(StoreKeyStockId), quoteSqliteIdentifier(StoreKeyTrxDate) }
+		for _, field := range fields {
+			if s.pDatabase.hasColumn(s.module, field) && strings.Compare(field, StoreKeyStockId) != 0 &&
+				strings.Compare(field, StoreKeyTrxDate) != 0 {
+				selectedColumns = append(selectedColumns, quoteSqliteIdentifier(field))
+			}
+		}
+		columns = strings.Join(selectedColumns, ", ")
+	}
+	where, args := s.buildWhere(stockId, from, to)
+	statement := fmt.Sprintf("SELECT _rowid_, %v FROM %v%v ORDER BY %v, _rowid_", columns, quoteSqliteIdentifier(s.module),
+		where, quoteSqliteIdentifier(StoreKeyTrxDate))
+	if limit > 0 {
+		statement = fmt.Sprintf("%v LIMIT %v", statement, limit)
+	}
+	pIterator, err := s.newIterator(statement, args, nil)
+	if err != nil {
+		s.handleCommonErrorForResponse(&response, err)
+		return
+	}
+	defer func() {
+		_ = pIterator.Close()
+	}()
+	matchedRecords := make([]map[string]StructStoreValue, 0)
+	for pIterator.Next() {
+		matchedRecords = append(matchedRecords, pIterator.Record().Value.(map[string]StructStoreValue))
+	}
+	err = pIterator.Err()
+	if err != nil {
+		s.handleCommonErrorForResponse(&response, err)
+		return
+	}
+	records = BuildQueryResult(matchedRecords, fields, limit)
+	return
+}
+
+// iterate the records of the store's symbol (chronological order) matching all the predicates;
+// the iterator holds a read cursor on the database, hence MUST be closed after use
+func (s *StructSqliteStore) Iterate(predicates ...StoreRecordPredicate) (response StructStoreResponse, iterator IStoreIterator, err error) {
+	response = s.newStructStoreResponse(CodeSuccess, "", common.FileStatusAvailable)
+	err = s.checkDatabase()
+	if err != nil {
+		s.handleCommonErrorForResponse(&response, err)
+		return
+	}
+	where, args := s.buildWhere(s.symbol, time.Time{}, time.Time{})
+	iterator, err = s.newIterator(fmt.Sprintf("SELECT _rowid_, * FROM %v%v ORDER BY %v, _rowid_", quoteSqliteIdentifier(s.module),
+		where, quoteSqliteIdentifier(StoreKeyTrxDate)), args, predicates)
+	if err != nil {
+		s.handleCommonErrorForResponse(&response, err)
+	}
+	return
+}
+
+// modify the record(s) associated with the key; VALUE must be an object (map[string]StructStoreValue)
+// containing the fields to update. The record identity (stock_id and trx_date) could not be modified
+func (s *StructSqliteStore) ModifyByKey(key string, value StructStoreValue) (response StructStoreResponse, err error) {
+	response = s.newStructStoreResponse(CodeSuccess, "", common.FileStatusAvailable)
+	fieldMap, isMap := value.Value.(map[string]StructStoreValue)
+	if !value.IsObject || !isMap {
+		err = errors.New(fmt.Sprintf("value for key [%v] must be an object of fields (map[string]StructStoreValue)", key))
+	}
+	if err == nil {
+		err = s.checkDatabase()
+	}
+	if err != nil {
+		s.handleCommonErrorForResponse(&response, err)
+		return
+	}
+	fieldMap = GetRecordWithFieldKeys(fieldMap)
+	err = s.pDatabase.ensureColumns(s.module, fieldMap)
+	if err != nil {
+		s.handleCommonErrorForResponse(&response, err)
+		return
+	}
+	isFound := true
+	err = s.pDatabase.write(func(tx *sql.Tx) (err error) {
+		rowIds, records, err := s.selectByKey(tx, key)
+		if err != nil {
+			return
+		}
+		if len(records) == 0 {
+			isFound = false
+			return errors.New(fmt.Sprintf("no record found for key [%v]", key))
+		}
+		assignments := make([]string, 0, len(fieldMap))
+		args := make([]interface{}, 0, len(fieldMap)+1)
+		for fieldName, fieldValue := range fieldMap {
+			if strings.Compare(fieldName, StoreKeyStockId) == 0 || strings.Compare(fieldName, StoreKeyTrxDate) == 0 {
+				for _, record := range records {
+					if !isStoreValueEqual(record[fieldName].Value, fieldValue.Value) {
+						return errors.New(fmt.Sprintf("field [%v] is part of the record key and could not be modified", fieldName))
+					}
+				}
+			}
+			arg, err := toSqliteValue(fieldValue)
+			if err != nil {
+				return errors.New(fmt.Sprintf("field [%v] => %v", fieldName, err))
+			}
+			assignments = append(assignments, fmt.Sprintf("%v = ?", quoteSqliteIdentifier(fieldName)))
+			args = append(args, arg)
+		}
+		if len(assignments) == 0 {
+			return
+		}
+		for _, rowId := range rowIds {
+			_, err = tx.Exec(fmt.Sprintf("UPDATE %v SET %v WHERE _rowid_ = ?", quoteSqliteIdentifier(s.module),
+				strings.Join(assignments, ", ")), append(args, rowId)...)
+			if err != nil {
+				return
+			}
+		}
+		return
+	})
+	if err != nil {
+		s.handleCommonErrorForResponse(&response, err)
+		if !isFound {
+			response.AdditionalCode = common.FileStatusNotAvailable
+		}
+	}
+	return
+}
+
+// remove the record(s) associated with the key; the removed record is returned as an object
+func (s *StructSqliteStore) RemoveByKey(key string) (response StructStoreResponse, valueRemoved StructStoreValue, err error) {
+	response = s.newStructStoreResponse(CodeSuccess, "", common.FileStatusAvailable)
+	err = s.checkDatabase()
+	if err != nil {
+		s.handleCommonErrorForResponse(&response, err)
+		return
+	}
+	isFound := true
+	err = s.pDatabase.write(func(tx *sql.Tx) (err error) {
+		rowIds, records, err := s.selectByKey(tx, key)
+		if err != nil {
+			return
+		}
+		if len(records) == 0 {
+			isFound = false
+			return errors.New(fmt.Sprintf("no record found for key [%v]", key))
+		}
+		for i, rowId := range rowIds {
+			_, err = tx.Exec(fmt.Sprintf("DELETE FROM %v WHERE _rowid_ = ?", quoteSqliteIdentifier(s.module)), rowId)
+			if err != nil {
+				return
+			}
+			valueRemoved = StructStoreValue{Key: key, Value: records[i], IsObject: true}
+		}
+		return
+	})
+	if err != nil {
+		valueRemoved = StructStoreValue{}
+		s.handleCommonErrorForResponse(&response, err)
+		if !isFound {
+			response.AdditionalCode = common.FileStatusNotAvailable
+		}
+	}
+	return
+}
+
+// remove all records of the store's symbol, be careful~
+func (s *StructSqliteStore) RemoveAll() (response StructStoreResponse, err error) {
+	response = s.newStructStoreResponse(CodeSuccess, "", common.FileStatusAvailable)
+	err = s.checkDatabase()
+	if err == nil {
+		err = s.pDatabase.write(func(tx *sql.Tx) (err error) {
+			where, args := s.buildWhere(s.symbol, time.Time{}, time.Time{})
+			_, err = tx.Exec(fmt.Sprintf("DELETE FROM %v%v", quoteSqliteIdentifier(s.module), where), args...)
+			return
+		})
+	}
+	if err != nil {
+		s.handleCommonErrorForResponse(&response, err)
+	}
+	return
+}
+
+// remove the records of the stock (empty means all stocks of the module) whose trx_date is before the given time
+func (s *StructSqliteStore) RemoveBefore(stockId string, before time.Time) (response StructStoreResponse, removed int, err error) {
+	response = s.newStructStoreResponse(CodeSuccess, "", common.FileStatusAvailable)
+	err = s.checkDatabase()
+	if err == nil {
+		err = s.pDatabase.write(func(tx *sql.Tx) (err error) {
+			where, args := s.buildWhere(stockId, time.Time{}, time.Time{})
+			condition := fmt.Sprintf("%v < ?", quoteSqliteIdentifier(StoreKeyTrxDate))
+			if util.IsEmptyString(where) {
+				where = " WHERE " + condition
+			} else {
+				where = where + " AND " + condition
+			}
+			args = append(args, before.UTC().Format(sqliteDateFormat))
+			result, err := tx.Exec(fmt.Sprintf("DELETE FROM %v%v", quoteSqliteIdentifier(s.module), where), args...)
+			if err != nil {
+				return
+			}
+			rowsAffected, err := result.RowsAffected()
+			removed = int(rowsAffected)
+			return
+		})
+	}
+	if err != nil {
+		removed = 0
+		s.handleCommonErrorForResponse(&response, err)
+	}
+	return
+}
+
+// set the natural key identifying a record and how Persist handles a record whose natural key already exists
+func (s *StructSqliteStore) SetNaturalKey(naturalKey StructNaturalKey) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.naturalKey = naturalKey
+}
+
+func (s *StructSqliteStore) getNaturalKey() StructNaturalKey {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.naturalKey
+}
+
+func (s *StructSqliteStore) checkDatabase() (err error) {
+	if s.pDatabase == nil {
+		err = errors.New(fmt.Sprintf("sqlite database [%v] is NOT available", s.path))
+	}
+	return
+}
+
+// build the where clause of the stock (empty means all) and the trx_date range (zero means unbounded)
+func (s *StructSqliteStore) buildWhere(stockId string, from, to time.Time) (where string, args []interface{}) {
+	conditions := make([]string, 0)
+	args = make([]interface{}, 0)
+	if !util.IsEmptyString(stockId) {
+		conditions = append(conditions, fmt.Sprintf("%v = ?", quoteSqliteIdentifier(StoreKeyStockId)))
+		args = append(args, stockId)
+	}
+	if !from.IsZero() {
+		conditions = append(conditions, fmt.Sprintf("%v >= ?", quoteSqliteIdentifier(StoreKeyTrxDate)))
+		args = append(args, from.UTC().Format(sqliteDateFormat))
+	}
+	if !to.IsZero() {
+		conditions = append(conditions, fmt.Sprintf("%v <= ?", quoteSqliteIdentifier(StoreKeyTrxDate)))
+		args = append(args, to.UTC().Format(sqliteDateFormat))
+	}
+	if len(conditions) > 0 {
+		where = " WHERE " + strings.Join(conditions, " AND ")
+	}
+	return
+}
+
+// select the records (and their row ids) of the key ({stock_id}|{trx_date})
+func (s *StructSqliteStore) selectByKey(querier iSqliteQuerier, key string) (rowIds []int64, records []map[string]StructStoreValue, err error) {
+	stockId, trxDate, err := ParseRecordKey(key)
+	if err != nil {
+		return
+	}
+	where, args := s.buildWhere(stockId, trxDate, trxDate)
+	rows, err := querier.Query(fmt.Sprintf("SELECT _rowid_, * FROM %v%v ORDER BY _rowid_", quoteSqliteIdentifier(s.module), where), args...)
+	if err != nil {
+		return
+	}
+	defer func() {
+		err2 := rows.Close()
+		if err == nil {
+			err = err2
+		}
+	}()
+	columnNames, err := rows.Columns()
+	if err != nil {
+		return
+	}
+	for rows.Next() {
+		rowId, record, err2 := s.pDatabase.scanRecord(s.module, rows, columnNames)
+		if err2 != nil {
+			err = err2
+			return
+		}
+		rowIds = append(rowIds, rowId)
+		records = append(records, record)
+	}
+	err = rows.Err()
+	return
+}
+
+func (s *StructSqliteStore) newIterator(statement string, args []interface{}, predicates []StoreRecordPredicate) (pIterator *structSqliteIterator, err error) {
+	rows, err := s.pDatabase.pDB.Query(statement, args...)
+	if err != nil {
+		return
+	}
+	columnNames, err := rows.Columns()
+	if err != nil {
+		_ = rows.Close()
+		return
+	}
+	pIterator = &structSqliteIterator{pStore: s, rows: rows, columnNames: columnNames, predicates: predicates}
+	return
+}
+
+func (s *StructSqliteStore) newStructStoreResponse(code int, message string, additionalCode int) (response StructStoreResponse) {
+	response.Code = code
+	response.Message = message
+	response.AdditionalCode = additionalCode
+	return
+}
+
+func (s *StructSqliteStore) handleCommonErrorForResponse(pResponseStruct *StructStoreResponse, err error) {
+	if pResponseStruct != nil && err != nil {
+		pResponseStruct.Code = CodeFailure
+		pResponseStruct.Message = err.Error()
+		pResponseStruct.AdditionalCode = common.FileStatusUnknown
+	}
+}
+
+// * ******************* *
+// * database and types  *
+// * ******************* *
+
+// Query is shared by *sql.DB and *sql.Tx
+type iSqliteQuerier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// the StructStoreValue type of a column
+type structSqliteColumn struct {
+	Type     int
+	IsArray  bool
+	IsObject bool
+}
+
+// a sqlite database file shared by the stores configured with the same path
+type structSqliteDatabase struct {
+	pDB *sql.DB
+	// sqlite allows 1 writer at a time; writes (and schema changes) of this process are serialized
+	writeLock sync.Mutex
+	// table => column => type; guarded by columnsLock
+	columns     map[string]map[string]structSqliteColumn
+	columnsLock sync.RWMutex
+}
+
+// opened databases by path
+var sqliteDatabases = make(map[string]*structSqliteDatabase)
+var sqliteDatabasesLock sync.Mutex
+
+// open (or return the already opened) database of the path; WAL journal mode lets readers run alongside the writer
+func openSqliteDatabase(path string, busyTimeout time.Duration) (pDatabase *structSqliteDatabase, err error) {
+	sqliteDatabasesLock.Lock()
+	defer sqliteDatabasesLock.Unlock()
+
+	pDatabase = sqliteDatabases[path]
+	if pDatabase != nil {
+		return
+	}
+	if !isSqliteDriverAvailable() {
+		err = errors.New(fmt.Sprintf("could not open sqlite database [%v] => the sqlite driver is not compiled in, build with -tags %v",
+			path, sqliteBuildTag))
+		return
+	}
+	dsn := fmt.Sprintf("file:%v?_pragma=busy_timeout(%v)&_pragma=journal_mode(wal)", path, busyTimeout.Nanoseconds()/int64(time.Millisecond))
+	pDB, err := sql.Open(sqliteDriverName, dsn)
+	if err == nil {
+		_, err = pDB.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %v (table_name TEXT NOT NULL, column_name TEXT NOT NULL, "+
+			"store_type INTEGER NOT NULL, is_array INTEGER NOT NULL, is_object INTEGER NOT NULL, PRIMARY KEY (table_name, column_name))",
+			sqliteColumnsTable))
+	}
+	if err != nil {
+		if pDB != nil {
+			_ = pDB.Close()
+		}
+		pDatabase = nil
+		err = errors.New(fmt.Sprintf("could not open sqlite database [%v] => %v", path, err))
+		return
+	}
+	pDatabase = &structSqliteDatabase{pDB: pDB, columns: make(map[string]map[string]structSqliteColumn)}
+	sqliteDatabases[path] = pDatabase
+	return
+}
+
+// is the sqlite driver compiled in (registered to database/sql)?
+func isSqliteDriverAvailable() bool {
+	for _, driverName := range sql.Drivers() {
+		if strings.Compare(driverName, sqliteDriverName) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// run fn within a transaction; committed if fn returns no error, otherwise rolled back
+func (d *structSqliteDatabase) write(fn func(tx *sql.Tx) error) (err error) {
+	d.writeLock.Lock()
+	defer d.writeLock.Unlock()
+
+	tx, err := d.pDB.Begin()
+	if err != nil {
+		return
+	}
+	err = fn(tx)
+	if err != nil {
+		_ = tx.Rollback()
+		return
+	}
+	err = tx.Commit()
+	return
+}
+
+// create the table of the module (with the stock_id and trx_date columns plus their indices) if not yet available
+func (d *structSqliteDatabase) ensureTable(table string) (err error) {
+	d.writeLock.Lock()
+	defer d.writeLock.Unlock()
+
+	quotedTable := quoteSqliteIdentifier(table)
+	statements := []string{
+		fmt.Sprintf("CREATE TABLE IF NOT EXISTS %v (%v TEXT NOT NULL, %v TEXT NOT NULL)", quotedTable,
+			quoteSqliteIdentifier(StoreKeyStockId), quoteSqliteIdentifier(StoreKeyTrxDate)),
+		fmt.Sprintf("CREATE INDEX IF NOT EXISTS %v ON %v (%v, %v)", quoteSqliteIdentifier("idx_"+table+"_stock_id_trx_date"),
+			quotedTable, quoteSqliteIdentifier(StoreKeyStockId), quoteSqliteIdentifier(StoreKeyTrxDate)),
+		fmt.Sprintf("CREATE INDEX IF NOT EXISTS %v ON %v (%v)", quoteSqliteIdentifier("idx_"+table+"_trx_date"),
+			quotedTable, quoteSqliteIdentifier(StoreKeyTrxDate)),
+		fmt.Sprintf("INSERT OR IGNORE INTO %v VALUES (?, ?, %v, 0, 0), (?, ?, %v, 0, 0)", sqliteColumnsTable, TypeString, TypeDate),
+	}
+	for i, statement := range statements {
+		if i == len(statements)-1 {
+			_, err = d.pDB.Exec(statement, table, StoreKeyStockId, table, StoreKeyTrxDate)
+		} else {
+			_, err = d.pDB.Exec(statement)
+		}
+		if err != nil {
+			return
+		}
+	}
+	err = d.loadColumns(table)
+	return
+}
+
+// (re)load the column types of the table
+func (d *structSqliteDatabase) loadColumns(table string) (err error) {
+	rows, err := d.pDB.Query(fmt.Sprintf("SELECT column_name, store_type, is_array, is_object FROM %v WHERE table_name = ?", sqliteColumnsTable), table)
+	if err != nil {
+		return
+	}
+	defer func() {
+		err2 := rows.Close()
+		if err == nil {
+			err = err2
+		}
+	}()
+	columns := make(map[string]structSqliteColumn)
+	for rows.Next() {
+		var name string
+		var column structSqliteColumn
+		err = rows.Scan(&name, &column.Type, &column.IsArray, &column.IsObject)
+		if err != nil {
+			return
+		}
+		columns[name] = column
+	}
+	err = rows.Err()
+	if err != nil {
+		return
+	}
+	d.columnsLock.Lock()
+	d.columns[table] = columns
+	d.columnsLock.Unlock()
+	return
+}
+
+func (d *structSqliteDatabase) getColumn(table, name string) (column structSqliteColumn, isAvailable bool) {
+	d.columnsLock.RLock()
+	defer d.columnsLock.RUnlock()
+	column, isAvailable = d.columns[table][name]
+	return
+}
+
+func (d *structSqliteDatabase) hasColumn(table, name string) bool {
+	_, isAvailable := d.getColumn(table, name)
+	return isAvailable
+}
+
+// add a typed column for every field of the record not yet available in the table
+func (d *structSqliteDatabase) ensureColumns(table string, record map[string]StructStoreValue) (err error) {
+	isReloaded := false
+	for fieldName, fieldValue := range record {
+		if d.hasColumn(table, fieldName) {
+			continue
+		}
+		d.writeLock.Lock()
+		if !isReloaded {
+			// the column might have been added by another process
+			err = d.loadColumns(table)
+			isReloaded = true
+		}
+		if err == nil && !d.hasColumn(table, fieldName) {
+			err = d.addColumn(table, fieldName, fieldValue)
+		}
+		d.writeLock.Unlock()
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// add the column (MUST be called under the write lock)
+func (d *structSqliteDatabase) addColumn(table, name string, value StructStoreValue) (err error) {
+	column := structSqliteColumn{Type: value.Type, IsArray: value.IsArray, IsObject: value.IsObject}
+	tx, err := d.pDB.Begin()
+	if err != nil {
+		return
+	}
+	_, err = tx.Exec(fmt.Sprintf("ALTER TABLE %v ADD COLUMN %v %v", quoteSqliteIdentifier(table), quoteSqliteIdentifier(name), getSqliteColumnType(column)))
+	if err == nil {
+		_, err = tx.Exec(fmt.Sprintf("INSERT OR REPLACE INTO %v VALUES (?, ?, ?, ?, ?)", sqliteColumnsTable),
+			table, name, column.Type, column.IsArray, column.IsObject)
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		err = errors.New(fmt.Sprintf("could not add column [%v] to table [%v] => %v", name, table, err))
+		return
+	}
+	err = tx.Commit()
+	if err == nil {
+		d.columnsLock.Lock()
+		d.columns[table][name] = column
+		d.columnsLock.Unlock()
+	}
+	return
+}
+
+// scan the current row (_rowid_ followed by the columns) into a record; NULL columns are left out
+func (d *structSqliteDatabase) scanRecord(table string, rows *sql.Rows, columnNames []string) (rowId int64, record map[string]StructStoreValue, err error) {
+	rawValues := make([]interface{}, len(columnNames))
+	pointers := make([]interface{}, len(columnNames))
+	for i := range rawValues {
+		pointers[i] = &rawValues[i]
+	}
+	pointers[0] = &rowId
+	err = rows.Scan(pointers...)
+	if err != nil {
+		return
+	}
+	record = make(map[string]StructStoreValue)
+	for i := 1; i < len(columnNames); i++ {
+		column, isAvailable := d.getColumn(table, columnNames[i])
+		if !isAvailable {
+			column.Type = TypeString
+		}
+		value, isAvailable, err2 := fromSqliteValue(rawValues[i], column)
+		if err2 != nil {
+			err = errors.New(fmt.Sprintf("column [%v] => %v", columnNames[i], err2))
+			return
+		}
+		if isAvailable {
+			record[columnNames[i]] = value
+		}
+	}
+	return
+}
+
+// sqlite column type of the StructStoreValue type; arrays and objects are kept as json text, so are
+// decimals kept as text (e.g. 330.000) as REAL is not exact
+func getSqliteColumnType(column structSqliteColumn) string {
+	switch {
+	case column.IsArray || column.IsObject:
+		return "TEXT"
+	case column.Type == TypeInteger || column.Type == TypeBool:
+		return "INTEGER"
+	case column.Type == TypeFloat:
+		return "REAL"
+	}
+	return "TEXT"
+}
+
+// convert the StructStoreValue into a sqlite value
+func toSqliteValue(storeValue StructStoreValue) (value interface{}, err error) {
+	if isNilValue(storeValue.Value) {
+		return
+	}
+	if storeValue.IsArray || storeValue.IsObject {
+		var bValue bytes.Buffer
+		err = encodeStoreValue(&bValue, storeValue)
+		value = bValue.String()
+		return
+	}
+	switch storeValue.Type {
+	case TypeInteger:
+		iValue, isInteger := toInt64(storeValue.Value)
+		if !isInteger {
+			err = errors.New(fmt.Sprintf("invalid integer value => %v", storeValue.Value))
+		}
+		value = iValue
+	case TypeFloat:
+		fValue, isFloat := toFloat64(storeValue.Value)
+		switch {
+		case !isFloat:
+			err = errors.New(fmt.Sprintf("invalid float value => %v", storeValue.Value))
+		case math.IsInf(fValue, 0):
+			err = errors.New(fmt.Sprintf("infinite float value is not supported => %v", fValue))
+		case !math.IsNaN(fValue):
+			// NaN is kept as NULL
+			value = fValue
+		}
+	case TypeBool:
+		bValue, isBool := storeValue.Value.(bool)
+		if !isBool {
+			err = errors.New(fmt.Sprintf("invalid bool value => %v", storeValue.Value))
+		} else if bValue {
+			value = 1
+		} else {
+			value = 0
+		}
+	case TypeDate:
+		dValue, isDate := toStoreDate(storeValue.Value)
+		if !isDate {
+			err = errors.New(fmt.Sprintf("invalid date value => %v", storeValue.Value))
+		}
+		value = dValue.UTC().Format(sqliteDateFormat)
+	case TypeDecimal:
+		dValue, isDecimal := toDecimal(storeValue.Value)
+		if !isDecimal {
+			err = errors.New(fmt.Sprintf("invalid decimal value => %v", storeValue.Value))
+		}
+		value = dValue.String()
+	default:
+		value = fmt.Sprintf("%v", storeValue.Value)
+	}
+	return
+}
+
+// convert the sqlite value back into a StructStoreValue of the column's type; isAvailable is false for NULL
+func fromSqliteValue(rawValue interface{}, column structSqliteColumn) (storeValue StructStoreValue, isAvailable bool, err error) {
+	if bValue, isBytes := rawValue.([]byte); isBytes {
+		rawValue = string(bValue)
+	}
+	if rawValue == nil {
+		return
+	}
+	isAvailable = true
+	if column.IsArray || column.IsObject {
+		decoder := json.NewDecoder(strings.NewReader(fmt.Sprintf("%v", rawValue)))
+		decoder.UseNumber()
+		var jsonValue interface{}
+		err = decoder.Decode(&jsonValue)
+		if err == nil {
+			storeValue, err = decodeStoreValue(jsonValue)
+		}
+		return
+	}
+	storeValue.Type = column.Type
+	switch v := rawValue.(type) {
+	case int64:
+		switch column.Type {
+		case TypeBool:
+			storeValue.Value = v != 0
+		case TypeFloat:
+			storeValue.Value = float64(v)
+		default:
+			storeValue.Type = TypeInteger
+			storeValue.Value = int(v)
+		}
+	case float64:
+		storeValue.Type = TypeFloat
+		storeValue.Value = v
+	case string:
+		storeValue.Type = TypeString
+		storeValue.Value = v
+		switch column.Type {
+		case TypeDate:
+			if dValue, err2 := time.Parse(sqliteDateFormat, v); err2 == nil {
+				storeValue.Type = TypeDate
+				storeValue.Value = dValue
+			}
+		case TypeDecimal:
+			if dValue, err2 := ParseDecimal(v); err2 == nil {
+				storeValue.Type = TypeDecimal
+				storeValue.Value = dValue
+			}
+		}
+	case time.Time:
+		storeValue.Type = TypeDate
+		storeValue.Value = v.UTC()
+	default:
+		storeValue.Type = TypeString
+		storeValue.Value = fmt.Sprintf("%v", v)
+	}
+	return
+}
+
+// quote a table / column name (e.g. a field named "order" or containing spaces)
+func quoteSqliteIdentifier(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
+
+// * ********* *
+// * iterator  *
+// * ********* *
+
+// iterator over the rows of a select statement
+type structSqliteIterator struct {
+	pStore      *StructSqliteStore
+	rows        *sql.Rows
+	columnNames []string
+	predicates  []StoreRecordPredicate
+
+	record   StructStoreValue
+	err      error
+	isClosed bool
+}
+
+func (i *structSqliteIterator) Next() bool {
+	i.record = StructStoreValue{}
+	if i.isClosed || i.err != nil {
+		return false
+	}
+	for i.rows.Next() {
+		_, record, err := i.pStore.pDatabase.scanRecord(i.pStore.module, i.rows, i.columnNames)
+		if err != nil {
+			i.err = err
+			return false
+		}
+		if IsRecordMatchingPredicates(record, i.predicates) {
+			i.record = NewRecordStoreValue(record)
+			return true
+		}
+	}
+	i.err = i.rows.Err()
+	return false
+}
+
+func (i *structSqliteIterator) Record() StructStoreValue {
+	return i.record
+}
+
+func (i *structSqliteIterator) Err() error {
+	return i.err
+}
+
+func (i *structSqliteIterator) Close() error {
+	if i.isClosed {
+		return nil
+	}
+	i.isClosed = true
+	return i.rows.Close()
+}
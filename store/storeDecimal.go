@@ -0,0 +1,237 @@
+/*
+ *  Copyright Project - Stockbinator, Author - quoeamaster, (C) 2019
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+package store
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// an exact decimal number (e.g. a price of 330.000); the value is unscaled / 10^scale.
+// The scale is kept as given, hence "330.000" is formatted back as "330.000" (NOT 330).
+// A StructDecimal is immutable; all the arithmetic returns a new StructDecimal. The zero value is 0
+type StructDecimal struct {
+	// nil means 0
+	unscaled *big.Int
+	// number of digits after the decimal point
+	scale int
+}
+
+// syntax accepted by ParseDecimal
+var regexpDecimal = regexp.MustCompile(`^[+-]?[0-9]+(\.[0-9]+)?$`)
+
+// parse the decimal string (e.g. "330.000", "-1.5", "+20"); exponents are not accepted
+func ParseDecimal(value string) (decimal StructDecimal, err error) {
+	sValue := strings.TrimSpace(value)
+	if !regexpDecimal.MatchString(sValue) {
+		err = errors.New(fmt.Sprintf("invalid decimal [%v]", value))
+		return
+	}
+	isNegative := strings.HasPrefix(sValue, "-")
+	parts := strings.Split(strings.TrimLeft(sValue, "+-"), ".")
+	digits := parts[0]
+	if len(parts) == 2 {
+		digits = digits + parts[1]
+		decimal.scale = len(parts[1])
+	}
+	decimal.unscaled, _ = new(big.Int).SetString(digits, 10)
+	if isNegative {
+		decimal.unscaled.Neg(decimal.unscaled)
+	}
+	return
+}
+
+// create a decimal of the integer (scale 0)
+func NewDecimalFromInt(value int64) StructDecimal {
+	return StructDecimal{ unscaled: big.NewInt(value) }
+}
+
+// create a decimal of the float's shortest representation (e.g. 0.1 => 0.1, NOT 0.1000000000000000055...);
+// NaN and Inf are invalid
+func NewDecimalFromFloat(value float64) (decimal StructDecimal, err error) {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		err = errors.New(fmt.Sprintf("invalid decimal [%v]", value))
+		return
+	}
+	return ParseDecimal(strconv.FormatFloat(value, 'f', -1, 64))
+}
+
+func (d StructDecimal) getUnscaled() *big.Int {
+	if d.unscaled == nil {
+		return new(big.Int)
+	}
+	return d.unscaled
+}
+
+// number of digits after the decimal point
+func (d StructDecimal) Scale() int {
+	return d.scale
+}
+
+// -1, 0 or +1 for a negative, zero or positive decimal
+func (d StructDecimal) Sign() int {
+	return d.getUnscaled().Sign()
+}
+
+// the decimal with the digits after the decimal point (e.g. 330.000, -0.50)
+func (d StructDecimal) String() string {
+	unscaled := d.getUnscaled()
+	digits := new(big.Int).Abs(unscaled).String()
+	if d.scale > 0 {
+		if len(digits) <= d.scale {
+			digits = strings.Repeat("0", d.scale-len(digits)+1) + digits
+		}
+		digits = digits[:len(digits)-d.scale] + "." + digits[len(digits)-d.scale:]
+	}
+	if unscaled.Sign() < 0 {
+		digits = "-" + digits
+	}
+	return digits
+}
+
+// the nearest float64; for display or statistics ONLY as the exactness is lost
+func (d StructDecimal) Float64() float64 {
+	fValue, _ := strconv.ParseFloat(d.String(), 64)
+	return fValue
+}
+
+// return both decimals' unscaled values at the larger scale of the two
+func alignDecimals(d, other StructDecimal) (unscaled, otherUnscaled *big.Int, scale int) {
+	scale = d.scale
+	if other.scale > scale {
+		scale = other.scale
+	}
+	return d.rescaleUnscaled(scale), other.rescaleUnscaled(scale), scale
+}
+
+// unscaled value at a scale larger than (or equal to) the decimal's scale
+func (d StructDecimal) rescaleUnscaled(scale int) *big.Int {
+	factor := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(scale-d.scale)), nil)
+	return new(big.Int).Mul(d.getUnscaled(), factor)
+}
+
+// d + other; the scale is the larger of the two
+func (d StructDecimal) Add(other StructDecimal) StructDecimal {
+	unscaled, otherUnscaled, scale := alignDecimals(d, other)
+	return StructDecimal{ unscaled: unscaled.Add(unscaled, otherUnscaled), scale: scale }
+}
+
+// d - other; the scale is the larger of the two
+func (d StructDecimal) Sub(other StructDecimal) StructDecimal {
+	unscaled, otherUnscaled, scale := alignDecimals(d, other)
+	return StructDecimal{ unscaled: unscaled.Sub(unscaled, otherUnscaled), scale: scale }
+}
+
+// d * other; the scale is the sum of the two (e.g. 1.50 * 2.5 = 3.750)
+func (d StructDecimal) Mul(other StructDecimal) StructDecimal {
+	return StructDecimal{ unscaled: new(big.Int).Mul(d.getUnscaled(), other.getUnscaled()), scale: d.scale + other.scale }
+}
+
+// d / other rounded (half away from zero) to the given scale; dividing by zero is invalid
+func (d StructDecimal) Div(other StructDecimal, scale int) (result StructDecimal, err error) {
+	if other.Sign() == 0 {
+		err = errors.New(fmt.Sprintf("division of %v by zero", d))
+		return
+	}
+	if scale < 0 {
+		scale = 0
+	}
+	// d / other = (d.unscaled * 10^(scale + other.scale - d.scale)) / other.unscaled, at the given scale;
+	// 1 more digit is kept for the rounding
+	exponent := scale + 1 + other.scale - d.scale
+	numerator := new(big.Int).Set(d.getUnscaled())
+	denominator := new(big.Int).Set(other.getUnscaled())
+	if exponent >= 0 {
+		numerator.Mul(numerator, new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(exponent)), nil))
+	} else {
+		denominator.Mul(denominator, new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(-exponent)), nil))
+	}
+	quotient := new(big.Int).Quo(numerator, denominator)
+	result = StructDecimal{ unscaled: quotient, scale: scale + 1 }.Round(scale)
+	return
+}
+
+// the decimal rounded (half away from zero) to the given scale, e.g. 1.005 => 1.01 (scale 2);
+// a larger scale pads zeros (e.g. 1.5 => 1.500 with scale 3)
+func (d StructDecimal) Round(scale int) StructDecimal {
+	if scale < 0 {
+		scale = 0
+	}
+	if scale >= d.scale {
+		return StructDecimal{ unscaled: d.rescaleUnscaled(scale), scale: scale }
+	}
+	factor := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(d.scale-scale)), nil)
+	quotient, remainder := new(big.Int).QuoRem(d.getUnscaled(), factor, new(big.Int))
+	// |remainder| * 2 >= factor => away from zero
+	if new(big.Int).Mul(new(big.Int).Abs(remainder), big.NewInt(2)).Cmp(factor) >= 0 {
+		quotient.Add(quotient, big.NewInt(int64(d.getUnscaled().Sign())))
+	}
+	return StructDecimal{ unscaled: quotient, scale: scale }
+}
+
+// -1, 0 or +1 for d < other, d == other (regardless of the scales, 1.50 == 1.5) or d > other
+func (d StructDecimal) Cmp(other StructDecimal) int {
+	unscaled, otherUnscaled, _ := alignDecimals(d, other)
+	return unscaled.Cmp(otherUnscaled)
+}
+
+// the decimal as a json number keeping its scale (e.g. 330.000)
+func (d StructDecimal) MarshalJSON() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// accepts a json number or string (e.g. 330.000 or "330.000")
+func (d *StructDecimal) UnmarshalJSON(data []byte) (err error) {
+	decimal, err := ParseDecimal(strings.Trim(string(data), `"`))
+	if err == nil {
+		*d = decimal
+	}
+	return
+}
+
+// return the value as a decimal; accepting StructDecimal (or its pointer), decimal strings, integers and
+// finite floats (their shortest representation)
+func toDecimal(value interface{}) (decimal StructDecimal, isDecimal bool) {
+	switch v := value.(type) {
+	case StructDecimal:
+		return v, true
+	case *StructDecimal:
+		if v != nil {
+			return *v, true
+		}
+		return
+	case string:
+		decimal, err := ParseDecimal(v)
+		return decimal, err == nil
+	}
+	reflectValue := reflect.ValueOf(value)
+	switch reflectValue.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return NewDecimalFromInt(reflectValue.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return StructDecimal{ unscaled: new(big.Int).SetUint64(reflectValue.Uint()) }, true
+	case reflect.Float32, reflect.Float64:
+		decimal, err := NewDecimalFromFloat(reflectValue.Float())
+		return decimal, err == nil
+	}
+	return
+}
@@ -0,0 +1,138 @@
+/*
+ *  Copyright Project - Stockbinator, Author - quoeamaster, (C) 2019
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+package store
+
+import (
+	"Stockbinator/util"
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// write the records of the iterator as csv (1 header row + 1 row per record). The columns are the fields of
+// the schema in the order declared with the units in the header (e.g. "price (HKD)"); without a schema the
+// columns are the fields of the first record (identity fields first) and fields of later records not
+// available in the first one are left out. Dates are written in util.CommonDateFormat, decimals with their scale
+// (e.g. 330.000), arrays and objects as json
+func ExportRecordsAsCsv(pWriter io.Writer, iterator IStoreIterator, pSchema *StructStoreSchema) (count int, err error) {
+	pCsvWriter := csv.NewWriter(pWriter)
+	var columns []string
+	for iterator.Next() {
+		record, isObject := iterator.Record().Value.(map[string]StructStoreValue)
+		if !isObject {
+			continue
+		}
+		if columns == nil {
+			columns = getExportColumns(record, pSchema)
+			err = pCsvWriter.Write(getExportHeader(columns, pSchema))
+			if err != nil {
+				return
+			}
+		}
+		row := make([]string, len(columns))
+		for i, column := range columns {
+			row[i], err = formatExportValue(record[column])
+			if err != nil {
+				err = errors.New(fmt.Sprintf("record %v, field [%v] => %v", count+1, column, err))
+				return
+			}
+		}
+		err = pCsvWriter.Write(row)
+		if err != nil {
+			return
+		}
+		count++
+	}
+	err = iterator.Err()
+	if err != nil {
+		return
+	}
+	// no records; the header is still written if the columns are known
+	if columns == nil && pSchema != nil {
+		columns = pSchema.GetFieldNames()
+		err = pCsvWriter.Write(getExportHeader(columns, pSchema))
+		if err != nil {
+			return
+		}
+	}
+	pCsvWriter.Flush()
+	err = pCsvWriter.Error()
+	return
+}
+
+func getExportColumns(record map[string]StructStoreValue, pSchema *StructStoreSchema) (columns []string) {
+	if pSchema != nil {
+		return pSchema.GetFieldNames()
+	}
+	columns = []string{ StoreKeyStockId, StoreKeyTrxDate }
+	otherColumns := make([]string, 0, len(record))
+	for fieldName := range record {
+		if strings.Compare(fieldName, StoreKeyStockId) != 0 && strings.Compare(fieldName, StoreKeyTrxDate) != 0 {
+			otherColumns = append(otherColumns, fieldName)
+		}
+	}
+	sort.Strings(otherColumns)
+	columns = append(columns, otherColumns...)
+	return
+}
+
+func getExportHeader(columns []string, pSchema *StructStoreSchema) (header []string) {
+	header = make([]string, len(columns))
+	for i, column := range columns {
+		header[i] = column
+		if field, found := pSchema.GetField(column); found && !util.IsEmptyString(field.Unit) {
+			header[i] = fmt.Sprintf("%v (%v)", column, field.Unit)
+		}
+	}
+	return
+}
+
+// format the value as a csv cell; missing / null values are empty cells
+func formatExportValue(value StructStoreValue) (cell string, err error) {
+	if isNilValue(value.Value) {
+		return
+	}
+	if value.IsArray || value.IsObject {
+		var bContent bytes.Buffer
+		err = encodeStoreValue(&bContent, value)
+		cell = bContent.String()
+		return
+	}
+	switch value.Type {
+	case TypeDate:
+		if date, isDate := toStoreDate(value.Value); isDate {
+			cell = date.Format(util.CommonDateFormat)
+			return
+		}
+	case TypeDecimal:
+		if dValue, isDecimal := toDecimal(value.Value); isDecimal {
+			cell = dValue.String()
+			return
+		}
+	case TypeFloat:
+		if fValue, isFloat := toFloat64(value.Value); isFloat {
+			cell = strconv.FormatFloat(fValue, 'f', -1, 64)
+			return
+		}
+	}
+	cell = fmt.Sprintf("%v", value.Value)
+	return
+}
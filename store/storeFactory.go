@@ -17,14 +17,19 @@ package store
 
 import (
 	"Stockbinator/common"
+	"Stockbinator/util"
 	"errors"
 	"fmt"
 	"github.com/micro/go-config"
+	"sort"
 	"strings"
+	"sync"
 )
 
 // internal storage (map) for the store implementation(s)
 var storeCache map[string]IStore
+// lock guarding the store cache; the cron jobs and the spool retries resolve stores concurrently
+var storeCacheLock sync.Mutex
 
 // get store implementation by key (e.g. filestore);
 // if the store instance is not available, try its best to create the store
@@ -32,17 +37,29 @@ var storeCache map[string]IStore
 // Parameter config is the config read from app.toml
 // Optional parameter params which is a map of object(s)
 func GetStoreByKey(key string, config config.Config, params... map[string]interface{}) (store IStore, err error)  {
+	storeCacheLock.Lock()
+	defer storeCacheLock.Unlock()
+	return getStoreByKey(key, config, params...)
+}
+
+// non thread-safe version of GetStoreByKey; the caller MUST hold the storeCacheLock
+func getStoreByKey(key string, config config.Config, params... map[string]interface{}) (store IStore, err error)  {
 	// TODO singleton??? thunder herd should not happen normally
 	// https://news.ycombinator.com/item?id=1722213
 	if storeCache == nil {
 		storeCache = make(map[string]IStore)
 	}
-	// key MUST be... starting with either "filestore.x.y" or "datastore.x.y"
+	// key MUST be... starting with either "filestore.x.y", "datastore.x.y", "sqlitestore.x.y", "boltstore.x.y",
+	// "influxstore.x.y" or "memorystore.x.y"
 	store = storeCache[key]
 	if store == nil {
 		// try to create store that are recognizable
 		isFilestore := strings.Index(key, common.ConfigKeyStoreFile) == 0
 		isDatastore := strings.Index(key, common.ConfigKeyStoreData) == 0
+		isSqlitestore := strings.Index(key, common.ConfigKeyStoreSqlite) == 0
+		isBoltstore := strings.Index(key, common.ConfigKeyStoreBolt) == 0
+		isInfluxstore := strings.Index(key, common.ConfigKeyStoreInflux) == 0
+		isMemorystore := strings.Index(key, common.ConfigKeyStoreMemory) == 0
 
 		if isFilestore {
 			filename := common.StoreDefaultDateFilename
@@ -57,11 +74,95 @@ func GetStoreByKey(key string, config config.Config, params... map[string]interf
 			store = NewStructFilestore(config, filename)
 			storeCache[key] = store
 		} else if isDatastore {
-			// TODO: add other store(s) like datastore
+			// datastore.{stock_module}.{symbol}; the implementation is picked by [datastore] type
+			name := key[len(common.ConfigKeyStoreData)+1:]
+			dataType := common.StoreDataTypeElasticsearch
+			if config != nil {
+				dataType = config.Get(common.ConfigKeyStoreData, common.ConfigKeyStoreDataType).String(dataType)
+			}
+			switch strings.ToLower(dataType) {
+			case common.StoreDataTypeElasticsearch:
+				store = NewStructElasticsearchStore(config, name)
+				storeCache[key] = store
+			default:
+				store = nil
+				err = errors.New(fmt.Sprintf("unknown datastore type [%v] => %v", dataType, key))
+			}
+		} else if isSqlitestore {
+			// sqlitestore.{stock_module}.{symbol}
+			store = NewStructSqliteStore(config, key[len(common.ConfigKeyStoreSqlite)+1:])
+			storeCache[key] = store
+		} else if isBoltstore {
+			// boltstore.{stock_module}.{symbol}
+			store = NewStructBoltStore(config, key[len(common.ConfigKeyStoreBolt)+1:])
+			storeCache[key] = store
+		} else if isInfluxstore {
+			// influxstore.{stock_module}.{symbol}
+			store = NewStructInfluxStore(config, key[len(common.ConfigKeyStoreInflux)+1:])
+			storeCache[key] = store
+		} else if isMemorystore {
+			// memorystore.{stock_module}.{symbol}; a read-through cache if [memorystore] backing is configured
+			name := key[len(common.ConfigKeyStoreMemory)+1:]
+			pMemoryStore := NewStructMemoryStore(config, name)
+			backing := ""
+			if config != nil {
+				backing = config.Get(common.ConfigKeyStoreMemory, common.ConfigKeyStoreMemoryBacking).String("")
+			}
+			if strings.Compare(backing, common.ConfigKeyStoreMemory) == 0 {
+				err = errors.New(fmt.Sprintf("memorystore could not be backed by another memorystore => %v", key))
+				return
+			}
+			if !util.IsEmptyString(backing) {
+				backingStore, err2 := getStoreByKey(fmt.Sprintf("%v.%v", backing, name), config, params...)
+				if err2 != nil {
+					err = err2
+					return
+				}
+				pMemoryStore.SetBackingStore(backingStore)
+			}
+			store = pMemoryStore
+			storeCache[key] = store
 		} else {
 			store = nil
 			err = errors.New(fmt.Sprintf("unknown Store type => %v", key))
 		}
 	} // end -- if (store is nil, create one if recognized)
 	return
-}
\ No newline at end of file
+}
+
+// return a snapshot of the stores created so far (store key -> store), e.g. for reporting their statistics
+func GetCachedStores() (stores map[string]IStore) {
+	storeCacheLock.Lock()
+	defer storeCacheLock.Unlock()
+	stores = make(map[string]IStore, len(storeCache))
+	for key, iStore := range storeCache {
+		stores[key] = iStore
+	}
+	return
+}
+
+// stop the background work of the stores created so far and write what is still pending (e.g. the pending
+// lines of the influx stores); called on shutdown
+func CloseCachedStores() (err error) {
+	stores := GetCachedStores()
+	storeKeys := make([]string, 0, len(stores))
+	for storeKey := range stores {
+		storeKeys = append(storeKeys, storeKey)
+	}
+	sort.Strings(storeKeys)
+	messages := make([]string, 0)
+	for _, storeKey := range storeKeys {
+		switch pStore := stores[storeKey].(type) {
+		case *StructInfluxStore:
+			if err2 := pStore.Close(); err2 != nil {
+				messages = append(messages, fmt.Sprintf("%v => %v", storeKey, err2))
+			}
+		case *StructFilestore:
+			pStore.StopCompression()
+		}
+	}
+	if len(messages) > 0 {
+		err = errors.New(fmt.Sprintf("could not close the stores => %v", strings.Join(messages, "; ")))
+	}
+	return
+}
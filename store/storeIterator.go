@@ -0,0 +1,85 @@
+/*
+ *  Copyright Project - Stockbinator, Author - quoeamaster, (C) 2019
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+package store
+
+import (
+	"fmt"
+	"time"
+)
+
+// predicate on a record; ONLY records returning true are returned by an iterator
+type StoreRecordPredicate func(record map[string]StructStoreValue) bool
+
+// cursor over the records of a store; records are decoded one at a time, hence memory usage is
+// bounded by the size of a single record regardless of the size of the store.
+//
+// usage:
+//	response, iterator, err := iStore.Iterate(PredicateByStockId("700_tencent"))
+//	defer iterator.Close()
+//	for iterator.Next() {
+//		record := iterator.Record()
+//	}
+//	err = iterator.Err()
+type IStoreIterator interface {
+	// move to the next matching record; false when there are no more records or an error occurred (check Err)
+	Next() bool
+	// the current record as an object (map[string]StructStoreValue) keyed by BuildRecordKey
+	Record() StructStoreValue
+	// the error occurred during iteration (if any)
+	Err() error
+	// release the resources held by the iterator
+	Close() error
+}
+
+// predicate matching the records of the given stock
+func PredicateByStockId(stockId string) StoreRecordPredicate {
+	return func(record map[string]StructStoreValue) bool {
+		return isStoreValueEqual(record[StoreKeyStockId].Value, stockId)
+	}
+}
+
+// predicate matching the records whose trx_date falls within [from, to]; a zero from or to means unbounded
+func PredicateByTrxDateRange(from, to time.Time) StoreRecordPredicate {
+	return func(record map[string]StructStoreValue) bool {
+		return IsRecordInQueryRange(record, "", from, to)
+	}
+}
+
+// predicate matching the records with all the given fields matching (see IsRecordMatchingFilters)
+func PredicateByFilters(filters map[string]interface{}) StoreRecordPredicate {
+	return func(record map[string]StructStoreValue) bool {
+		return IsRecordMatchingFilters(record, filters)
+	}
+}
+
+// check whether the record matches all the predicates (nil predicates are ignored)
+func IsRecordMatchingPredicates(record map[string]StructStoreValue, predicates []StoreRecordPredicate) bool {
+	for _, predicate := range predicates {
+		if predicate != nil && !predicate(record) {
+			return false
+		}
+	}
+	return true
+}
+
+// wrap the record as an object store-value keyed by BuildRecordKey
+func NewRecordStoreValue(record map[string]StructStoreValue) (value StructStoreValue) {
+	trxDate, _ := toStoreDate(record[StoreKeyTrxDate].Value)
+	value.Key = BuildRecordKey(fmt.Sprintf("%v", record[StoreKeyStockId].Value), trxDate)
+	value.Value = record
+	value.IsObject = true
+	return
+}
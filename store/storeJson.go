@@ -0,0 +1,370 @@
+/*
+ *  Copyright Project - Stockbinator, Author - quoeamaster, (C) 2019
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+package store
+
+import (
+	"Stockbinator/util"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// key of the json object holding a decimal (see EncodeStoreRecord)
+const storeJsonDecimalKey = "$decimal"
+
+// encode the record into a json object (1 line, no line feed); fields are sorted by name.
+// Encoding rules per StructStoreValue:
+// a. nil Value => null
+// b. IsArray => json array; Value could be []StructStoreValue or a slice of values of the given Type
+// c. IsObject => json object; Value could be map[string]StructStoreValue or map[string]interface{}
+// d. TypeFloat => number always with a decimal point or exponent (hence decoded back as TypeFloat);
+//    NaN is encoded as null whilst +Inf / -Inf are invalid
+// e. TypeDate => string in util.CommonDateFormat; Value could be time.Time or a string in that format
+// f. TypeDecimal => object of the decimal string keeping the scale (e.g. {"$decimal":"330.000"}) as json
+//    numbers are decoded as float64 and plain strings stay strings; Value could be StructDecimal,
+//    a decimal string, an integer or a float
+func EncodeStoreRecord(record map[string]StructStoreValue) (jsonValue string, err error) {
+	var bContent bytes.Buffer
+	err = encodeStoreObject(&bContent, record)
+	if err != nil {
+		return
+	}
+	jsonValue = bContent.String()
+	return
+}
+
+// decode a json object (encoded by EncodeStoreRecord) back into a record.
+// Decoding rules: integers => TypeInteger (int), other numbers => TypeFloat (float64),
+// strings in util.CommonDateFormat => TypeDate (time.Time), other strings => TypeString,
+// decimal objects (e.g. {"$decimal":"330.000"}) => TypeDecimal (StructDecimal),
+// arrays => IsArray ([]StructStoreValue), objects => IsObject (map[string]StructStoreValue), null => nil Value
+func DecodeStoreRecord(jsonValue string) (record map[string]StructStoreValue, err error) {
+	decoder := json.NewDecoder(strings.NewReader(jsonValue))
+	decoder.UseNumber()
+	rawMap := make(map[string]interface{})
+	err = decoder.Decode(&rawMap)
+	if err != nil {
+		return
+	}
+	value, err := decodeStoreValue(rawMap)
+	if err != nil {
+		return
+	}
+	record = value.Value.(map[string]StructStoreValue)
+	return
+}
+
+func encodeStoreObject(pBuffer *bytes.Buffer, fieldMap map[string]StructStoreValue) (err error) {
+	// the StructStoreValue's Key overrides the map key
+	finalMap := make(map[string]StructStoreValue)
+	for fieldName, storeValue := range fieldMap {
+		if !util.IsEmptyString(storeValue.Key) {
+			fieldName = storeValue.Key
+		}
+		finalMap[fieldName] = storeValue
+	}
+	fieldNames := make([]string, 0, len(finalMap))
+	for fieldName := range finalMap {
+		fieldNames = append(fieldNames, fieldName)
+	}
+	sort.Strings(fieldNames)
+
+	pBuffer.WriteString("{")
+	for i, fieldName := range fieldNames {
+		if i > 0 {
+			pBuffer.WriteString(",")
+		}
+		encodeJsonString(pBuffer, fieldName)
+		pBuffer.WriteString(":")
+		err = encodeStoreValue(pBuffer, finalMap[fieldName])
+		if err != nil {
+			err = errors.New(fmt.Sprintf("field [%v] => %v", fieldName, err))
+			return
+		}
+	}
+	pBuffer.WriteString("}")
+	return
+}
+
+func encodeStoreValue(pBuffer *bytes.Buffer, storeValue StructStoreValue) (err error) {
+	if isNilValue(storeValue.Value) {
+		pBuffer.WriteString("null")
+		return
+	}
+	if storeValue.IsArray {
+		return encodeStoreArray(pBuffer, storeValue)
+	}
+	if storeValue.IsObject {
+		switch v := storeValue.Value.(type) {
+		case map[string]StructStoreValue:
+			return encodeStoreObject(pBuffer, v)
+		case map[string]interface{}:
+			fieldMap := make(map[string]StructStoreValue)
+			for fieldName, fieldValue := range v {
+				fieldMap[fieldName] = guessStoreValue(fieldValue)
+			}
+			return encodeStoreObject(pBuffer, fieldMap)
+		default:
+			return errors.New(fmt.Sprintf("object value must be a map[string]StructStoreValue or map[string]interface{} BUT got %T", storeValue.Value))
+		}
+	}
+	return encodeStoreScalar(pBuffer, storeValue.Value, storeValue.Type)
+}
+
+func encodeStoreArray(pBuffer *bytes.Buffer, storeValue StructStoreValue) (err error) {
+	elements := make([]StructStoreValue, 0)
+	switch v := storeValue.Value.(type) {
+	case []StructStoreValue:
+		elements = v
+	default:
+		reflectValue := reflect.ValueOf(storeValue.Value)
+		if reflectValue.Kind() != reflect.Slice && reflectValue.Kind() != reflect.Array {
+			return errors.New(fmt.Sprintf("array value must be a slice BUT got %T", storeValue.Value))
+		}
+		for i := 0; i < reflectValue.Len(); i++ {
+			element := reflectValue.Index(i).Interface()
+			if _, isGeneric := storeValue.Value.([]interface{}); isGeneric {
+				elements = append(elements, guessStoreValue(element))
+			} else {
+				elements = append(elements, StructStoreValue{Value: element, Type: storeValue.Type})
+			}
+		}
+	}
+	pBuffer.WriteString("[")
+	for i, element := range elements {
+		if i > 0 {
+			pBuffer.WriteString(",")
+		}
+		err = encodeStoreValue(pBuffer, element)
+		if err != nil {
+			err = errors.New(fmt.Sprintf("index [%v] => %v", i, err))
+			return
+		}
+	}
+	pBuffer.WriteString("]")
+	return
+}
+
+func encodeStoreScalar(pBuffer *bytes.Buffer, value interface{}, valueType int) (err error) {
+	switch valueType {
+	case TypeString:
+		sValue, isString := value.(string)
+		if !isString {
+			return errors.New(fmt.Sprintf("expected a string BUT got %T", value))
+		}
+		encodeJsonString(pBuffer, sValue)
+	case TypeInteger:
+		iValue, isInteger := toInt64(value)
+		if !isInteger {
+			return errors.New(fmt.Sprintf("expected an integer BUT got %T (%v)", value, value))
+		}
+		pBuffer.WriteString(strconv.FormatInt(iValue, 10))
+	case TypeFloat:
+		fValue, isFloat := toFloat64(value)
+		if !isFloat {
+			return errors.New(fmt.Sprintf("expected a float BUT got %T", value))
+		}
+		if math.IsNaN(fValue) {
+			pBuffer.WriteString("null")
+			return
+		}
+		if math.IsInf(fValue, 0) {
+			return errors.New(fmt.Sprintf("infinite float [%v] is not supported", fValue))
+		}
+		pBuffer.WriteString(formatJsonFloat(fValue))
+	case TypeDecimal:
+		dValue, isDecimal := toDecimal(value)
+		if !isDecimal {
+			return errors.New(fmt.Sprintf("expected a decimal BUT got %T (%v)", value, value))
+		}
+		pBuffer.WriteString("{")
+		encodeJsonString(pBuffer, storeJsonDecimalKey)
+		pBuffer.WriteString(":")
+		encodeJsonString(pBuffer, dValue.String())
+		pBuffer.WriteString("}")
+	case TypeBool:
+		bValue, isBool := value.(bool)
+		if !isBool {
+			return errors.New(fmt.Sprintf("expected a bool BUT got %T", value))
+		}
+		pBuffer.WriteString(strconv.FormatBool(bValue))
+	case TypeDate:
+		switch v := value.(type) {
+		case time.Time:
+			encodeJsonString(pBuffer, v.Format(util.CommonDateFormat))
+		case *time.Time:
+			encodeJsonString(pBuffer, v.Format(util.CommonDateFormat))
+		case string:
+			// invalid date format; hence parsing failed
+			if _, err = time.Parse(util.CommonDateFormat, v); err != nil {
+				return
+			}
+			encodeJsonString(pBuffer, v)
+		default:
+			return errors.New(fmt.Sprintf("expected a time.Time or date string BUT got %T", value))
+		}
+	default:
+		return errors.New(fmt.Sprintf("unknown type [%v]", valueType))
+	}
+	return
+}
+
+// write the string with json escaping (quotes, backslashes, control characters)
+func encodeJsonString(pBuffer *bytes.Buffer, value string) {
+	bValue, _ := json.Marshal(value)
+	pBuffer.Write(bValue)
+}
+
+// format the float so that it is always decoded back as a float (e.g. 50 => 50.0)
+func formatJsonFloat(value float64) string {
+	sValue := strconv.FormatFloat(value, 'g', -1, 64)
+	if !strings.ContainsAny(sValue, ".eE") {
+		sValue = sValue + ".0"
+	}
+	return sValue
+}
+
+// build a StructStoreValue based on the go type of the value
+func guessStoreValue(value interface{}) (storeValue StructStoreValue) {
+	storeValue.Value = value
+	switch v := value.(type) {
+	case StructStoreValue:
+		return v
+	case string:
+		storeValue.Type = TypeString
+	case bool:
+		storeValue.Type = TypeBool
+	case float32, float64:
+		storeValue.Type = TypeFloat
+	case time.Time, *time.Time:
+		storeValue.Type = TypeDate
+	case StructDecimal, *StructDecimal:
+		storeValue.Type = TypeDecimal
+	case map[string]StructStoreValue, map[string]interface{}:
+		storeValue.IsObject = true
+	case []StructStoreValue, []interface{}:
+		storeValue.IsArray = true
+	default:
+		if _, isInteger := toInt64(value); isInteger {
+			storeValue.Type = TypeInteger
+		}
+	}
+	return
+}
+
+func decodeStoreValue(rawValue interface{}) (storeValue StructStoreValue, err error) {
+	switch v := rawValue.(type) {
+	case nil:
+		storeValue.Value = nil
+	case string:
+		storeValue.Type = TypeString
+		storeValue.Value = v
+		if dDate, err2 := time.Parse(util.CommonDateFormat, v); err2 == nil {
+			storeValue.Type = TypeDate
+			storeValue.Value = dDate
+		}
+	case json.Number:
+		if iValue, err2 := strconv.ParseInt(v.String(), 10, 0); err2 == nil {
+			storeValue.Type = TypeInteger
+			storeValue.Value = int(iValue)
+		} else {
+			storeValue.Type = TypeFloat
+			storeValue.Value, err = v.Float64()
+		}
+	case bool:
+		storeValue.Type = TypeBool
+		storeValue.Value = v
+	case []interface{}:
+		elements := make([]StructStoreValue, len(v))
+		for i, rawElement := range v {
+			elements[i], err = decodeStoreValue(rawElement)
+			if err != nil {
+				return
+			}
+			// the array's type is its elements' type
+			storeValue.Type = elements[i].Type
+		}
+		storeValue.IsArray = true
+		storeValue.Value = elements
+	case map[string]interface{}:
+		if sDecimal, isDecimal := v[storeJsonDecimalKey].(string); isDecimal && len(v) == 1 {
+			storeValue.Type = TypeDecimal
+			storeValue.Value, err = ParseDecimal(sDecimal)
+			return
+		}
+		fieldMap := make(map[string]StructStoreValue)
+		for fieldName, rawField := range v {
+			fieldMap[fieldName], err = decodeStoreValue(rawField)
+			if err != nil {
+				return
+			}
+		}
+		storeValue.IsObject = true
+		storeValue.Value = fieldMap
+	default:
+		err = errors.New(fmt.Sprintf("unsupported json value type => %T", rawValue))
+	}
+	return
+}
+
+func isNilValue(value interface{}) bool {
+	if value == nil {
+		return true
+	}
+	reflectValue := reflect.ValueOf(value)
+	switch reflectValue.Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Slice, reflect.Interface:
+		return reflectValue.IsNil()
+	}
+	return false
+}
+
+func toInt64(value interface{}) (iValue int64, isInteger bool) {
+	reflectValue := reflect.ValueOf(value)
+	switch reflectValue.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return reflectValue.Int(), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(reflectValue.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		// whole floats are accepted as integers
+		fValue := reflectValue.Float()
+		if fValue == math.Trunc(fValue) && !math.IsInf(fValue, 0) {
+			return int64(fValue), true
+		}
+	}
+	return
+}
+
+func toFloat64(value interface{}) (fValue float64, isFloat bool) {
+	reflectValue := reflect.ValueOf(value)
+	switch reflectValue.Kind() {
+	case reflect.Float32, reflect.Float64:
+		return reflectValue.Float(), true
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(reflectValue.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(reflectValue.Uint()), true
+	}
+	return
+}
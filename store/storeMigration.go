@@ -0,0 +1,439 @@
+/*
+ *  Copyright Project - Stockbinator, Author - quoeamaster, (C) 2019
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+package store
+
+import (
+	"Stockbinator/common"
+	"Stockbinator/util"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// status of a migration
+const (
+	MigrationStatusPending   = "pending"
+	MigrationStatusRunning   = "running"
+	MigrationStatusCompleted = "completed"
+	MigrationStatusFailed    = "failed"
+)
+
+// the checkpoint is saved after this number of records read
+const migrationCheckpointInterval = 500
+
+// structure describing what to copy; the stores are resolved as {Source|Target}.{Module}.{symbol}
+type StructStoreMigrationRequest struct {
+	// key prefix of the source and target stores (e.g. "filestore" and "sqlitestore")
+	Source string
+	Target string
+	// the stock module (e.g. stock_aastocks)
+	Module string
+	// the symbols (e.g. 700_tencent) to copy
+	Symbols []string
+	// only the records whose trx_date falls within [From, To] are copied; a zero From or To means unbounded
+	From time.Time
+	To   time.Time
+}
+
+// progress of a symbol within a migration
+type StructStoreMigrationSymbolProgress struct {
+	Symbol string
+	// number of matching records read from the source; a resumed migration skips this number of records
+	Read int
+	// number of records written into the target
+	Written int
+	// number of records skipped by the target (natural key already exists under the skip policy)
+	Skipped int
+	// number of records the target failed to write
+	Failed int
+	// all the records of the symbol have been read
+	Completed bool
+	// verification; the number of matching records in the source and in the target after the copy
+	SourceCount int
+	TargetCount int
+	Verified    bool
+	// why the verification is not available (e.g. the target is write-only)
+	VerifyError string
+	// the latest error of the symbol
+	LastError string
+}
+
+// progress of a migration
+type StructStoreMigrationProgress struct {
+	Request StructStoreMigrationRequest
+	// one of MigrationStatusXXX
+	Status    string
+	StartTime time.Time
+	EndTime   time.Time
+	// the migration continued from a checkpoint
+	Resumed bool
+	// totals of all the symbols
+	Read    int
+	Written int
+	Skipped int
+	Failed  int
+	Symbols []StructStoreMigrationSymbolProgress
+	// error stopping the migration (if any)
+	Error string
+}
+
+// streams the records of the source stores into the target stores symbol by symbol.
+// The progress is saved into a checkpoint file (if a filepath is provided); running the same request
+// again continues from the checkpoint. Completed symbols are skipped and a partially copied symbol skips
+// the records already read, hence the source should not be modified in between
+type StructStoreMigration struct {
+	checkpointFilepath string
+	resolver           StoreResolver
+	clock              util.IClock
+	// called with a snapshot of the progress on every checkpoint (optional)
+	progressListener func(progress StructStoreMigrationProgress)
+
+	progress StructStoreMigrationProgress
+	// guards the progress
+	lock sync.Mutex
+	// only one run at a time
+	runLock sync.Mutex
+}
+
+// creation method for StructStoreMigration; the progress is loaded from the checkpoint file if it was
+// saved by an unfinished run of the same request.
+// The optional clock tells the current time (util.SystemClock by default)
+func NewStructStoreMigration(request StructStoreMigrationRequest, checkpointFilepath string,
+	resolver StoreResolver, clock ...util.IClock) (pMigration *StructStoreMigration, err error) {
+
+	err = validateMigrationRequest(request)
+	if err != nil {
+		return
+	}
+	pMigration = new(StructStoreMigration)
+	pMigration.checkpointFilepath = checkpointFilepath
+	pMigration.resolver = resolver
+	pMigration.clock = util.GetClock(clock...)
+	pMigration.progress = newMigrationProgress(request)
+
+	if !util.IsEmptyString(checkpointFilepath) {
+		err = pMigration.loadCheckpoint()
+	}
+	return
+}
+
+func validateMigrationRequest(request StructStoreMigrationRequest) (err error) {
+	if util.IsEmptyString(request.Source) || util.IsEmptyString(request.Target) {
+		return errors.New("both the source and target stores are required")
+	}
+	if strings.Compare(request.Source, request.Target) == 0 {
+		return errors.New(fmt.Sprintf("the source and target stores must be different => %v", request.Source))
+	}
+	if util.IsEmptyString(request.Module) {
+		return errors.New("the stock module is required")
+	}
+	if len(request.Symbols) == 0 {
+		return errors.New(fmt.Sprintf("no symbols to migrate for %v", request.Module))
+	}
+	if !request.From.IsZero() && !request.To.IsZero() && request.From.After(request.To) {
+		return errors.New(fmt.Sprintf("invalid date range [%v, %v]", request.From, request.To))
+	}
+	return
+}
+
+func newMigrationProgress(request StructStoreMigrationRequest) (progress StructStoreMigrationProgress) {
+	progress.Request = request
+	progress.Status = MigrationStatusPending
+	progress.Symbols = make([]StructStoreMigrationSymbolProgress, len(request.Symbols))
+	for i, symbol := range request.Symbols {
+		progress.Symbols[i].Symbol = symbol
+	}
+	return
+}
+
+// set the function called with the progress on every checkpoint
+func (m *StructStoreMigration) SetProgressListener(listener func(progress StructStoreMigrationProgress)) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.progressListener = listener
+}
+
+// return a snapshot of the progress
+func (m *StructStoreMigration) GetProgress() (progress StructStoreMigrationProgress) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.copyProgress()
+}
+
+// copy the progress; the caller MUST hold the lock
+func (m *StructStoreMigration) copyProgress() (progress StructStoreMigrationProgress) {
+	progress = m.progress
+	progress.Request.Symbols = append([]string{}, m.progress.Request.Symbols...)
+	progress.Symbols = append([]StructStoreMigrationSymbolProgress{}, m.progress.Symbols...)
+	return
+}
+
+// run (or continue) the migration; failed record writes are counted and do not stop the migration
+// whilst a source which could not be read does (the run could be continued later)
+func (m *StructStoreMigration) Run() (progress StructStoreMigrationProgress, err error) {
+	m.runLock.Lock()
+	defer m.runLock.Unlock()
+
+	m.lock.Lock()
+	m.progress.Status = MigrationStatusRunning
+	m.progress.StartTime = m.clock.Now()
+	m.progress.EndTime = time.Time{}
+	m.progress.Error = ""
+	m.lock.Unlock()
+
+	for i := range m.progress.Symbols {
+		m.lock.Lock()
+		completed := m.progress.Symbols[i].Completed
+		m.lock.Unlock()
+		if completed {
+			continue
+		}
+		err = m.migrateSymbol(i)
+		if err != nil {
+			break
+		}
+	}
+
+	m.lock.Lock()
+	m.progress.EndTime = m.clock.Now()
+	if err != nil {
+		m.progress.Status = MigrationStatusFailed
+		m.progress.Error = err.Error()
+	} else {
+		m.progress.Status = MigrationStatusCompleted
+	}
+	err2 := m.saveCheckpoint()
+	if err == nil {
+		err = err2
+	}
+	progress = m.copyProgress()
+	listener := m.progressListener
+	m.lock.Unlock()
+
+	if listener != nil {
+		listener(progress)
+	}
+	return
+}
+
+// copy the records of the symbol at the given index then verify the counts
+func (m *StructStoreMigration) migrateSymbol(index int) (err error) {
+	request := m.progress.Request
+	symbol := request.Symbols[index]
+	sourceStore, targetStore, err := m.resolveStores(symbol)
+	if err != nil {
+		m.setSymbolError(index, err)
+		return
+	}
+	predicates := []StoreRecordPredicate{ PredicateByStockId(symbol), PredicateByTrxDateRange(request.From, request.To) }
+
+	m.lock.Lock()
+	skipCount := m.progress.Symbols[index].Read
+	m.lock.Unlock()
+
+	_, iterator, err := sourceStore.Iterate(predicates...)
+	if err != nil {
+		m.setSymbolError(index, err)
+		return
+	}
+	defer func() {
+		_ = iterator.Close()
+	}()
+	position := 0
+	for iterator.Next() {
+		position++
+		// already read by a previous run
+		if position <= skipCount {
+			continue
+		}
+		record, isObject := iterator.Record().Value.(map[string]StructStoreValue)
+		if !isObject {
+			continue
+		}
+		response, err2 := targetStore.Persist(record)
+
+		m.lock.Lock()
+		pSymbol := &m.progress.Symbols[index]
+		pSymbol.Read++
+		m.progress.Read++
+		if err2 != nil {
+			pSymbol.Failed++
+			m.progress.Failed++
+			pSymbol.LastError = err2.Error()
+		} else if response.Code != CodeSuccess {
+			pSymbol.Failed++
+			m.progress.Failed++
+			pSymbol.LastError = fmt.Sprintf("(%v) - %v", response.Code, response.Message)
+		} else if response.AdditionalCode == common.FileStatusSkipped {
+			pSymbol.Skipped++
+			m.progress.Skipped++
+		} else {
+			pSymbol.Written++
+			m.progress.Written++
+		}
+		if pSymbol.Read%migrationCheckpointInterval == 0 {
+			m.checkpoint()
+		}
+		m.lock.Unlock()
+	}
+	err = iterator.Err()
+	if err != nil {
+		m.setSymbolError(index, err)
+		return
+	}
+	// buffered targets (e.g. influxstore) are flushed before the verification
+	if iFlushable, isFlushable := targetStore.(interface{ Flush() error }); isFlushable {
+		err2 := iFlushable.Flush()
+		if err2 != nil {
+			m.lock.Lock()
+			m.progress.Symbols[index].LastError = err2.Error()
+			m.lock.Unlock()
+		}
+	}
+	sourceCount, err := countMatchingRecords(sourceStore, predicates)
+	if err != nil {
+		m.setSymbolError(index, err)
+		return
+	}
+	targetCount, err2 := countMatchingRecords(targetStore, predicates)
+
+	m.lock.Lock()
+	pSymbol := &m.progress.Symbols[index]
+	pSymbol.Completed = true
+	pSymbol.SourceCount = sourceCount
+	pSymbol.TargetCount = targetCount
+	if err2 != nil {
+		pSymbol.VerifyError = err2.Error()
+	} else {
+		pSymbol.VerifyError = ""
+		pSymbol.Verified = sourceCount == targetCount
+	}
+	m.checkpoint()
+	m.lock.Unlock()
+	return
+}
+
+func (m *StructStoreMigration) resolveStores(symbol string) (sourceStore, targetStore IStore, err error) {
+	request := m.progress.Request
+	sourceStore, err = m.resolver(fmt.Sprintf("%v.%v.%v", request.Source, request.Module, symbol))
+	if err != nil {
+		return
+	}
+	targetStore, err = m.resolver(fmt.Sprintf("%v.%v.%v", request.Target, request.Module, symbol))
+	if err != nil {
+		return
+	}
+	if sourceStore == nil || targetStore == nil {
+		err = errors.New(fmt.Sprintf("stores are not available for %v.%v", request.Module, symbol))
+	}
+	return
+}
+
+func (m *StructStoreMigration) setSymbolError(index int, err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.progress.Symbols[index].LastError = err.Error()
+}
+
+// number of records matching all the predicates
+func countMatchingRecords(iStore IStore, predicates []StoreRecordPredicate) (count int, err error) {
+	_, iterator, err := iStore.Iterate(predicates...)
+	if err != nil {
+		return
+	}
+	defer func() {
+		_ = iterator.Close()
+	}()
+	for iterator.Next() {
+		count++
+	}
+	err = iterator.Err()
+	return
+}
+
+// save the checkpoint and notify the listener; the caller MUST hold the lock.
+// A checkpoint which could not be saved only affects resumability, hence it is kept as the progress error
+func (m *StructStoreMigration) checkpoint() {
+	err := m.saveCheckpoint()
+	if err != nil {
+		m.progress.Error = fmt.Sprintf("could not save the checkpoint => %v", err)
+	}
+	if m.progressListener != nil {
+		listener := m.progressListener
+		progress := m.copyProgress()
+		// the listener is called without the lock held
+		m.lock.Unlock()
+		listener(progress)
+		m.lock.Lock()
+	}
+}
+
+// save the progress into the checkpoint file (temp file + rename); the caller MUST hold the lock
+func (m *StructStoreMigration) saveCheckpoint() (err error) {
+	if util.IsEmptyString(m.checkpointFilepath) {
+		return
+	}
+	bProgress, err := json.Marshal(m.progress)
+	if err != nil {
+		return
+	}
+	tmpFilepath := m.checkpointFilepath + ".tmp"
+	err = ioutil.WriteFile(tmpFilepath, bProgress, 0666)
+	if err != nil {
+		return
+	}
+	err = os.Rename(tmpFilepath, m.checkpointFilepath)
+	return
+}
+
+// continue from the checkpoint if it belongs to an unfinished run of the same request
+func (m *StructStoreMigration) loadCheckpoint() (err error) {
+	bProgress, err := ioutil.ReadFile(m.checkpointFilepath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	progress := StructStoreMigrationProgress{}
+	// a corrupted checkpoint simply means starting over
+	if json.Unmarshal(bProgress, &progress) != nil {
+		return
+	}
+	if progress.Status == MigrationStatusCompleted || !isSameMigrationRequest(progress.Request, m.progress.Request) ||
+		len(progress.Symbols) != len(m.progress.Symbols) {
+		return
+	}
+	progress.Request = m.progress.Request
+	progress.Status = MigrationStatusPending
+	progress.Resumed = true
+	m.progress = progress
+	return
+}
+
+func isSameMigrationRequest(request, otherRequest StructStoreMigrationRequest) bool {
+	return strings.Compare(request.Source, otherRequest.Source) == 0 &&
+		strings.Compare(request.Target, otherRequest.Target) == 0 &&
+		strings.Compare(request.Module, otherRequest.Module) == 0 &&
+		reflect.DeepEqual(request.Symbols, otherRequest.Symbols) &&
+		request.From.Equal(otherRequest.From) && request.To.Equal(otherRequest.To)
+}
@@ -15,6 +15,19 @@
  */
 package store
 
+import (
+	"Stockbinator/common"
+	"Stockbinator/util"
+	"errors"
+	"fmt"
+	"github.com/daviddengcn/go-colortext"
+	"github.com/daviddengcn/go-colortext/fmt"
+	"github.com/micro/go-config"
+	"sort"
+	"strings"
+	"time"
+)
+
 // type constants
 const (
 	TypeInteger = iota
@@ -22,6 +35,8 @@ const (
 	TypeString
 	TypeBool
 	TypeDate
+	// exact decimal (e.g. a price of 330.000); Value is a StructDecimal or a decimal string
+	TypeDecimal
 )
 
 // code constants
@@ -69,11 +84,21 @@ type IStore interface {
 	// save all data into the store
 	Persist(data map[string]StructStoreValue) (response StructStoreResponse, err error)
 
-	// read all contents from the store (might be an issue when the content size is HUGE
+	// read all contents from the store (might be an issue when the content size is HUGE, use Iterate instead
 	ReadAll() (response StructStoreResponse, content string, err error)
 	// read only the content associated by the KEY, PARAMS contains additional information for the read operation
 	ReadByKey(key string, params interface{}) (response StructStoreResponse, value StructStoreValue, err error)
 
+	// query the records of the given stock (empty means all stocks) whose trx_date falls within [from, to],
+	// a zero from or to means unbounded. Records are returned in chronological order as objects
+	// (map[string]StructStoreValue) with ONLY the given fields (all fields if none given);
+	// at most LIMIT records are returned (0 means no limit)
+	Query(stockId string, from, to time.Time, fields []string, limit int) (response StructStoreResponse, records []StructStoreValue, err error)
+
+	// iterate the records matching all the predicates (in the order stored) one at a time;
+	// the iterator MUST be closed after use
+	Iterate(predicates ...StoreRecordPredicate) (response StructStoreResponse, iterator IStoreIterator, err error)
+
 	// modify the value associated with the key
 	ModifyByKey(key string, value StructStoreValue) (response StructStoreResponse, err error)
 
@@ -81,4 +106,247 @@ type IStore interface {
 	RemoveByKey(key string) (response StructStoreResponse, valueRemoved StructStoreValue, err error)
 	// remove all data in the store, be careful~
 	RemoveAll() (response StructStoreResponse, err error)
-}
\ No newline at end of file
+	// remove the records of the given stock (empty means all stocks) whose trx_date is before the given time
+	// (e.g. records older than the retention period); returns the number of records removed
+	RemoveBefore(stockId string, before time.Time) (response StructStoreResponse, removed int, err error)
+
+	// set the natural key identifying a record and how Persist handles a record whose natural key already exists
+	SetNaturalKey(naturalKey StructNaturalKey)
+}
+
+// structure describing the natural key of the records of a stock module
+type StructNaturalKey struct {
+	// fields identifying a record (e.g. stock_id + trx_date)
+	Fields []string
+	// one of common.StoreDuplicatePolicyXXX
+	DuplicatePolicy string
+}
+
+// return the natural key of the stock module from the config; [{storeSection}.{stock_module}] overrides
+// [{storeSection}] (e.g. [filestore.stock_aastocks] overrides [filestore]). Defaults to stock_id + trx_date
+// with the replace policy
+func GetNaturalKeyFromConfig(cfg config.Config, storeSection string, stockModuleName string) (naturalKey StructNaturalKey, err error) {
+	naturalKey.Fields = []string{ StoreKeyStockId, StoreKeyTrxDate }
+	naturalKey.DuplicatePolicy = common.StoreDuplicatePolicyReplace
+	if cfg == nil {
+		return
+	}
+	naturalKey.Fields = cfg.Get(storeSection, common.ConfigKeyStoreNaturalKey).StringSlice(naturalKey.Fields)
+	naturalKey.DuplicatePolicy = cfg.Get(storeSection, common.ConfigKeyStoreDuplicatePolicy).String(naturalKey.DuplicatePolicy)
+	if !util.IsEmptyString(stockModuleName) {
+		naturalKey.Fields = cfg.Get(storeSection, stockModuleName, common.ConfigKeyStoreNaturalKey).StringSlice(naturalKey.Fields)
+		naturalKey.DuplicatePolicy = cfg.Get(storeSection, stockModuleName, common.ConfigKeyStoreDuplicatePolicy).String(naturalKey.DuplicatePolicy)
+	}
+	switch naturalKey.DuplicatePolicy {
+	case common.StoreDuplicatePolicyReplace, common.StoreDuplicatePolicySkip, common.StoreDuplicatePolicyAppend:
+	default:
+		err = errors.New(fmt.Sprintf("unknown duplicate policy [%v] for %v, %v is used instead",
+			naturalKey.DuplicatePolicy, stockModuleName, common.StoreDuplicatePolicyReplace))
+		naturalKey.DuplicatePolicy = common.StoreDuplicatePolicyReplace
+	}
+	return
+}
+
+// check whether both records share the same natural key; records missing any of the key fields never match
+func IsSameNaturalKey(record, otherRecord map[string]StructStoreValue, naturalKey StructNaturalKey) bool {
+	if len(naturalKey.Fields) == 0 {
+		return false
+	}
+	for _, field := range naturalKey.Fields {
+		value, found := record[field]
+		otherValue, otherFound := otherRecord[field]
+		if !found || !otherFound || isNilValue(value.Value) || !isStoreValueEqual(value.Value, otherValue.Value) {
+			return false
+		}
+	}
+	return true
+}
+
+// build an identifier from the natural key's values (dates in UTC), e.g. 700_tencent|2019-07-03T08:00:00+00:00;
+// false if the record misses any of the key fields
+func BuildNaturalKeyId(record map[string]StructStoreValue, naturalKey StructNaturalKey) (id string, isAvailable bool) {
+	if len(naturalKey.Fields) == 0 {
+		return
+	}
+	parts := make([]string, len(naturalKey.Fields))
+	for i, field := range naturalKey.Fields {
+		storeValue, found := record[field]
+		if !found || isNilValue(storeValue.Value) {
+			return
+		}
+		if date, isDate := toStoreDate(storeValue.Value); isDate {
+			parts[i] = date.UTC().Format(util.CommonDateFormat)
+		} else {
+			parts[i] = fmt.Sprintf("%v", storeValue.Value)
+		}
+	}
+	id = strings.Join(parts, StoreKeySeparator)
+	isAvailable = true
+	return
+}
+
+// return the record with the fields named by their StructStoreValue's Key (if given)
+func GetRecordWithFieldKeys(record map[string]StructStoreValue) (finalRecord map[string]StructStoreValue) {
+	finalRecord = make(map[string]StructStoreValue)
+	for fieldName, storeValue := range record {
+		if !util.IsEmptyString(storeValue.Key) {
+			fieldName = storeValue.Key
+		}
+		finalRecord[fieldName] = storeValue
+	}
+	return
+}
+
+// field names identifying a record (a stock's quote on a trx-date)
+const (
+	StoreKeyStockId = "stock_id"
+	StoreKeyTrxDate = "trx_date"
+	// separator between the stock-id and trx-date in a record key (e.g. 700_tencent|2019-07-03T16:00:00+08:00)
+	StoreKeySeparator = "|"
+)
+
+// structure describing additional information for ReadByKey
+type StructStoreReadParams struct {
+	// field name => expected value; ONLY records with all fields matching are returned
+	// (values are compared in their string form, dates are compared as time)
+	Filters map[string]interface{}
+	// fields to return (empty means all fields)
+	Fields []string
+}
+
+// build the key identifying the record of the given stock on the given trx-date
+func BuildRecordKey(stockId string, trxDate time.Time) string {
+	return fmt.Sprintf("%v%v%v", stockId, StoreKeySeparator, trxDate.Format(util.CommonDateFormat))
+}
+
+// parse the key built by BuildRecordKey back into the stock-id and trx-date
+func ParseRecordKey(key string) (stockId string, trxDate time.Time, err error) {
+	parts := strings.SplitN(key, StoreKeySeparator, 2)
+	if len(parts) != 2 || util.IsEmptyString(parts[0]) {
+		err = errors.New(fmt.Sprintf("invalid record key [%v], expected format => {stock_id}%v{trx_date}", key, StoreKeySeparator))
+		return
+	}
+	stockId = parts[0]
+	trxDate, err = time.Parse(util.CommonDateFormat, parts[1])
+	return
+}
+
+// return the read params from the given interface; accepting StructStoreReadParams (or its pointer),
+// a map of filters or nil
+func GetStoreReadParams(params interface{}) (readParams StructStoreReadParams, err error) {
+	switch p := params.(type) {
+	case nil:
+	case StructStoreReadParams:
+		readParams = p
+	case *StructStoreReadParams:
+		if p != nil {
+			readParams = *p
+		}
+	case map[string]interface{}:
+		readParams.Filters = p
+	default:
+		err = errors.New(fmt.Sprintf("unsupported read params type => %T", params))
+	}
+	return
+}
+
+// check whether the given record matches all the filters
+func IsRecordMatchingFilters(record map[string]StructStoreValue, filters map[string]interface{}) bool {
+	for field, expected := range filters {
+		storeValue, found := record[field]
+		if !found {
+			return false
+		}
+		if !isStoreValueEqual(storeValue.Value, expected) {
+			return false
+		}
+	}
+	return true
+}
+
+// return a copy of the record with ONLY the given fields (all fields if none given)
+func SelectRecordFields(record map[string]StructStoreValue, fields []string) (selected map[string]StructStoreValue) {
+	if len(fields) == 0 {
+		return record
+	}
+	selected = make(map[string]StructStoreValue)
+	for _, field := range fields {
+		if storeValue, found := record[field]; found {
+			selected[field] = storeValue
+		}
+	}
+	return
+}
+
+// check whether the given record belongs to the stock (empty means any stock) and
+// its trx_date falls within [from, to]; a zero from or to means unbounded
+func IsRecordInQueryRange(record map[string]StructStoreValue, stockId string, from, to time.Time) bool {
+	if !util.IsEmptyString(stockId) && !isStoreValueEqual(record[StoreKeyStockId].Value, stockId) {
+		return false
+	}
+	if from.IsZero() && to.IsZero() {
+		return true
+	}
+	trxDate, isDate := toStoreDate(record[StoreKeyTrxDate].Value)
+	if !isDate {
+		return false
+	}
+	if !from.IsZero() && trxDate.Before(from) {
+		return false
+	}
+	if !to.IsZero() && trxDate.After(to) {
+		return false
+	}
+	return true
+}
+
+// build the query result of the given records (chronological order, selected fields and limit applied)
+func BuildQueryResult(records []map[string]StructStoreValue, fields []string, limit int) (results []StructStoreValue) {
+	sort.SliceStable(records, func(i, j int) bool {
+		dateI, _ := toStoreDate(records[i][StoreKeyTrxDate].Value)
+		dateJ, _ := toStoreDate(records[j][StoreKeyTrxDate].Value)
+		return dateI.Before(dateJ)
+	})
+	if limit > 0 && len(records) > limit {
+		records = records[:limit]
+	}
+	results = make([]StructStoreValue, len(records))
+	for i, record := range records {
+		results[i] = NewRecordStoreValue(record)
+		results[i].Value = SelectRecordFields(record, fields)
+	}
+	return
+}
+
+// compare values; dates are compared as time (any timezone), decimals by their values (1.50 equals 1.5)
+// and the rest in their string form
+func isStoreValueEqual(value, expected interface{}) bool {
+	dValue, isValueDate := toStoreDate(value)
+	dExpected, isExpectedDate := toStoreDate(expected)
+	if isValueDate && isExpectedDate {
+		return dValue.Equal(dExpected)
+	}
+	if decValue, isValueDecimal := value.(StructDecimal); isValueDecimal {
+		if decExpected, isExpectedDecimal := toDecimal(expected); isExpectedDecimal {
+			return decValue.Cmp(decExpected) == 0
+		}
+	}
+	return strings.Compare(fmt.Sprintf("%v", value), fmt.Sprintf("%v", expected)) == 0
+}
+
+func toStoreDate(value interface{}) (date time.Time, isDate bool) {
+	switch v := value.(type) {
+	case time.Time:
+		return v, true
+	case string:
+		date, err := time.Parse(util.CommonDateFormat, v)
+		return date, err == nil
+	}
+	return
+}
+
+// log the error of a background routine (e.g. a periodic flush) as there is no caller to return it to
+func logStoreError(module string, funcName string, msg string) {
+	ctfmt.Print(ct.Red, true, fmt.Sprintf("[%v.%v] ", module, funcName))
+	ctfmt.Println(ct.White, true, msg)
+}
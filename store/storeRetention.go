@@ -0,0 +1,85 @@
+/*
+ *  Copyright Project - Stockbinator, Author - quoeamaster, (C) 2019
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+package store
+
+import (
+	"Stockbinator/common"
+	"github.com/micro/go-config"
+	"time"
+)
+
+// result of enforcing the retention rule on a store
+type StructRetentionResult struct {
+	StoreKey string
+	KeepDays int
+	// records whose trx_date is before this are removed
+	Before  time.Time
+	Removed int
+	// the store does not support removing records (e.g. influxstore; the database's retention policy applies)
+	Skipped bool
+	Error   string
+}
+
+// a run of the retention rules across the stores
+type StructRetentionRun struct {
+	StartTime time.Time
+	EndTime   time.Time
+	// total records removed
+	Removed int
+	// number of stores failed
+	Failed int
+	Stores  []StructRetentionResult
+}
+
+// return the number of days the records of the stock module are kept in the store type (e.g. sqlitestore);
+// 0 means forever. The most specific rule wins, e.g.
+//	[retention]
+//	keep_days = 0
+//	[retention.stock_aastocks_intraday]
+//	keep_days = 30
+//	[retention.stock_aastocks_intraday.filestore]
+//	keep_days = 90
+func GetRetentionDaysFromConfig(cfg config.Config, storeType string, stockModuleName string) (keepDays int) {
+	if cfg == nil {
+		return
+	}
+	keepDays = cfg.Get(common.ConfigKeyRetention, common.ConfigKeyRetentionKeepDays).Int(0)
+	keepDays = cfg.Get(common.ConfigKeyRetention, storeType, common.ConfigKeyRetentionKeepDays).Int(keepDays)
+	keepDays = cfg.Get(common.ConfigKeyRetention, stockModuleName, common.ConfigKeyRetentionKeepDays).Int(keepDays)
+	keepDays = cfg.Get(common.ConfigKeyRetention, stockModuleName, storeType, common.ConfigKeyRetentionKeepDays).Int(keepDays)
+	if keepDays < 0 {
+		keepDays = 0
+	}
+	return
+}
+
+// remove the records of the stock older than keepDays (relative to now) from the store
+func ApplyRetention(iStore IStore, storeKey string, stockId string, keepDays int, now time.Time) (result StructRetentionResult) {
+	result.StoreKey = storeKey
+	result.KeepDays = keepDays
+	result.Before = now.AddDate(0, 0, -keepDays)
+	response, removed, err := iStore.RemoveBefore(stockId, result.Before)
+	result.Removed = removed
+	switch {
+	case err == ErrInfluxStoreWriteOnly:
+		result.Skipped = true
+	case err != nil:
+		result.Error = err.Error()
+	case response.Code != CodeSuccess:
+		result.Error = response.Message
+	}
+	return
+}
@@ -0,0 +1,335 @@
+/*
+ *  Copyright Project - Stockbinator, Author - quoeamaster, (C) 2019
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+package store
+
+import (
+	"Stockbinator/common"
+	"Stockbinator/util"
+	"errors"
+	"fmt"
+	"github.com/micro/go-config"
+	"sort"
+	"strings"
+)
+
+// names of the store value types used by the schema declaration
+var storeValueTypeNames = map[int]string{
+	TypeInteger: "integer",
+	TypeFloat:   "float",
+	TypeString:  "string",
+	TypeBool:    "bool",
+	TypeDate:    "date",
+	TypeDecimal: "decimal",
+}
+
+// return the type constant (e.g. TypeFloat) of the type name (e.g. "float")
+func ParseStoreValueType(name string) (valueType int, err error) {
+	for valueType, typeName := range storeValueTypeNames {
+		if strings.Compare(typeName, strings.ToLower(strings.TrimSpace(name))) == 0 {
+			return valueType, nil
+		}
+	}
+	err = errors.New(fmt.Sprintf("unknown type [%v]", name))
+	return
+}
+
+// return the type name (e.g. "float") of the type constant (e.g. TypeFloat)
+func GetStoreValueTypeName(valueType int) string {
+	if typeName, found := storeValueTypeNames[valueType]; found {
+		return typeName
+	}
+	return fmt.Sprintf("unknown(%v)", valueType)
+}
+
+// structure describing a field of a module's records
+type StructSchemaField struct {
+	Name string
+	// one of TypeXXX
+	Type    int
+	IsArray bool
+	// a required field must be available (and not null) in every record
+	Required bool
+	// unit of the value (e.g. HKD), informational only
+	Unit string
+}
+
+// the fields of a stock module's records; records are validated against the schema on Persist
+type StructStoreSchema struct {
+	Module string
+	// fields in the order declared
+	Fields []StructSchemaField
+	// are fields not declared accepted?
+	AllowUnknownFields bool
+}
+
+// error returned when a record does not match the schema; such a record would never be accepted, hence
+// it should not be retried
+type StructSchemaError struct {
+	Module   string
+	Problems []string
+}
+
+func (e *StructSchemaError) Error() string {
+	return fmt.Sprintf("record does not match the schema of %v => %v", e.Module, strings.Join(e.Problems, "; "))
+}
+
+// is the error caused by a record not matching the schema?
+func IsSchemaError(err error) bool {
+	_, isSchemaError := err.(*StructSchemaError)
+	return isSchemaError
+}
+
+// return the schema of the stock module declared under [schema.{stock_module}]; nil if no schema is declared.
+// The identity fields (stock_id and trx_date) are always required even if not declared, e.g.
+//	[schema.stock_aastocks]
+//	fields = [ "price", "volume" ]
+//	[schema.stock_aastocks.price]
+//	type = "decimal"
+//	required = true
+//	unit = "HKD"
+func GetSchemaFromConfig(cfg config.Config, stockModuleName string) (pSchema *StructStoreSchema, err error) {
+	if cfg == nil || util.IsEmptyString(stockModuleName) {
+		return
+	}
+	fieldNames := cfg.Get(common.ConfigKeySchema, stockModuleName, common.ConfigKeySchemaFields).StringSlice(nil)
+	if len(fieldNames) == 0 {
+		return
+	}
+	schema := StructStoreSchema{ Module: stockModuleName, Fields: make([]StructSchemaField, 0, len(fieldNames)+2) }
+	schema.AllowUnknownFields = cfg.Get(common.ConfigKeySchema, stockModuleName, common.ConfigKeySchemaAllowUnknownFields).Bool(false)
+	for _, fieldName := range fieldNames {
+		field := StructSchemaField{ Name: fieldName }
+		typeName := cfg.Get(common.ConfigKeySchema, stockModuleName, fieldName, common.ConfigKeySchemaType).String("string")
+		field.Type, err = ParseStoreValueType(typeName)
+		if err != nil {
+			err = errors.New(fmt.Sprintf("schema of %v, field [%v] => %v", stockModuleName, fieldName, err))
+			return
+		}
+		field.Required = cfg.Get(common.ConfigKeySchema, stockModuleName, fieldName, common.ConfigKeySchemaRequired).Bool(false)
+		field.IsArray = cfg.Get(common.ConfigKeySchema, stockModuleName, fieldName, common.ConfigKeySchemaArray).Bool(false)
+		field.Unit = cfg.Get(common.ConfigKeySchema, stockModuleName, fieldName, common.ConfigKeySchemaUnit).String("")
+		schema.Fields = append(schema.Fields, field)
+	}
+	schema.addIdentityFields()
+	pSchema = &schema
+	return
+}
+
+// the identity fields are required, hence added in front if not declared
+func (s *StructStoreSchema) addIdentityFields() {
+	identityFields := make([]StructSchemaField, 0, 2)
+	if _, found := s.GetField(StoreKeyStockId); !found {
+		identityFields = append(identityFields, StructSchemaField{ Name: StoreKeyStockId, Type: TypeString, Required: true })
+	}
+	if _, found := s.GetField(StoreKeyTrxDate); !found {
+		identityFields = append(identityFields, StructSchemaField{ Name: StoreKeyTrxDate, Type: TypeDate, Required: true })
+	}
+	s.Fields = append(identityFields, s.Fields...)
+}
+
+// return the field declared by the name
+func (s *StructStoreSchema) GetField(name string) (field StructSchemaField, found bool) {
+	if s == nil {
+		return
+	}
+	for _, field = range s.Fields {
+		if strings.Compare(field.Name, name) == 0 {
+			return field, true
+		}
+	}
+	return StructSchemaField{}, false
+}
+
+// return the names of the fields in the order declared
+func (s *StructStoreSchema) GetFieldNames() (names []string) {
+	names = make([]string, 0)
+	if s == nil {
+		return
+	}
+	for _, field := range s.Fields {
+		names = append(names, field.Name)
+	}
+	return
+}
+
+// return a record with a typed (nil) value per field declared; handy for creating typed mappings / columns
+func (s *StructStoreSchema) GetTemplateRecord() (record map[string]StructStoreValue) {
+	record = make(map[string]StructStoreValue)
+	if s == nil {
+		return
+	}
+	for _, field := range s.Fields {
+		record[field.Name] = StructStoreValue{ Type: field.Type, IsArray: field.IsArray }
+	}
+	return
+}
+
+// validate the record against the schema; all the problems found are reported in 1 StructSchemaError.
+// A nil schema accepts any record
+func (s *StructStoreSchema) Validate(data map[string]StructStoreValue) (err error) {
+	_, err = s.Conform(data)
+	return
+}
+
+// convert the record's values to the types declared by the schema and validate it; floats and decimals are
+// accepted for each other (e.g. float history migrated into a decimal price) and converted, hence the stores
+// persist the returned record instead. The record keeps the keys of the data; a nil schema returns the data as is
+func (s *StructStoreSchema) Conform(data map[string]StructStoreValue) (conformed map[string]StructStoreValue, err error) {
+	conformed = data
+	if s == nil {
+		return
+	}
+	isCopied := false
+	for key, value := range data {
+		fieldName := key
+		if !util.IsEmptyString(value.Key) {
+			fieldName = value.Key
+		}
+		field, found := s.GetField(fieldName)
+		if !found {
+			continue
+		}
+		conformedValue, isConverted := conformSchemaValue(field, value)
+		if !isConverted {
+			continue
+		}
+		// copied on the 1st conversion; the caller's data is left untouched
+		if !isCopied {
+			conformed = make(map[string]StructStoreValue, len(data))
+			for dataKey, dataValue := range data {
+				conformed[dataKey] = dataValue
+			}
+			isCopied = true
+		}
+		conformed[key] = conformedValue
+	}
+	record := GetRecordWithFieldKeys(conformed)
+	problems := make([]string, 0)
+	for _, field := range s.Fields {
+		value, found := record[field.Name]
+		if !found || isNilValue(value.Value) {
+			if field.Required {
+				problems = append(problems, fmt.Sprintf("field [%v] is required", field.Name))
+			}
+			continue
+		}
+		problem := validateSchemaValue(field, value)
+		if !util.IsEmptyString(problem) {
+			problems = append(problems, fmt.Sprintf("field [%v] %v", field.Name, problem))
+		}
+	}
+	if !s.AllowUnknownFields {
+		unknownFields := make([]string, 0)
+		for fieldName := range record {
+			if _, found := s.GetField(fieldName); !found {
+				unknownFields = append(unknownFields, fieldName)
+			}
+		}
+		sort.Strings(unknownFields)
+		for _, fieldName := range unknownFields {
+			problems = append(problems, fmt.Sprintf("field [%v] is not declared", fieldName))
+		}
+	}
+	if len(problems) > 0 {
+		err = &StructSchemaError{ Module: s.Module, Problems: problems }
+	}
+	return
+}
+
+// convert a float into a decimal field's decimal (its shortest representation) and a decimal into a float
+// field's nearest float; arrays and values of other types are left to the validation
+func conformSchemaValue(field StructSchemaField, value StructStoreValue) (conformed StructStoreValue, isConverted bool) {
+	if field.IsArray || value.IsArray || value.IsObject || isNilValue(value.Value) {
+		return
+	}
+	conformed = value
+	switch {
+	case field.Type == TypeDecimal && value.Type == TypeFloat:
+		decimal, isDecimal := toDecimal(value.Value)
+		if !isDecimal {
+			return
+		}
+		conformed.Value = decimal
+	case field.Type == TypeFloat && value.Type == TypeDecimal:
+		decimal, isDecimal := toDecimal(value.Value)
+		if !isDecimal {
+			return
+		}
+		conformed.Value = decimal.Float64()
+	default:
+		return
+	}
+	conformed.Type = field.Type
+	isConverted = true
+	return
+}
+
+// check the value against the field; returns the problem found (if any)
+func validateSchemaValue(field StructSchemaField, value StructStoreValue) (problem string) {
+	expected := GetStoreValueTypeName(field.Type)
+	if field.IsArray {
+		expected = fmt.Sprintf("array of %v", expected)
+	}
+	if value.IsObject || value.IsArray != field.IsArray {
+		return fmt.Sprintf("expected %v BUT got %v", expected, describeStoreValueType(value))
+	}
+	// an integer is accepted as a float or decimal (e.g. a price of 330)
+	if value.Type != field.Type && !((field.Type == TypeFloat || field.Type == TypeDecimal) && value.Type == TypeInteger) {
+		return fmt.Sprintf("expected %v BUT got %v", expected, describeStoreValueType(value))
+	}
+	if field.IsArray {
+		return
+	}
+	if !isValueOfStoreType(value.Value, field.Type) {
+		return fmt.Sprintf("expected %v BUT got a %T value (%v)", expected, value.Value, value.Value)
+	}
+	return
+}
+
+func describeStoreValueType(value StructStoreValue) string {
+	switch {
+	case value.IsObject:
+		return "object"
+	case value.IsArray:
+		return fmt.Sprintf("array of %v", GetStoreValueTypeName(value.Type))
+	}
+	return GetStoreValueTypeName(value.Type)
+}
+
+// does the go value match the store type?
+func isValueOfStoreType(value interface{}, valueType int) bool {
+	switch valueType {
+	case TypeString:
+		_, isString := value.(string)
+		return isString
+	case TypeInteger:
+		_, isInteger := toInt64(value)
+		return isInteger
+	case TypeFloat:
+		_, isFloat := toFloat64(value)
+		return isFloat
+	case TypeBool:
+		_, isBool := value.(bool)
+		return isBool
+	case TypeDate:
+		_, isDate := toStoreDate(value)
+		return isDate
+	case TypeDecimal:
+		_, isDecimal := toDecimal(value)
+		return isDecimal
+	}
+	return false
+}
@@ -0,0 +1,478 @@
+/*
+ *  Copyright Project - Stockbinator, Author - quoeamaster, (C) 2019
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+package store
+
+import (
+	"Stockbinator/util"
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// structure describing a failed store write waiting for a retry
+type StructStoreSpoolEntry struct {
+	// sequence id of the entry within the spool
+	Id int64
+	// key of the store the record should be written into (e.g. datastore.stock_aastocks.700_tencent)
+	StoreKey string
+	// the record encoded by EncodeStoreRecord
+	Record json.RawMessage
+	// number of failed writes so far (including the original one)
+	Attempts int
+	// error of the latest failed write
+	LastError string
+	// when the entry was spooled
+	CreatedTime time.Time
+	// the entry is not retried before this time (unless replayed explicitly)
+	NextRetryTime time.Time
+}
+
+// summary of the spool
+type StructStoreSpoolStatus struct {
+	// number of entries in the spool
+	Depth int
+	// number of entries per store key
+	StoreDepths map[string]int
+	// creation time of the oldest entry (zero if the spool is empty)
+	OldestTime time.Time
+	// earliest retry time among the entries (zero if the spool is empty)
+	NextRetryTime time.Time
+}
+
+// outcome of a replay
+type StructStoreSpoolReplayResult struct {
+	// number of entries attempted
+	Attempted int
+	// number of entries written and removed from the spool
+	Replayed int
+	// number of entries failed again (kept with a longer backoff)
+	Failed int
+	// number of entries left in the spool
+	Remaining int
+}
+
+// function resolving a store key into the store instance (e.g. GetStoreByKey)
+type StoreResolver func(storeKey string) (IStore, error)
+
+// durable dead-letter queue of the failed store writes; entries are kept in memory and
+// appended to a json-lines file (if a filepath is provided) so that they survive a restart.
+// Due entries are retried with an exponential backoff; successful writes are removed from the spool
+type StructStoreSpool struct {
+	// the file storing the entries (empty means in-memory only)
+	filepath string
+	// delay before the first retry; doubled per failed attempt up to maxBackoff
+	backoff    time.Duration
+	maxBackoff time.Duration
+	// entries in the order spooled
+	entries []StructStoreSpoolEntry
+	// id of the next entry
+	nextId int64
+	clock  util.IClock
+
+	// guards the entries; NEVER held whilst writing into a store
+	lock sync.Mutex
+	// only one replay at a time
+	replayLock sync.Mutex
+}
+
+// creation method for StructStoreSpool; entries already available in the file would be loaded.
+// The optional clock tells the current time (util.SystemClock by default)
+func NewStructStoreSpool(filepath string, backoff, maxBackoff time.Duration, clock ...util.IClock) (pSpool *StructStoreSpool, err error) {
+	pSpool = new(StructStoreSpool)
+	pSpool.filepath = filepath
+	pSpool.backoff = backoff
+	pSpool.maxBackoff = maxBackoff
+	if pSpool.maxBackoff < pSpool.backoff {
+		pSpool.maxBackoff = pSpool.backoff
+	}
+	pSpool.entries = make([]StructStoreSpoolEntry, 0)
+	pSpool.nextId = 1
+	pSpool.clock = util.GetClock(clock...)
+
+	if !util.IsEmptyString(filepath) {
+		err = pSpool.load()
+	}
+	return
+}
+
+// inject the clock telling the current time (e.g. a util.StructFakeClock for testing)
+func (s *StructStoreSpool) SetClock(clock util.IClock) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.clock = util.GetClock(clock)
+}
+
+// the current time of the spool's clock
+func (s *StructStoreSpool) getNow() time.Time {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.clock.Now()
+}
+
+// spool the record which could not be written into the store; reason is the error of the failed write
+func (s *StructStoreSpool) Add(storeKey string, record map[string]StructStoreValue, reason string) (err error) {
+	jsonRecord, err := EncodeStoreRecord(record)
+	if err != nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := s.clock.Now()
+	entry := StructStoreSpoolEntry{
+		Id:            s.nextId,
+		StoreKey:      storeKey,
+		Record:        json.RawMessage(jsonRecord),
+		Attempts:      1,
+		LastError:     reason,
+		CreatedTime:   now,
+		NextRetryTime: now.Add(s.getBackoff(1)),
+	}
+	s.nextId++
+	s.entries = append(s.entries, entry)
+	if !util.IsEmptyString(s.filepath) {
+		err = s.appendToFile(entry)
+	}
+	return
+}
+
+// return the spool's depth (in total and per store key) and its timings
+func (s *StructStoreSpool) GetStatus() (status StructStoreSpoolStatus) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	status.Depth = len(s.entries)
+	status.StoreDepths = make(map[string]int)
+	for _, entry := range s.entries {
+		status.StoreDepths[entry.StoreKey]++
+		if status.OldestTime.IsZero() || entry.CreatedTime.Before(status.OldestTime) {
+			status.OldestTime = entry.CreatedTime
+		}
+		if status.NextRetryTime.IsZero() || entry.NextRetryTime.Before(status.NextRetryTime) {
+			status.NextRetryTime = entry.NextRetryTime
+		}
+	}
+	return
+}
+
+// return the entries of the given store key (empty means all stores)
+func (s *StructStoreSpool) List(storeKey string) (entries []StructStoreSpoolEntry) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	entries = make([]StructStoreSpoolEntry, 0)
+	for _, entry := range s.entries {
+		if util.IsEmptyString(storeKey) || strings.Compare(entry.StoreKey, storeKey) == 0 {
+			entries = append(entries, entry)
+		}
+	}
+	return
+}
+
+// retry the entries; only the entries due for a retry are attempted unless force is set (replay everything).
+// Written entries are removed, failed ones are kept with a longer backoff
+func (s *StructStoreSpool) Replay(resolver StoreResolver, force bool) (result StructStoreSpoolReplayResult, err error) {
+	s.replayLock.Lock()
+	defer s.replayLock.Unlock()
+
+	// snapshot the due entries; the stores are written without holding the lock
+	s.lock.Lock()
+	now := s.clock.Now()
+	dueEntries := make([]StructStoreSpoolEntry, 0)
+	for _, entry := range s.entries {
+		if force || !entry.NextRetryTime.After(now) {
+			dueEntries = append(dueEntries, entry)
+		}
+	}
+	s.lock.Unlock()
+
+	if len(dueEntries) == 0 {
+		result.Remaining = s.GetStatus().Depth
+		return
+	}
+	replayedIds := make(map[int64]bool)
+	failedErrors := make(map[int64]string)
+	for _, entry := range dueEntries {
+		result.Attempted++
+		errMessage := s.replayEntry(resolver, entry)
+		if util.IsEmptyString(errMessage) {
+			replayedIds[entry.Id] = true
+			result.Replayed++
+		} else {
+			failedErrors[entry.Id] = errMessage
+			result.Failed++
+			recordStoreWriteError(entry.StoreKey, errMessage, s.getNow())
+		}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now = s.clock.Now()
+	entries := make([]StructStoreSpoolEntry, 0, len(s.entries))
+	for _, entry := range s.entries {
+		if replayedIds[entry.Id] {
+			continue
+		}
+		if errMessage, isFailed := failedErrors[entry.Id]; isFailed {
+			entry.Attempts++
+			entry.LastError = errMessage
+			entry.NextRetryTime = now.Add(s.getBackoff(entry.Attempts))
+		}
+		entries = append(entries, entry)
+	}
+	s.entries = entries
+	result.Remaining = len(s.entries)
+	err = s.rewrite()
+	return
+}
+
+// write the entry's record into its store; returns the error message if failed
+func (s *StructStoreSpool) replayEntry(resolver StoreResolver, entry StructStoreSpoolEntry) (errMessage string) {
+	iStore, err := resolver(entry.StoreKey)
+	if err != nil {
+		return err.Error()
+	}
+	if iStore == nil {
+		return fmt.Sprintf("store [%v] is not available", entry.StoreKey)
+	}
+	record, err := DecodeStoreRecord(string(entry.Record))
+	if err != nil {
+		return fmt.Sprintf("spooled record is corrupted => %v", err)
+	}
+	response, err := iStore.Persist(record)
+	if err != nil {
+		return err.Error()
+	}
+	if response.Code != CodeSuccess {
+		return fmt.Sprintf("(%v) - %v", response.Code, response.Message)
+	}
+	return
+}
+
+// remove the entries of the given store key (empty means all stores) without retrying them
+func (s *StructStoreSpool) Purge(storeKey string) (purged int, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	entries := make([]StructStoreSpoolEntry, 0, len(s.entries))
+	for _, entry := range s.entries {
+		if util.IsEmptyString(storeKey) || strings.Compare(entry.StoreKey, storeKey) == 0 {
+			purged++
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	if purged == 0 {
+		return
+	}
+	s.entries = entries
+	err = s.rewrite()
+	return
+}
+
+// backoff after the given number of failed attempts => backoff * 2^(attempts-1), capped by maxBackoff
+func (s *StructStoreSpool) getBackoff(attempts int) (backoff time.Duration) {
+	backoff = s.backoff
+	for i := 1; i < attempts && backoff < s.maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > s.maxBackoff {
+		backoff = s.maxBackoff
+	}
+	return
+}
+
+// load the entries from the spool file (a missing file simply means an empty spool)
+func (s *StructStoreSpool) load() (err error) {
+	pFile, err := os.Open(s.filepath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	defer func() {
+		err2 := pFile.Close()
+		if err == nil && err2 != nil {
+			err = err2
+		}
+	}()
+	pScanner := bufio.NewScanner(pFile)
+	// a record could be longer than the default 64k token
+	pScanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for pScanner.Scan() {
+		line := pScanner.Text()
+		if util.IsEmptyString(line) {
+			continue
+		}
+		entry := new(StructStoreSpoolEntry)
+		// skip corrupted lines instead of failing the whole spool
+		if json.Unmarshal([]byte(line), entry) != nil {
+			continue
+		}
+		s.entries = append(s.entries, *entry)
+		if entry.Id >= s.nextId {
+			s.nextId = entry.Id + 1
+		}
+	}
+	err = pScanner.Err()
+	return
+}
+
+func (s *StructStoreSpool) appendToFile(entry StructStoreSpoolEntry) (err error) {
+	bEntry, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	pFile, err := os.OpenFile(s.filepath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0666)
+	if err != nil {
+		return
+	}
+	defer func() {
+		err2 := pFile.Close()
+		if err == nil && err2 != nil {
+			err = err2
+		}
+	}()
+	_, err = pFile.WriteString(string(bEntry) + "\n")
+	return
+}
+
+// re-write the whole spool file with the entries in memory (temp file + rename)
+func (s *StructStoreSpool) rewrite() (err error) {
+	if util.IsEmptyString(s.filepath) {
+		return
+	}
+	tmpFilepath := s.filepath + ".tmp"
+	pFile, err := os.OpenFile(tmpFilepath, os.O_TRUNC|os.O_WRONLY|os.O_CREATE, 0666)
+	if err != nil {
+		return
+	}
+	pWriter := bufio.NewWriter(pFile)
+	for _, entry := range s.entries {
+		bEntry, err2 := json.Marshal(entry)
+		if err2 != nil {
+			err = err2
+			break
+		}
+		_, err = pWriter.WriteString(string(bEntry) + "\n")
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = pWriter.Flush()
+	}
+	err2 := pFile.Close()
+	if err == nil {
+		err = err2
+	}
+	if err != nil {
+		return
+	}
+	err = os.Rename(tmpFilepath, s.filepath)
+	return
+}
+
+// * ************** *
+// * spooling store *
+// * ************** *
+
+// store wrapper spooling the records whose Persist failed; every other operation goes to the wrapped store
+type StructSpoolingStore struct {
+	IStore
+	// key of the wrapped store (e.g. sqlitestore.stock_aastocks.700_tencent)
+	storeKey string
+	pSpool   *StructStoreSpool
+	// number of the records the wrapped store accepted (spooled records excluded); guarded by lock
+	persistedCount int
+	lock           sync.Mutex
+}
+
+// creation method for StructSpoolingStore
+func NewStructSpoolingStore(iStore IStore, storeKey string, pSpool *StructStoreSpool) (pStore *StructSpoolingStore) {
+	pStore = new(StructSpoolingStore)
+	pStore.IStore = iStore
+	pStore.storeKey = storeKey
+	pStore.pSpool = pSpool
+	// influx lines are written later (in batches or by the background flush), hence the records of the lines
+	// dropped after failed writes are spooled too
+	if pInfluxStore, isInflux := iStore.(*StructInfluxStore); isInflux && pSpool != nil {
+		pInfluxStore.SetDroppedRecordsHandler(pStore.spoolDroppedRecords)
+	}
+	return
+}
+
+// spool the records dropped by the wrapped store (never written) for a retry
+func (s *StructSpoolingStore) spoolDroppedRecords(records []map[string]StructStoreValue, reason string) {
+	recordStoreWriteError(s.storeKey, reason, s.pSpool.getNow())
+	for _, record := range records {
+		err := s.pSpool.Add(s.storeKey, record, reason)
+		if err != nil {
+			logStoreError("storeSpool", "spoolDroppedRecords", fmt.Sprintf("could not spool the dropped record of store [%v] => %v", s.storeKey, err))
+		}
+	}
+}
+
+// return the key of the wrapped store
+func (s *StructSpoolingStore) GetStoreKey() string {
+	return s.storeKey
+}
+
+// number of the records the wrapped store accepted so far (spooled records excluded)
+func (s *StructSpoolingStore) GetPersistedCount() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.persistedCount
+}
+
+// persist into the wrapped store; on failure the record is spooled for a retry and the failure is still returned
+func (s *StructSpoolingStore) Persist(data map[string]StructStoreValue) (response StructStoreResponse, err error) {
+	response, err = s.IStore.Persist(data)
+	reason := ""
+	if err != nil {
+		reason = err.Error()
+	} else if response.Code != CodeSuccess {
+		reason = fmt.Sprintf("(%v) - %v", response.Code, response.Message)
+	} else {
+		s.lock.Lock()
+		s.persistedCount++
+		s.lock.Unlock()
+		return
+	}
+	recordStoreWriteError(s.storeKey, reason, s.pSpool.getNow())
+	// a record rejected by the schema would never be accepted, hence not spooled
+	if IsSchemaError(err) {
+		return
+	}
+	err2 := s.pSpool.Add(s.storeKey, data, reason)
+	if err2 != nil {
+		err = errors.New(fmt.Sprintf("%v => could not be spooled for retry => %v", reason, err2))
+		return
+	}
+	if err != nil {
+		err = errors.New(fmt.Sprintf("%v => spooled for retry", reason))
+	} else {
+		response.Message = fmt.Sprintf("%v => spooled for retry", response.Message)
+	}
+	return
+}
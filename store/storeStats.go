@@ -0,0 +1,215 @@
+/*
+ *  Copyright Project - Stockbinator, Author - quoeamaster, (C) 2019
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+package store
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// statistics of a store; tells whether the store is still growing
+type StructStoreStats struct {
+	StoreKey string
+	// store type (e.g. filestore, sqlitestore)
+	Type string
+	// where the records are kept; the file (or segment directory) path, or the url(s) of a remote store
+	Location string
+	// number of records (-1 if the store could not be read, e.g. influxstore)
+	RecordCount int
+	// size of the store's files on disk (0 for the remote and in-memory stores)
+	Bytes int64
+	// statistics per symbol (stock_id), ordered by the symbol
+	Symbols []StructStoreSymbolStats
+	// the latest failed write since the process started (nil if none)
+	LastWriteError *StructStoreWriteError
+	// number of records dropped before being written (e.g. influxstore over max_pending_lines)
+	DroppedRecords int
+	// error reading the records (e.g. the store is write only)
+	Error string
+}
+
+// statistics of a symbol (stock_id) within a store
+type StructStoreSymbolStats struct {
+	StockId     string
+	RecordCount int
+	// the oldest and latest trx_date of the symbol's records
+	FirstTrxDate time.Time
+	LastTrxDate  time.Time
+}
+
+// a failed write into a store
+type StructStoreWriteError struct {
+	Time    time.Time
+	Message string
+}
+
+// store key -> the latest failed write
+var storeWriteErrors = make(map[string]StructStoreWriteError)
+var storeWriteErrorsLock sync.Mutex
+
+// record the failed write into the store of the given key (e.g. by StructSpoolingStore)
+func recordStoreWriteError(storeKey string, message string, failedTime time.Time) {
+	storeWriteErrorsLock.Lock()
+	defer storeWriteErrorsLock.Unlock()
+	storeWriteErrors[storeKey] = StructStoreWriteError{ Time: failedTime, Message: message }
+}
+
+// return the latest failed write into the store of the given key
+func GetStoreWriteError(storeKey string) (writeError StructStoreWriteError, isAvailable bool) {
+	storeWriteErrorsLock.Lock()
+	defer storeWriteErrorsLock.Unlock()
+	writeError, isAvailable = storeWriteErrors[storeKey]
+	return
+}
+
+// collect the statistics of the store; the records are iterated once to count them per symbol
+func GetStoreStats(storeKey string, iStore IStore) (stats StructStoreStats) {
+	stats.StoreKey = storeKey
+	stats.Type = strings.SplitN(storeKey, ".", 2)[0]
+	stats.Symbols = make([]StructStoreSymbolStats, 0)
+	stats.Location, stats.Bytes = getStoreLocation(iStore)
+
+	pInfluxStore, isInflux := iStore.(*StructInfluxStore)
+	if isInflux {
+		stats.DroppedRecords = pInfluxStore.GetDroppedLineCount()
+	}
+	if writeError, isAvailable := GetStoreWriteError(storeKey); isAvailable {
+		stats.LastWriteError = &writeError
+	} else if isInflux {
+		// the influx writes are batched in the background, hence failures are only known by the store
+		if err := pInfluxStore.GetLastError(); err != nil {
+			stats.LastWriteError = &StructStoreWriteError{ Message: err.Error() }
+		}
+	}
+
+	symbols, err := countStoreRecords(iStore)
+	if err != nil {
+		stats.RecordCount = -1
+		stats.Error = err.Error()
+		return
+	}
+	for _, symbolStats := range symbols {
+		stats.RecordCount += symbolStats.RecordCount
+		stats.Symbols = append(stats.Symbols, *symbolStats)
+	}
+	sort.Slice(stats.Symbols, func(i, j int) bool {
+		return stats.Symbols[i].StockId < stats.Symbols[j].StockId
+	})
+	return
+}
+
+// count the records of the store per symbol (stock_id)
+func countStoreRecords(iStore IStore) (symbols map[string]*StructStoreSymbolStats, err error) {
+	response, iterator, err := iStore.Iterate()
+	if err != nil {
+		return
+	}
+	if iterator != nil {
+		defer iterator.Close()
+	}
+	if response.Code != CodeSuccess || iterator == nil {
+		err = errors.New(fmt.Sprintf("(%v) - %v", response.Code, response.Message))
+		return
+	}
+
+	symbols = make(map[string]*StructStoreSymbolStats)
+	for iterator.Next() {
+		record, isObject := iterator.Record().Value.(map[string]StructStoreValue)
+		if !isObject {
+			continue
+		}
+		stockId := ""
+		if value, isAvailable := record[StoreKeyStockId]; isAvailable && value.Value != nil {
+			stockId = fmt.Sprintf("%v", value.Value)
+		}
+		pSymbolStats := symbols[stockId]
+		if pSymbolStats == nil {
+			pSymbolStats = &StructStoreSymbolStats{ StockId: stockId }
+			symbols[stockId] = pSymbolStats
+		}
+		pSymbolStats.RecordCount++
+
+		trxDate, isDate := toStoreDate(record[StoreKeyTrxDate].Value)
+		if !isDate {
+			continue
+		}
+		if pSymbolStats.FirstTrxDate.IsZero() || trxDate.Before(pSymbolStats.FirstTrxDate) {
+			pSymbolStats.FirstTrxDate = trxDate
+		}
+		if trxDate.After(pSymbolStats.LastTrxDate) {
+			pSymbolStats.LastTrxDate = trxDate
+		}
+	}
+	err = iterator.Err()
+	return
+}
+
+// return where the store keeps its records and the size of its files on disk
+func getStoreLocation(iStore IStore) (location string, bytes int64) {
+	switch pStore := iStore.(type) {
+	case *StructFilestore:
+		location = pStore.filepath
+		if pStore.isPartitioned() {
+			location = pStore.getSegmentDirectory()
+		}
+		filepaths, err := pStore.listSegmentFilepaths(time.Time{}, time.Time{})
+		if err == nil {
+			bytes = getFileSizes(filepaths...)
+		}
+	case *StructSqliteStore:
+		// the WAL journal holds the writes not yet checkpointed into the database file
+		location = pStore.path
+		bytes = getFileSizes(pStore.path, pStore.path+"-wal")
+	case *StructBoltStore:
+		location = pStore.path
+		bytes = getFileSizes(pStore.path)
+	case *StructElasticsearchStore:
+		location = strings.Join(pStore.hosts, ",")
+	case *StructInfluxStore:
+		// without the query (e.g. db and credentials)
+		location = pStore.writeUrl
+		if pUrl, err := url.Parse(pStore.writeUrl); err == nil {
+			pUrl.RawQuery = ""
+			pUrl.User = nil
+			location = pUrl.String()
+		}
+	case *StructMemoryStore:
+		location = "memory"
+		if backing := pStore.getBackingStore(); backing != nil {
+			backingLocation, _ := getStoreLocation(backing)
+			location = fmt.Sprintf("memory (backed by %v)", backingLocation)
+		}
+	case *StructSpoolingStore:
+		location, bytes = getStoreLocation(pStore.IStore)
+	}
+	return
+}
+
+// total size of the files; missing files are ignored
+func getFileSizes(filepaths ...string) (bytes int64) {
+	for _, filepath := range filepaths {
+		if fileInfo, err := os.Stat(filepath); err == nil && !fileInfo.IsDir() {
+			bytes += fileInfo.Size()
+		}
+	}
+	return
+}
@@ -0,0 +1,214 @@
+/*
+ *  Copyright Project - Stockbinator, Author - quoeamaster, (C) 2019
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+package tests
+
+import (
+	"Stockbinator/store"
+	"Stockbinator/util"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBoltStorePersistAndQuery(t *testing.T) {
+	if !*pFlagBolt {
+		t.SkipNow()
+	}
+	LogTestOutput("TestBoltStorePersistAndQuery", "a. store selected by the key prefix")
+	cfgFilepath := helperCreateBoltConfig("", t)
+	cfg, err := util.LoadConfig(cfgFilepath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iStore, err := store.GetStoreByKey("boltstore.stock_test.700_tencent", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pStore, isBolt := iStore.(*store.StructBoltStore)
+	if !isBolt {
+		t.Fatal(fmt.Sprintf("expected a bolt store BUT got %T", iStore))
+	}
+	iOtherStore, err := store.GetStoreByKey("boltstore.stock_test.939_ccb", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	LogTestOutput("TestBoltStorePersistAndQuery", "b. persist records out of order")
+	baseTime := time.Date(2019, 7, 1, 1, 0, 0, 0, time.UTC)
+	for _, i := range []int{ 3, 0, 4, 1, 2 } {
+		resp, err := pStore.Persist(helperElasticsearchRecord("700_tencent", baseTime.Add(time.Hour*time.Duration(i)), float64(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		helperFilestoreFlowsCommonResponseHandler(resp, t)
+	}
+	_, err = iOtherStore.Persist(helperElasticsearchRecord("939_ccb", baseTime.Add(time.Hour*2), 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = pStore.Persist(map[string]store.StructStoreValue{ "price": {Value: 1.5, Type: store.TypeFloat} })
+	if err == nil {
+		t.Fatal("expected a record without trx_date is rejected")
+	}
+
+	LogTestOutput("TestBoltStorePersistAndQuery", "c. range scans are chronological")
+	_, records, err := pStore.Query("700_tencent", baseTime.Add(time.Hour), baseTime.Add(time.Hour*3), []string{ "price" }, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 {
+		t.Fatal(fmt.Sprintf("expected 3 records BUT got %v", records))
+	}
+	for i, record := range records {
+		if price := helperFilestoreRecordField(record, "price", t); price != float64(i+1) {
+			t.Fatal(fmt.Sprintf("expected price %v at index %v BUT got %v", i+1, i, price))
+		}
+	}
+	_, records, err = pStore.Query("", baseTime.Add(time.Hour*2), baseTime.Add(time.Hour*2), nil, 0)
+	if err != nil || len(records) != 2 {
+		t.Fatal(fmt.Sprintf("expected 1 record per symbol BUT got %v (%v)", records, err))
+	}
+
+	LogTestOutput("TestBoltStorePersistAndQuery", "d. writing whilst iterating does not block")
+	_, iterator, err := pStore.Iterate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	iterated := 0
+	for iterator.Next() {
+		if iterated == 0 {
+			_, err = pStore.Persist(helperElasticsearchRecord("700_tencent", baseTime.Add(time.Hour*10), 10))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		iterated++
+	}
+	// the record written after the (only) page was read is not visited
+	if iterator.Err() != nil || iterated != 5 {
+		t.Fatal(fmt.Sprintf("expected 5 iterated records BUT got %v (%v)", iterated, iterator.Err()))
+	}
+	_ = iterator.Close()
+
+	LogTestOutput("TestBoltStorePersistAndQuery", "e. modify, remove by key and remove all")
+	key := store.BuildRecordKey("700_tencent", baseTime.Add(time.Hour))
+	_, err = pStore.ModifyByKey(key, store.StructStoreValue{IsObject: true, Value: map[string]store.StructStoreValue{
+		"volume": {Value: "1 Million", Type: store.TypeString},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, value, err := pStore.ReadByKey(key, nil)
+	if err != nil || helperFilestoreRecordField(value, "volume", t) != "1 Million" {
+		t.Fatal(fmt.Sprintf("expected the modified record BUT got %v (%v)", value, err))
+	}
+	_, err = pStore.ModifyByKey(key, store.StructStoreValue{IsObject: true, Value: map[string]store.StructStoreValue{
+		"trx_date": {Value: baseTime, Type: store.TypeDate},
+		"volume":   {Value: "2 Million", Type: store.TypeString},
+	}})
+	if err == nil {
+		t.Fatal("expected the record identity could not be modified")
+	}
+	_, value, err = pStore.ReadByKey(key, nil)
+	if err != nil || helperFilestoreRecordField(value, "volume", t) != "1 Million" {
+		t.Fatal(fmt.Sprintf("expected the failed modification rolled back BUT got %v (%v)", value, err))
+	}
+	_, removed, err := pStore.RemoveByKey(key)
+	if err != nil || helperFilestoreRecordField(removed, "price", t) != float64(1) {
+		t.Fatal(fmt.Sprintf("expected the removed record BUT got %v (%v)", removed, err))
+	}
+	resp, _, err := pStore.RemoveByKey(key)
+	if err == nil || resp.Code != store.CodeFailure {
+		t.Fatal("expected the removed record is not available anymore")
+	}
+	_, err = pStore.RemoveAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, content, err := pStore.ReadAll()
+	if err != nil || strings.TrimSpace(content) != "" {
+		t.Fatal(fmt.Sprintf("expected no records left BUT got [%v] (%v)", content, err))
+	}
+	_, content, err = iOtherStore.ReadAll()
+	if err != nil || strings.Count(content, "\n") != 1 {
+		t.Fatal(fmt.Sprintf("expected the other symbol's record kept BUT got [%v] (%v)", content, err))
+	}
+}
+
+func TestBoltStoreDeduplication(t *testing.T) {
+	if !*pFlagBolt {
+		t.SkipNow()
+	}
+	cfg, err := util.LoadConfig(helperCreateBoltConfig("duplicate_policy = \"skip\"\n", t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pStore := store.NewStructBoltStore(cfg, "stock_test.700_tencent")
+	trxDate := time.Date(2019, 7, 2, 2, 0, 0, 0, time.UTC)
+	key := store.BuildRecordKey("700_tencent", trxDate)
+
+	LogTestOutput("TestBoltStoreDeduplication", "a. skip (configured)")
+	for _, price := range []float64{ 1, 2 } {
+		_, err = pStore.Persist(helperElasticsearchRecord("700_tencent", trxDate, price))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, value, err := pStore.ReadByKey(key, nil)
+	if err != nil || helperFilestoreRecordField(value, "price", t) != float64(1) {
+		t.Fatal(fmt.Sprintf("expected the original price 1 BUT got %v (%v)", value, err))
+	}
+
+	LogTestOutput("TestBoltStoreDeduplication", "b. replace")
+	pStore.SetNaturalKey(store.StructNaturalKey{Fields: []string{ store.StoreKeyStockId, store.StoreKeyTrxDate }, DuplicatePolicy: "replace"})
+	_, err = pStore.Persist(helperElasticsearchRecord("700_tencent", trxDate, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, content, err := pStore.ReadAll()
+	if err != nil || strings.Count(content, "\n") != 1 || !strings.Contains(content, "3.0") {
+		t.Fatal(fmt.Sprintf("expected the replaced record ONLY BUT got [%v] (%v)", content, err))
+	}
+
+	LogTestOutput("TestBoltStoreDeduplication", "c. append")
+	pStore.SetNaturalKey(store.StructNaturalKey{Fields: []string{ store.StoreKeyStockId, store.StoreKeyTrxDate }, DuplicatePolicy: "append"})
+	_, err = pStore.Persist(helperElasticsearchRecord("700_tencent", trxDate, 4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, content, err = pStore.ReadAll()
+	if err != nil || strings.Count(content, "\n") != 2 {
+		t.Fatal(fmt.Sprintf("expected 2 records with the same key BUT got [%v] (%v)", content, err))
+	}
+}
+
+// app.toml with a [boltstore] pointing to a new temp database file
+func helperCreateBoltConfig(additionalConfig string, t *testing.T) (cfgFilepath string) {
+	repo, err := ioutil.TempDir("", "boltstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfgFilepath = filepath.Join(repo, "app.toml")
+	err = ioutil.WriteFile(cfgFilepath, []byte(fmt.Sprintf("[boltstore]\npath = \"%v\"\n%v\n",
+		filepath.Join(repo, "stockbinator.bolt"), additionalConfig)), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
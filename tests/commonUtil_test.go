@@ -18,6 +18,8 @@ package tests
 import (
 	"Stockbinator/util"
 	"fmt"
+	"io/ioutil"
+	"os"
 	"strings"
 	"testing"
 	"time"
@@ -275,3 +277,96 @@ func TestParseEnvVar(t *testing.T)  {
 	LogTestOutput("TestParseEnvVar", "** end test **\n")
 }
 
+// test on "today" calculation with a fake clock (midnight, year-end and DST rollover)
+func TestCreateTodayTargetTimeWithClock(t *testing.T) {
+	if !*pFlagCommonUtil {
+		t.SkipNow()
+	}
+	LogTestOutput("TestCreateTodayTargetTimeWithClock", "** start test **")
+
+	pLondon, err := time.LoadLocation("Europe/London")
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := []struct {
+		clockTime string
+		pLocation *time.Location
+		hour      int
+		min       int
+		timezone  string
+		expected  string
+	}{
+		// already "tomorrow" in +08:00 though still "today" in UTC
+		{ "2019-07-03T23:30:00+00:00", time.UTC, 16, 10, "+08:00", "2019-07-04T16:10:00+08:00" },
+		{ "2019-07-03T15:59:00+00:00", time.UTC, 16, 10, "+08:00", "2019-07-03T16:10:00+08:00" },
+		// year-end rollover in both directions
+		{ "2019-12-31T20:00:00+00:00", time.UTC, 0, 15, "+08:00", "2020-01-01T00:15:00+08:00" },
+		{ "2020-01-01T03:00:00+00:00", time.UTC, 21, 0, "-07:00", "2019-12-31T21:00:00-07:00" },
+		// DST starts in London on 2019-03-31 01:00 (GMT => BST); the fixed offset schedule is not affected
+		{ "2019-03-31T00:30:00+00:00", pLondon, 8, 0, "+00:00", "2019-03-31T08:00:00+00:00" },
+		{ "2019-03-31T23:30:00+00:00", pLondon, 8, 0, "+00:00", "2019-03-31T08:00:00+00:00" },
+		{ "2019-03-31T23:30:00+00:00", pLondon, 8, 0, "+01:00", "2019-04-01T08:00:00+01:00" },
+	}
+	for _, result := range results {
+		clockTime, err := time.Parse(util.CommonDateFormat, result.clockTime)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pClock := util.NewStructFakeClock(clockTime.In(result.pLocation))
+		sToday := util.CreateTodayTargetTimeByHourMinTimezone(result.hour, result.min, result.timezone, pClock)
+		if strings.Compare(sToday, result.expected) != 0 {
+			t.Fatal(fmt.Sprintf("clock at %v => expected [%v] BUT got [%v]", result.clockTime, result.expected, sToday))
+		}
+		dToday, err := util.ParseStringDateToTodayUTC(result.hour, result.min, result.timezone, pClock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dExpected, _ := time.Parse(util.CommonDateFormat, result.expected)
+		if !dToday.Equal(dExpected) || dToday.Location() != time.UTC {
+			t.Fatal(fmt.Sprintf("expected UTC date of %v BUT got %v", result.expected, dToday))
+		}
+	}
+	LogTestOutput("TestCreateTodayTargetTimeWithClock", "** end test **\n")
+}
+
+// test on the current year's holidays with a fake clock crossing the year-end
+func TestGetCurrentYearHolidaysWithClock(t *testing.T) {
+	if !*pFlagCommonUtil {
+		t.SkipNow()
+	}
+	LogTestOutput("TestGetCurrentYearHolidaysWithClock", "** start test **")
+
+	tmpFile, err := ioutil.TempFile("", "holiday*.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.Remove(tmpFile.Name())
+	}()
+	_, err = tmpFile.WriteString(`
+[2019]
+holidays = [ "2019-01-01T00:00:00+08:00", "2019-12-25T00:00:00+08:00" ]
+[2020]
+holidays = [ "2020-01-01T00:00:00+08:00" ]
+`)
+	_ = tmpFile.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	holidayConfig, err := util.LoadConfig(tmpFile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	clockTime, _ := time.Parse(util.CommonDateFormat, "2019-12-31T23:59:59+00:00")
+	pClock := util.NewStructFakeClock(clockTime)
+	holidaySlice, err := util.GetCurrentYearHolidays(&holidayConfig, pClock)
+	if err != nil || len(holidaySlice) != 2 {
+		t.Fatal(fmt.Sprintf("expected the 2 holidays of 2019 BUT got %v (err => %v)", holidaySlice, err))
+	}
+	pClock.Advance(time.Second)
+	holidaySlice, err = util.GetCurrentYearHolidays(&holidayConfig, pClock)
+	if err != nil || len(holidaySlice) != 1 {
+		t.Fatal(fmt.Sprintf("expected the 1 holiday of 2020 BUT got %v (err => %v)", holidaySlice, err))
+	}
+	LogTestOutput("TestGetCurrentYearHolidaysWithClock", "** end test **\n")
+}
@@ -0,0 +1,454 @@
+/*
+ *  Copyright Project - Stockbinator, Author - quoeamaster, (C) 2019
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+package tests
+
+import (
+	"Stockbinator/common"
+	"Stockbinator/config"
+	"Stockbinator/util"
+	"Stockbinator/webservice"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCronServiceUpsertRemovePauseResume(t *testing.T) {
+	if !*pFlagCronService {
+		t.SkipNow()
+	}
+	LogTestOutput("TestCronServiceUpsertRemovePauseResume", "** start test **")
+	pCron := webservice.NewStructCron(nil)
+
+	LogTestOutput("TestCronServiceUpsertRemovePauseResume", "a. insert and re-upsert on the same time")
+	inserted, err := pCron.UpsertTimeCron(16, 10, 0, "+08:00", stockModuleKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !inserted {
+		t.Fatal("expected a NEW time-cron entry to be inserted")
+	}
+	inserted, err = pCron.UpsertTimeCron(16, 10, 0, "+08:00", stockModuleKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inserted {
+		t.Fatal("expected the time-cron entry to be updated instead of inserted")
+	}
+
+	LogTestOutput("TestCronServiceUpsertRemovePauseResume", "b. pause and re-schedule to another time")
+	found, err := pCron.PauseTimeCron(stockModuleKey)
+	if err != nil || !found {
+		t.Fatal(fmt.Sprintf("expected the rule to be paused, found? %v, err => %v", found, err))
+	}
+	_, err = pCron.UpsertTimeCron(17, 30, 0, "+08:00", stockModuleKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, found := pCron.GetTimeCronByRule(stockModuleKey)
+	if !found {
+		t.Fatal("expected the rule to be still scheduled after re-scheduling")
+	}
+	if entry.UTCTime.Hour() != 9 || entry.UTCTime.Minute() != 30 {
+		t.Fatal(fmt.Sprintf("expected the rule to be moved to 09:30 UTC BUT got %v", entry.UTCTime))
+	}
+	if len(entry.StocksModuleRuleList) != 1 || len(entry.PausedStocksModuleRuleList) != 1 {
+		t.Fatal(fmt.Sprintf("expected 1 rule (paused) under the entry BUT got %v (paused %v)",
+			entry.StocksModuleRuleList, entry.PausedStocksModuleRuleList))
+	}
+
+	LogTestOutput("TestCronServiceUpsertRemovePauseResume", "c. resume and remove")
+	found, err = pCron.ResumeTimeCron(stockModuleKey)
+	if err != nil || !found {
+		t.Fatal(fmt.Sprintf("expected the rule to be resumed, found? %v, err => %v", found, err))
+	}
+	entry, _ = pCron.GetTimeCronByRule(stockModuleKey)
+	if len(entry.PausedStocksModuleRuleList) != 0 {
+		t.Fatal(fmt.Sprintf("expected no paused rules BUT got %v", entry.PausedStocksModuleRuleList))
+	}
+	removed, err := pCron.RemoveTimeCron(stockModuleKey)
+	if err != nil || !removed {
+		t.Fatal(fmt.Sprintf("expected the rule to be removed, removed? %v, err => %v", removed, err))
+	}
+	removed, err = pCron.RemoveTimeCron(stockModuleKey)
+	if err != nil || removed {
+		t.Fatal(fmt.Sprintf("expected nothing to be removed, removed? %v, err => %v", removed, err))
+	}
+	found, _ = pCron.PauseTimeCron(stockModuleKey)
+	if found {
+		t.Fatal("expected a non scheduled rule could NOT be paused")
+	}
+
+	LogTestOutput("TestCronServiceUpsertRemovePauseResume", "** end test **\n")
+}
+
+func TestCronHistoryBoundedQuery(t *testing.T) {
+	if !*pFlagCronService {
+		t.SkipNow()
+	}
+	LogTestOutput("TestCronHistoryBoundedQuery", "** start test **")
+	tmpDir, err := ioutil.TempDir("", "cronHistory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+	historyFilepath := fmt.Sprintf("%v/%v", tmpDir, "cron.history")
+
+	LogTestOutput("TestCronHistoryBoundedQuery", "a. append records over the bound")
+	pHistory, err := webservice.NewStructCronHistory(historyFilepath, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	startTime, _ := time.Parse(time.RFC3339, "2019-07-01T08:10:00Z")
+	for i := 0; i < 5; i++ {
+		record := webservice.StructCronJobRecord{
+			StocksModuleRule: stockModuleKey,
+			StartTime:        startTime.Add(time.Hour * 24 * time.Duration(i)),
+			EndTime:          startTime.Add(time.Hour * 24 * time.Duration(i)).Add(time.Second),
+			Outcome:          webservice.CronJobOutcomeSuccess,
+		}
+		if i == 4 {
+			record.StocksModuleRule = "stock_aastocks.1299_aia"
+			record.Outcome = webservice.CronJobOutcomeFailure
+			record.ErrorMessage = "connection refused"
+		}
+		err = pHistory.Append(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the file is compacted in a batch once over 1.5 x the bound (4 lines)
+		bContent, err := ioutil.ReadFile(historyFilepath)
+		expectedLines := map[int]int{ 0: 1, 1: 2, 2: 3, 3: 4, 4: 3 }[i]
+		if err != nil || strings.Count(string(bContent), "\n") != expectedLines {
+			t.Fatal(fmt.Sprintf("expected %v lines in the history file after the record %v BUT got [%v] (%v)", expectedLines, i, string(bContent), err))
+		}
+	}
+	records := pHistory.Query("", time.Time{}, time.Time{})
+	if len(records) != 3 {
+		t.Fatal(fmt.Sprintf("expected 3 records kept BUT got %v", len(records)))
+	}
+
+	LogTestOutput("TestCronHistoryBoundedQuery", "b. reload from file and query by rule + date range")
+	pHistory, err = webservice.NewStructCronHistory(historyFilepath, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records = pHistory.Query(stockModuleKey, startTime.Add(time.Hour*24*3), time.Time{})
+	if len(records) != 1 || !records[0].StartTime.Equal(startTime.Add(time.Hour*24*3)) {
+		t.Fatal(fmt.Sprintf("expected only the 4th record of %v BUT got %v", stockModuleKey, records))
+	}
+	records = pHistory.Query("stock_aastocks.1299_aia", time.Time{}, time.Time{})
+	if len(records) != 1 || records[0].Outcome != webservice.CronJobOutcomeFailure || records[0].ErrorMessage != "connection refused" {
+		t.Fatal(fmt.Sprintf("expected the failure record of 1299_aia BUT got %v", records))
+	}
+
+	LogTestOutput("TestCronHistoryBoundedQuery", "** end test **\n")
+}
+
+func TestCronMisfirePolicy(t *testing.T) {
+	if !*pFlagCronService {
+		t.SkipNow()
+	}
+	LogTestOutput("TestCronMisfirePolicy", "** start test **")
+	tmpDir, err := ioutil.TempDir("", "cronMisfire")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+	appToml := fmt.Sprintf("%v/app.toml", tmpDir)
+	loadAppToml := func(aastocksPolicy string) (pCfg *config.StructConfig) {
+		err := ioutil.WriteFile(appToml, []byte(fmt.Sprintf(`
+[cron]
+repo = "%v/"
+misfire_policy = "run_once"
+misfire_grace = "5m"
+
+[cron.stock_unknown]
+misfire_policy = "skip"
+
+[cron.stock_aastocks]
+misfire_policy = "%v"
+`, tmpDir, aastocksPolicy)), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pCfg = new(config.StructConfig)
+		pCfg.ModuleConfigs = make(map[string]config.StructStockModuleConfig)
+		pCfg.AppConfig, err = util.LoadConfig(appToml)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	LogTestOutput("TestCronMisfirePolicy", "a. policy per module")
+	// no crawler could backfill past dates, hence run_all is rejected on load
+	err = loadAppToml("run_all").ValidateAppConf()
+	if err == nil || !strings.Contains(err.Error(), "[run_all] under [cron.stock_aastocks]") {
+		t.Fatal(fmt.Sprintf("expected run_all to be rejected BUT got %v", err))
+	}
+	pCfg := loadAppToml("run_once")
+	if err = pCfg.ValidateAppConf(); err != nil {
+		t.Fatal(err)
+	}
+	pCron := webservice.NewStructCron(pCfg)
+	policy := pCron.GetMisfirePolicy(stockModuleName)
+	if policy.Policy != common.CronMisfirePolicyRunOnce || policy.Grace != time.Minute*5 {
+		t.Fatal(fmt.Sprintf("expected run_once for %v BUT got %v", stockModuleName, policy))
+	}
+	policy = pCron.GetMisfirePolicy("stock_unknown")
+	if policy.Policy != common.CronMisfirePolicySkip {
+		t.Fatal(fmt.Sprintf("expected the [cron.stock_unknown] policy BUT got %v", policy))
+	}
+
+	LogTestOutput("TestCronMisfirePolicy", "b. missed and late schedules are skipped")
+	ruleKey := "stock_unknown.0001_test"
+	_, err = pCron.UpsertTimeCron(8, 10, 0, "+00:00", ruleKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, _ := pCron.GetTimeCronByRule(ruleKey)
+	// pretend the last run was a week ago
+	lastRunTime := entry.UTCTime.Add(time.Hour * -24 * 7)
+	pHistory, err := webservice.NewStructCronHistory(fmt.Sprintf("%v/%v", tmpDir, common.CronHistoryFilename), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = pHistory.Append(webservice.StructCronJobRecord{
+		StocksModuleRule: ruleKey, ScheduledTime: lastRunTime, StartTime: lastRunTime, EndTime: lastRunTime,
+		Outcome: webservice.CronJobOutcomeSuccess })
+	if err != nil {
+		t.Fatal(err)
+	}
+	// re-create the cron service to pick up the history written above
+	pCron = webservice.NewStructCron(pCfg)
+	_, err = pCron.UpsertTimeCron(8, 10, 0, "+00:00", ruleKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedMissed := 0
+	for i := 1; i < 7; i++ {
+		if !util.IsWeekend(entry.UTCTime.Add(time.Hour * -24 * time.Duration(i))) {
+			expectedMissed++
+		}
+	}
+	pCron.RunDueTimeCrons(entry.UTCTime.Add(time.Hour * 2))
+
+	records := pCron.GetHistory(ruleKey, lastRunTime.Add(time.Second), time.Time{})
+	if len(records) != expectedMissed+1 {
+		t.Fatal(fmt.Sprintf("expected %v missed trading days + 1 late schedule to be recorded BUT got %v",
+			expectedMissed, records))
+	}
+	for _, record := range records {
+		if record.Outcome != webservice.CronJobOutcomeSkipped {
+			t.Fatal(fmt.Sprintf("expected all schedules to be skipped BUT got %v", record))
+		}
+	}
+	entry2, _ := pCron.GetTimeCronByRule(ruleKey)
+	if !entry2.UTCTime.Equal(entry.UTCTime.Add(time.Hour * 24)) {
+		t.Fatal(fmt.Sprintf("expected the entry to be moved to the next day BUT got %v", entry2.UTCTime))
+	}
+
+	LogTestOutput("TestCronMisfirePolicy", "c. a schedule already run before a restart is not run again")
+	ruleKey = "stock_unknown.0002_test"
+	_, err = pCron.UpsertTimeCron(8, 10, 0, "+00:00", ruleKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, _ = pCron.GetTimeCronByRule(ruleKey)
+	pHistory, err = webservice.NewStructCronHistory(fmt.Sprintf("%v/%v", tmpDir, common.CronHistoryFilename), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = pHistory.Append(webservice.StructCronJobRecord{
+		StocksModuleRule: ruleKey, ScheduledTime: entry.UTCTime, StartTime: entry.UTCTime, EndTime: entry.UTCTime,
+		Outcome: webservice.CronJobOutcomeSuccess })
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the restarted cron service schedules today's time again
+	pCron = webservice.NewStructCron(pCfg)
+	_, err = pCron.UpsertTimeCron(8, 10, 0, "+00:00", ruleKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pCron.RunDueTimeCrons(entry.UTCTime.Add(time.Hour * 2))
+
+	records = pCron.GetHistory(ruleKey, time.Time{}, time.Time{})
+	if len(records) != 1 || records[0].Outcome != webservice.CronJobOutcomeSuccess {
+		t.Fatal(fmt.Sprintf("expected ONLY the success record before the restart BUT got %v", records))
+	}
+	entry2, _ = pCron.GetTimeCronByRule(ruleKey)
+	if !entry2.UTCTime.Equal(entry.UTCTime.Add(time.Hour * 24)) {
+		t.Fatal(fmt.Sprintf("expected the entry to be moved to the next day BUT got %v", entry2.UTCTime))
+	}
+
+	LogTestOutput("TestCronMisfirePolicy", "** end test **\n")
+}
+
+func TestCronSchedulerDueOrderAndConcurrency(t *testing.T) {
+	if !*pFlagCronService {
+		t.SkipNow()
+	}
+	LogTestOutput("TestCronSchedulerDueOrderAndConcurrency", "** start test **")
+	pCron := webservice.NewStructCron(nil)
+
+	LogTestOutput("TestCronSchedulerDueOrderAndConcurrency", "a. only entries due are moved to the next day")
+	for hour := 0; hour < 24; hour++ {
+		_, err := pCron.UpsertTimeCron(hour, 30, 0, "+00:00", fmt.Sprintf("stock_unknown.%v_test", hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	entry, _ := pCron.GetTimeCronByRule("stock_unknown.12_test")
+	pCron.RunDueTimeCrons(entry.UTCTime.Add(time.Minute))
+	for hour := 0; hour < 24; hour++ {
+		rule := fmt.Sprintf("stock_unknown.%v_test", hour)
+		ruleEntry, found := pCron.GetTimeCronByRule(rule)
+		if !found {
+			t.Fatal(fmt.Sprintf("expected %v to be still scheduled", rule))
+		}
+		expectedTime := entry.UTCTime.Add(time.Hour * time.Duration(hour-12))
+		if hour <= 12 {
+			expectedTime = expectedTime.Add(time.Hour * 24)
+		}
+		if !ruleEntry.UTCTime.Equal(expectedTime) {
+			t.Fatal(fmt.Sprintf("expected %v to be scheduled at %v BUT got %v", rule, expectedTime, ruleEntry.UTCTime))
+		}
+	}
+	if len(pCron.GetHistory("", time.Time{}, time.Time{})) != 13 {
+		t.Fatal(fmt.Sprintf("expected 13 job-runs BUT got %v", len(pCron.GetHistory("", time.Time{}, time.Time{}))))
+	}
+
+	LogTestOutput("TestCronSchedulerDueOrderAndConcurrency", "b. concurrent schedule changes while the scheduler is running (run with -race)")
+	err := pCron.RunCron()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for worker := 0; worker < 8; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				rule := fmt.Sprintf("stock_unknown.%v_%v_race", worker, i%5)
+				_, _ = pCron.UpsertTimeCron(i%24, worker, 0, "+00:00", rule)
+				_, _ = pCron.PauseTimeCron(rule)
+				_, _ = pCron.ResumeTimeCron(rule)
+				_ = pCron.ListTimeCron()
+				if i%3 == 0 {
+					_, _ = pCron.RemoveTimeCron(rule)
+				}
+			}
+		}(worker)
+	}
+	wg.Wait()
+	err = pCron.StopCron()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, listedEntry := range pCron.ListTimeCron() {
+		if len(listedEntry.StocksModuleRuleList) == 0 {
+			t.Fatal(fmt.Sprintf("expected no empty entries BUT got %v", key))
+		}
+		for _, rule := range listedEntry.StocksModuleRuleList {
+			ruleEntry, found := pCron.GetTimeCronByRule(rule)
+			if !found || !ruleEntry.UTCTime.Equal(listedEntry.UTCTime) {
+				t.Fatal(fmt.Sprintf("rule index out of sync for %v => %v", rule, ruleEntry.UTCTime))
+			}
+		}
+	}
+
+	LogTestOutput("TestCronSchedulerDueOrderAndConcurrency", "** end test **\n")
+}
+
+func TestCronSchedulerWithFakeClock(t *testing.T) {
+	if !*pFlagCronService {
+		t.SkipNow()
+	}
+	LogTestOutput("TestCronSchedulerWithFakeClock", "** start test **")
+	clockTime, _ := time.Parse(util.CommonDateFormat, "2019-07-03T07:00:00+00:00")
+	pClock := util.NewStructFakeClock(clockTime)
+	pCron := webservice.NewStructCron(nil)
+	pCron.SetClock(pClock)
+
+	ruleKey := "stock_unknown.0002_test"
+	_, err := pCron.UpsertTimeCron(16, 10, 0, "+08:00", ruleKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = pCron.RunCron()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = pCron.StopCron()
+	}()
+
+	scheduledTimes := []string{ "2019-07-03T08:10:00+00:00", "2019-07-04T08:10:00+00:00" }
+	for idx, sScheduledTime := range scheduledTimes {
+		LogTestOutput("TestCronSchedulerWithFakeClock", fmt.Sprintf("round %v => %v", idx, sScheduledTime))
+		scheduledTime, _ := time.Parse(util.CommonDateFormat, sScheduledTime)
+		// not due yet
+		pClock.Set(scheduledTime.Add(time.Second * -1))
+		time.Sleep(time.Millisecond * 50)
+		if len(pCron.GetHistory(ruleKey, time.Time{}, time.Time{})) != idx {
+			t.Fatal(fmt.Sprintf("expected %v job-runs before %v", idx, sScheduledTime))
+		}
+		// due
+		pClock.Set(scheduledTime.Add(time.Second))
+		records := helperWaitForCronHistory(pCron, ruleKey, idx+1)
+		if len(records) != idx+1 || !records[idx].ScheduledTime.Equal(scheduledTime) {
+			t.Fatal(fmt.Sprintf("expected job-run scheduled at %v BUT got %v", sScheduledTime, records))
+		}
+		entry, _ := pCron.GetTimeCronByRule(ruleKey)
+		if !entry.UTCTime.Equal(scheduledTime.Add(time.Hour * 24)) {
+			t.Fatal(fmt.Sprintf("expected next schedule to be %v BUT got %v", scheduledTime.Add(time.Hour*24), entry.UTCTime))
+		}
+	}
+
+	LogTestOutput("TestCronSchedulerWithFakeClock", "re-upsert the same time after the job-run (e.g. rules re-registered)")
+	inserted, err := pCron.UpsertTimeCron(16, 10, 0, "+08:00", ruleKey)
+	if err != nil || inserted {
+		t.Fatal(fmt.Sprintf("expected the rule kept as scheduled BUT got inserted => %v (%v)", inserted, err))
+	}
+	time.Sleep(time.Millisecond * 50)
+	entry, _ := pCron.GetTimeCronByRule(ruleKey)
+	if len(pCron.GetHistory(ruleKey, time.Time{}, time.Time{})) != len(scheduledTimes) ||
+		entry.UTCTime.Format(util.CommonDateFormat) != "2019-07-05T08:10:00+00:00" {
+		t.Fatal(fmt.Sprintf("expected no duplicate job-run and the next schedule kept BUT got %v", entry.UTCTime))
+	}
+	LogTestOutput("TestCronSchedulerWithFakeClock", "** end test **\n")
+}
+
+// wait (at most 2 seconds) until the scheduler recorded the expected number of job-runs
+func helperWaitForCronHistory(pCron *webservice.StructCron, rule string, expected int) (records []webservice.StructCronJobRecord) {
+	for i := 0; i < 200; i++ {
+		records = pCron.GetHistory(rule, time.Time{}, time.Time{})
+		if len(records) >= expected {
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	return
+}
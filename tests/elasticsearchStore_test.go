@@ -0,0 +1,426 @@
+/*
+ *  Copyright Project - Stockbinator, Author - quoeamaster, (C) 2019
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+package tests
+
+import (
+	"Stockbinator/common"
+	"Stockbinator/store"
+	"Stockbinator/util"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestElasticsearchStorePersistAndQuery(t *testing.T) {
+	if !*pFlagElasticsearch {
+		t.SkipNow()
+	}
+	pFake := newStructFakeElasticsearch()
+	pServer := httptest.NewServer(pFake)
+	defer pServer.Close()
+	pStore := helperCreateElasticsearchStore(pServer.URL, "", t)
+
+	LogTestOutput("TestElasticsearchStorePersistAndQuery", "a. persist records across 2 months")
+	baseTime := time.Date(2019, 7, 31, 22, 0, 0, 0, time.UTC)
+	for i := 0; i < 4; i++ {
+		resp, err := pStore.Persist(helperElasticsearchRecord("700_tencent", baseTime.Add(time.Hour*time.Duration(i)), float64(300+i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		helperFilestoreFlowsCommonResponseHandler(resp, t)
+	}
+	if !pFake.hasTemplate("stockbinator_stock_test") {
+		t.Fatal("expected the index template to be installed before the first write")
+	}
+	if pFake.count("stock_test_2019.07") != 2 || pFake.count("stock_test_2019.08") != 2 {
+		t.Fatal(fmt.Sprintf("expected 2 docs per monthly index BUT got %v", pFake.indexCounts()))
+	}
+
+	LogTestOutput("TestElasticsearchStorePersistAndQuery", "b. persist the same natural key again (replace)")
+	resp, err := pStore.Persist(helperElasticsearchRecord("700_tencent", baseTime, 999))
+	if err != nil {
+		t.Fatal(err)
+	}
+	helperFilestoreFlowsCommonResponseHandler(resp, t)
+	if pFake.count("stock_test_2019.07") != 2 {
+		t.Fatal(fmt.Sprintf("expected the document to be replaced BUT got %v", pFake.indexCounts()))
+	}
+
+	LogTestOutput("TestElasticsearchStorePersistAndQuery", "c. query a range of trx_date")
+	resp, records, err := pStore.Query("700_tencent", baseTime, baseTime.Add(time.Hour*2), []string{ "price" }, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 {
+		t.Fatal(fmt.Sprintf("expected 3 records BUT got %v", records))
+	}
+	if price := helperFilestoreRecordField(records[0], "price", t); price != float64(999) {
+		t.Fatal(fmt.Sprintf("expected the replaced price 999 BUT got %v", price))
+	}
+	if _, isAvailable := records[0].Value.(map[string]store.StructStoreValue)["volume"]; isAvailable {
+		t.Fatal("expected ONLY the selected fields plus the record identity")
+	}
+
+	LogTestOutput("TestElasticsearchStorePersistAndQuery", "d. iterate, read, modify and remove by key")
+	resp, iterator, err := pStore.Iterate(store.PredicateByTrxDateRange(baseTime.Add(time.Hour), time.Time{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	iterated := 0
+	for iterator.Next() {
+		iterated++
+	}
+	if iterator.Err() != nil || iterated != 3 {
+		t.Fatal(fmt.Sprintf("expected 3 iterated records BUT got %v (%v)", iterated, iterator.Err()))
+	}
+	_ = iterator.Close()
+
+	key := store.BuildRecordKey("700_tencent", baseTime.Add(time.Hour))
+	resp, err = pStore.ModifyByKey(key, store.StructStoreValue{IsObject: true, Value: map[string]store.StructStoreValue{
+		"volume": store.StructStoreValue{Value: "1 Million", Type: store.TypeString},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, value, err := pStore.ReadByKey(key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if volume := helperFilestoreRecordField(value, "volume", t); volume != "1 Million" {
+		t.Fatal(fmt.Sprintf("expected the modified volume BUT got %v", volume))
+	}
+	resp, err = pStore.ModifyByKey(key, store.StructStoreValue{IsObject: true, Value: map[string]store.StructStoreValue{
+		store.StoreKeyStockId: store.StructStoreValue{Value: "939_ccb", Type: store.TypeString},
+	}})
+	if err == nil {
+		t.Fatal("expected the record identity could not be modified")
+	}
+	resp, _, err = pStore.RemoveByKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, _, err = pStore.ReadByKey(key, nil)
+	if err == nil || resp.Code != store.CodeFailure {
+		t.Fatal("expected the removed record is not available anymore")
+	}
+
+	LogTestOutput("TestElasticsearchStorePersistAndQuery", "e. remove all")
+	resp, err = pStore.RemoveAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, content, err := pStore.ReadAll()
+	if err != nil || strings.TrimSpace(content) != "" {
+		t.Fatal(fmt.Sprintf("expected no records left BUT got [%v] (%v)", content, err))
+	}
+}
+
+func TestElasticsearchStoreBulkRetry(t *testing.T) {
+	if !*pFlagElasticsearch {
+		t.SkipNow()
+	}
+	pFake := newStructFakeElasticsearch()
+	pServer := httptest.NewServer(pFake)
+	defer pServer.Close()
+	pStore := helperCreateElasticsearchStore(pServer.URL, "retry_backoff = \"1ms\"\nretry_max = 3\n", t)
+
+	LogTestOutput("TestElasticsearchStoreBulkRetry", "a. 429 on the whole request and on single items")
+	pFake.setRejections(1, 1)
+	baseTime := time.Date(2019, 7, 1, 1, 0, 0, 0, time.UTC)
+	records := make([]map[string]store.StructStoreValue, 0)
+	for i := 0; i < 3; i++ {
+		records = append(records, helperElasticsearchRecord("700_tencent", baseTime.Add(time.Hour*time.Duration(i)), float64(i)))
+	}
+	resp, err := pStore.PersistBulk(records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	helperFilestoreFlowsCommonResponseHandler(resp, t)
+	if pFake.count("stock_test_2019.07") != 3 {
+		t.Fatal(fmt.Sprintf("expected all 3 records written after retries BUT got %v", pFake.indexCounts()))
+	}
+
+	LogTestOutput("TestElasticsearchStoreBulkRetry", "b. retries exhausted")
+	pFake.setRejections(10, 0)
+	resp, err = pStore.Persist(records[0])
+	if err == nil || resp.Code != store.CodeFailure {
+		t.Fatal("expected a failure once the retries are exhausted")
+	}
+
+	LogTestOutput("TestElasticsearchStoreBulkRetry", "c. skip policy keeps the existing document")
+	pStore.SetNaturalKey(store.StructNaturalKey{Fields: []string{ store.StoreKeyStockId, store.StoreKeyTrxDate }, DuplicatePolicy: "skip"})
+	pFake.setRejections(0, 0)
+	resp, err = pStore.Persist(helperElasticsearchRecord("700_tencent", baseTime, 12345))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(resp.Message, "skipped") || resp.AdditionalCode != common.FileStatusSkipped {
+		t.Fatal(fmt.Sprintf("expected the record is skipped BUT got %v", resp.Message))
+	}
+	resp, value, err := pStore.ReadByKey(store.BuildRecordKey("700_tencent", baseTime), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if price := helperFilestoreRecordField(value, "price", t); price != float64(0) {
+		t.Fatal(fmt.Sprintf("expected the original price 0 BUT got %v", price))
+	}
+}
+
+func helperCreateElasticsearchStore(host string, additionalConfig string, t *testing.T) (pStore *store.StructElasticsearchStore) {
+	repo, err := ioutil.TempDir("", "elasticsearch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfgFilepath := filepath.Join(repo, "app.toml")
+	err = ioutil.WriteFile(cfgFilepath, []byte(fmt.Sprintf("[datastore]\ntype = \"elasticsearch\"\nhosts = [\"%v\"]\n%v\n", host, additionalConfig)), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := util.LoadConfig(cfgFilepath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pStore = store.NewStructElasticsearchStore(cfg, "stock_test.700_tencent")
+	return
+}
+
+func helperElasticsearchRecord(stockId string, trxDate time.Time, price float64) map[string]store.StructStoreValue {
+	return map[string]store.StructStoreValue{
+		store.StoreKeyStockId: store.StructStoreValue{Value: stockId, Type: store.TypeString},
+		store.StoreKeyTrxDate: store.StructStoreValue{Value: trxDate, Type: store.TypeDate},
+		"price":               store.StructStoreValue{Value: price, Type: store.TypeFloat},
+		"volume":              store.StructStoreValue{Value: "500 Million", Type: store.TypeString},
+	}
+}
+
+// * ****************************************************************** *
+// * fake elasticsearch; ONLY the apis used by the store are supported  *
+// * ****************************************************************** *
+
+type structFakeElasticsearch struct {
+	lock      sync.Mutex
+	templates map[string]bool
+	// index => id => source (kept as is, like elasticsearch does)
+	indices map[string]map[string]json.RawMessage
+	nextId  int
+	// number of whole bulk requests and bulk items to reject with 429
+	requestRejections int
+	itemRejections    int
+}
+
+func newStructFakeElasticsearch() (pFake *structFakeElasticsearch) {
+	pFake = new(structFakeElasticsearch)
+	pFake.templates = make(map[string]bool)
+	pFake.indices = make(map[string]map[string]json.RawMessage)
+	return
+}
+
+func (f *structFakeElasticsearch) setRejections(requestRejections, itemRejections int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.requestRejections = requestRejections
+	f.itemRejections = itemRejections
+}
+
+func (f *structFakeElasticsearch) hasTemplate(name string) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.templates[name]
+}
+
+func (f *structFakeElasticsearch) count(index string) int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return len(f.indices[index])
+}
+
+func (f *structFakeElasticsearch) indexCounts() map[string]int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	counts := make(map[string]int)
+	for index, docs := range f.indices {
+		counts[index] = len(docs)
+	}
+	return counts
+}
+
+func (f *structFakeElasticsearch) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	body, _ := ioutil.ReadAll(r.Body)
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case r.Method == http.MethodPut && parts[0] == "_index_template":
+		f.templates[parts[1]] = true
+		f.writeJson(w, http.StatusOK, map[string]interface{}{ "acknowledged": true })
+	case parts[0] == "_bulk":
+		if f.requestRejections > 0 {
+			f.requestRejections--
+			f.writeJson(w, http.StatusTooManyRequests, map[string]interface{}{ "status": 429 })
+			return
+		}
+		f.writeJson(w, http.StatusOK, f.bulk(body))
+	case len(parts) == 2 && parts[1] == "_search":
+		request := make(map[string]interface{})
+		_ = json.Unmarshal(body, &request)
+		f.writeJson(w, http.StatusOK, f.search(parts[0], request))
+	case len(parts) == 2 && parts[1] == "_delete_by_query":
+		request := make(map[string]interface{})
+		_ = json.Unmarshal(body, &request)
+		hits := f.match(parts[0], request["query"].(map[string]interface{}))
+		for _, hit := range hits {
+			delete(f.indices[hit["_index"].(string)], hit["_id"].(string))
+		}
+		f.writeJson(w, http.StatusOK, map[string]interface{}{ "deleted": len(hits) })
+	default:
+		f.writeJson(w, http.StatusBadRequest, map[string]interface{}{ "error": "unsupported " + r.URL.Path })
+	}
+}
+
+func (f *structFakeElasticsearch) bulk(body []byte) map[string]interface{} {
+	items := make([]interface{}, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		action := make(map[string]map[string]string)
+		_ = json.Unmarshal(scanner.Bytes(), &action)
+		for actionName, meta := range action {
+			index, id := meta["_index"], meta["_id"]
+			var source json.RawMessage
+			if actionName != "delete" {
+				scanner.Scan()
+				source = append(json.RawMessage{}, scanner.Bytes()...)
+			}
+			status := http.StatusOK
+			if f.itemRejections > 0 {
+				f.itemRejections--
+				items = append(items, map[string]interface{}{ actionName: map[string]interface{}{ "status": http.StatusTooManyRequests } })
+				continue
+			}
+			if f.indices[index] == nil {
+				f.indices[index] = make(map[string]json.RawMessage)
+			}
+			if id == "" {
+				f.nextId++
+				id = fmt.Sprintf("auto_%v", f.nextId)
+			}
+			_, isExisting := f.indices[index][id]
+			switch {
+			case actionName == "create" && isExisting:
+				status = http.StatusConflict
+			case actionName == "delete" && !isExisting:
+				status = http.StatusNotFound
+			case actionName == "delete":
+				delete(f.indices[index], id)
+			default:
+				f.indices[index][id] = source
+			}
+			items = append(items, map[string]interface{}{ actionName: map[string]interface{}{ "_index": index, "_id": id, "status": status } })
+		}
+	}
+	return map[string]interface{}{ "errors": false, "items": items }
+}
+
+func (f *structFakeElasticsearch) search(indexPattern string, request map[string]interface{}) map[string]interface{} {
+	hits := f.match(indexPattern, request["query"].(map[string]interface{}))
+	sort.SliceStable(hits, func(i, j int) bool {
+		return f.compareSort(hits[i]["sort"].([]interface{}), hits[j]["sort"].([]interface{})) < 0
+	})
+	if searchAfter, isAvailable := request["search_after"].([]interface{}); isAvailable {
+		remaining := make([]map[string]interface{}, 0)
+		for _, hit := range hits {
+			if f.compareSort(hit["sort"].([]interface{}), searchAfter) > 0 {
+				remaining = append(remaining, hit)
+			}
+		}
+		hits = remaining
+	}
+	if size := int(request["size"].(float64)); len(hits) > size {
+		hits = hits[:size]
+	}
+	return map[string]interface{}{ "hits": map[string]interface{}{ "hits": hits } }
+}
+
+// ONLY bool filters of term (stock_id) and range (trx_date; gte, lte and lt) are supported
+func (f *structFakeElasticsearch) match(indexPattern string, query map[string]interface{}) (hits []map[string]interface{}) {
+	hits = make([]map[string]interface{}, 0)
+	filters := query["bool"].(map[string]interface{})["filter"].([]interface{})
+	for index, docs := range f.indices {
+		if isMatched, _ := path.Match(indexPattern, index); !isMatched {
+			continue
+		}
+		for id, rawSource := range docs {
+			source := make(map[string]interface{})
+			_ = json.Unmarshal(rawSource, &source)
+			trxDate, _ := time.Parse(util.CommonDateFormat, source[store.StoreKeyTrxDate].(string))
+			isMatched := true
+			for _, filter := range filters {
+				filterMap := filter.(map[string]interface{})
+				if term, isTerm := filterMap["term"].(map[string]interface{}); isTerm {
+					isMatched = isMatched && term[store.StoreKeyStockId] == source[store.StoreKeyStockId]
+				}
+				if dateRange, isRange := filterMap["range"].(map[string]interface{}); isRange {
+					bounds := dateRange[store.StoreKeyTrxDate].(map[string]interface{})
+					if gte, isAvailable := bounds["gte"].(string); isAvailable {
+						from, _ := time.Parse(util.CommonDateFormat, gte)
+						isMatched = isMatched && !trxDate.Before(from)
+					}
+					if lte, isAvailable := bounds["lte"].(string); isAvailable {
+						to, _ := time.Parse(util.CommonDateFormat, lte)
+						isMatched = isMatched && !trxDate.After(to)
+					}
+					if lt, isAvailable := bounds["lt"].(string); isAvailable {
+						before, _ := time.Parse(util.CommonDateFormat, lt)
+						isMatched = isMatched && trxDate.Before(before)
+					}
+				}
+			}
+			if isMatched {
+				hits = append(hits, map[string]interface{}{
+					"_index": index, "_id": id, "_source": rawSource,
+					"sort": []interface{}{ float64(trxDate.UnixNano() / int64(time.Millisecond)), source[store.StoreKeyStockId] },
+				})
+			}
+		}
+	}
+	return
+}
+
+func (f *structFakeElasticsearch) compareSort(a, b []interface{}) int {
+	if a[0].(float64) != b[0].(float64) {
+		if a[0].(float64) < b[0].(float64) {
+			return -1
+		}
+		return 1
+	}
+	return strings.Compare(fmt.Sprintf("%v", a[1]), fmt.Sprintf("%v", b[1]))
+}
+
+func (f *structFakeElasticsearch) writeJson(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,123 @@
+//go:build !windows
+// +build !windows
+
+/*
+ *  Copyright Project - Stockbinator, Author - quoeamaster, (C) 2019
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+package tests
+
+import (
+	"Stockbinator/common"
+	"Stockbinator/store"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestFilestoreFileLock(t *testing.T) {
+	if !*pFlagFilestore {
+		t.SkipNow()
+	}
+	LogTestOutput("TestFilestoreFileLock", "** start test **")
+	repo, pFilestore := helperCreatePartitionedFilestore(common.StorePartitionDaily,
+		"lock_wait = \"10ms\"\nlock_timeout = \"200ms\"", t)
+	defer func() {
+		_ = os.RemoveAll(repo)
+	}()
+	entryMap := func(i int) map[string]store.StructStoreValue {
+		return map[string]store.StructStoreValue{
+			"stock_id": *store.NewStructStoreValue("", "700_tencent", store.TypeString, false, false),
+			"trx_date": *store.NewStructStoreValue("", time.Date(2019, 7, 3, 8, 0, i, 0, time.UTC), store.TypeDate, false, false),
+			"price":    *store.NewStructStoreValue("", float64(i), store.TypeFloat, false, false),
+		}
+	}
+	resp, err := pFilestore.Persist(entryMap(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	helperFilestoreFlowsCommonResponseHandler(resp, t)
+
+	LogTestOutput("TestFilestoreFileLock", "a. lock held by another process => FileStatusLocked after the timeout")
+	pLockFile, err := os.OpenFile(filepath.Join(repo, "stock_test", "700_tencent", common.StoreLockFileExtension), os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = pLockFile.Close()
+	}()
+	err = syscall.Flock(int(pLockFile.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	resp, err = pFilestore.Persist(entryMap(1))
+	if err != store.ErrFilestoreLocked || resp.Code != store.CodeFailure || resp.AdditionalCode != common.FileStatusLocked {
+		t.Fatal(fmt.Sprintf("expected locked response BUT got %v (err => %v)", resp, err))
+	}
+	if elapsed := time.Since(start); elapsed < time.Millisecond*200 {
+		t.Fatal(fmt.Sprintf("expected waiting for the lock timeout BUT returned after %v", elapsed))
+	}
+	resp, err = pFilestore.RemoveAll()
+	if err != store.ErrFilestoreLocked || resp.AdditionalCode != common.FileStatusLocked {
+		t.Fatal(fmt.Sprintf("expected locked response BUT got %v (err => %v)", resp, err))
+	}
+
+	LogTestOutput("TestFilestoreFileLock", "b. lock released within the timeout => write proceeds")
+	go func() {
+		time.Sleep(time.Millisecond * 50)
+		_ = syscall.Flock(int(pLockFile.Fd()), syscall.LOCK_UN)
+	}()
+	resp, err = pFilestore.Persist(entryMap(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	helperFilestoreFlowsCommonResponseHandler(resp, t)
+
+	LogTestOutput("TestFilestoreFileLock", "c. 2 filestore instances (as 2 processes) appending concurrently")
+	pOtherFilestore := store.NewStructFilestore(pFilestore.AppConfig, pFilestore.Filename)
+	waitGroup := new(sync.WaitGroup)
+	for w, pStore := range []*store.StructFilestore{ pFilestore, pOtherFilestore } {
+		waitGroup.Add(1)
+		go func(w int, pStore *store.StructFilestore) {
+			defer waitGroup.Done()
+			for i := 0; i < 50; i++ {
+				if _, err := pStore.Persist(entryMap(2 + w*50 + i)); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(w, pStore)
+	}
+	waitGroup.Wait()
+	_, contents, err := pFilestore.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(contents), "\n")
+	if len(lines) != 102 {
+		t.Fatal(fmt.Sprintf("expected 102 lines BUT got %v", len(lines)))
+	}
+	for _, line := range lines {
+		if _, err := store.DecodeStoreRecord(line); err != nil {
+			t.Fatal(fmt.Sprintf("corrupted line [%v] => %v", line, err))
+		}
+	}
+	LogTestOutput("TestFilestoreFileLock", "** end test **\n")
+}
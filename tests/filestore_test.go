@@ -16,11 +16,18 @@
 package tests
 
 import (
+	"Stockbinator/common"
 	"Stockbinator/store"
 	"Stockbinator/util"
 	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 
@@ -79,6 +86,871 @@ func TestFilestorePersistFlow(t *testing.T) {
 	LogTestOutput("TestFilestorePersistFlow", "** end test **\n")
 }
 
+func TestFilestoreKeyFlow(t *testing.T) {
+	if !*pFlagFilestore {
+		t.SkipNow()
+	}
+	LogTestOutput("TestFilestoreKeyFlow", "** start test **")
+	LogTestOutput("TestFilestoreKeyFlow", "a. reset the test file with all 5 entries")
+	resp, err := FileStore.RemoveAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	helperFilestoreFlowsCommonResponseHandler(resp, t)
+	keys := make([]string, len(TestStoreEntriesList))
+	for i, entryMap := range TestStoreEntriesList {
+		resp, err = FileStore.Persist(entryMap)
+		if err != nil {
+			t.Fatal(err)
+		}
+		helperFilestoreFlowsCommonResponseHandler(resp, t)
+		keys[i] = store.BuildRecordKey(entryMap["stock_id"].Value.(string), entryMap["trx_date"].Value.(time.Time))
+	}
+
+	LogTestOutput("TestFilestoreKeyFlow", "b. read by key (with filters)")
+	resp, value, err := FileStore.ReadByKey(keys[1], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	helperFilestoreFlowsCommonResponseHandler(resp, t)
+	if price := helperFilestoreRecordField(value, "price", t); price != float64(100) {
+		t.Fatal(fmt.Sprintf("expected price of 100 BUT got %v", price))
+	}
+	resp, value, err = FileStore.ReadByKey(keys[1], store.StructStoreReadParams{
+		Filters: map[string]interface{}{ "price": 100 },
+		Fields: []string{ "price" },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(value.Value.(map[string]store.StructStoreValue)) != 1 {
+		t.Fatal(fmt.Sprintf("expected ONLY the price field BUT got %v", value.Value))
+	}
+	resp, _, err = FileStore.ReadByKey(keys[1], map[string]interface{}{ "price": 999 })
+	if err == nil || resp.Code != store.CodeFailure || resp.AdditionalCode != common.FileStatusNotAvailable {
+		t.Fatal(fmt.Sprintf("expected no record found BUT got %v", resp))
+	}
+	// entry 0 and 4 share the same key, the latest record wins
+	_, value, err = FileStore.ReadByKey(keys[0], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if price := helperFilestoreRecordField(value, "price", t); price != float64(250) {
+		t.Fatal(fmt.Sprintf("expected price of 250 BUT got %v", price))
+	}
+
+	LogTestOutput("TestFilestoreKeyFlow", "c. modify by key")
+	modifiedFields := map[string]store.StructStoreValue{
+		"price": *store.NewStructStoreValue("", float64(999), store.TypeFloat, false, false),
+	}
+	resp, err = FileStore.ModifyByKey(keys[2], *store.NewStructStoreValue(keys[2], modifiedFields, store.TypeString, false, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	helperFilestoreFlowsCommonResponseHandler(resp, t)
+	_, value, err = FileStore.ReadByKey(keys[2], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if price := helperFilestoreRecordField(value, "price", t); price != float64(999) {
+		t.Fatal(fmt.Sprintf("expected modified price of 999 BUT got %v", price))
+	}
+	if volume := helperFilestoreRecordField(value, "volume", t); volume != "1500 Million" {
+		t.Fatal(fmt.Sprintf("expected untouched volume of 1500 Million BUT got %v", volume))
+	}
+	modifiedFields = map[string]store.StructStoreValue{
+		"trx_date": *store.NewStructStoreValue("", time.Now().Add(time.Hour * 240), store.TypeDate, false, false),
+	}
+	resp, err = FileStore.ModifyByKey(keys[2], *store.NewStructStoreValue(keys[2], modifiedFields, store.TypeString, false, true))
+	if err == nil || resp.Code != store.CodeFailure {
+		t.Fatal("expected record identity could not be modified")
+	}
+
+	LogTestOutput("TestFilestoreKeyFlow", "d. remove by key")
+	resp, value, err = FileStore.RemoveByKey(keys[3])
+	if err != nil {
+		t.Fatal(err)
+	}
+	helperFilestoreFlowsCommonResponseHandler(resp, t)
+	if price := helperFilestoreRecordField(value, "price", t); price != float64(200) {
+		t.Fatal(fmt.Sprintf("expected removed price of 200 BUT got %v", price))
+	}
+	resp, _, err = FileStore.RemoveByKey(keys[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, contents, err := FileStore.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// entry 1 and 2 remain (plus the trailing line feed)
+	if lines := strings.Split(contents, "\n"); len(lines) != (2 + 1) {
+		t.Fatal(fmt.Sprintf("expecting contents to be in 2 lines of data BUT got %v", contents))
+	}
+	resp, _, err = FileStore.RemoveByKey(keys[3])
+	if err == nil || resp.AdditionalCode != common.FileStatusNotAvailable {
+		t.Fatal(fmt.Sprintf("expected no record found BUT got %v", resp))
+	}
+	LogTestOutput("TestFilestoreKeyFlow", "** end test **\n")
+}
+
+func TestFilestoreQuery(t *testing.T) {
+	if !*pFlagFilestore {
+		t.SkipNow()
+	}
+	LogTestOutput("TestFilestoreQuery", "** start test **")
+	LogTestOutput("TestFilestoreQuery", "a. reset the test file with all 5 entries plus 1 entry of another stock")
+	resp, err := FileStore.RemoveAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	helperFilestoreFlowsCommonResponseHandler(resp, t)
+	for _, entryMap := range TestStoreEntriesList {
+		resp, err = FileStore.Persist(entryMap)
+		if err != nil {
+			t.Fatal(err)
+		}
+		helperFilestoreFlowsCommonResponseHandler(resp, t)
+	}
+	otherEntryMap := make(map[string]store.StructStoreValue)
+	for k, v := range TestStoreEntriesList[1] {
+		otherEntryMap[k] = v
+	}
+	otherEntryMap["stock_id"] = *store.NewStructStoreValue("", "5_hsbc", store.TypeString, false, false)
+	resp, err = FileStore.Persist(otherEntryMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	LogTestOutput("TestFilestoreQuery", "b. query by stock and time-range")
+	baseDate := TestStoreEntriesList[0]["trx_date"].Value.(time.Time)
+	results := []struct {
+		stockId  string
+		from     time.Time
+		to       time.Time
+		fields   []string
+		limit    int
+		expected []float64
+	}{
+		// entry 4 replaced entry 0 (same stock_id + trx_date)
+		{ "700_tencent", time.Time{}, time.Time{}, nil, 0, []float64{ 250, 100, 150, 200 } },
+		{ "700_tencent", baseDate.Add(time.Hour * 24), baseDate.Add(time.Hour * 48), nil, 0, []float64{ 100, 150 } },
+		{ "700_tencent", baseDate.Add(time.Hour * 24), time.Time{}, []string{ "price" }, 2, []float64{ 100, 150 } },
+		{ "5_hsbc", time.Time{}, time.Time{}, nil, 0, []float64{ 100 } },
+		{ "", baseDate.Add(time.Hour * 24), baseDate.Add(time.Hour * 24), nil, 0, []float64{ 100, 100 } },
+		{ "1_ckh", time.Time{}, time.Time{}, nil, 0, []float64{} },
+	}
+	for _, result := range results {
+		resp, records, err := FileStore.Query(result.stockId, result.from, result.to, result.fields, result.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		helperFilestoreFlowsCommonResponseHandler(resp, t)
+		if len(records) != len(result.expected) {
+			t.Fatal(fmt.Sprintf("expected %v records BUT got %v", len(result.expected), records))
+		}
+		for i, record := range records {
+			if price := helperFilestoreRecordField(record, "price", t); price != result.expected[i] {
+				t.Fatal(fmt.Sprintf("expected price %v at index %v BUT got %v", result.expected[i], i, price))
+			}
+			if len(result.fields) > 0 && len(record.Value.(map[string]store.StructStoreValue)) != len(result.fields) {
+				t.Fatal(fmt.Sprintf("expected ONLY the fields %v BUT got %v", result.fields, record.Value))
+			}
+			if _, _, err := store.ParseRecordKey(record.Key); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	LogTestOutput("TestFilestoreQuery", "** end test **\n")
+}
+
+func TestFilestoreIterate(t *testing.T) {
+	if !*pFlagFilestore {
+		t.SkipNow()
+	}
+	LogTestOutput("TestFilestoreIterate", "** start test **")
+	resp, err := FileStore.RemoveAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	helperFilestoreFlowsCommonResponseHandler(resp, t)
+	for _, entryMap := range TestStoreEntriesList {
+		resp, err = FileStore.Persist(entryMap)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	baseDate := TestStoreEntriesList[0]["trx_date"].Value.(time.Time)
+	results := []struct {
+		predicates []store.StoreRecordPredicate
+		expected   []float64
+	}{
+		// entry 4 replaced entry 0 (same stock_id + trx_date)
+		{ nil, []float64{ 100, 150, 200, 250 } },
+		{ []store.StoreRecordPredicate{ store.PredicateByStockId("700_tencent") }, []float64{ 100, 150, 200, 250 } },
+		{ []store.StoreRecordPredicate{ store.PredicateByStockId("5_hsbc") }, []float64{} },
+		{ []store.StoreRecordPredicate{
+			store.PredicateByStockId("700_tencent"),
+			store.PredicateByTrxDateRange(baseDate.Add(time.Hour * 24), time.Time{}),
+		}, []float64{ 100, 150, 200 } },
+		{ []store.StoreRecordPredicate{
+			store.PredicateByFilters(map[string]interface{}{ "volume": "1500 Million" }),
+		}, []float64{ 150 } },
+	}
+	for _, result := range results {
+		resp, iterator, err := FileStore.Iterate(result.predicates...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		helperFilestoreFlowsCommonResponseHandler(resp, t)
+		prices := make([]float64, 0)
+		for iterator.Next() {
+			prices = append(prices, helperFilestoreRecordField(iterator.Record(), "price", t).(float64))
+		}
+		if iterator.Err() != nil {
+			t.Fatal(iterator.Err())
+		}
+		if err := iterator.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprintf("%v", prices) != fmt.Sprintf("%v", result.expected) {
+			t.Fatal(fmt.Sprintf("expected prices %v BUT got %v", result.expected, prices))
+		}
+		if iterator.Next() {
+			t.Fatal("expected a closed iterator returns no more records")
+		}
+	}
+	LogTestOutput("TestFilestoreIterate", "** end test **\n")
+}
+
+func TestStoreJsonRoundTrip(t *testing.T) {
+	if !*pFlagFilestore {
+		t.SkipNow()
+	}
+	LogTestOutput("TestStoreJsonRoundTrip", "** start test **")
+	dDate, _ := time.Parse(util.CommonDateFormat, "2019-07-03T16:10:00+08:00")
+	record := map[string]store.StructStoreValue{
+		"quote":    *store.NewStructStoreValue("", `say "hi" \ c:\temp`+"\n\ttab", store.TypeString, false, false),
+		"volume":   *store.NewStructStoreValue("", 1500, store.TypeInteger, false, false),
+		"price":    *store.NewStructStoreValue("", float64(50), store.TypeFloat, false, false),
+		"ratio":    *store.NewStructStoreValue("", 0.125, store.TypeFloat, false, false),
+		"active":   *store.NewStructStoreValue("", true, store.TypeBool, false, false),
+		"trx_date": *store.NewStructStoreValue("", dDate, store.TypeDate, false, false),
+		"nothing":  *store.NewStructStoreValue("", nil, store.TypeString, false, false),
+		"prices":   *store.NewStructStoreValue("", []float64{ 1.5, 2 }, store.TypeFloat, true, false),
+		"ranges":   *store.NewStructStoreValue("", []store.StructStoreValue{
+			*store.NewStructStoreValue("", "49-51", store.TypeString, false, false),
+			*store.NewStructStoreValue("", nil, store.TypeString, false, false),
+		}, store.TypeString, true, false),
+		"detail":   *store.NewStructStoreValue("", map[string]store.StructStoreValue{
+			"high": *store.NewStructStoreValue("", 51.5, store.TypeFloat, false, false),
+			"tags": *store.NewStructStoreValue("", []string{ "a\"b" }, store.TypeString, true, false),
+		}, store.TypeString, false, true),
+		"ignored_key": *store.NewStructStoreValue("renamed", "x", store.TypeString, false, false),
+	}
+	jsonValue, err := store.EncodeStoreRecord(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	LogTestOutput("TestStoreJsonRoundTrip", jsonValue)
+	if strings.Contains(jsonValue, "\n") {
+		t.Fatal("expected the json to be in 1 line")
+	}
+	decoded, err := store.DecodeStoreRecord(jsonValue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reEncoded, err := store.EncodeStoreRecord(decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Compare(jsonValue, reEncoded) != 0 {
+		t.Fatal(fmt.Sprintf("expected round-trip encoding [%v] BUT got [%v]", jsonValue, reEncoded))
+	}
+	checks := []struct {
+		field     string
+		valueType int
+		value     interface{}
+	}{
+		{ "quote", store.TypeString, record["quote"].Value },
+		{ "volume", store.TypeInteger, 1500 },
+		{ "price", store.TypeFloat, float64(50) },
+		{ "ratio", store.TypeFloat, 0.125 },
+		{ "active", store.TypeBool, true },
+		{ "renamed", store.TypeString, "x" },
+	}
+	for _, check := range checks {
+		if decoded[check.field].Type != check.valueType || decoded[check.field].Value != check.value {
+			t.Fatal(fmt.Sprintf("field [%v] expected %v BUT got %v", check.field, check.value, decoded[check.field]))
+		}
+	}
+	if decoded["trx_date"].Type != store.TypeDate || !decoded["trx_date"].Value.(time.Time).Equal(dDate) {
+		t.Fatal(fmt.Sprintf("expected date %v BUT got %v", dDate, decoded["trx_date"]))
+	}
+	if decoded["nothing"].Value != nil {
+		t.Fatal(fmt.Sprintf("expected null BUT got %v", decoded["nothing"]))
+	}
+	if !decoded["prices"].IsArray || len(decoded["prices"].Value.([]store.StructStoreValue)) != 2 {
+		t.Fatal(fmt.Sprintf("expected array of 2 BUT got %v", decoded["prices"]))
+	}
+	detail := decoded["detail"].Value.(map[string]store.StructStoreValue)
+	if !decoded["detail"].IsObject || detail["tags"].Value.([]store.StructStoreValue)[0].Value != "a\"b" {
+		t.Fatal(fmt.Sprintf("expected nested object BUT got %v", decoded["detail"]))
+	}
+
+	LogTestOutput("TestStoreJsonRoundTrip", "NaN is encoded as null, Inf and mismatched types are invalid")
+	jsonValue, err = store.EncodeStoreRecord(map[string]store.StructStoreValue{
+		"price": *store.NewStructStoreValue("", math.NaN(), store.TypeFloat, false, false),
+	})
+	if err != nil || strings.Compare(jsonValue, `{"price":null}`) != 0 {
+		t.Fatal(fmt.Sprintf("expected NaN encoded as null BUT got %v (err => %v)", jsonValue, err))
+	}
+	invalidValues := []store.StructStoreValue{
+		*store.NewStructStoreValue("", math.Inf(1), store.TypeFloat, false, false),
+		*store.NewStructStoreValue("", "abc", store.TypeInteger, false, false),
+		*store.NewStructStoreValue("", "2019-07-03", store.TypeDate, false, false),
+		*store.NewStructStoreValue("", "abc", store.TypeString, true, false),
+	}
+	for _, invalidValue := range invalidValues {
+		_, err = store.EncodeStoreRecord(map[string]store.StructStoreValue{ "field": invalidValue })
+		if err == nil {
+			t.Fatal(fmt.Sprintf("expected invalid value %v", invalidValue))
+		}
+	}
+	LogTestOutput("TestStoreJsonRoundTrip", "** end test **\n")
+}
+
+func TestFilestorePartitionedSegments(t *testing.T) {
+	if !*pFlagFilestore {
+		t.SkipNow()
+	}
+	LogTestOutput("TestFilestorePartitionedSegments", "** start test **")
+	for _, partition := range []string{ common.StorePartitionDaily, common.StorePartitionMonthly } {
+		LogTestOutput("TestFilestorePartitionedSegments", fmt.Sprintf("partition => %v", partition))
+		clockDate, _ := time.Parse(util.CommonDateFormat, "2019-08-05T10:00:00+00:00")
+		repo, pFilestore := helperCreatePartitionedFilestore(partition, "", t, util.NewStructFakeClock(clockDate))
+		defer func() {
+			_ = os.RemoveAll(repo)
+		}()
+		segmentDirectory := filepath.Join(repo, "stock_test", "700_tencent")
+
+		sDates := []string{ "2019-06-28T16:10:00+08:00", "2019-07-02T16:10:00+08:00", "2019-07-03T16:10:00+08:00", "2019-07-04T16:10:00+08:00" }
+		dates := make([]time.Time, len(sDates))
+		for i, sDate := range sDates {
+			dates[i], _ = time.Parse(util.CommonDateFormat, sDate)
+			entryMap := map[string]store.StructStoreValue{
+				"stock_id": *store.NewStructStoreValue("", "700_tencent", store.TypeString, false, false),
+				"trx_date": *store.NewStructStoreValue("", dates[i], store.TypeDate, false, false),
+				"price":    *store.NewStructStoreValue("", float64(i + 1), store.TypeFloat, false, false),
+			}
+			resp, err := pFilestore.Persist(entryMap)
+			if err != nil {
+				t.Fatal(err)
+			}
+			helperFilestoreFlowsCommonResponseHandler(resp, t)
+		}
+		expectedSegments := []string{ "2019-06-28.data", "2019-07-02.data", "2019-07-03.data", "2019-07-04.data" }
+		if partition == common.StorePartitionMonthly {
+			expectedSegments = []string{ "2019-06.data", "2019-07.data" }
+		}
+		for _, segment := range expectedSegments {
+			if exists, _ := util.IsFileExists(filepath.Join(segmentDirectory, segment)); !exists {
+				t.Fatal(fmt.Sprintf("expected segment %v to exist", segment))
+			}
+		}
+		// plant a record (within the query range) into a segment outside the query range;
+		// it is ONLY returned if that segment is (wrongly) opened
+		plantedFile, err := os.OpenFile(filepath.Join(segmentDirectory, expectedSegments[0]), os.O_APPEND|os.O_WRONLY, 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = plantedFile.WriteString(`{"price":99.0,"stock_id":"700_tencent","trx_date":"2019-07-03T16:10:00+08:00"}` + "\n")
+		_ = plantedFile.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp, records, err := pFilestore.Query("700_tencent", dates[1], dates[3], []string{ "price" }, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		helperFilestoreFlowsCommonResponseHandler(resp, t)
+		prices := make([]interface{}, 0)
+		for _, record := range records {
+			prices = append(prices, helperFilestoreRecordField(record, "price", t))
+		}
+		if fmt.Sprintf("%v", prices) != "[2 3 4]" {
+			t.Fatal(fmt.Sprintf("expected prices [2 3 4] BUT got %v", prices))
+		}
+		resp, iterator, err := pFilestore.Iterate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		count := 0
+		for iterator.Next() {
+			count++
+		}
+		_ = iterator.Close()
+		if count != 5 {
+			t.Fatal(fmt.Sprintf("expected 5 records (incl. the planted one) BUT got %v", count))
+		}
+
+		LogTestOutput("TestFilestorePartitionedSegments", "key operations on the segment")
+		key := store.BuildRecordKey("700_tencent", dates[2])
+		modifiedFields := map[string]store.StructStoreValue{
+			"price": *store.NewStructStoreValue("", float64(30), store.TypeFloat, false, false),
+		}
+		_, err = pFilestore.ModifyByKey(key, *store.NewStructStoreValue(key, modifiedFields, store.TypeString, false, true))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, value, err := pFilestore.ReadByKey(key, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if price := helperFilestoreRecordField(value, "price", t); price != float64(30) {
+			t.Fatal(fmt.Sprintf("expected modified price of 30 BUT got %v", price))
+		}
+		_, _, err = pFilestore.RemoveByKey(store.BuildRecordKey("700_tencent", dates[3]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, err = pFilestore.ReadByKey(store.BuildRecordKey("700_tencent", dates[3].AddDate(0, 0, 10)), nil)
+		if err == nil {
+			t.Fatal("expected no record found on a missing segment")
+		}
+
+		LogTestOutput("TestFilestorePartitionedSegments", "key operations with another timezone offset")
+		utcDate, _ := time.Parse(util.CommonDateFormat, "2019-07-02T18:00:00+00:00")
+		resp, err = pFilestore.Persist(map[string]store.StructStoreValue{
+			"stock_id": *store.NewStructStoreValue("", "700_tencent", store.TypeString, false, false),
+			"trx_date": *store.NewStructStoreValue("", utcDate, store.TypeDate, false, false),
+			"price":    *store.NewStructStoreValue("", float64(5), store.TypeFloat, false, false),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		helperFilestoreFlowsCommonResponseHandler(resp, t)
+		// 2019-07-03T02:00:00+08:00 => the same record, stored in the segment of its UTC date
+		key = store.BuildRecordKey("700_tencent", utcDate.In(time.FixedZone("", 8*60*60)))
+		_, value, err = pFilestore.ReadByKey(key, nil)
+		if err != nil || helperFilestoreRecordField(value, "price", t) != float64(5) {
+			t.Fatal(fmt.Sprintf("expected price 5 for key %v BUT got %v (err => %v)", key, value, err))
+		}
+		_, _, err = pFilestore.RemoveByKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		LogTestOutput("TestFilestorePartitionedSegments", "a record without trx_date goes to the segment of the store clock")
+		resp, err = pFilestore.Persist(map[string]store.StructStoreValue{
+			"stock_id": *store.NewStructStoreValue("", "700_tencent", store.TypeString, false, false),
+			"price":    *store.NewStructStoreValue("", float64(6), store.TypeFloat, false, false),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		helperFilestoreFlowsCommonResponseHandler(resp, t)
+		clockSegment := "2019-08-05.data"
+		if partition == common.StorePartitionMonthly {
+			clockSegment = "2019-08.data"
+		}
+		if exists, _ := util.IsFileExists(filepath.Join(segmentDirectory, clockSegment)); !exists {
+			t.Fatal(fmt.Sprintf("expected segment %v of the store clock to exist", clockSegment))
+		}
+
+		_, err = pFilestore.RemoveAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, contents, err := pFilestore.ReadAll()
+		if err != nil || !util.IsEmptyString(contents) {
+			t.Fatal(fmt.Sprintf("expected no contents after RemoveAll BUT got %v (err => %v)", contents, err))
+		}
+	}
+	LogTestOutput("TestFilestorePartitionedSegments", "** end test **\n")
+}
+
+func TestFilestoreCompressedSegments(t *testing.T) {
+	if !*pFlagFilestore {
+		t.SkipNow()
+	}
+	LogTestOutput("TestFilestoreCompressedSegments", "** start test **")
+	repo, pFilestore := helperCreatePartitionedFilestore(common.StorePartitionDaily,
+		"compression = \"gzip\"\ncompression_interval = \"0\"", t)
+	defer func() {
+		_ = os.RemoveAll(repo)
+	}()
+	segmentDirectory := filepath.Join(repo, "stock_test", "700_tencent")
+	persist := func(trxDate time.Time, price float64) {
+		resp, err := pFilestore.Persist(map[string]store.StructStoreValue{
+			"stock_id": *store.NewStructStoreValue("", "700_tencent", store.TypeString, false, false),
+			"trx_date": *store.NewStructStoreValue("", trxDate, store.TypeDate, false, false),
+			"price":    *store.NewStructStoreValue("", price, store.TypeFloat, false, false),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		helperFilestoreFlowsCommonResponseHandler(resp, t)
+	}
+	queryPrices := func() string {
+		_, records, err := pFilestore.Query("700_tencent", time.Time{}, time.Time{}, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		prices := make([]interface{}, 0)
+		for _, record := range records {
+			prices = append(prices, helperFilestoreRecordField(record, "price", t))
+		}
+		return fmt.Sprintf("%v", prices)
+	}
+	closedDate, _ := time.Parse(util.CommonDateFormat, "2019-07-03T16:10:00+08:00")
+	openDate := time.Now().Truncate(time.Second)
+	persist(closedDate, 1)
+	persist(closedDate.Add(time.Minute), 2)
+	persist(openDate, 3)
+
+	LogTestOutput("TestFilestoreCompressedSegments", "a. compress the closed segment ONLY")
+	compressedFilepaths, err := pFilestore.CompressClosedSegments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedSegment := filepath.Join(segmentDirectory, "2019-07-03.data")
+	if len(compressedFilepaths) != 1 || compressedFilepaths[0] != closedSegment+".gz" {
+		t.Fatal(fmt.Sprintf("expected ONLY the closed segment compressed BUT got %v", compressedFilepaths))
+	}
+	if exists, _ := util.IsFileExists(closedSegment); exists {
+		t.Fatal("expected the plain closed segment removed")
+	}
+	if prices := queryPrices(); prices != "[1 2 3]" {
+		t.Fatal(fmt.Sprintf("expected prices [1 2 3] BUT got %v", prices))
+	}
+	_, contents, err := pFilestore.ReadAll()
+	if err != nil || len(strings.Split(strings.TrimSpace(contents), "\n")) != 3 {
+		t.Fatal(fmt.Sprintf("expected 3 lines BUT got %v (err => %v)", contents, err))
+	}
+
+	LogTestOutput("TestFilestoreCompressedSegments", "b. late write and key operations on the compressed segment")
+	persist(closedDate.Add(time.Minute * 2), 4)
+	if prices := queryPrices(); prices != "[1 2 4 3]" {
+		t.Fatal(fmt.Sprintf("expected prices [1 2 4 3] BUT got %v", prices))
+	}
+	key := store.BuildRecordKey("700_tencent", closedDate)
+	_, value, err := pFilestore.ReadByKey(key, nil)
+	if err != nil || helperFilestoreRecordField(value, "price", t) != float64(1) {
+		t.Fatal(fmt.Sprintf("expected price 1 BUT got %v (err => %v)", value, err))
+	}
+	_, _, err = pFilestore.RemoveByKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists, _ := util.IsFileExists(closedSegment + ".gz"); exists {
+		t.Fatal("expected the compressed segment re-written into the plain segment")
+	}
+	compressedFilepaths, err = pFilestore.CompressClosedSegments()
+	if err != nil || len(compressedFilepaths) != 1 {
+		t.Fatal(fmt.Sprintf("expected the closed segment compressed again BUT got %v (err => %v)", compressedFilepaths, err))
+	}
+	if prices := queryPrices(); prices != "[2 4 3]" {
+		t.Fatal(fmt.Sprintf("expected prices [2 4 3] BUT got %v", prices))
+	}
+
+	LogTestOutput("TestFilestoreCompressedSegments", "c. a record replaced in the compressed segment keeps it compressed")
+	persist(closedDate.Add(time.Minute), 20)
+	if prices := queryPrices(); prices != "[20 4 3]" {
+		t.Fatal(fmt.Sprintf("expected prices [20 4 3] BUT got %v", prices))
+	}
+	if exists, _ := util.IsFileExists(closedSegment + ".gz"); !exists {
+		t.Fatal("expected the compressed segment kept")
+	}
+
+	LogTestOutput("TestFilestoreCompressedSegments", "d. recovery of a torn late write keeps the compressed segment")
+	lateLine := `{"price":5.0,"stock_id":"700_tencent","trx_date":"2019-07-03T16:13:00+08:00"}`
+	partialLine := `{"price":6.0,"stock_id":"700_tencent","trx_da`
+	bLateWrites, err := ioutil.ReadFile(closedSegment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(closedSegment, []byte(string(bLateWrites)+lateLine+"\n"+partialLine), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pFilestore = store.NewStructFilestore(pFilestore.AppConfig, pFilestore.Filename)
+	report := pFilestore.GetRecoveryReport()
+	if len(report.QuarantinedLines) != 1 || len(report.Errors) != 0 {
+		t.Fatal(fmt.Sprintf("expected ONLY the partial line quarantined BUT got %v", report))
+	}
+	if exists, _ := util.IsFileExists(closedSegment + ".gz"); !exists {
+		t.Fatal("expected the compressed segment kept by the recovery")
+	}
+	bContents, err := ioutil.ReadFile(closedSegment)
+	if err != nil || string(bContents) != string(bLateWrites)+lateLine+"\n" {
+		t.Fatal(fmt.Sprintf("expected ONLY the valid late lines remain BUT got %v (err => %v)", string(bContents), err))
+	}
+	if prices := queryPrices(); prices != "[20 4 5 3]" {
+		t.Fatal(fmt.Sprintf("expected prices [20 4 5 3] BUT got %v", prices))
+	}
+	LogTestOutput("TestFilestoreCompressedSegments", "** end test **\n")
+}
+
+func TestFilestoreCompressionLoop(t *testing.T) {
+	if !*pFlagFilestore {
+		t.SkipNow()
+	}
+	LogTestOutput("TestFilestoreCompressionLoop", "** start test **")
+	closedDate, _ := time.Parse(util.CommonDateFormat, "2019-07-03T16:10:00+08:00")
+	pClock := util.NewStructFakeClock(closedDate.Add(time.Hour))
+	repo, pFilestore := helperCreatePartitionedFilestore(common.StorePartitionDaily,
+		"compression = \"gzip\"\ncompression_interval = \"1h\"", t, pClock)
+	defer func() {
+		pFilestore.StopCompression()
+		_ = os.RemoveAll(repo)
+	}()
+	closedSegment := filepath.Join(repo, "stock_test", "700_tencent", "2019-07-03.data")
+	persist := func(trxDate time.Time, price float64) {
+		resp, err := pFilestore.Persist(map[string]store.StructStoreValue{
+			"stock_id": *store.NewStructStoreValue("", "700_tencent", store.TypeString, false, false),
+			"trx_date": *store.NewStructStoreValue("", trxDate, store.TypeDate, false, false),
+			"price":    *store.NewStructStoreValue("", price, store.TypeFloat, false, false),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		helperFilestoreFlowsCommonResponseHandler(resp, t)
+	}
+	persist(closedDate, 1)
+
+	LogTestOutput("TestFilestoreCompressionLoop", "a. the segment is compressed once closed by the injected clock")
+	if exists, _ := util.IsFileExists(closedSegment); !exists {
+		t.Fatal("expected the segment kept open by the injected clock")
+	}
+	isCompressed := false
+	for i := 0; i < 200 && !isCompressed; i++ {
+		pClock.Advance(time.Hour * 24)
+		time.Sleep(time.Millisecond * 10)
+		isCompressed, _ = util.IsFileExists(closedSegment + ".gz")
+	}
+	if !isCompressed {
+		t.Fatal("expected the segment compressed in the background")
+	}
+
+	LogTestOutput("TestFilestoreCompressionLoop", "b. no compression after the loop is stopped")
+	pFilestore.StopCompression()
+	persist(closedDate.Add(time.Minute), 2)
+	for i := 0; i < 5; i++ {
+		pClock.Advance(time.Hour * 24)
+		time.Sleep(time.Millisecond * 10)
+	}
+	if exists, _ := util.IsFileExists(closedSegment); !exists {
+		t.Fatal("expected the late write kept in the plain segment")
+	}
+	LogTestOutput("TestFilestoreCompressionLoop", "** end test **\n")
+}
+
+func TestFilestoreRecoveryAndSync(t *testing.T) {
+	if !*pFlagFilestore {
+		t.SkipNow()
+	}
+	LogTestOutput("TestFilestoreRecoveryAndSync", "** start test **")
+	repo, pFilestore := helperCreatePartitionedFilestore(common.StorePartitionDaily, "sync = \"group\"", t)
+	defer func() {
+		_ = os.RemoveAll(repo)
+	}()
+	segmentFilepath := filepath.Join(repo, "stock_test", "700_tencent", "2019-07-03.data")
+
+	LogTestOutput("TestFilestoreRecoveryAndSync", "a. segment with a corrupt line and a partial last line (crash)")
+	validLine := `{"price":1.0,"stock_id":"700_tencent","trx_date":"2019-07-03T16:10:00+08:00"}`
+	corruptLine := `{"price":2.0,"stock_id":"700_tenc`
+	partialLine := `{"price":3.0,"stock_id":"700_tencent","trx_date":"2019-07-03T16:12:00+08:00"}`
+	err := os.MkdirAll(filepath.Dir(segmentFilepath), 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(segmentFilepath, []byte(validLine+"\n"+corruptLine+"\n"+partialLine), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pRecovered := store.NewStructFilestore(pFilestore.AppConfig, pFilestore.Filename)
+	report := pRecovered.GetRecoveryReport()
+	if report.ScannedFiles != 1 || report.ScannedLines != 3 || len(report.QuarantinedLines) != 2 {
+		t.Fatal(fmt.Sprintf("expected 2 of 3 lines quarantined BUT got %v", report))
+	}
+	if report.QuarantinedLines[0].LineNumber != 2 || report.QuarantinedLines[1].LineNumber != 3 ||
+		!strings.Contains(report.QuarantinedLines[1].Reason, "partial") {
+		t.Fatal(fmt.Sprintf("expected line 2 (corrupt) and 3 (partial) quarantined BUT got %v", report.QuarantinedLines))
+	}
+	bContents, err := ioutil.ReadFile(segmentFilepath)
+	if err != nil || string(bContents) != validLine+"\n" {
+		t.Fatal(fmt.Sprintf("expected ONLY the valid line remains BUT got %v (err => %v)", string(bContents), err))
+	}
+	bContents, err = ioutil.ReadFile(segmentFilepath + common.StoreQuarantineFileExtension)
+	if err != nil || len(strings.Split(strings.TrimSpace(string(bContents)), "\n")) != 2 {
+		t.Fatal(fmt.Sprintf("expected 2 quarantined lines BUT got %v (err => %v)", string(bContents), err))
+	}
+	if report = pRecovered.Recover(); len(report.QuarantinedLines) != 0 {
+		t.Fatal(fmt.Sprintf("expected nothing to recover on the 2nd scan BUT got %v", report))
+	}
+
+	LogTestOutput("TestFilestoreRecoveryAndSync", "b. appending after a partial line starts on a new line")
+	err = ioutil.WriteFile(segmentFilepath, []byte(validLine+"\n"+corruptLine), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trxDate, _ := time.Parse(util.CommonDateFormat, "2019-07-03T16:13:00+08:00")
+	resp, err := pRecovered.Persist(map[string]store.StructStoreValue{
+		"stock_id": *store.NewStructStoreValue("", "700_tencent", store.TypeString, false, false),
+		"trx_date": *store.NewStructStoreValue("", trxDate, store.TypeDate, false, false),
+		"price":    *store.NewStructStoreValue("", float64(4), store.TypeFloat, false, false),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	helperFilestoreFlowsCommonResponseHandler(resp, t)
+	_, value, err := pRecovered.ReadByKey(store.BuildRecordKey("700_tencent", trxDate), nil)
+	if err != nil || helperFilestoreRecordField(value, "price", t) != float64(4) {
+		t.Fatal(fmt.Sprintf("expected the appended record intact BUT got %v (err => %v)", value, err))
+	}
+
+	LogTestOutput("TestFilestoreRecoveryAndSync", "c. concurrent writers with group commit")
+	waitGroup := new(sync.WaitGroup)
+	for i := 0; i < 20; i++ {
+		waitGroup.Add(1)
+		go func(i int) {
+			defer waitGroup.Done()
+			_, err := pRecovered.Persist(map[string]store.StructStoreValue{
+				"stock_id": *store.NewStructStoreValue("", "700_tencent", store.TypeString, false, false),
+				"trx_date": *store.NewStructStoreValue("", trxDate.Add(time.Second*time.Duration(i+1)), store.TypeDate, false, false),
+				"price":    *store.NewStructStoreValue("", float64(i), store.TypeFloat, false, false),
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	waitGroup.Wait()
+	_, records, err := pRecovered.Query("700_tencent", time.Time{}, time.Time{}, nil, 0)
+	if err != nil || len(records) != 22 {
+		t.Fatal(fmt.Sprintf("expected 22 records BUT got %v (err => %v)", len(records), err))
+	}
+	LogTestOutput("TestFilestoreRecoveryAndSync", "** end test **\n")
+}
+
+func TestFilestoreDeduplication(t *testing.T) {
+	if !*pFlagFilestore {
+		t.SkipNow()
+	}
+	LogTestOutput("TestFilestoreDeduplication", "** start test **")
+	// per module override => skip for stock_test
+	repo, pFilestore := helperCreatePartitionedFilestore(common.StorePartitionDaily,
+		"[filestore.stock_test]\nduplicate_policy = \"skip\"", t)
+	defer func() {
+		_ = os.RemoveAll(repo)
+	}()
+	trxDate, _ := time.Parse(util.CommonDateFormat, "2019-07-03T16:00:00+08:00")
+	persist := func(price float64, volume string) store.StructStoreResponse {
+		resp, err := pFilestore.Persist(map[string]store.StructStoreValue{
+			"stock_id": *store.NewStructStoreValue("", "700_tencent", store.TypeString, false, false),
+			// same trx_date in another timezone is still the same record
+			"trx_date": *store.NewStructStoreValue("", trxDate.UTC(), store.TypeDate, false, false),
+			"price":    *store.NewStructStoreValue("", price, store.TypeFloat, false, false),
+			"volume":   *store.NewStructStoreValue("", volume, store.TypeString, false, false),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		helperFilestoreFlowsCommonResponseHandler(resp, t)
+		return resp
+	}
+	queryPrices := func() string {
+		_, records, err := pFilestore.Query("700_tencent", time.Time{}, time.Time{}, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		prices := make([]interface{}, 0)
+		for _, record := range records {
+			prices = append(prices, helperFilestoreRecordField(record, "price", t))
+		}
+		return fmt.Sprintf("%v", prices)
+	}
+	results := []struct {
+		naturalKey *store.StructNaturalKey
+		price      float64
+		volume     string
+		expected   string
+	}{
+		{ nil, 1, "1M", "[1]" },
+		// skip (module config)
+		{ nil, 2, "1M", "[1]" },
+		{ &store.StructNaturalKey{ Fields: []string{ "stock_id", "trx_date" }, DuplicatePolicy: common.StoreDuplicatePolicyReplace }, 3, "1M", "[3]" },
+		{ &store.StructNaturalKey{ Fields: []string{ "stock_id", "trx_date" }, DuplicatePolicy: common.StoreDuplicatePolicyAppend }, 4, "2M", "[3 4]" },
+		// replace removes all the duplicates
+		{ &store.StructNaturalKey{ Fields: []string{ "stock_id", "trx_date" }, DuplicatePolicy: common.StoreDuplicatePolicyReplace }, 5, "2M", "[5]" },
+		// a natural key including the volume
+		{ &store.StructNaturalKey{ Fields: []string{ "stock_id", "trx_date", "volume" }, DuplicatePolicy: common.StoreDuplicatePolicyReplace }, 6, "3M", "[5 6]" },
+		{ nil, 7, "3M", "[5 7]" },
+	}
+	for i, result := range results {
+		if result.naturalKey != nil {
+			pFilestore.SetNaturalKey(*result.naturalKey)
+		}
+		resp := persist(result.price, result.volume)
+		if prices := queryPrices(); prices != result.expected {
+			t.Fatal(fmt.Sprintf("[%v] expected prices %v BUT got %v (%v)", i, result.expected, prices, resp.Message))
+		}
+	}
+
+	LogTestOutput("TestFilestoreDeduplication", "b. duplicates written by another writer (e.g. process) are found too")
+	pFilestore.SetNaturalKey(store.StructNaturalKey{ Fields: []string{ "stock_id", "trx_date" }, DuplicatePolicy: common.StoreDuplicatePolicyReplace })
+	pOtherFilestore := store.NewStructFilestore(pFilestore.AppConfig, "stock_test.700_tencent")
+	pOtherFilestore.SetNaturalKey(store.StructNaturalKey{ Fields: []string{ "stock_id", "trx_date" }, DuplicatePolicy: common.StoreDuplicatePolicyAppend })
+	for _, iStore := range []store.IStore{ pOtherFilestore, pFilestore } {
+		_, err := iStore.Persist(map[string]store.StructStoreValue{
+			"stock_id": *store.NewStructStoreValue("", "700_tencent", store.TypeString, false, false),
+			"trx_date": *store.NewStructStoreValue("", trxDate.Add(time.Hour), store.TypeDate, false, false),
+			"price":    *store.NewStructStoreValue("", float64(8), store.TypeFloat, false, false),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if prices := queryPrices(); prices != "[5 7 8]" {
+		t.Fatal(fmt.Sprintf("expected the record appended by the other writer replaced BUT got %v", prices))
+	}
+
+	naturalKey, err := store.GetNaturalKeyFromConfig(pFilestore.AppConfig, common.ConfigKeyStoreFile, "stock_other")
+	if err != nil || naturalKey.DuplicatePolicy != common.StoreDuplicatePolicyReplace || len(naturalKey.Fields) != 2 {
+		t.Fatal(fmt.Sprintf("expected the default natural key BUT got %v (err => %v)", naturalKey, err))
+	}
+	LogTestOutput("TestFilestoreDeduplication", "** end test **\n")
+}
+
+// create a filestore (stock_test.700_tencent) with the given partition scheme under a temp repo
+func helperCreatePartitionedFilestore(partition string, additionalConfig string, t *testing.T, clock ...util.IClock) (repo string, pFilestore *store.StructFilestore) {
+	repo, err := ioutil.TempDir("", "filestore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfgFilepath := filepath.Join(repo, "app.toml")
+	err = ioutil.WriteFile(cfgFilepath, []byte(fmt.Sprintf("[filestore]\nrepo = \"%v/\"\npartition = \"%v\"\n%v\n", repo, partition, additionalConfig)), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := util.LoadConfig(cfgFilepath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pFilestore = store.NewStructFilestore(cfg, "stock_test.700_tencent", clock...)
+	return
+}
+
+func helperFilestoreRecordField(value store.StructStoreValue, field string, t *testing.T) interface{} {
+	record, isMap := value.Value.(map[string]store.StructStoreValue)
+	if !value.IsObject || !isMap {
+		t.Fatal(fmt.Sprintf("expected an object value BUT got %v", value))
+	}
+	return record[field].Value
+}
+
 func helperFilestoreFlowsCommonResponseHandler(r store.StructStoreResponse, t *testing.T) {
 	if r.Code != store.CodeSuccess {
 		t.Fatal(fmt.Sprintf("no Error previously HOWEVER there is a non SUCCESS code and message from response =>[%v] %v", r.Code, r.Message))
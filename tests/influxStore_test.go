@@ -0,0 +1,294 @@
+/*
+ *  Copyright Project - Stockbinator, Author - quoeamaster, (C) 2019
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+package tests
+
+import (
+	"Stockbinator/common"
+	"Stockbinator/store"
+	"Stockbinator/util"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestInfluxStoreBatchWrites(t *testing.T) {
+	if !*pFlagInflux {
+		t.SkipNow()
+	}
+	pReceiver := new(structInfluxReceiver)
+	pServer := httptest.NewServer(pReceiver)
+	defer pServer.Close()
+	pStore := helperCreateInfluxStore(pServer.URL+"/api/v2/write?org=sb&bucket=stocks", "batch_size = 2\nflush_interval = \"0s\"\ntoken = \"secret\"\n", t)
+
+	LogTestOutput("TestInfluxStoreBatchWrites", "a. lines are written once the batch is full")
+	trxDate := time.Date(2019, 7, 1, 1, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		record := helperElasticsearchRecord("700_tencent", trxDate.Add(time.Hour*time.Duration(i)), 330.2)
+		record["trades"] = store.StructStoreValue{Value: i, Type: store.TypeInteger}
+		resp, err := pStore.Persist(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		helperFilestoreFlowsCommonResponseHandler(resp, t)
+	}
+	requests := pReceiver.getRequests()
+	if len(requests) != 1 || pStore.GetPendingLineCount() != 1 {
+		t.Fatal(fmt.Sprintf("expected 1 request and 1 pending line BUT got %v and %v", requests, pStore.GetPendingLineCount()))
+	}
+	expectedLine := fmt.Sprintf("stock_test,module=stock_test,stock_id=700_tencent price=330.2,trades=0i %v", trxDate.Unix())
+	if lines := strings.Split(requests[0].body, "\n"); len(lines) != 2 || lines[0] != expectedLine {
+		t.Fatal(fmt.Sprintf("expected 2 lines starting with [%v] BUT got %v", expectedLine, lines))
+	}
+	if requests[0].authorization != "Token secret" || !strings.Contains(requests[0].query, "precision=s") || !strings.Contains(requests[0].query, "bucket=stocks") {
+		t.Fatal(fmt.Sprintf("expected the token and precision sent BUT got %v", requests[0]))
+	}
+
+	LogTestOutput("TestInfluxStoreBatchWrites", "b. failed writes are kept for the next flush")
+	pReceiver.setFailing(true)
+	resp, err := pStore.Persist(helperElasticsearchRecord("700_tencent", trxDate.Add(time.Hour*3), 1))
+	if err == nil || resp.Code != store.CodeFailure || pStore.GetLastError() == nil || pStore.GetPendingLineCount() != 2 {
+		t.Fatal(fmt.Sprintf("expected a failed write with 2 pending lines BUT got %v (%v)", pStore.GetPendingLineCount(), err))
+	}
+	pReceiver.setFailing(false)
+	err = pStore.Flush()
+	if err != nil || pStore.GetPendingLineCount() != 0 || len(pReceiver.getRequests()) != 2 {
+		t.Fatal(fmt.Sprintf("expected the pending lines written BUT got %v pending (%v)", pStore.GetPendingLineCount(), err))
+	}
+
+	LogTestOutput("TestInfluxStoreBatchWrites", "c. non numeric records are skipped and reads are not supported")
+	resp, err = pStore.Persist(map[string]store.StructStoreValue{
+		"trx_date": {Value: trxDate, Type: store.TypeDate},
+		"volume":   {Value: "1 Million", Type: store.TypeString},
+	})
+	if err != nil || resp.AdditionalCode != common.FileStatusSkipped || pStore.GetPendingLineCount() != 0 {
+		t.Fatal(fmt.Sprintf("expected the record skipped BUT got %v (%v)", resp, err))
+	}
+	_, _, err = pStore.Query("700_tencent", time.Time{}, time.Time{}, nil, 0)
+	if err != store.ErrInfluxStoreWriteOnly {
+		t.Fatal(fmt.Sprintf("expected the write only error BUT got %v", err))
+	}
+}
+
+func TestInfluxStorePendingLines(t *testing.T) {
+	if !*pFlagInflux {
+		t.SkipNow()
+	}
+	pReceiver := new(structInfluxReceiver)
+	pServer := httptest.NewServer(pReceiver)
+	defer pServer.Close()
+	pStore := helperCreateInfluxStore(pServer.URL+"/write?db=stockbinator", "batch_size = 10\nflush_interval = \"0s\"\nmax_pending_lines = 3\n", t)
+	trxDate := time.Date(2019, 7, 1, 1, 0, 0, 0, time.UTC)
+	persist := func(trades int) {
+		record := helperElasticsearchRecord("700_tencent", trxDate.Add(time.Hour*time.Duration(trades)), 330.2)
+		record["trades"] = store.StructStoreValue{Value: trades, Type: store.TypeInteger}
+		if _, err := pStore.Persist(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	LogTestOutput("TestInfluxStorePendingLines", "a. lines dropped whilst writing are not mistaken for the written ones")
+	persist(0)
+	persist(1)
+	pReceiver.lock.Lock()
+	pReceiver.arrivedChannel, pReceiver.blockChannel = make(chan bool, 1), make(chan bool)
+	arrivedChannel, blockChannel := pReceiver.arrivedChannel, pReceiver.blockChannel
+	pReceiver.lock.Unlock()
+	flushChannel := make(chan error, 1)
+	go func() {
+		flushChannel <- pStore.Flush()
+	}()
+	<-arrivedChannel
+	// the lines 0 and 1 (being written) are dropped from the pending lines as over the max
+	persist(2)
+	persist(3)
+	persist(4)
+	if err := pStore.GetLastError(); err == nil || !strings.Contains(err.Error(), "2 line(s) dropped so far") {
+		t.Fatal(fmt.Sprintf("expected the dropped lines told by the last error BUT got %v", err))
+	}
+	pReceiver.lock.Lock()
+	pReceiver.arrivedChannel, pReceiver.blockChannel = nil, nil
+	pReceiver.lock.Unlock()
+	close(blockChannel)
+	// the flush goes on with the lines persisted whilst writing
+	if err := <-flushChannel; err != nil || pStore.GetPendingLineCount() != 0 {
+		t.Fatal(fmt.Sprintf("expected the pending lines written BUT got %v (%v)", pStore.GetPendingLineCount(), err))
+	}
+	requests := pReceiver.getRequests()
+	if len(requests) != 2 {
+		t.Fatal(fmt.Sprintf("expected 2 requests BUT got %v", requests))
+	}
+	lines := strings.Split(requests[1].body, "\n")
+	if len(lines) != 3 || !strings.Contains(lines[0], "trades=2i") || !strings.Contains(lines[2], "trades=4i") {
+		t.Fatal(fmt.Sprintf("expected the lines 2 to 4 written BUT got %v", lines))
+	}
+	if stats := store.GetStoreStats("influxstore.stock_test.700_tencent", pStore); stats.DroppedRecords != 2 {
+		t.Fatal(fmt.Sprintf("expected 2 dropped records BUT got %v", stats))
+	}
+
+	LogTestOutput("TestInfluxStorePendingLines", "b. the background flush stops")
+	pStore = helperCreateInfluxStore(pServer.URL+"/write?db=stockbinator", "batch_size = 10\nflush_interval = \"10ms\"\n", t)
+	persist(5)
+	for i := 0; i < 100 && pStore.GetPendingLineCount() > 0; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if pStore.GetPendingLineCount() != 0 {
+		t.Fatal("expected the pending line written in the background")
+	}
+	pStore.StopFlush()
+	persist(6)
+	time.Sleep(time.Millisecond * 100)
+	if pStore.GetPendingLineCount() != 1 {
+		t.Fatal(fmt.Sprintf("expected the line kept pending once stopped BUT got %v", pStore.GetPendingLineCount()))
+	}
+
+	LogTestOutput("TestInfluxStorePendingLines", "c. the pending lines are written when the cached stores are closed")
+	storeKey := "influxstore.stock_test.close_test"
+	iStore, err := store.GetStoreByKey(storeKey, pStore.AppConfig, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pStore = iStore.(*store.StructInfluxStore)
+	persist(7)
+	requestCount := len(pReceiver.getRequests())
+	// other cached stores (of the other tests) might fail to close
+	if err = store.CloseCachedStores(); err != nil && strings.Contains(err.Error(), storeKey) {
+		t.Fatal(err)
+	}
+	requests = pReceiver.getRequests()
+	if pStore.GetPendingLineCount() != 0 || len(requests) != requestCount+1 || !strings.Contains(requests[requestCount].body, "trades=7i") {
+		t.Fatal(fmt.Sprintf("expected the pending line written on close BUT got %v", requests[requestCount:]))
+	}
+
+	LogTestOutput("TestInfluxStorePendingLines", "d. the records of the dropped lines are spooled")
+	pReceiver.setFailing(true)
+	pStore = helperCreateInfluxStore(pServer.URL+"/write?db=stockbinator", "batch_size = 10\nflush_interval = \"0s\"\nmax_pending_lines = 2\n", t)
+	pSpool, err := store.NewStructStoreSpool("", time.Minute, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pSpoolingStore := store.NewStructSpoolingStore(pStore, "influxstore.stock_test.700_tencent", pSpool)
+	for trades := 10; trades < 13; trades++ {
+		record := helperElasticsearchRecord("700_tencent", trxDate.Add(time.Hour*time.Duration(trades)), 330.2)
+		record["trades"] = store.StructStoreValue{Value: trades, Type: store.TypeInteger}
+		if _, err = pSpoolingStore.Persist(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries := pSpool.List("influxstore.stock_test.700_tencent")
+	if len(entries) != 1 || !strings.Contains(string(entries[0].Record), "10") || !strings.Contains(entries[0].LastError, "dropped") {
+		t.Fatal(fmt.Sprintf("expected the record of the dropped line spooled BUT got %v", entries))
+	}
+	if pStore.GetDroppedLineCount() != 1 || pStore.GetPendingLineCount() != 2 {
+		t.Fatal(fmt.Sprintf("expected 1 dropped and 2 pending lines BUT got %v and %v", pStore.GetDroppedLineCount(), pStore.GetPendingLineCount()))
+	}
+}
+
+func TestInfluxStoreLineEscaping(t *testing.T) {
+	if !*pFlagInflux {
+		t.SkipNow()
+	}
+	pReceiver := new(structInfluxReceiver)
+	pServer := httptest.NewServer(pReceiver)
+	defer pServer.Close()
+	pStore := helperCreateInfluxStore(pServer.URL+"/write?db=stockbinator", "batch_size = 1\nmeasurement = \"hk stocks\"\nprecision = \"ms\"\n", t)
+
+	trxDate := time.Date(2019, 7, 1, 1, 0, 0, 0, time.UTC)
+	_, err := pStore.Persist(map[string]store.StructStoreValue{
+		"stock_id":  {Value: "700 tencent,hk", Type: store.TypeString},
+		"trx_date":  {Value: trxDate, Type: store.TypeDate},
+		"bid=ask":   {Value: 1.5, Type: store.TypeFloat},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	requests := pReceiver.getRequests()
+	expectedLine := fmt.Sprintf(`hk\ stocks,module=stock_test,stock_id=700\ tencent\,hk bid\=ask=1.5 %v`, trxDate.UnixNano()/int64(time.Millisecond))
+	if len(requests) != 1 || requests[0].body != expectedLine || !strings.Contains(requests[0].query, "precision=ms") {
+		t.Fatal(fmt.Sprintf("expected [%v] BUT got %v", expectedLine, requests))
+	}
+}
+
+func helperCreateInfluxStore(writeUrl string, additionalConfig string, t *testing.T) (pStore *store.StructInfluxStore) {
+	repo, err := ioutil.TempDir("", "influxstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfgFilepath := filepath.Join(repo, "app.toml")
+	err = ioutil.WriteFile(cfgFilepath, []byte(fmt.Sprintf("[influxstore]\nurl = \"%v\"\n%v\n", writeUrl, additionalConfig)), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := util.LoadConfig(cfgFilepath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pStore = store.NewStructInfluxStore(cfg, "stock_test.700_tencent")
+	return
+}
+
+// local receiver recording the write requests
+type structInfluxReceiver struct {
+	lock      sync.Mutex
+	requests  []structInfluxRequest
+	isFailing bool
+	// if set, a request is signalled through arrivedChannel and held until blockChannel is closed
+	arrivedChannel chan bool
+	blockChannel   chan bool
+}
+
+type structInfluxRequest struct {
+	query         string
+	authorization string
+	body          string
+}
+
+func (r *structInfluxReceiver) ServeHTTP(w http.ResponseWriter, pRequest *http.Request) {
+	r.lock.Lock()
+	arrivedChannel, blockChannel := r.arrivedChannel, r.blockChannel
+	r.lock.Unlock()
+	if blockChannel != nil {
+		arrivedChannel <- true
+		<-blockChannel
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.isFailing {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	body, _ := ioutil.ReadAll(pRequest.Body)
+	r.requests = append(r.requests, structInfluxRequest{query: pRequest.URL.RawQuery,
+		authorization: pRequest.Header.Get("Authorization"), body: string(body)})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (r *structInfluxReceiver) setFailing(isFailing bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.isFailing = isFailing
+}
+
+func (r *structInfluxReceiver) getRequests() []structInfluxRequest {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]structInfluxRequest{}, r.requests...)
+}
@@ -0,0 +1,216 @@
+/*
+ *  Copyright Project - Stockbinator, Author - quoeamaster, (C) 2019
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+package tests
+
+import (
+	"Stockbinator/store"
+	"Stockbinator/util"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMemoryStoreFlow(t *testing.T) {
+	if !*pFlagMemory {
+		t.SkipNow()
+	}
+	var iStore store.IStore = store.NewStructMemoryStore(nil, "stock_test.700_tencent")
+
+	LogTestOutput("TestMemoryStoreFlow", "a. concurrent persists")
+	baseTime := time.Date(2019, 7, 1, 1, 0, 0, 0, time.UTC)
+	var waitGroup sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		waitGroup.Add(1)
+		go func(i int) {
+			defer waitGroup.Done()
+			_, err := iStore.Persist(helperElasticsearchRecord("700_tencent", baseTime.Add(time.Hour*time.Duration(i)), float64(i)))
+			if err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	waitGroup.Wait()
+	_, err := iStore.Persist(helperElasticsearchRecord("939_ccb", baseTime, 6.5))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	LogTestOutput("TestMemoryStoreFlow", "b. read by key (any timezone) and query")
+	hkTime := baseTime.Add(time.Hour * 3).In(time.FixedZone("HKT", 8*3600))
+	_, value, err := iStore.ReadByKey(store.BuildRecordKey("700_tencent", hkTime), map[string]interface{}{ "price": 3.0 })
+	if err != nil || helperFilestoreRecordField(value, "price", t) != float64(3) {
+		t.Fatal(fmt.Sprintf("expected the record of price 3 BUT got %v (%v)", value, err))
+	}
+	_, records, err := iStore.Query("700_tencent", baseTime.Add(time.Hour*5), baseTime.Add(time.Hour*9), []string{ "price" }, 3)
+	if err != nil || len(records) != 3 || helperFilestoreRecordField(records[0], "price", t) != float64(5) {
+		t.Fatal(fmt.Sprintf("expected 3 records from price 5 BUT got %v (%v)", records, err))
+	}
+	_, iterator, err := iStore.Iterate(store.PredicateByTrxDateRange(baseTime.Add(time.Hour*15), time.Time{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	iterated := 0
+	for iterator.Next() {
+		iterated++
+	}
+	_ = iterator.Close()
+	if iterated != 5 {
+		t.Fatal(fmt.Sprintf("expected 5 iterated records BUT got %v", iterated))
+	}
+
+	LogTestOutput("TestMemoryStoreFlow", "c. modify, remove by key and remove all")
+	key := store.BuildRecordKey("700_tencent", baseTime)
+	_, err = iStore.ModifyByKey(key, store.StructStoreValue{IsObject: true, Value: map[string]store.StructStoreValue{
+		"volume": {Value: "1 Million", Type: store.TypeString},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = iStore.ModifyByKey(key, store.StructStoreValue{IsObject: true, Value: map[string]store.StructStoreValue{
+		"stock_id": {Value: "939_ccb", Type: store.TypeString},
+	}})
+	if err == nil {
+		t.Fatal("expected the record identity could not be modified")
+	}
+	_, removed, err := iStore.RemoveByKey(key)
+	if err != nil || helperFilestoreRecordField(removed, "volume", t) != "1 Million" {
+		t.Fatal(fmt.Sprintf("expected the modified record removed BUT got %v (%v)", removed, err))
+	}
+	resp, _, err := iStore.ReadByKey(key, nil)
+	if err == nil || resp.Code != store.CodeFailure {
+		t.Fatal("expected the removed record is not available anymore")
+	}
+	_, err = iStore.RemoveAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, content, err := iStore.ReadAll()
+	if err != nil || strings.TrimSpace(content) != "" {
+		t.Fatal(fmt.Sprintf("expected no records of the symbol left BUT got [%v] (%v)", content, err))
+	}
+	_, records, err = iStore.Query("939_ccb", time.Time{}, time.Time{}, nil, 0)
+	if err != nil || len(records) != 1 {
+		t.Fatal(fmt.Sprintf("expected the other symbol's record kept BUT got %v (%v)", records, err))
+	}
+}
+
+func TestMemoryStoreLimits(t *testing.T) {
+	if !*pFlagMemory {
+		t.SkipNow()
+	}
+	pClock := util.NewStructFakeClock(time.Date(2019, 7, 1, 0, 0, 0, 0, time.UTC))
+	pStore := store.NewStructMemoryStore(nil, "stock_test.700_tencent", pClock)
+	pStore.SetLimits(3, time.Minute*10)
+	baseTime := time.Date(2019, 7, 1, 1, 0, 0, 0, time.UTC)
+
+	LogTestOutput("TestMemoryStoreLimits", "a. the oldest records are evicted beyond the max size")
+	for i := 0; i < 5; i++ {
+		_, err := pStore.Persist(helperElasticsearchRecord("700_tencent", baseTime.Add(time.Hour*time.Duration(i)), float64(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		pClock.Advance(time.Minute)
+	}
+	if pStore.GetRecordCount() != 3 {
+		t.Fatal(fmt.Sprintf("expected 3 records kept BUT got %v", pStore.GetRecordCount()))
+	}
+	_, _, err := pStore.ReadByKey(store.BuildRecordKey("700_tencent", baseTime.Add(time.Hour)), nil)
+	if err == nil {
+		t.Fatal("expected the 2nd record evicted")
+	}
+
+	LogTestOutput("TestMemoryStoreLimits", "b. records expire after the ttl")
+	// records 2, 3 and 4 were stored at minute 2, 3 and 4
+	pClock.Set(time.Date(2019, 7, 1, 0, 13, 30, 0, time.UTC))
+	if pStore.GetRecordCount() != 1 {
+		t.Fatal(fmt.Sprintf("expected 1 record left BUT got %v", pStore.GetRecordCount()))
+	}
+	_, value, err := pStore.ReadByKey(store.BuildRecordKey("700_tencent", baseTime.Add(time.Hour*4)), nil)
+	if err != nil || helperFilestoreRecordField(value, "price", t) != float64(4) {
+		t.Fatal(fmt.Sprintf("expected the last record still available BUT got %v (%v)", value, err))
+	}
+}
+
+func TestMemoryStoreReadThroughCache(t *testing.T) {
+	if !*pFlagMemory {
+		t.SkipNow()
+	}
+	pBacking := &structCountingStore{IStore: store.NewStructMemoryStore(nil, "stock_test.700_tencent")}
+	pCache := store.NewStructMemoryStore(nil, "stock_test.700_tencent")
+	pCache.SetBackingStore(pBacking)
+	trxDate := time.Date(2019, 7, 1, 1, 0, 0, 0, time.UTC)
+	key := store.BuildRecordKey("700_tencent", trxDate)
+
+	LogTestOutput("TestMemoryStoreReadThroughCache", "a. writes go to the backing store")
+	_, err := pCache.Persist(helperElasticsearchRecord("700_tencent", trxDate, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pCache.GetRecordCount() != 0 {
+		t.Fatal("expected nothing cached on write")
+	}
+
+	LogTestOutput("TestMemoryStoreReadThroughCache", "b. reads are loaded once then served from memory")
+	for i := 0; i < 3; i++ {
+		_, value, err := pCache.ReadByKey(key, nil)
+		if err != nil || helperFilestoreRecordField(value, "price", t) != float64(1) {
+			t.Fatal(fmt.Sprintf("expected price 1 BUT got %v (%v)", value, err))
+		}
+	}
+	if hitCount, missCount := pCache.GetCacheStats(); pBacking.getReadCount() != 1 || hitCount != 2 || missCount != 1 {
+		t.Fatal(fmt.Sprintf("expected 1 backing read, 2 hits and 1 miss BUT got %v, %v and %v", pBacking.getReadCount(), hitCount, missCount))
+	}
+
+	LogTestOutput("TestMemoryStoreReadThroughCache", "c. writes invalidate the cached record")
+	_, err = pCache.Persist(helperElasticsearchRecord("700_tencent", trxDate, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, value, err := pCache.ReadByKey(key, nil)
+	if err != nil || helperFilestoreRecordField(value, "price", t) != float64(2) || pBacking.getReadCount() != 2 {
+		t.Fatal(fmt.Sprintf("expected the replaced price 2 loaded again BUT got %v (%v)", value, err))
+	}
+	_, _, err = pCache.RemoveByKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = pCache.ReadByKey(key, nil)
+	if err == nil {
+		t.Fatal("expected the removed record is not served from memory")
+	}
+}
+
+// IStore counting the ReadByKey calls
+type structCountingStore struct {
+	store.IStore
+	readCount int
+	lock      sync.Mutex
+}
+
+func (c *structCountingStore) ReadByKey(key string, params interface{}) (store.StructStoreResponse, store.StructStoreValue, error) {
+	c.lock.Lock()
+	c.readCount++
+	c.lock.Unlock()
+	return c.IStore.ReadByKey(key, params)
+}
+
+func (c *structCountingStore) getReadCount() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.readCount
+}
@@ -0,0 +1,248 @@
+/*
+ *  Copyright Project - Stockbinator, Author - quoeamaster, (C) 2019
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+package tests
+
+import (
+	"Stockbinator/common"
+	"Stockbinator/store"
+	"Stockbinator/util"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSqliteStorePersistAndQuery(t *testing.T) {
+	if !*pFlagSqlite {
+		t.SkipNow()
+	}
+	dbPath, pStore := helperCreateSqliteStore("stock_test.700_tencent", "", t)
+	_, pOtherStore := helperCreateSqliteStoreWithPath(dbPath, "stock_test.939_ccb", "", t)
+
+	LogTestOutput("TestSqliteStorePersistAndQuery", "a. persist records of various types")
+	baseTime := time.Date(2019, 7, 1, 1, 0, 0, 0, time.FixedZone("HKT", 8*3600))
+	for i := 0; i < 5; i++ {
+		record := helperElasticsearchRecord("700_tencent", baseTime.Add(time.Hour*time.Duration(i)), float64(300+i)+0.5)
+		record["trades"] = store.StructStoreValue{Value: i * 10, Type: store.TypeInteger}
+		record["is_suspended"] = store.StructStoreValue{Value: i == 3, Type: store.TypeBool}
+		record["tags"] = store.StructStoreValue{Value: []string{ "hk", fmt.Sprintf("t%v", i) }, Type: store.TypeString, IsArray: true}
+		resp, err := pStore.Persist(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		helperFilestoreFlowsCommonResponseHandler(resp, t)
+	}
+	resp, err := pOtherStore.Persist(helperElasticsearchRecord("939_ccb", baseTime, 6.5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	helperFilestoreFlowsCommonResponseHandler(resp, t)
+
+	LogTestOutput("TestSqliteStorePersistAndQuery", "b. typed columns and indices are visible to any sql tool")
+	pDB, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pDB.Close()
+	columnTypes := helperSqliteColumnTypes(pDB, "stock_test", t)
+	expectedTypes := map[string]string{ "stock_id": "TEXT", "trx_date": "TEXT", "price": "REAL", "trades": "INTEGER",
+		"is_suspended": "INTEGER", "tags": "TEXT", "volume": "TEXT" }
+	for column, expectedType := range expectedTypes {
+		if columnTypes[column] != expectedType {
+			t.Fatal(fmt.Sprintf("expected column [%v] of type %v BUT got %v", column, expectedType, columnTypes))
+		}
+	}
+	indexCount := 0
+	err = pDB.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'index' AND tbl_name = 'stock_test' AND sql LIKE '%stock_id%'").Scan(&indexCount)
+	if err != nil || indexCount != 1 {
+		t.Fatal(fmt.Sprintf("expected an index on stock_id + trx_date BUT got %v (%v)", indexCount, err))
+	}
+	trxDate := ""
+	err = pDB.QueryRow("SELECT trx_date FROM stock_test WHERE stock_id = '700_tencent' ORDER BY trx_date LIMIT 1").Scan(&trxDate)
+	if err != nil || trxDate != "2019-06-30T17:00:00Z" {
+		t.Fatal(fmt.Sprintf("expected trx_date kept in UTC BUT got %v (%v)", trxDate, err))
+	}
+
+	LogTestOutput("TestSqliteStorePersistAndQuery", "c. read by key keeps the types")
+	key := store.BuildRecordKey("700_tencent", baseTime.Add(time.Hour*3))
+	resp, value, err := pStore.ReadByKey(key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trades := helperFilestoreRecordField(value, "trades", t); trades != 30 {
+		t.Fatal(fmt.Sprintf("expected trades 30 (int) BUT got %v (%T)", trades, trades))
+	}
+	if isSuspended := helperFilestoreRecordField(value, "is_suspended", t); isSuspended != true {
+		t.Fatal(fmt.Sprintf("expected is_suspended true BUT got %v", isSuspended))
+	}
+	if price := helperFilestoreRecordField(value, "price", t); price != 303.5 {
+		t.Fatal(fmt.Sprintf("expected price 303.5 BUT got %v", price))
+	}
+	if date, isDate := helperFilestoreRecordField(value, "trx_date", t).(time.Time); !isDate || !date.Equal(baseTime.Add(time.Hour*3)) {
+		t.Fatal(fmt.Sprintf("expected trx_date %v BUT got %v", baseTime.Add(time.Hour*3), date))
+	}
+	if tags, isArray := helperFilestoreRecordField(value, "tags", t).([]store.StructStoreValue); !isArray || len(tags) != 2 || tags[1].Value != "t3" {
+		t.Fatal(fmt.Sprintf("expected tags [hk t3] BUT got %v", tags))
+	}
+
+	LogTestOutput("TestSqliteStorePersistAndQuery", "d. query by range, fields and limit")
+	resp, records, err := pStore.Query("700_tencent", baseTime.Add(time.Hour), baseTime.Add(time.Hour*4), []string{ "price" }, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || helperFilestoreRecordField(records[0], "price", t) != 301.5 || helperFilestoreRecordField(records[1], "price", t) != 302.5 {
+		t.Fatal(fmt.Sprintf("expected the 2nd and 3rd records BUT got %v", records))
+	}
+	if _, isAvailable := records[0].Value.(map[string]store.StructStoreValue)["volume"]; isAvailable {
+		t.Fatal("expected ONLY the selected fields plus the record identity")
+	}
+
+	LogTestOutput("TestSqliteStorePersistAndQuery", "e. iterate ONLY the store's symbol")
+	resp, iterator, err := pStore.Iterate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	iterated := 0
+	for iterator.Next() {
+		if helperFilestoreRecordField(iterator.Record(), "stock_id", t) != "700_tencent" {
+			t.Fatal(fmt.Sprintf("expected ONLY 700_tencent records BUT got %v", iterator.Record()))
+		}
+		iterated++
+	}
+	if iterator.Err() != nil || iterated != 5 {
+		t.Fatal(fmt.Sprintf("expected 5 iterated records BUT got %v (%v)", iterated, iterator.Err()))
+	}
+	_ = iterator.Close()
+
+	LogTestOutput("TestSqliteStorePersistAndQuery", "f. modify (with a new field), remove by key and remove all")
+	resp, err = pStore.ModifyByKey(key, store.StructStoreValue{IsObject: true, Value: map[string]store.StructStoreValue{
+		"volume": {Value: "1 Million", Type: store.TypeString},
+		"remark": {Value: "halted", Type: store.TypeString},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, value, err = pStore.ReadByKey(key, nil)
+	if err != nil || helperFilestoreRecordField(value, "remark", t) != "halted" || helperFilestoreRecordField(value, "volume", t) != "1 Million" {
+		t.Fatal(fmt.Sprintf("expected the modified record BUT got %v (%v)", value, err))
+	}
+	resp, err = pStore.ModifyByKey(key, store.StructStoreValue{IsObject: true, Value: map[string]store.StructStoreValue{
+		"stock_id": {Value: "939_ccb", Type: store.TypeString},
+	}})
+	if err == nil {
+		t.Fatal("expected the record identity could not be modified")
+	}
+	resp, removed, err := pStore.RemoveByKey(key)
+	if err != nil || helperFilestoreRecordField(removed, "remark", t) != "halted" {
+		t.Fatal(fmt.Sprintf("expected the removed record BUT got %v (%v)", removed, err))
+	}
+	resp, _, err = pStore.ReadByKey(key, nil)
+	if err == nil || resp.Code != store.CodeFailure {
+		t.Fatal("expected the removed record is not available anymore")
+	}
+	resp, err = pStore.RemoveAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, content, err := pStore.ReadAll()
+	if err != nil || strings.TrimSpace(content) != "" {
+		t.Fatal(fmt.Sprintf("expected no records left BUT got [%v] (%v)", content, err))
+	}
+	resp, content, err = pOtherStore.ReadAll()
+	if err != nil || strings.Count(content, "\n") != 1 {
+		t.Fatal(fmt.Sprintf("expected the other symbol's record kept BUT got [%v] (%v)", content, err))
+	}
+}
+
+func TestSqliteStoreDeduplication(t *testing.T) {
+	if !*pFlagSqlite {
+		t.SkipNow()
+	}
+	_, pStore := helperCreateSqliteStore("stock_test.700_tencent", "", t)
+	trxDate := time.Date(2019, 7, 2, 2, 0, 0, 0, time.UTC)
+	key := store.BuildRecordKey("700_tencent", trxDate)
+
+	LogTestOutput("TestSqliteStoreDeduplication", "a. replace (default)")
+	for _, price := range []float64{ 1, 2 } {
+		_, err := pStore.Persist(helperElasticsearchRecord("700_tencent", trxDate, price))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, value, err := pStore.ReadByKey(key, nil)
+	if err != nil || helperFilestoreRecordField(value, "price", t) != float64(2) {
+		t.Fatal(fmt.Sprintf("expected the replaced price 2 BUT got %v (%v)", value, err))
+	}
+
+	LogTestOutput("TestSqliteStoreDeduplication", "b. skip")
+	pStore.SetNaturalKey(store.StructNaturalKey{Fields: []string{ store.StoreKeyStockId, store.StoreKeyTrxDate }, DuplicatePolicy: "skip"})
+	resp, err := pStore.Persist(helperElasticsearchRecord("700_tencent", trxDate, 3))
+	if err != nil || !strings.Contains(resp.Message, "skipped") || resp.AdditionalCode != common.FileStatusSkipped {
+		t.Fatal(fmt.Sprintf("expected the record skipped BUT got %v (%v)", resp, err))
+	}
+
+	LogTestOutput("TestSqliteStoreDeduplication", "c. append")
+	pStore.SetNaturalKey(store.StructNaturalKey{Fields: []string{ store.StoreKeyStockId, store.StoreKeyTrxDate }, DuplicatePolicy: "append"})
+	_, err = pStore.Persist(helperElasticsearchRecord("700_tencent", trxDate, 4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, content, err := pStore.ReadAll()
+	if err != nil || strings.Count(content, "\n") != 2 {
+		t.Fatal(fmt.Sprintf("expected 2 records with the same key BUT got [%v] (%v)", content, err))
+	}
+}
+
+func helperCreateSqliteStore(name string, additionalConfig string, t *testing.T) (dbPath string, pStore *store.StructSqliteStore) {
+	repo, err := ioutil.TempDir("", "sqlitestore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return helperCreateSqliteStoreWithPath(filepath.Join(repo, "stockbinator.db"), name, additionalConfig, t)
+}
+
+func helperCreateSqliteStoreWithPath(dbPath string, name string, additionalConfig string, t *testing.T) (string, *store.StructSqliteStore) {
+	cfgFilepath := filepath.Join(filepath.Dir(dbPath), "app.toml")
+	err := ioutil.WriteFile(cfgFilepath, []byte(fmt.Sprintf("[sqlitestore]\npath = \"%v\"\n%v\n", dbPath, additionalConfig)), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := util.LoadConfig(cfgFilepath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dbPath, store.NewStructSqliteStore(cfg, name)
+}
+
+func helperSqliteColumnTypes(pDB *sql.DB, table string, t *testing.T) (columnTypes map[string]string) {
+	columnTypes = make(map[string]string)
+	rows, err := pDB.Query(fmt.Sprintf("SELECT name, type FROM pragma_table_info('%v')", table))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name, columnType string
+		if err = rows.Scan(&name, &columnType); err != nil {
+			t.Fatal(err)
+		}
+		columnTypes[name] = columnType
+	}
+	return
+}
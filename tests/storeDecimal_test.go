@@ -0,0 +1,189 @@
+/*
+ *  Copyright Project - Stockbinator, Author - quoeamaster, (C) 2019
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+package tests
+
+import (
+	"Stockbinator/common"
+	"Stockbinator/store"
+	"Stockbinator/util"
+	"bytes"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStoreDecimalArithmetic(t *testing.T) {
+	if !*pFlagDecimal {
+		t.SkipNow()
+	}
+	parse := func(value string) store.StructDecimal {
+		decimal, err := store.ParseDecimal(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return decimal
+	}
+	LogTestOutput("TestStoreDecimalArithmetic", "a. parse and format")
+	for value, expected := range map[string]string{
+		"330.000": "330.000", "-0.050": "-0.050", "+20": "20", " 1.5 ": "1.5", "0.0": "0.0",
+	} {
+		if decimal := parse(value); decimal.String() != expected {
+			t.Fatal(fmt.Sprintf("expected [%v] formatted as [%v] BUT got [%v]", value, expected, decimal))
+		}
+	}
+	for _, value := range []string{ "", "1e3", "1.", ".5", "1,234.5", "--1", "NaN" } {
+		if _, err := store.ParseDecimal(value); err == nil {
+			t.Fatal(fmt.Sprintf("expected [%v] to be rejected", value))
+		}
+	}
+
+	LogTestOutput("TestStoreDecimalArithmetic", "b. exact arithmetic")
+	sum := store.StructDecimal{}
+	for i := 0; i < 10; i++ {
+		sum = sum.Add(parse("0.1"))
+	}
+	if sum.String() != "1.0" || sum.Cmp(store.NewDecimalFromInt(1)) != 0 {
+		t.Fatal(fmt.Sprintf("expected 0.1 x 10 to be exactly 1.0 BUT got %v", sum))
+	}
+	checks := []struct{ actual store.StructDecimal; expected string }{
+		{ parse("330.000").Sub(parse("329.8")), "0.200" },
+		{ parse("1.50").Mul(parse("2.5")), "3.750" },
+		{ parse("1.005").Round(2), "1.01" },
+		{ parse("-1.005").Round(2), "-1.01" },
+		{ parse("1.004").Round(2), "1.00" },
+		{ parse("1.5").Round(3), "1.500" },
+	}
+	for i, check := range checks {
+		if check.actual.String() != check.expected {
+			t.Fatal(fmt.Sprintf("[%v] expected %v BUT got %v", i, check.expected, check.actual))
+		}
+	}
+	quotient, err := parse("10").Div(parse("3"), 4)
+	if err != nil || quotient.String() != "3.3333" {
+		t.Fatal(fmt.Sprintf("expected 10 / 3 = 3.3333 BUT got %v (%v)", quotient, err))
+	}
+	quotient, err = parse("-2.000").Div(parse("0.3"), 2)
+	if err != nil || quotient.String() != "-6.67" {
+		t.Fatal(fmt.Sprintf("expected -2 / 0.3 = -6.67 BUT got %v (%v)", quotient, err))
+	}
+	if _, err = parse("1").Div(store.StructDecimal{}, 2); err == nil {
+		t.Fatal("expected a division by zero to be rejected")
+	}
+	if parse("1.50").Cmp(parse("1.5")) != 0 || parse("-1").Cmp(parse("0.001")) != -1 {
+		t.Fatal("unexpected comparison")
+	}
+	LogTestOutput("TestStoreDecimalArithmetic", "** end test **\n")
+}
+
+func TestStoreDecimalPersistence(t *testing.T) {
+	if !*pFlagDecimal {
+		t.SkipNow()
+	}
+	price, _ := store.ParseDecimal("330.000")
+	trxDate := time.Date(2019, 7, 1, 1, 0, 0, 0, time.UTC)
+	record := map[string]store.StructStoreValue{
+		"stock_id": { Value: "700_tencent", Type: store.TypeString },
+		"trx_date": { Value: trxDate, Type: store.TypeDate },
+		"price":    { Value: price, Type: store.TypeDecimal },
+		// numeric looking strings stay strings
+		"lot":      { Value: "100", Type: store.TypeString },
+		"ratio":    { Value: "1.25", Type: store.TypeString },
+	}
+
+	LogTestOutput("TestStoreDecimalPersistence", "a. json encoding")
+	jsonValue, err := store.EncodeStoreRecord(record)
+	if err != nil || !strings.Contains(jsonValue, `"price":{"$decimal":"330.000"}`) || !strings.Contains(jsonValue, `"ratio":"1.25"`) {
+		t.Fatal(fmt.Sprintf("expected the price encoded with its scale BUT got %v (%v)", jsonValue, err))
+	}
+	decoded, err := store.DecodeStoreRecord(jsonValue)
+	if err != nil || decoded["price"].Type != store.TypeDecimal || decoded["lot"].Type != store.TypeString ||
+		decoded["ratio"].Type != store.TypeString || decoded["ratio"].Value != "1.25" {
+		t.Fatal(fmt.Sprintf("expected a decimal price and the string lot and ratio BUT got %v (%v)", decoded, err))
+	}
+
+	LogTestOutput("TestStoreDecimalPersistence", "b. every store keeps the exact price")
+	_, pFilestore := helperCreatePartitionedFilestore(common.StorePartitionNone, "", t)
+	cfgFilepath := helperCreateBoltConfig("", t)
+	appConfig, err := util.LoadConfig(cfgFilepath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, pSqliteStore := helperCreateSqliteStore("stock_test.700_tencent", "", t)
+	storeList := []store.IStore{
+		pFilestore,
+		store.NewStructMemoryStore(appConfig, "stock_test.700_tencent"),
+		store.NewStructBoltStore(appConfig, "stock_test.700_tencent"),
+		pSqliteStore,
+	}
+	for _, iStore := range storeList {
+		_, err = iStore.Persist(record)
+		if err != nil {
+			t.Fatal(fmt.Sprintf("%T => %v", iStore, err))
+		}
+		_, records, err := iStore.Query("700_tencent", time.Time{}, time.Time{}, nil, 0)
+		if err != nil || len(records) != 1 {
+			t.Fatal(fmt.Sprintf("%T => expected 1 record BUT got %v (%v)", iStore, records, err))
+		}
+		value := records[0].Value.(map[string]store.StructStoreValue)["price"]
+		decimal, isDecimal := value.Value.(store.StructDecimal)
+		if value.Type != store.TypeDecimal || !isDecimal || decimal.String() != "330.000" {
+			t.Fatal(fmt.Sprintf("%T => expected the decimal 330.000 BUT got %v", iStore, value))
+		}
+
+		_, iterator, err := iStore.Iterate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var bContent bytes.Buffer
+		_, err = store.ExportRecordsAsCsv(&bContent, iterator, nil)
+		iterator.Close()
+		if err != nil || !strings.Contains(bContent.String(), ",330.000") {
+			t.Fatal(fmt.Sprintf("%T => expected the exported price 330.000 BUT got %v (%v)", iStore, bContent.String(), err))
+		}
+	}
+	LogTestOutput("TestStoreDecimalPersistence", "c. elasticsearch keeps the decimal as a string parsed back by the schema")
+	pFake := newStructFakeElasticsearch()
+	pServer := httptest.NewServer(pFake)
+	defer pServer.Close()
+	pEsStore := helperCreateElasticsearchStore(pServer.URL, `
+[schema.stock_test]
+fields = [ "price" ]
+allow_unknown_fields = true
+[schema.stock_test.price]
+type = "decimal"
+`, t)
+	_, err = pEsStore.Persist(record)
+	if err != nil || pFake.count("stock_test_2019.07") != 1 {
+		t.Fatal(fmt.Sprintf("expected 1 doc BUT got %v (%v)", pFake.indexCounts(), err))
+	}
+	for _, source := range pFake.indices["stock_test_2019.07"] {
+		if !strings.Contains(string(source), `"price":"330.000"`) || !strings.Contains(string(source), `"ratio":"1.25"`) {
+			t.Fatal(fmt.Sprintf("expected the price indexed as a plain string BUT got %v", string(source)))
+		}
+	}
+	_, records, err := pEsStore.Query("700_tencent", time.Time{}, time.Time{}, nil, 0)
+	if err != nil || len(records) != 1 {
+		t.Fatal(fmt.Sprintf("expected 1 record BUT got %v (%v)", records, err))
+	}
+	fields := records[0].Value.(map[string]store.StructStoreValue)
+	decimal, isDecimal := fields["price"].Value.(store.StructDecimal)
+	if !isDecimal || decimal.String() != "330.000" || fields["ratio"].Value != "1.25" {
+		t.Fatal(fmt.Sprintf("expected the decimal 330.000 and the string ratio BUT got %v", fields))
+	}
+	LogTestOutput("TestStoreDecimalPersistence", "** end test **\n")
+}
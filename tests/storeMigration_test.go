@@ -0,0 +1,218 @@
+/*
+ *  Copyright Project - Stockbinator, Author - quoeamaster, (C) 2019
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+package tests
+
+import (
+	"Stockbinator/config"
+	"Stockbinator/store"
+	"Stockbinator/util"
+	"Stockbinator/webservice"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStoreMigrationResumeAndVerify(t *testing.T) {
+	if !*pFlagMigration {
+		t.SkipNow()
+	}
+	cfgFilepath := helperCreateBoltConfig("", t)
+	appConfig, err := util.LoadConfig(cfgFilepath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkpointFilepath := filepath.Join(filepath.Dir(cfgFilepath), "migration.checkpoint")
+	baseTime := time.Date(2019, 7, 1, 0, 0, 0, 0, time.UTC)
+	symbols := []string{"700_tencent", "1299_aia"}
+	for i, symbol := range symbols {
+		iSource, err := store.GetStoreByKey(fmt.Sprintf("memorystore.stock_migrate.%v", symbol), appConfig, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 1200 / 600 records within the range plus 5 records before
+		for j := -5; j < 1200/(i+1); j++ {
+			_, err = iSource.Persist(helperElasticsearchRecord(symbol, baseTime.Add(time.Hour*time.Duration(j)), float64(j)))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	request := store.StructStoreMigrationRequest{
+		Source: "memorystore", Target: "boltstore", Module: "stock_migrate", Symbols: symbols, From: baseTime,
+	}
+	// the source of the 2nd symbol breaks after 300 records on the 1st run
+	breakSource := true
+	resolver := func(storeKey string) (store.IStore, error) {
+		iStore, err := store.GetStoreByKey(storeKey, appConfig, nil)
+		if err == nil && breakSource && strings.Compare(storeKey, "memorystore.stock_migrate.1299_aia") == 0 {
+			iStore = &structBreakingIterateStore{IStore: iStore, breakAfter: 300}
+		}
+		return iStore, err
+	}
+
+	LogTestOutput("TestStoreMigrationResumeAndVerify", "a. an interrupted migration")
+	pMigration, err := store.NewStructStoreMigration(request, checkpointFilepath, resolver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkpoints := 0
+	pMigration.SetProgressListener(func(progress store.StructStoreMigrationProgress) {
+		checkpoints++
+	})
+	progress, err := pMigration.Run()
+	if err == nil || progress.Status != store.MigrationStatusFailed {
+		t.Fatal(fmt.Sprintf("expected the migration to fail BUT got %v (%v)", progress.Status, err))
+	}
+	if !progress.Symbols[0].Completed || !progress.Symbols[0].Verified || progress.Symbols[0].TargetCount != 1200 {
+		t.Fatal(fmt.Sprintf("expected the 1st symbol copied and verified BUT got %v", progress.Symbols[0]))
+	}
+	if progress.Symbols[1].Completed || progress.Symbols[1].Read != 300 || checkpoints < 3 {
+		t.Fatal(fmt.Sprintf("expected 300 records of the 2nd symbol read (with checkpoints) BUT got %v, %v checkpoint(s)",
+			progress.Symbols[1], checkpoints))
+	}
+
+	LogTestOutput("TestStoreMigrationResumeAndVerify", "b. resume from the checkpoint")
+	breakSource = false
+	pMigration, err = store.NewStructStoreMigration(request, checkpointFilepath, resolver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pMigration.GetProgress().Resumed {
+		t.Fatal("expected the migration to be resumed from the checkpoint")
+	}
+	progress, err = pMigration.Run()
+	if err != nil || progress.Status != store.MigrationStatusCompleted {
+		t.Fatal(fmt.Sprintf("expected the migration completed BUT got %v (%v)", progress, err))
+	}
+	// the 1st symbol is not read again, the 2nd continues after the 300 records read
+	if progress.Read != 1800 || progress.Written != 1800 || progress.Symbols[1].Read != 600 {
+		t.Fatal(fmt.Sprintf("expected 1800 records read and written in total BUT got %v", progress))
+	}
+	if !progress.Symbols[1].Verified || progress.Symbols[1].SourceCount != 600 || progress.Symbols[1].TargetCount != 600 {
+		t.Fatal(fmt.Sprintf("expected the 2nd symbol verified BUT got %v", progress.Symbols[1]))
+	}
+
+	LogTestOutput("TestStoreMigrationResumeAndVerify", "c. records already in the target are skipped")
+	iTarget, _ := store.GetStoreByKey("boltstore.stock_migrate.700_tencent", appConfig, nil)
+	iTarget.(*store.StructBoltStore).SetNaturalKey(store.StructNaturalKey{
+		Fields: []string{ store.StoreKeyStockId, store.StoreKeyTrxDate }, DuplicatePolicy: "skip" })
+	skipRequest := request
+	skipRequest.Symbols = symbols[:1]
+	pMigration, err = store.NewStructStoreMigration(skipRequest, "", resolver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	progress, err = pMigration.Run()
+	if err != nil || progress.Read != 1200 || progress.Skipped != 1200 || progress.Written != 0 || progress.Failed != 0 {
+		t.Fatal(fmt.Sprintf("expected the 1200 records skipped BUT got %v (%v)", progress, err))
+	}
+
+	LogTestOutput("TestStoreMigrationResumeAndVerify", "d. invalid requests")
+	_, err = store.NewStructStoreMigration(store.StructStoreMigrationRequest{
+		Source: "boltstore", Target: "boltstore", Module: "stock_migrate", Symbols: symbols}, "", resolver)
+	if err == nil {
+		t.Fatal("expected the same source and target to be rejected")
+	}
+	LogTestOutput("TestStoreMigrationResumeAndVerify", "** end test **\n")
+}
+
+func TestStoreMigrationService(t *testing.T) {
+	if !*pFlagMigration {
+		t.SkipNow()
+	}
+	cfgFilepath := helperCreateBoltConfig(fmt.Sprintf("[filestore]\nrepo = \"%v/\"\n", filepath.Dir(helperCreateBoltConfig("", t))), t)
+	pCfg := new(config.StructConfig)
+	pCfg.ModuleConfigs = make(map[string]config.StructStockModuleConfig)
+	var err error
+	pCfg.AppConfig, err = util.LoadConfig(cfgFilepath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iSource, err := store.GetStoreByKey("memorystore.stock_migrate_ws.700_tencent", pCfg.AppConfig, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseTime := time.Date(2019, 7, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 10; i++ {
+		_, err = iSource.Persist(helperElasticsearchRecord("700_tencent", baseTime.Add(time.Hour*time.Duration(i)), float64(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	pService := webservice.NewStructStoreService(pCfg)
+
+	LogTestOutput("TestStoreMigrationService", "a. migration in the background")
+	id, _, err := pService.StartMigration(store.StructStoreMigrationRequest{
+		Source: "memorystore", Target: "boltstore", Module: "stock_migrate_ws", Symbols: []string{"700_tencent"},
+		To: baseTime.Add(time.Hour * 4),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var view webservice.StructStoreMigrationView
+	for i := 0; i < 100; i++ {
+		view = pService.ListMigrations()[0]
+		if view.Progress.Status == store.MigrationStatusCompleted || view.Progress.Status == store.MigrationStatusFailed {
+			break
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+	if view.Id != id || view.Progress.Status != store.MigrationStatusCompleted || view.Progress.Written != 5 ||
+		!view.Progress.Symbols[0].Verified {
+		t.Fatal(fmt.Sprintf("expected 5 records migrated and verified BUT got %v", view))
+	}
+	LogTestOutput("TestStoreMigrationService", "** end test **\n")
+}
+
+// store wrapper whose iterator fails after the given number of records
+type structBreakingIterateStore struct {
+	store.IStore
+	breakAfter int
+}
+
+func (b *structBreakingIterateStore) Iterate(predicates ...store.StoreRecordPredicate) (store.StructStoreResponse, store.IStoreIterator, error) {
+	response, iterator, err := b.IStore.Iterate(predicates...)
+	if err != nil {
+		return response, iterator, err
+	}
+	return response, &structBreakingIterator{IStoreIterator: iterator, breakAfter: b.breakAfter}, nil
+}
+
+type structBreakingIterator struct {
+	store.IStoreIterator
+	breakAfter int
+	count      int
+	err        error
+}
+
+func (b *structBreakingIterator) Next() bool {
+	if b.count >= b.breakAfter {
+		b.err = errors.New("source is not reachable")
+		return false
+	}
+	b.count++
+	return b.IStoreIterator.Next()
+}
+
+func (b *structBreakingIterator) Err() error {
+	if b.err != nil {
+		return b.err
+	}
+	return b.IStoreIterator.Err()
+}
@@ -0,0 +1,187 @@
+/*
+ *  Copyright Project - Stockbinator, Author - quoeamaster, (C) 2019
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+package tests
+
+import (
+	"Stockbinator/common"
+	"Stockbinator/config"
+	"Stockbinator/store"
+	"Stockbinator/util"
+	"Stockbinator/webservice"
+	"encoding/json"
+	"fmt"
+	"github.com/emicklei/go-restful"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStoreRetentionRemoveBefore(t *testing.T) {
+	if !*pFlagRetention {
+		t.SkipNow()
+	}
+	pFake := newStructFakeElasticsearch()
+	pServer := httptest.NewServer(pFake)
+	defer pServer.Close()
+	repo, pFilestore := helperCreatePartitionedFilestore(common.StorePartitionDaily, "", t)
+	appConfig, err := util.LoadConfig(helperCreateBoltConfig("", t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, pSqliteStore := helperCreateSqliteStore("stock_test.700_tencent", "", t)
+	storeList := []store.IStore{
+		pFilestore,
+		store.NewStructMemoryStore(appConfig, "stock_test.700_tencent"),
+		store.NewStructBoltStore(appConfig, "stock_test.700_tencent"),
+		pSqliteStore,
+		helperCreateElasticsearchStore(pServer.URL, "", t),
+	}
+	baseTime := time.Date(2019, 7, 1, 8, 0, 0, 0, time.UTC)
+	before := time.Date(2019, 7, 4, 0, 0, 0, 0, time.UTC)
+
+	LogTestOutput("TestStoreRetentionRemoveBefore", "a. records before the given time are removed")
+	for _, iStore := range storeList {
+		for i := 0; i < 10; i++ {
+			_, err = iStore.Persist(helperElasticsearchRecord("700_tencent", baseTime.AddDate(0, 0, i), float64(i)))
+			if err != nil {
+				t.Fatal(fmt.Sprintf("%T => %v", iStore, err))
+			}
+		}
+		_, removed, err := iStore.RemoveBefore("700_tencent", before)
+		if err != nil || removed != 3 {
+			t.Fatal(fmt.Sprintf("%T => expected 3 records removed BUT got %v (%v)", iStore, removed, err))
+		}
+		_, records, err := iStore.Query("", time.Time{}, time.Time{}, nil, 0)
+		if err != nil || len(records) != 7 {
+			t.Fatal(fmt.Sprintf("%T => expected 7 records remaining BUT got %v (%v)", iStore, len(records), err))
+		}
+		trxDate := records[0].Value.(map[string]store.StructStoreValue)[store.StoreKeyTrxDate].Value.(time.Time)
+		if !trxDate.Equal(baseTime.AddDate(0, 0, 3)) {
+			t.Fatal(fmt.Sprintf("%T => expected the oldest record on 2019-07-04 BUT got %v", iStore, trxDate))
+		}
+		// nothing left to remove
+		_, removed, err = iStore.RemoveBefore("", before)
+		if err != nil || removed != 0 {
+			t.Fatal(fmt.Sprintf("%T => expected no more records removed BUT got %v (%v)", iStore, removed, err))
+		}
+	}
+	// the emptied segments are removed
+	if _, err = os.Stat(filepath.Join(repo, "stock_test", "700_tencent", "2019-07-01"+common.StoreSegmentFileExtension)); !os.IsNotExist(err) {
+		t.Fatal(fmt.Sprintf("expected the segment of 2019-07-01 removed (%v)", err))
+	}
+
+	LogTestOutput("TestStoreRetentionRemoveBefore", "b. write only stores are skipped")
+	result := store.ApplyRetention(helperCreateInfluxStore(pServer.URL, "", t), "influxstore.stock_test.700_tencent", "700_tencent", 30, before)
+	if !result.Skipped || result.Error != "" {
+		t.Fatal(fmt.Sprintf("expected the influx store skipped BUT got %v", result))
+	}
+	LogTestOutput("TestStoreRetentionRemoveBefore", "** end test **\n")
+}
+
+func TestStoreRetentionService(t *testing.T) {
+	if !*pFlagRetention {
+		t.SkipNow()
+	}
+	LogTestOutput("TestStoreRetentionService", "a. the most specific rule wins")
+	cfgFilepath := helperCreateBoltConfig(`
+[retention]
+keep_days = 365
+interval = "24h"
+[retention.sqlitestore]
+keep_days = 180
+[retention.stock_retention_intraday]
+keep_days = 30
+[retention.stock_retention_intraday.filestore]
+keep_days = 90
+[retention.stock_retention_daily]
+keep_days = 0
+`, t)
+	appConfig, err := util.LoadConfig(cfgFilepath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, check := range []struct{ storeType, module string; expected int }{
+		{ "filestore", "stock_retention_intraday", 90 },
+		{ "boltstore", "stock_retention_intraday", 30 },
+		{ "sqlitestore", "stock_other", 180 },
+		{ "boltstore", "stock_other", 365 },
+		{ "boltstore", "stock_retention_daily", 0 },
+	} {
+		if keepDays := store.GetRetentionDaysFromConfig(appConfig, check.storeType, check.module); keepDays != check.expected {
+			t.Fatal(fmt.Sprintf("%v of %v => expected %v days BUT got %v", check.storeType, check.module, check.expected, keepDays))
+		}
+	}
+
+	LogTestOutput("TestStoreRetentionService", "b. a run across the modules")
+	rulesFilepath := filepath.Join(filepath.Dir(cfgFilepath), "rules.toml")
+	err = ioutil.WriteFile(rulesFilepath, []byte("[700_tencent]\nurl = \"http://localhost\"\n"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules, err := util.LoadConfig(rulesFilepath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pCfg := new(config.StructConfig)
+	pCfg.AppConfig = appConfig
+	pCfg.ModuleConfigs = map[string]config.StructStockModuleConfig{
+		"stock_retention_intraday": { Name: "stock_retention_intraday", Rules: rules },
+		"stock_retention_daily":    { Name: "stock_retention_daily", Rules: rules },
+	}
+	baseTime := time.Date(2019, 7, 1, 8, 0, 0, 0, time.UTC)
+	for _, module := range []string{ "stock_retention_intraday", "stock_retention_daily" } {
+		iStore, err := store.GetStoreByKey(fmt.Sprintf("boltstore.%v.700_tencent", module), appConfig, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 40; i++ {
+			_, err = iStore.Persist(helperElasticsearchRecord("700_tencent", baseTime.AddDate(0, 0, i), float64(i)))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	pClock := util.NewStructFakeClock(time.Date(2019, 8, 10, 0, 0, 0, 0, time.UTC))
+	pService := webservice.NewStructStoreService(pCfg)
+	pService.SetClock(pClock)
+	run := pService.RunRetention()
+	// 30 days before 2019-08-10 => the records of 2019-07-01 to 2019-07-10 are removed; the daily module is kept forever
+	if run.Removed != 10 || run.Failed != 0 || len(run.Stores) != 1 ||
+		run.Stores[0].StoreKey != "boltstore.stock_retention_intraday.700_tencent" || run.Stores[0].KeepDays != 30 {
+		t.Fatal(fmt.Sprintf("expected 10 records removed from the intraday store BUT got %v", run))
+	}
+
+	LogTestOutput("TestStoreRetentionService", "c. the periodic runs are reported through the API")
+	pService.StartRetention()
+	defer pService.StopRetention()
+	for i := 0; i < 100 && len(pService.ListRetentionRuns()) < 2; i++ {
+		pClock.Advance(time.Hour * 24)
+		time.Sleep(time.Millisecond * 10)
+	}
+	pContainer := restful.NewContainer()
+	pContainer.Add(pService.CreateWebservice())
+	pRecorder := helperServeSpoolAPI(pContainer, http.MethodGet, "/stores/retention")
+	runs := make([]store.StructRetentionRun, 0)
+	err = json.Unmarshal(pRecorder.Body.Bytes(), &runs)
+	if err != nil || pRecorder.Code != http.StatusOK || len(runs) < 2 || runs[0].Removed != 10 || runs[1].Removed < 1 {
+		t.Fatal(fmt.Sprintf("expected the 2nd run (a day later) to remove the record(s) expired since BUT got %v (%v)", pRecorder.Body.String(), err))
+	}
+	LogTestOutput("TestStoreRetentionService", "** end test **\n")
+}
@@ -0,0 +1,193 @@
+/*
+ *  Copyright Project - Stockbinator, Author - quoeamaster, (C) 2019
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+package tests
+
+import (
+	"Stockbinator/store"
+	"Stockbinator/util"
+	"bytes"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const schemaTestConfig = `
+[schema.stock_test]
+fields = [ "price", "volume", "trades" ]
+[schema.stock_test.price]
+type = "float"
+required = true
+unit = "HKD"
+[schema.stock_test.volume]
+type = "string"
+required = true
+[schema.stock_test.trades]
+type = "integer"
+`
+
+func TestStoreSchemaValidation(t *testing.T) {
+	if !*pFlagSchema {
+		t.SkipNow()
+	}
+	cfgFilepath := helperCreateBoltConfig(schemaTestConfig, t)
+	appConfig, err := util.LoadConfig(cfgFilepath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	LogTestOutput("TestStoreSchemaValidation", "a. schema from the config")
+	pSchema, err := store.GetSchemaFromConfig(appConfig, "stock_test")
+	if err != nil || pSchema == nil {
+		t.Fatal(fmt.Sprintf("expected the schema of stock_test (%v)", err))
+	}
+	if strings.Join(pSchema.GetFieldNames(), ",") != "stock_id,trx_date,price,volume,trades" {
+		t.Fatal(fmt.Sprintf("expected the identity fields in front of the declared ones BUT got %v", pSchema.GetFieldNames()))
+	}
+	if field, _ := pSchema.GetField("price"); field.Type != store.TypeFloat || !field.Required || field.Unit != "HKD" {
+		t.Fatal(fmt.Sprintf("unexpected price field => %v", field))
+	}
+	if pSchema, _ = store.GetSchemaFromConfig(appConfig, "stock_unknown"); pSchema != nil {
+		t.Fatal("expected no schema for a module not declared")
+	}
+
+	LogTestOutput("TestStoreSchemaValidation", "b. every store validates on persist")
+	trxDate := time.Date(2019, 7, 1, 1, 0, 0, 0, time.UTC)
+	validRecord := helperElasticsearchRecord("700_tencent", trxDate, 330)
+	invalidRecord := helperElasticsearchRecord("700_tencent", trxDate, 330)
+	invalidRecord["price"] = store.StructStoreValue{Value: "330.000", Type: store.TypeString}
+	invalidRecord["trades"] = store.StructStoreValue{Value: 1.5, Type: store.TypeInteger}
+	invalidRecord["currency"] = store.StructStoreValue{Value: "HKD", Type: store.TypeString}
+	delete(invalidRecord, "volume")
+	storeList := []store.IStore{
+		store.NewStructMemoryStore(appConfig, "stock_test.700_tencent"),
+		store.NewStructBoltStore(appConfig, "stock_test.700_tencent"),
+	}
+	for _, iStore := range storeList {
+		response, err := iStore.Persist(validRecord)
+		if err != nil || response.Code != store.CodeSuccess {
+			t.Fatal(fmt.Sprintf("%T => expected the valid record accepted BUT got %v (%v)", iStore, response, err))
+		}
+		response, err = iStore.Persist(invalidRecord)
+		if err == nil || !store.IsSchemaError(err) || response.Code != store.CodeFailure {
+			t.Fatal(fmt.Sprintf("%T => expected the invalid record rejected BUT got %v (%v)", iStore, response, err))
+		}
+		for _, problem := range []string{"field [price] expected float BUT got string", "field [volume] is required",
+			"field [trades] expected integer BUT got a float64 value", "field [currency] is not declared"} {
+			if strings.Index(err.Error(), problem) == -1 {
+				t.Fatal(fmt.Sprintf("%T => expected [%v] reported BUT got %v", iStore, problem, err))
+			}
+		}
+	}
+
+	LogTestOutput("TestStoreSchemaValidation", "c. floats and decimals are accepted for each other and converted")
+	decimalRecord := helperElasticsearchRecord("700_tencent", trxDate.AddDate(0, 0, 1), 0)
+	decimalPrice, _ := store.ParseDecimal("330.50")
+	decimalRecord["price"] = store.StructStoreValue{Value: decimalPrice, Type: store.TypeDecimal}
+	for _, iStore := range storeList {
+		response, err := iStore.Persist(decimalRecord)
+		if err != nil || response.Code != store.CodeSuccess {
+			t.Fatal(fmt.Sprintf("%T => expected the decimal price accepted BUT got %v (%v)", iStore, response, err))
+		}
+		_, records, err := iStore.Query("700_tencent", trxDate.AddDate(0, 0, 1), time.Time{}, nil, 0)
+		if err != nil || len(records) != 1 {
+			t.Fatal(fmt.Sprintf("%T => expected 1 record BUT got %v (%v)", iStore, records, err))
+		}
+		value := records[0].Value.(map[string]store.StructStoreValue)["price"]
+		if value.Type != store.TypeFloat || value.Value != 330.5 {
+			t.Fatal(fmt.Sprintf("%T => expected the float price 330.5 BUT got %v", iStore, value))
+		}
+	}
+	if decimalRecord["price"].Type != store.TypeDecimal {
+		t.Fatal("expected the caller's record left untouched")
+	}
+	pDecimalSchema := &store.StructStoreSchema{ Module: "stock_test", AllowUnknownFields: true, Fields: []store.StructSchemaField{
+		{ Name: "price", Type: store.TypeDecimal, Required: true },
+	}}
+	conformed, err := pDecimalSchema.Conform(validRecord)
+	decimal, isDecimal := conformed["price"].Value.(store.StructDecimal)
+	if err != nil || conformed["price"].Type != store.TypeDecimal || !isDecimal || decimal.String() != "330" {
+		t.Fatal(fmt.Sprintf("expected the float price converted into the decimal 330 BUT got %v (%v)", conformed["price"], err))
+	}
+
+	LogTestOutput("TestStoreSchemaValidation", "d. schema errors are not spooled")
+	pSpool, _ := store.NewStructStoreSpool("", time.Minute, time.Minute)
+	_, err = store.NewStructSpoolingStore(storeList[0], "memorystore.stock_test.700_tencent", pSpool).Persist(invalidRecord)
+	if err == nil || pSpool.GetStatus().Depth != 0 {
+		t.Fatal(fmt.Sprintf("expected the schema error returned without spooling (%v)", err))
+	}
+	LogTestOutput("TestStoreSchemaValidation", "** end test **\n")
+}
+
+func TestStoreSchemaMappingAndExport(t *testing.T) {
+	if !*pFlagSchema {
+		t.SkipNow()
+	}
+	repo, err := ioutil.TempDir("", "sqlitestore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbPath, pStore := helperCreateSqliteStoreWithPath(filepath.Join(repo, "stockbinator.db"), "stock_test.700_tencent", schemaTestConfig, t)
+	trxDate := time.Date(2019, 7, 1, 1, 0, 0, 0, time.UTC)
+
+	LogTestOutput("TestStoreSchemaMappingAndExport", "a. the columns are typed by the schema")
+	// the 1st price is a whole number; the column is still REAL as declared
+	record := helperElasticsearchRecord("700_tencent", trxDate, 330)
+	record["price"] = store.StructStoreValue{Value: 330, Type: store.TypeInteger}
+	resp, err := pStore.Persist(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	helperFilestoreFlowsCommonResponseHandler(resp, t)
+	record = helperElasticsearchRecord("700_tencent", trxDate.Add(time.Hour), 330.2)
+	record["trades"] = store.StructStoreValue{Value: 12, Type: store.TypeInteger}
+	_, err = pStore.Persist(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pDB, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pDB.Close()
+	columnTypes := helperSqliteColumnTypes(pDB, "stock_test", t)
+	if columnTypes["price"] != "REAL" || columnTypes["trades"] != "INTEGER" {
+		t.Fatal(fmt.Sprintf("expected the declared column types BUT got %v", columnTypes))
+	}
+
+	LogTestOutput("TestStoreSchemaMappingAndExport", "b. csv export")
+	pSchema, _ := store.GetSchemaFromConfig(pStore.AppConfig, "stock_test")
+	_, iterator, err := pStore.Iterate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer iterator.Close()
+	var bContent bytes.Buffer
+	count, err := store.ExportRecordsAsCsv(&bContent, iterator, pSchema)
+	if err != nil || count != 2 {
+		t.Fatal(fmt.Sprintf("expected 2 records exported BUT got %v (%v)", count, err))
+	}
+	expected := "stock_id,trx_date,price (HKD),volume,trades\n" +
+		"700_tencent,2019-07-01T01:00:00+00:00,330,500 Million,\n" +
+		"700_tencent,2019-07-01T02:00:00+00:00,330.2,500 Million,12\n"
+	if bContent.String() != expected {
+		t.Fatal(fmt.Sprintf("expected csv [%v] BUT got [%v]", expected, bContent.String()))
+	}
+	LogTestOutput("TestStoreSchemaMappingAndExport", "** end test **\n")
+}
@@ -0,0 +1,256 @@
+/*
+ *  Copyright Project - Stockbinator, Author - quoeamaster, (C) 2019
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+package tests
+
+import (
+	"Stockbinator/config"
+	"Stockbinator/store"
+	"Stockbinator/util"
+	"Stockbinator/webservice"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/emicklei/go-restful"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStoreSpoolRetryAndBackoff(t *testing.T) {
+	if !*pFlagSpool {
+		t.SkipNow()
+	}
+	tmpDir, err := ioutil.TempDir("", "storeSpool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+	spoolFilepath := fmt.Sprintf("%v/store.spool", tmpDir)
+	pClock := util.NewStructFakeClock(time.Date(2019, 7, 1, 8, 0, 0, 0, time.UTC))
+	pSpool, err := store.NewStructStoreSpool(spoolFilepath, time.Minute, time.Minute*3, pClock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pFailing := &structFailingStore{IStore: store.NewStructMemoryStore(nil, "stock_test.700_tencent"), failing: true}
+	pHealthy := store.NewStructMemoryStore(nil, "stock_test.700_tencent")
+	storeList := []store.IStore{
+		store.NewStructSpoolingStore(pFailing, "failing.stock_test.700_tencent", pSpool),
+		store.NewStructSpoolingStore(pHealthy, "healthy.stock_test.700_tencent", pSpool),
+	}
+	resolver := func(storeKey string) (store.IStore, error) {
+		if strings.Index(storeKey, "failing.") == 0 {
+			return pFailing, nil
+		}
+		return nil, errors.New(fmt.Sprintf("unknown store => %v", storeKey))
+	}
+	trxDate := time.Date(2019, 7, 1, 1, 0, 0, 0, time.UTC)
+
+	LogTestOutput("TestStoreSpoolRetryAndBackoff", "a. a failed write is spooled, the other store still gets the record")
+	for _, iStore := range storeList {
+		_, err = iStore.Persist(helperElasticsearchRecord("700_tencent", trxDate, 330.2))
+		if err != nil && strings.Index(err.Error(), "spooled for retry") == -1 {
+			t.Fatal(fmt.Sprintf("expected the failure to be spooled BUT got %v", err))
+		}
+	}
+	if pHealthy.GetRecordCount() != 1 {
+		t.Fatal(fmt.Sprintf("expected the healthy store to have 1 record BUT got %v", pHealthy.GetRecordCount()))
+	}
+	// ONLY the records accepted by the wrapped store are counted (e.g. the stores listed in the cron history)
+	if storeList[0].(*store.StructSpoolingStore).GetPersistedCount() != 0 || storeList[1].(*store.StructSpoolingStore).GetPersistedCount() != 1 {
+		t.Fatal("expected ONLY the healthy store to count the persisted record")
+	}
+	status := pSpool.GetStatus()
+	if status.Depth != 1 || status.StoreDepths["failing.stock_test.700_tencent"] != 1 {
+		t.Fatal(fmt.Sprintf("expected 1 spooled write of the failing store BUT got %v", status))
+	}
+
+	LogTestOutput("TestStoreSpoolRetryAndBackoff", "b. entries are not retried before the backoff, failures double the backoff")
+	result, err := pSpool.Replay(resolver, false)
+	if err != nil || result.Attempted != 0 {
+		t.Fatal(fmt.Sprintf("expected nothing due yet BUT got %v (%v)", result, err))
+	}
+	pClock.Advance(time.Minute)
+	result, err = pSpool.Replay(resolver, false)
+	if err != nil || result.Failed != 1 || result.Remaining != 1 {
+		t.Fatal(fmt.Sprintf("expected 1 failed retry BUT got %v (%v)", result, err))
+	}
+	entries := pSpool.List("")
+	if entries[0].Attempts != 2 || !entries[0].NextRetryTime.Equal(pClock.Now().Add(time.Minute*2)) {
+		t.Fatal(fmt.Sprintf("expected 2 attempts and a backoff of 2 minutes BUT got %v", entries[0]))
+	}
+	pClock.Advance(time.Minute * 2)
+	_, _ = pSpool.Replay(resolver, false)
+	entries = pSpool.List("")
+	if !entries[0].NextRetryTime.Equal(pClock.Now().Add(time.Minute * 3)) {
+		t.Fatal(fmt.Sprintf("expected the backoff capped at 3 minutes BUT got %v", entries[0].NextRetryTime))
+	}
+
+	LogTestOutput("TestStoreSpoolRetryAndBackoff", "c. the spool survives a restart and a replay writes the record")
+	pSpool, err = store.NewStructStoreSpool(spoolFilepath, time.Minute, time.Minute*3, pClock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries = pSpool.List("")
+	if len(entries) != 1 || entries[0].Attempts != 3 {
+		t.Fatal(fmt.Sprintf("expected the spooled write reloaded with 3 attempts BUT got %v", entries))
+	}
+	pFailing.setFailing(false)
+	result, err = pSpool.Replay(resolver, true)
+	if err != nil || result.Replayed != 1 || result.Remaining != 0 {
+		t.Fatal(fmt.Sprintf("expected 1 replayed write BUT got %v (%v)", result, err))
+	}
+	_, value, err := pFailing.ReadByKey(store.BuildRecordKey("700_tencent", trxDate), nil)
+	if err != nil || helperFilestoreRecordField(value, "price", t) != 330.2 {
+		t.Fatal(fmt.Sprintf("expected the replayed record BUT got %v (%v)", value, err))
+	}
+
+	LogTestOutput("TestStoreSpoolRetryAndBackoff", "d. purge")
+	pFailing.setFailing(true)
+	pSpoolingStore := store.NewStructSpoolingStore(pFailing, "failing.stock_test.700_tencent", pSpool)
+	for i := 0; i < 3; i++ {
+		_, _ = pSpoolingStore.Persist(helperElasticsearchRecord("700_tencent", trxDate.Add(time.Hour*time.Duration(i)), 1))
+	}
+	purged, err := pSpool.Purge("unknown.key")
+	if err != nil || purged != 0 {
+		t.Fatal(fmt.Sprintf("expected nothing purged BUT got %v (%v)", purged, err))
+	}
+	purged, err = pSpool.Purge("")
+	if err != nil || purged != 3 || pSpool.GetStatus().Depth != 0 {
+		t.Fatal(fmt.Sprintf("expected 3 purged BUT got %v (%v)", purged, err))
+	}
+	pSpool, _ = store.NewStructStoreSpool(spoolFilepath, time.Minute, time.Minute*3, pClock)
+	if pSpool.GetStatus().Depth != 0 {
+		t.Fatal("expected the purge to be persisted")
+	}
+	LogTestOutput("TestStoreSpoolRetryAndBackoff", "** end test **\n")
+}
+
+func TestStoreSpoolAPI(t *testing.T) {
+	if !*pFlagSpool {
+		t.SkipNow()
+	}
+	tmpDir, err := ioutil.TempDir("", "storeSpoolAPI")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+	appToml := fmt.Sprintf("%v/app.toml", tmpDir)
+	err = ioutil.WriteFile(appToml, []byte(fmt.Sprintf(`
+[storespool]
+path = "%v/store.spool"
+backoff = "1m"
+`, tmpDir)), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pCfg := new(config.StructConfig)
+	pCfg.ModuleConfigs = make(map[string]config.StructStockModuleConfig)
+	pCfg.AppConfig, err = util.LoadConfig(appToml)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// spool 2 writes before the cron service starts
+	pSpool, err := store.NewStructStoreSpool(fmt.Sprintf("%v/store.spool", tmpDir), time.Minute, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trxDate := time.Date(2019, 7, 2, 1, 0, 0, 0, time.UTC)
+	storeKey := "memorystore.stock_spool.700_tencent"
+	for i := 0; i < 2; i++ {
+		err = pSpool.Add(storeKey, helperElasticsearchRecord("700_tencent", trxDate.Add(time.Hour*time.Duration(i)), 1), "connection refused")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	pCron := webservice.NewStructCron(pCfg)
+	pContainer := restful.NewContainer()
+	pContainer.Add(pCron.CreateWebservice())
+
+	LogTestOutput("TestStoreSpoolAPI", "a. spool depth")
+	pRecorder := helperServeSpoolAPI(pContainer, http.MethodGet, "/cron/spool")
+	view := webservice.StructCronSpoolView{}
+	err = json.Unmarshal(pRecorder.Body.Bytes(), &view)
+	if err != nil || view.Status.Depth != 2 || len(view.Entries) != 2 || view.Entries[0].LastError != "connection refused" {
+		t.Fatal(fmt.Sprintf("expected 2 spooled writes BUT got %v (%v)", pRecorder.Body.String(), err))
+	}
+
+	LogTestOutput("TestStoreSpoolAPI", "b. replay")
+	pRecorder = helperServeSpoolAPI(pContainer, http.MethodPost, "/cron/spool/replay")
+	result := store.StructStoreSpoolReplayResult{}
+	err = json.Unmarshal(pRecorder.Body.Bytes(), &result)
+	if err != nil || result.Replayed != 2 || result.Remaining != 0 {
+		t.Fatal(fmt.Sprintf("expected 2 replayed writes BUT got %v (%v)", pRecorder.Body.String(), err))
+	}
+	iStore, err := store.GetStoreByKey(storeKey, pCfg.AppConfig, nil)
+	if err != nil || iStore.(*store.StructMemoryStore).GetRecordCount() != 2 {
+		t.Fatal(fmt.Sprintf("expected 2 records written by the replay (%v)", err))
+	}
+
+	LogTestOutput("TestStoreSpoolAPI", "c. purge")
+	err = pSpool.Add(storeKey, helperElasticsearchRecord("700_tencent", trxDate, 1), "connection refused")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// reload the spool file written above
+	pCron = webservice.NewStructCron(pCfg)
+	pContainer = restful.NewContainer()
+	pContainer.Add(pCron.CreateWebservice())
+	pRecorder = helperServeSpoolAPI(pContainer, http.MethodDelete, fmt.Sprintf("/cron/spool?store=%v", storeKey))
+	if pRecorder.Code != http.StatusOK || pCron.GetSpoolStatus().Depth != 0 {
+		t.Fatal(fmt.Sprintf("expected the spool purged BUT got %v, %v", pRecorder.Code, pRecorder.Body.String()))
+	}
+	LogTestOutput("TestStoreSpoolAPI", "** end test **\n")
+}
+
+func helperServeSpoolAPI(pContainer *restful.Container, method, url string) (pRecorder *httptest.ResponseRecorder) {
+	pReq := httptest.NewRequest(method, url, nil)
+	pReq.Header.Set("Content-Type", restful.MIME_JSON)
+	pRecorder = httptest.NewRecorder()
+	pContainer.ServeHTTP(pRecorder, pReq)
+	return
+}
+
+// store wrapper failing every Persist whilst failing is set
+type structFailingStore struct {
+	store.IStore
+	failing bool
+	lock    sync.Mutex
+}
+
+func (f *structFailingStore) Persist(data map[string]store.StructStoreValue) (store.StructStoreResponse, error) {
+	f.lock.Lock()
+	failing := f.failing
+	f.lock.Unlock()
+	if failing {
+		return store.StructStoreResponse{}, errors.New("connection refused")
+	}
+	return f.IStore.Persist(data)
+}
+
+func (f *structFailingStore) setFailing(failing bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.failing = failing
+}
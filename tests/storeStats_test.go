@@ -0,0 +1,108 @@
+/*
+ *  Copyright Project - Stockbinator, Author - quoeamaster, (C) 2019
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+package tests
+
+import (
+	"Stockbinator/config"
+	"Stockbinator/store"
+	"Stockbinator/util"
+	"Stockbinator/webservice"
+	"encoding/json"
+	"fmt"
+	"github.com/emicklei/go-restful"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStoreStats(t *testing.T) {
+	if !*pFlagStats {
+		t.SkipNow()
+	}
+	cfgFilepath := helperCreateBoltConfig(`
+[influxstore]
+url = "http://127.0.0.1:1/write?db=stock&u=admin&p=secret"
+`, t)
+	appConfig, err := util.LoadConfig(cfgFilepath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseTime := time.Date(2019, 7, 1, 8, 0, 0, 0, time.UTC)
+	for symbol, count := range map[string]int{ "700_tencent": 3, "939_construction_bank_cn": 2 } {
+		iStore, err := store.GetStoreByKey(fmt.Sprintf("boltstore.stock_stats.%v", symbol), appConfig, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < count; i++ {
+			_, err = iStore.Persist(helperElasticsearchRecord(symbol, baseTime.AddDate(0, 0, i), float64(i)))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	_, err = store.GetStoreByKey("influxstore.stock_stats.700_tencent", appConfig, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	LogTestOutput("TestStoreStats", "a. failed writes are remembered per store")
+	iStore, _ := store.GetStoreByKey("boltstore.stock_stats.939_construction_bank_cn", appConfig, nil)
+	pClock := util.NewStructFakeClock(time.Date(2019, 8, 1, 0, 0, 0, 0, time.UTC))
+	pSpool, _ := store.NewStructStoreSpool("", time.Minute, time.Minute, pClock)
+	pSpoolingStore := store.NewStructSpoolingStore(&structFailingStore{IStore: iStore, failing: true},
+		"boltstore.stock_stats.939_construction_bank_cn", pSpool)
+	if _, err = pSpoolingStore.Persist(helperElasticsearchRecord("939_construction_bank_cn", baseTime.AddDate(0, 0, 5), 5)); err == nil {
+		t.Fatal("expected the write to fail")
+	}
+
+	LogTestOutput("TestStoreStats", "b. statistics of the stores in use")
+	pContainer := restful.NewContainer()
+	pContainer.Add(webservice.NewStructStoreService(new(config.StructConfig)).CreateWebservice())
+	pRecorder := helperServeSpoolAPI(pContainer, http.MethodGet, "/stores")
+	statsList := make([]store.StructStoreStats, 0)
+	err = json.Unmarshal(pRecorder.Body.Bytes(), &statsList)
+	if err != nil || pRecorder.Code != http.StatusOK {
+		t.Fatal(fmt.Sprintf("expected the store statistics BUT got %v (%v)", pRecorder.Body.String(), err))
+	}
+	statsMap := make(map[string]store.StructStoreStats)
+	for _, stats := range statsList {
+		statsMap[stats.StoreKey] = stats
+	}
+	stats := statsMap["boltstore.stock_stats.700_tencent"]
+	if stats.Type != "boltstore" || stats.Location != filepath.Join(filepath.Dir(cfgFilepath), "stockbinator.bolt") ||
+		stats.Bytes <= 0 || stats.RecordCount != 3 || len(stats.Symbols) != 1 || stats.LastWriteError != nil {
+		t.Fatal(fmt.Sprintf("expected 3 records in the bolt store BUT got %v", stats))
+	}
+	symbolStats := stats.Symbols[0]
+	if symbolStats.StockId != "700_tencent" || symbolStats.RecordCount != 3 ||
+		!symbolStats.FirstTrxDate.Equal(baseTime) || !symbolStats.LastTrxDate.Equal(baseTime.AddDate(0, 0, 2)) {
+		t.Fatal(fmt.Sprintf("expected the trx_date from 2019-07-01 to 2019-07-03 BUT got %v", symbolStats))
+	}
+	stats = statsMap["boltstore.stock_stats.939_construction_bank_cn"]
+	if stats.RecordCount != 2 || stats.LastWriteError == nil ||
+		!strings.Contains(stats.LastWriteError.Message, "connection refused") || !stats.LastWriteError.Time.Equal(pClock.Now()) {
+		t.Fatal(fmt.Sprintf("expected the failed write reported BUT got %v", stats))
+	}
+
+	LogTestOutput("TestStoreStats", "c. write only stores report no records")
+	stats = statsMap["influxstore.stock_stats.700_tencent"]
+	if stats.RecordCount != -1 || stats.Error == "" || stats.Location != "http://127.0.0.1:1/write" {
+		t.Fatal(fmt.Sprintf("expected the influx store unreadable and its url without the credentials BUT got %v", stats))
+	}
+	LogTestOutput("TestStoreStats", "** end test **\n")
+}
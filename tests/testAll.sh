@@ -1 +1 @@
-go test -util.common -util.crawler -store.file -log -log.file
+go test -tags sqlite -util.common -util.crawler -store.file -store.elasticsearch -store.sqlite -store.bolt -store.influx -store.memory -store.spool -store.migration -store.schema -store.decimal -store.retention -store.stats -webservice.cron -log -log.file
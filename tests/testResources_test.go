@@ -42,6 +42,19 @@ var (
 	pFlagCrawlerUtil = flag.Bool("util.crawler", false, "run ONLY crawler-util test")
 
 	pFlagFilestore = flag.Bool("store.file", false, "run ONLY filestore test")
+	pFlagElasticsearch = flag.Bool("store.elasticsearch", false, "run ONLY elasticsearch store test (against a fake elasticsearch)")
+	pFlagSqlite = flag.Bool("store.sqlite", false, "run ONLY sqlite store test")
+	pFlagBolt = flag.Bool("store.bolt", false, "run ONLY bolt store test")
+	pFlagInflux = flag.Bool("store.influx", false, "run ONLY influx store test (against a local receiver)")
+	pFlagMemory = flag.Bool("store.memory", false, "run ONLY memory store test")
+	pFlagSpool = flag.Bool("store.spool", false, "run ONLY store spool test")
+	pFlagMigration = flag.Bool("store.migration", false, "run ONLY store migration test")
+	pFlagSchema = flag.Bool("store.schema", false, "run ONLY store schema test")
+	pFlagDecimal = flag.Bool("store.decimal", false, "run ONLY store decimal test")
+	pFlagRetention = flag.Bool("store.retention", false, "run ONLY store retention test")
+	pFlagStats = flag.Bool("store.stats", false, "run ONLY store statistics test")
+
+	pFlagCronService = flag.Bool("webservice.cron", false, "run ONLY cron-service test")
 
 	// flag indicating logging feature
 	pFlagLog = flag.Bool("log", false, "display logs about the test")
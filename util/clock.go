@@ -0,0 +1,118 @@
+/*
+ *  Copyright Project - Stockbinator, Author - quoeamaster, (C) 2019
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+package util
+
+import (
+	"sync"
+	"time"
+)
+
+// interface for a clock; the scheduler, crawlers and calendar helpers ask the clock for the current time
+// instead of calling time.Now() directly, hence tests could run against a fake clock
+type IClock interface {
+	// return the current time
+	Now() time.Time
+	// return a channel which receives the current time once the duration has elapsed
+	After(d time.Duration) <-chan time.Time
+}
+
+// clock backed by the system time
+type StructSystemClock struct {
+}
+
+// the default clock; used whenever no clock is injected
+var SystemClock IClock = new(StructSystemClock)
+
+func (s *StructSystemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (s *StructSystemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// return the first clock given; the SystemClock if none (or nil) given.
+// Handy for the optional clock parameter(s) of the helper methods
+func GetClock(clock ...IClock) IClock {
+	if len(clock) > 0 && clock[0] != nil {
+		return clock[0]
+	}
+	return SystemClock
+}
+
+// clock for testing; the time ONLY moves when Set or Advance is called
+type StructFakeClock struct {
+	now     time.Time
+	waiters []structFakeClockWaiter
+	lock    sync.Mutex
+}
+
+type structFakeClockWaiter struct {
+	deadline time.Time
+	channel  chan time.Time
+}
+
+// creation method for StructFakeClock starting at the given time
+func NewStructFakeClock(now time.Time) (pClock *StructFakeClock) {
+	pClock = new(StructFakeClock)
+	pClock.now = now
+	pClock.waiters = make([]structFakeClockWaiter, 0)
+	return
+}
+
+func (f *StructFakeClock) Now() time.Time {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.now
+}
+
+func (f *StructFakeClock) After(d time.Duration) <-chan time.Time {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	channel := make(chan time.Time, 1)
+	if d <= 0 {
+		channel <- f.now
+		return channel
+	}
+	f.waiters = append(f.waiters, structFakeClockWaiter{deadline: f.now.Add(d), channel: channel})
+	return channel
+}
+
+// move the clock forward by the given duration
+func (f *StructFakeClock) Advance(d time.Duration) {
+	f.lock.Lock()
+	now := f.now.Add(d)
+	f.lock.Unlock()
+	f.Set(now)
+}
+
+// set the clock to the given time; channels returned by After() whose deadline passed are fired
+func (f *StructFakeClock) Set(now time.Time) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.now = now
+	waiters := make([]structFakeClockWaiter, 0)
+	for _, waiter := range f.waiters {
+		if !waiter.deadline.After(now) {
+			waiter.channel <- now
+		} else {
+			waiters = append(waiters, waiter)
+		}
+	}
+	f.waiters = waiters
+}
@@ -23,6 +23,7 @@ import (
 	"os"
 	"path"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -173,6 +174,25 @@ func IsValidTimezone(value string) (valid bool) {
 }
 
 
+var timezoneOffsetRegexp = regexp.MustCompile(`^([+-]?)([0-1]?[0-9]):([0-5][0-9])$`)
+
+// method to translate the given timezone (e.g. +08:00, +8:00, -07:00) to a fixed-offset location
+func ParseTimezone(value string) (pLocation *time.Location, err error) {
+	parts := timezoneOffsetRegexp.FindStringSubmatch(strings.Trim(value, " "))
+	if parts == nil {
+		err = errors.New(fmt.Sprintf("invalid timezone [%v], expected timezone is [+08:00]", value))
+		return
+	}
+	hours, _ := strconv.Atoi(parts[2])
+	mins, _ := strconv.Atoi(parts[3])
+	offset := hours*3600 + mins*60
+	if parts[1] == "-" {
+		offset = -offset
+	}
+	pLocation = time.FixedZone(value, offset)
+	return
+}
+
 // method to parse and return the request body contents in []byte
 func GetRequestBodyInBytes(pBody *io.ReadCloser) (bContent []byte, err error) {
 	bContent, err = ioutil.ReadAll(*pBody)
@@ -191,10 +211,15 @@ func IsEmptyString(value string) bool {
 // parse string to Date object...
 
 // 2019-05-28T07:30:00+0000
-func CreateTodayTargetTimeByHourMinTimezone(hour, min int, timezone string) (todayTargetTime string) {
+// "today" is the current date (of the optional clock, SystemClock by default) in the given timezone
+func CreateTodayTargetTimeByHourMinTimezone(hour, min int, timezone string, clock ...IClock) (todayTargetTime string) {
 	// skip validation as assume isValidTimePart() has been called earlier
 	bToday := ""
-	now := time.Now()
+	now := GetClock(clock...).Now()
+	pLocation, err := ParseTimezone(timezone)
+	if err == nil {
+		now = now.In(pLocation)
+	}
 	bToday = fmt.Sprintf("%v-", now.Year())
 
 	dPart := int64(now.Month())
@@ -235,8 +260,8 @@ func CreateTodayTargetTimeByHourMinTimezone(hour, min int, timezone string) (tod
 
 // helper method to create the date-time based on today's date associated with
 // the hours plus minutes plus timezone provided
-func ParseStringDateToTodayUTC(hh24, mm int, timezone string) (pDate time.Time, err error) {
-	sDate := CreateTodayTargetTimeByHourMinTimezone(hh24, mm, timezone)
+func ParseStringDateToTodayUTC(hh24, mm int, timezone string, clock ...IClock) (pDate time.Time, err error) {
+	sDate := CreateTodayTargetTimeByHourMinTimezone(hh24, mm, timezone, clock...)
 
 	pDate, err = time.Parse(CommonDateFormat, sDate)
 	pDate = pDate.In(time.UTC)
@@ -374,3 +399,25 @@ func PrepareTimebasedPatternWithGivenTime(pattern string, givenTime time.Time) (
 	}
 	return
 }
+
+// replace the env variable keys (e.g. {ENV_VAR_KEY} ) within the given path with the env variables' values;
+// an error is returned if any of the env variable(s) is NOT available
+func ReplaceEnvVarInPath(givenPath string) (finalPath string, err error) {
+	finalPath = givenPath
+	matches, _, err := ParseEnvVar(givenPath)
+	if err != nil {
+		return
+	}
+	for i := len(matches)-1; i >= 0; i-- {
+		envMatch := matches[i]
+		envVar := envMatch[1:len(envMatch)-1]
+		envVarVal := os.Getenv(envVar)
+		if IsEmptyString(envVarVal) {
+			err = errors.New(fmt.Sprintf("env variable [%v] is NOT available.", envVar))
+			finalPath = ""
+			return
+		}
+		finalPath = strings.Replace(finalPath, envMatch, envVarVal, 1)
+	}
+	return
+}
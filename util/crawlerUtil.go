@@ -21,10 +21,15 @@ import (
 	"fmt"
 	"github.com/micro/go-config"
 	"strings"
-	"time"
 )
 
-func GetCurrentYearHolidays(pHolidayConfig *config.Config) (holidaySlice []string, err error) {
+// get the holidays of the current year (based on the optional clock, SystemClock by default)
+func GetCurrentYearHolidays(pHolidayConfig *config.Config, clock ...IClock) (holidaySlice []string, err error) {
+	return GetHolidaysByYear(pHolidayConfig, GetClock(clock...).Now().Year())
+}
+
+// get the holidays of the given year from the holiday config
+func GetHolidaysByYear(pHolidayConfig *config.Config, year int) (holidaySlice []string, err error) {
 	holidaySlice = make([]string, 30)
 	// catching runtime errors when translating the config keys' value to []string
 	defer func() {
@@ -34,8 +39,8 @@ func GetCurrentYearHolidays(pHolidayConfig *config.Config) (holidaySlice []strin
 		}
 	}()
 	if pHolidayConfig != nil {
-		year := string(fmt.Sprintf("%v", time.Now().Year()))
-		holidaySlice = (*pHolidayConfig).Get(year, common.ConfigKeyHolidays).StringSlice(holidaySlice)
+		sYear := string(fmt.Sprintf("%v", year))
+		holidaySlice = (*pHolidayConfig).Get(sYear, common.ConfigKeyHolidays).StringSlice(holidaySlice)
 	}
 	// check if the contents are valid or not ("" is non valid)
 	// return an empty slice (length of 0) if non valid contents available
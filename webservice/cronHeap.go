@@ -0,0 +1,69 @@
+/*
+ *  Copyright Project - Stockbinator, Author - quoeamaster, (C) 2019
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+package webservice
+
+import (
+	"container/heap"
+)
+
+// min-heap of cron-time entries ordered by the next fire time (UTCTime);
+// implements heap.Interface and is NOT thread-safe (guarded by StructCron's lock)
+type cronEntryHeap []*StructCronEntry
+
+func (h cronEntryHeap) Len() int {
+	return len(h)
+}
+
+func (h cronEntryHeap) Less(i, j int) bool {
+	return h[i].UTCTime.Before(h[j].UTCTime)
+}
+
+func (h cronEntryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].heapIndex = i
+	h[j].heapIndex = j
+}
+
+func (h *cronEntryHeap) Push(x interface{}) {
+	pEntry := x.(*StructCronEntry)
+	pEntry.heapIndex = len(*h)
+	*h = append(*h, pEntry)
+}
+
+func (h *cronEntryHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	pEntry := old[n-1]
+	old[n-1] = nil
+	pEntry.heapIndex = -1
+	*h = old[0 : n-1]
+	return pEntry
+}
+
+// return the entry with the earliest fire time; nil if empty
+func (h cronEntryHeap) peek() (pEntry *StructCronEntry) {
+	if len(h) > 0 {
+		pEntry = h[0]
+	}
+	return
+}
+
+// remove the given entry from the heap (no-op if the entry is not in the heap)
+func (h *cronEntryHeap) remove(pEntry *StructCronEntry) {
+	if pEntry.heapIndex >= 0 && pEntry.heapIndex < len(*h) && (*h)[pEntry.heapIndex] == pEntry {
+		heap.Remove(h, pEntry.heapIndex)
+	}
+}
@@ -0,0 +1,264 @@
+/*
+ *  Copyright Project - Stockbinator, Author - quoeamaster, (C) 2019
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+package webservice
+
+import (
+	"Stockbinator/common"
+	"Stockbinator/util"
+	"bufio"
+	"encoding/json"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// outcome constants for a cron job-run
+const (
+	CronJobOutcomeSuccess = "success"
+	CronJobOutcomeFailure = "failure"
+	// the job-run was missed (e.g. server downtime) and skipped based on the misfire policy
+	CronJobOutcomeSkipped = "skipped"
+)
+
+// structure describing one execution of a crawler job triggered by the cron service
+type StructCronJobRecord struct {
+	// the stock-module-rule crawled (e.g. stock_aastocks.700_tencent)
+	StocksModuleRule string
+	// the time the job was scheduled to run at (differs from StartTime for late runs)
+	ScheduledTime time.Time
+	// when the job started / ended
+	StartTime time.Time
+	EndTime   time.Time
+	// duration of the job in milliseconds
+	DurationMillis int64
+	// the crawler implementation involved
+	Crawler string
+	// keys of the stores the record was written into (stores whose writes failed and were spooled excluded)
+	Stores []string
+	// outcome of the job-run (success, failure or skipped)
+	Outcome string
+	// error message if the outcome is a failure (or the reason of being skipped)
+	ErrorMessage string
+}
+
+// bounded history of job-run records; the records are kept in memory and
+// appended to a json-lines file (if a filepath is provided) so that they survive a restart.
+// Once the number of records exceeds maxRecords, the oldest records are dropped; the file is only re-written
+// (compacted) once it holds more than common.CronHistoryCompactionRatio x maxRecords records.
+type StructCronHistory struct {
+	// the file storing the records (empty means in-memory only)
+	filepath string
+	// max number of records to keep
+	maxRecords int
+	// records in chronological order
+	records []StructCronJobRecord
+	// number of records (lines) in the file, including the ones already dropped from memory
+	fileRecords int
+
+	lock sync.Mutex
+}
+
+// creation method for StructCronHistory; records already available in the file would be loaded
+func NewStructCronHistory(filepath string, maxRecords int) (pHistory *StructCronHistory, err error) {
+	pHistory = new(StructCronHistory)
+	pHistory.filepath = filepath
+	pHistory.maxRecords = maxRecords
+	pHistory.records = make([]StructCronJobRecord, 0)
+
+	if !util.IsEmptyString(filepath) {
+		err = pHistory.load()
+	}
+	return
+}
+
+// append a record to the history; the file is compacted (re-written) in batches when it is over its bound
+func (h *StructCronHistory) Append(record StructCronJobRecord) (err error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.records = append(h.records, record)
+	if h.maxRecords > 0 && len(h.records) > h.maxRecords {
+		h.records = h.records[len(h.records)-h.maxRecords:]
+	}
+	if util.IsEmptyString(h.filepath) {
+		return
+	}
+	if h.maxRecords > 0 && h.fileRecords+1 > h.getCompactionThreshold() {
+		err = h.rewrite()
+		return
+	}
+	err = h.appendToFile(record)
+	if err == nil {
+		h.fileRecords++
+	}
+	return
+}
+
+// max number of records in the file before it is compacted
+func (h *StructCronHistory) getCompactionThreshold() (threshold int) {
+	threshold = int(float64(h.maxRecords) * common.CronHistoryCompactionRatio)
+	if threshold < h.maxRecords {
+		threshold = h.maxRecords
+	}
+	return
+}
+
+// return the records matching the given stock-module-rule (empty means all rules) and
+// whose start-time falls within [from, to]; a zero from or to means unbounded
+func (h *StructCronHistory) Query(stocksModuleRule string, from, to time.Time) (records []StructCronJobRecord) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	records = make([]StructCronJobRecord, 0)
+	for _, record := range h.records {
+		if !util.IsEmptyString(stocksModuleRule) && strings.Compare(record.StocksModuleRule, stocksModuleRule) != 0 {
+			continue
+		}
+		if !from.IsZero() && record.StartTime.Before(from) {
+			continue
+		}
+		if !to.IsZero() && record.StartTime.After(to) {
+			continue
+		}
+		records = append(records, record)
+	}
+	return
+}
+
+// return the latest record of the given stock-module-rule
+func (h *StructCronHistory) LastRecord(stocksModuleRule string) (record StructCronJobRecord, found bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	for i := len(h.records)-1; i >= 0; i-- {
+		if strings.Compare(h.records[i].StocksModuleRule, stocksModuleRule) == 0 {
+			record = h.records[i]
+			found = true
+			return
+		}
+	}
+	return
+}
+
+// check whether the given stock-module-rule has a record of the given schedule (e.g. run before a restart)
+func (h *StructCronHistory) HasScheduledRecord(stocksModuleRule string, scheduledTime time.Time) (found bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	for i := len(h.records)-1; i >= 0; i-- {
+		if strings.Compare(h.records[i].StocksModuleRule, stocksModuleRule) == 0 &&
+			h.records[i].ScheduledTime.Equal(scheduledTime) {
+			found = true
+			return
+		}
+	}
+	return
+}
+
+// load the records from the history file (a missing file simply means no history yet)
+func (h *StructCronHistory) load() (err error) {
+	pFile, err := os.Open(h.filepath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	defer func() {
+		err2 := pFile.Close()
+		if err == nil && err2 != nil {
+			err = err2
+		}
+	}()
+	pScanner := bufio.NewScanner(pFile)
+	for pScanner.Scan() {
+		line := pScanner.Text()
+		if util.IsEmptyString(line) {
+			continue
+		}
+		h.fileRecords++
+		record := new(StructCronJobRecord)
+		// skip corrupted lines instead of failing the whole history
+		if json.Unmarshal([]byte(line), record) == nil {
+			h.records = append(h.records, *record)
+		}
+	}
+	err = pScanner.Err()
+	if h.maxRecords > 0 && len(h.records) > h.maxRecords {
+		h.records = h.records[len(h.records)-h.maxRecords:]
+	}
+	return
+}
+
+func (h *StructCronHistory) appendToFile(record StructCronJobRecord) (err error) {
+	bRecord, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+	pFile, err := os.OpenFile(h.filepath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0666)
+	if err != nil {
+		return
+	}
+	defer func() {
+		err2 := pFile.Close()
+		if err == nil && err2 != nil {
+			err = err2
+		}
+	}()
+	_, err = pFile.WriteString(string(bRecord) + "\n")
+	return
+}
+
+// re-write the whole history file with the records in memory (temp file + rename)
+func (h *StructCronHistory) rewrite() (err error) {
+	if util.IsEmptyString(h.filepath) {
+		return
+	}
+	tmpFilepath := h.filepath + ".tmp"
+	pFile, err := os.OpenFile(tmpFilepath, os.O_TRUNC|os.O_WRONLY|os.O_CREATE, 0666)
+	if err != nil {
+		return
+	}
+	pWriter := bufio.NewWriter(pFile)
+	for _, record := range h.records {
+		bRecord, err2 := json.Marshal(record)
+		if err2 != nil {
+			err = err2
+			break
+		}
+		_, err = pWriter.WriteString(string(bRecord) + "\n")
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = pWriter.Flush()
+	}
+	err2 := pFile.Close()
+	if err == nil {
+		err = err2
+	}
+	if err != nil {
+		_ = os.Remove(tmpFilepath)
+		return
+	}
+	err = os.Rename(tmpFilepath, h.filepath)
+	if err == nil {
+		h.fileRecords = len(h.records)
+	}
+	return
+}
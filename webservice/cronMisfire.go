@@ -0,0 +1,157 @@
+/*
+ *  Copyright Project - Stockbinator, Author - quoeamaster, (C) 2019
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+package webservice
+
+import (
+	"Stockbinator/common"
+	"Stockbinator/util"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// structure describing how job-runs missed during a downtime are handled for a stock module
+type StructMisfirePolicy struct {
+	// one of common.CronMisfirePolicySkip or common.CronMisfirePolicyRunOnce
+	Policy string
+	// a job-run started within this period after its schedule is still treated as on time
+	Grace time.Duration
+	// max number of missed days to look back
+	MaxBackfill int
+}
+
+// return the misfire policy of the given stock module; [cron.{stock_module}] overrides [cron]
+func (c *StructCron) GetMisfirePolicy(stockModuleName string) (policy StructMisfirePolicy) {
+	policy.Policy = common.CronMisfirePolicyRunOnce
+	policy.Grace = time.Minute * common.CronMisfireDefaultGraceMinutes
+	policy.MaxBackfill = common.CronMisfireDefaultMaxBackfill
+
+	if c.pCfg == nil || c.pCfg.AppConfig == nil {
+		return
+	}
+	cfg := c.pCfg.AppConfig
+	policy.Policy = cfg.Get(common.ConfigKeyCron, common.ConfigKeyCronMisfirePolicy).String(policy.Policy)
+	policy.Grace = cfg.Get(common.ConfigKeyCron, common.ConfigKeyCronMisfireGrace).Duration(policy.Grace)
+	policy.MaxBackfill = cfg.Get(common.ConfigKeyCron, common.ConfigKeyCronMisfireMaxBackfill).Int(policy.MaxBackfill)
+
+	policy.Policy = cfg.Get(common.ConfigKeyCron, stockModuleName, common.ConfigKeyCronMisfirePolicy).String(policy.Policy)
+	policy.Grace = cfg.Get(common.ConfigKeyCron, stockModuleName, common.ConfigKeyCronMisfireGrace).Duration(policy.Grace)
+	policy.MaxBackfill = cfg.Get(common.ConfigKeyCron, stockModuleName, common.ConfigKeyCronMisfireMaxBackfill).Int(policy.MaxBackfill)
+
+	switch policy.Policy {
+	case common.CronMisfirePolicySkip, common.CronMisfirePolicyRunOnce:
+	default:
+		c.logError("GetMisfirePolicy", fmt.Sprintf("unknown misfire policy [%v] for %v, %v is used instead",
+			policy.Policy, stockModuleName, common.CronMisfirePolicyRunOnce))
+		policy.Policy = common.CronMisfirePolicyRunOnce
+	}
+	return
+}
+
+// run the job of the given stock-module-rule which is due at dueTime (the latest schedule not after now);
+// missed schedules before dueTime (found through the job-run history) are handled based on the misfire policy.
+// A due schedule already recorded in the history is not run again.
+// Weekends and holidays of the stock module are never treated as missed.
+func (c *StructCron) runDueCrawlJob(stockModuleKey string, dueTime time.Time, location *time.Location, now time.Time) {
+	// the due schedule was already run (e.g. before a restart), hence it is NOT run again
+	if c.pHistory.HasScheduledRecord(stockModuleKey, dueTime) {
+		return
+	}
+	stockModuleName := strings.Split(stockModuleKey, ".")[0]
+	policy := c.GetMisfirePolicy(stockModuleName)
+	isLate := now.Sub(dueTime) > policy.Grace
+
+	// a) missed schedules before the due time
+	for _, missedTime := range c.getMissedScheduleTimes(stockModuleKey, dueTime, location, policy) {
+		c.recordSkippedJob(stockModuleKey, missedTime, fmt.Sprintf(
+			"missed schedule skipped by misfire policy [%v]", policy.Policy))
+	}
+	// b) the due schedule itself
+	if isLate && strings.Compare(policy.Policy, common.CronMisfirePolicySkip) == 0 {
+		c.recordSkippedJob(stockModuleKey, dueTime, fmt.Sprintf(
+			"late by %v (grace %v), skipped by misfire policy [%v]", now.Sub(dueTime), policy.Grace, policy.Policy))
+		return
+	}
+	c.runCrawlJob(stockModuleKey, dueTime)
+}
+
+// return the schedule times (chronological) between the last recorded job-run and the due time which were missed;
+// ONLY trading days (non weekend and non holiday) are returned
+func (c *StructCron) getMissedScheduleTimes(stockModuleKey string, dueTime time.Time, location *time.Location, policy StructMisfirePolicy) (missedTimes []time.Time) {
+	missedTimes = make([]time.Time, 0)
+
+	lastRecord, found := c.pHistory.LastRecord(stockModuleKey)
+	if !found {
+		// no idea when the last job-run was; hence nothing is treated as missed
+		return
+	}
+	lastRunTime := lastRecord.ScheduledTime
+	if lastRunTime.IsZero() {
+		lastRunTime = lastRecord.StartTime
+	}
+	for i := policy.MaxBackfill; i >= 1; i-- {
+		scheduleTime := dueTime.Add(time.Hour * -24 * time.Duration(i))
+		if !scheduleTime.After(lastRunTime) {
+			continue
+		}
+		if c.isTradingDay(stockModuleKey, scheduleTime.In(location)) {
+			missedTimes = append(missedTimes, scheduleTime)
+		}
+	}
+	return
+}
+
+// check whether the given (local) date is a trading day of the stock module => non weekend and non holiday
+func (c *StructCron) isTradingDay(stockModuleKey string, localDate time.Time) (isTradingDay bool) {
+	if util.IsWeekend(localDate) {
+		return
+	}
+	isTradingDay = true
+	if c.pCfg == nil {
+		return
+	}
+	moduleConfig, found := c.pCfg.ModuleConfigs[strings.Split(stockModuleKey, ".")[0]]
+	if !found || moduleConfig.Holidays == nil {
+		return
+	}
+	holidaySlice, err := util.GetHolidaysByYear(&moduleConfig.Holidays, localDate.Year())
+	if err != nil || len(holidaySlice) == 0 {
+		return
+	}
+	// holidays are given as the local midnight, hence compare with the truncated local date
+	truncatedDate, err := util.GetTimeTruncatedDate(&localDate)
+	if err != nil {
+		return
+	}
+	isHoliday, err := util.IsHoliday(&truncatedDate, nil, holidaySlice)
+	if err == nil && isHoliday {
+		isTradingDay = false
+	}
+	return
+}
+
+// record a skipped schedule in the history
+func (c *StructCron) recordSkippedJob(stockModuleKey string, scheduledTime time.Time, reason string) {
+	now := c.getClock().Now()
+	c.appendHistory(StructCronJobRecord{
+		StocksModuleRule: stockModuleKey,
+		ScheduledTime:    scheduledTime,
+		StartTime:        now,
+		EndTime:          now,
+		Outcome:          CronJobOutcomeSkipped,
+		ErrorMessage:     reason,
+	})
+}
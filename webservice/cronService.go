@@ -22,11 +22,16 @@ import (
 	"Stockbinator/store"
 	"Stockbinator/util"
 	"bytes"
+	"container/heap"
 	"errors"
 	"fmt"
 	"github.com/daviddengcn/go-colortext"
 	"github.com/daviddengcn/go-colortext/fmt"
 	"github.com/emicklei/go-restful"
+	config2 "github.com/micro/go-config"
+	"net/http"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -39,13 +44,29 @@ type StructCron struct {
 	pJsonParser *util.StructJsonParser
 	// map of StructCronEntry entries; each of these represent a time for running a crawler job
 	cronTimeEntries map[string]*StructCronEntry
+	// min-heap of the cron-time entries ordered by the next fire time; entries of running jobs are not in the heap
+	entryHeap cronEntryHeap
+	// stocksModuleRule -> key of the cron-time entry holding the rule
+	ruleIndex map[string]string
 	// the config information for the crawler job
 	pCfg *config.StructConfig
 
-	// the ticker for the cron service
-	pTickerCron *time.Ticker
-	// is the tick loop running?
+	// lock guarding the cron-time entries, the heap, the rule index and the loop status;
+	// NEVER held while a crawler job is running
+	lock sync.Mutex
+	// channel to wake up the scheduler loop when the schedules are changed
+	wakeChannel chan bool
+	// channel to stop the scheduler loop
+	stopChannel chan bool
+	// is the scheduler loop running?
 	isCronTickRunning bool
+	// the clock telling the current time (SystemClock unless injected through SetClock)
+	clock util.IClock
+
+	// history of the job-run(s)
+	pHistory *StructCronHistory
+	// spool of the store writes failed during the job-run(s); retried in the background
+	pSpool *store.StructStoreSpool
 }
 
 // creation method for StructCron
@@ -53,8 +74,122 @@ func NewStructCron(pCfg *config.StructConfig) (cron *StructCron) {
 	cron = new(StructCron)
 	cron.pJsonParser = util.NewStructJsonParser()
 	cron.cronTimeEntries = make(map[string]*StructCronEntry)
+	cron.entryHeap = make(cronEntryHeap, 0)
+	cron.ruleIndex = make(map[string]string)
 	cron.pCfg = pCfg
+	cron.wakeChannel = make(chan bool, 1)
 	cron.isCronTickRunning = false
+	cron.clock = util.SystemClock
+
+	var err error
+	cron.pHistory, err = NewStructCronHistory(cron.getHistoryFilepath(), cron.getHistorySize())
+	if err != nil {
+		// log down the error and proceed with an in-memory history
+		cron.logError("NewStructCron", fmt.Sprintf("could not load the cron history, in-memory history is used instead => %v", err))
+		cron.pHistory, _ = NewStructCronHistory("", cron.getHistorySize())
+	}
+	backoff, maxBackoff := cron.getSpoolBackoffs()
+	cron.pSpool, err = store.NewStructStoreSpool(cron.getSpoolFilepath(), backoff, maxBackoff)
+	if err != nil {
+		// log down the error and proceed with an in-memory spool
+		cron.logError("NewStructCron", fmt.Sprintf("could not load the store spool, in-memory spool is used instead => %v", err))
+		cron.pSpool, _ = store.NewStructStoreSpool("", backoff, maxBackoff)
+	}
+	return
+}
+
+// inject the clock telling the current time (e.g. a util.StructFakeClock for testing);
+// should be set before any schedule is added
+func (c *StructCron) SetClock(clock util.IClock) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.clock = util.GetClock(clock)
+	c.pSpool.SetClock(c.clock)
+	// wake the scheduler loop to re-calculate the sleep duration based on the new clock
+	c.wakeScheduler()
+}
+
+// the cron history file lives under [cron] repo; if not available, under [filestore] repo.
+// An empty filepath means the history is kept in memory only
+func (c *StructCron) getHistoryFilepath() (filepath string) {
+	if c.pCfg == nil || c.pCfg.AppConfig == nil {
+		return
+	}
+	repo := c.pCfg.AppConfig.Get(common.ConfigKeyCron, common.ConfigKeyRepo).String("")
+	if util.IsEmptyString(repo) {
+		repo = c.pCfg.AppConfig.Get(common.ConfigKeyStoreFile, common.ConfigKeyRepo).String("")
+	}
+	if util.IsEmptyString(repo) {
+		return
+	}
+	repo, err := util.ReplaceEnvVarInPath(repo)
+	if err != nil {
+		c.logError("getHistoryFilepath", err.Error())
+		return
+	}
+	filepath = fmt.Sprintf("%v%v", repo, common.CronHistoryFilename)
+	return
+}
+
+// the store spool file is [storespool] path; if not available, it lives under [filestore] repo.
+// An empty filepath means the spool is kept in memory only
+func (c *StructCron) getSpoolFilepath() (filepath string) {
+	if c.pCfg == nil || c.pCfg.AppConfig == nil {
+		return
+	}
+	filepath = c.pCfg.AppConfig.Get(common.ConfigKeyStoreSpool, common.ConfigKeyStorePath).String("")
+	if util.IsEmptyString(filepath) {
+		repo := c.pCfg.AppConfig.Get(common.ConfigKeyStoreFile, common.ConfigKeyRepo).String("")
+		if util.IsEmptyString(repo) {
+			return
+		}
+		filepath = fmt.Sprintf("%v%v", repo, common.StoreSpoolFilename)
+	}
+	filepath, err := util.ReplaceEnvVarInPath(filepath)
+	if err != nil {
+		c.logError("getSpoolFilepath", err.Error())
+		filepath = ""
+	}
+	return
+}
+
+// retry backoffs of the store spool ([storespool] backoff and max_backoff)
+func (c *StructCron) getSpoolBackoffs() (backoff, maxBackoff time.Duration) {
+	backoff = time.Second * common.StoreSpoolDefaultBackoffSeconds
+	maxBackoff = time.Second * common.StoreSpoolDefaultMaxBackoffSeconds
+	if c.pCfg != nil && c.pCfg.AppConfig != nil {
+		backoff = c.pCfg.AppConfig.Get(common.ConfigKeyStoreSpool, common.ConfigKeyStoreSpoolBackoff).Duration(backoff)
+		maxBackoff = c.pCfg.AppConfig.Get(common.ConfigKeyStoreSpool, common.ConfigKeyStoreSpoolMaxBackoff).Duration(maxBackoff)
+	}
+	return
+}
+
+// how often the store spool is checked for due entries ([storespool] retry_interval)
+func (c *StructCron) getSpoolRetryInterval() (interval time.Duration) {
+	interval = time.Second * common.StoreSpoolDefaultRetryIntervalSeconds
+	if c.pCfg != nil && c.pCfg.AppConfig != nil {
+		interval = c.pCfg.AppConfig.Get(common.ConfigKeyStoreSpool, common.ConfigKeyStoreSpoolRetryInterval).Duration(interval)
+	}
+	if interval <= 0 {
+		interval = time.Second * common.StoreSpoolDefaultRetryIntervalSeconds
+	}
+	return
+}
+
+// return the stock module config(s); nil if no config is available
+func (c *StructCron) getModuleConfigs() (moduleConfigs map[string]config.StructStockModuleConfig) {
+	if c.pCfg != nil {
+		moduleConfigs = c.pCfg.ModuleConfigs
+	}
+	return
+}
+
+// max number of job-run records kept ([cron] history_size)
+func (c *StructCron) getHistorySize() (size int) {
+	size = common.CronHistoryDefaultSize
+	if c.pCfg != nil && c.pCfg.AppConfig != nil {
+		size = c.pCfg.AppConfig.Get(common.ConfigKeyCron, common.ConfigKeyCronHistorySize).Int(size)
+	}
 	return
 }
 
@@ -68,19 +203,46 @@ type StructCronEntry struct {
 	UTCTime time.Time
 	// list of stocksModuleRule under this cron-time entry (usually size of 1)
 	StocksModuleRuleList []string
+	// list of stocksModuleRule under this cron-time entry which are paused (would not be crawled until resumed)
+	PausedStocksModuleRuleList []string
 	// boolean indicates whether the underlying cron-job is running
 	isJobRunning bool
+	// position in the heap (-1 if not in the heap)
+	heapIndex int
 }
 
 func NewStructCronEntry() (entry *StructCronEntry) {
 	entry = new(StructCronEntry)
 	entry.StocksModuleRuleList = make([]string, 0)
+	entry.PausedStocksModuleRuleList = make([]string, 0)
 	entry.isJobRunning = false
+	entry.heapIndex = -1
+	return
+}
+
+// return a copy of the entry; the slices are copied too hence safe to be used outside the lock
+func (e *StructCronEntry) copy() (entry StructCronEntry) {
+	entry = *e
+	entry.StocksModuleRuleList = append(make([]string, 0), e.StocksModuleRuleList...)
+	entry.PausedStocksModuleRuleList = append(make([]string, 0), e.PausedStocksModuleRuleList...)
+	return
+}
+
+// check if the given stocksModuleRule is paused under this entry
+func (e *StructCronEntry) isRulePaused(stocksModuleRule string) (paused bool) {
+	for _, rule := range e.PausedStocksModuleRuleList {
+		if strings.Compare(rule, stocksModuleRule) == 0 {
+			paused = true
+			break
+		}
+	}
 	return
 }
 
 // method to update or insert a cron schedule and its corresponding method.
 // However this cron service only handles hour, min, sec and timezone and excludes year, month and date.
+// If the stocksModuleRule is already scheduled at another time, it would be moved (re-scheduled) to the new time;
+// inserted is true ONLY when the rule was not scheduled before.
 func (c *StructCron) UpsertTimeCron( hour24, min, sec int, timezone, stocksModuleRule string ) (inserted bool, err error) {
 	// validation
 	valid := false
@@ -101,33 +263,189 @@ timezone[%v], stockModuleRule[%v]`, hour24, min, sec, timezone, stocksModuleRule
 	} else {
 		// add / update the cron
 		// a) prepare the cron-time for today
-		cronDisplayTime := util.CreateTodayTargetTimeByHourMinTimezone(hour24, min, timezone)
-		pCronTimeUTC, err2 := util.ParseStringDateToTodayUTC(hour24, min, timezone)
+		cronDisplayTime := util.CreateTodayTargetTimeByHourMinTimezone(hour24, min, timezone, c.getClock())
+		pCronTimeUTC, err2 := util.ParseStringDateToTodayUTC(hour24, min, timezone, c.getClock())
 		if err2 != nil {
 			err = err2
 			return
 		}
 		cronTimeUTC := pCronTimeUTC.Format(util.CommonDateFormat)
 
-		// b) check if the entry is already there or not
-		if c.cronTimeEntries[cronTimeUTC] != nil {
-			// means existed
-			pEntry := c.cronTimeEntries[cronTimeUTC]
-			pEntry.StocksModuleRuleList = append(pEntry.StocksModuleRuleList, stocksModuleRule)
+		c.lock.Lock()
+		defer c.lock.Unlock()
 
+		// b) check if the rule was scheduled before; if so the rule is "moved" to the new cron-time
+		prevEntryKey, pPrevEntry := c.findCronEntryByRule(stocksModuleRule)
+		if pPrevEntry != nil && isSameDailySchedule(pPrevEntry, pCronTimeUTC, cronDisplayTime) {
+			// same time of the day (the entry might be due tomorrow already); nothing to re-schedule
+			return
+		}
+		isPaused := false
+		if pPrevEntry != nil {
+			isPaused = pPrevEntry.isRulePaused(stocksModuleRule)
+			c.removeRuleFromCronEntry(prevEntryKey, stocksModuleRule)
 		} else {
+			inserted = true
+		}
+
+		// c) check if the entry is already there or not
+		pEntry := c.cronTimeEntries[cronTimeUTC]
+		if pEntry == nil {
 			// create a new entry
-			// pDate, err2 := util.ParseStringDateToTodayUTC(hour24, min, timezone)
-			if err2 != nil {
-				return
-			} else {
-				pEntry := NewStructCronEntry()
-				pEntry.DisplayName = cronDisplayTime
-				pEntry.UTCTime = pCronTimeUTC
-				pEntry.StocksModuleRuleList = append(pEntry.StocksModuleRuleList, stocksModuleRule)
-				c.cronTimeEntries[cronTimeUTC] = pEntry
-			}
+			pEntry = NewStructCronEntry()
+			pEntry.DisplayName = cronDisplayTime
+			pEntry.UTCTime = pCronTimeUTC
+			c.cronTimeEntries[cronTimeUTC] = pEntry
+			heap.Push(&c.entryHeap, pEntry)
+			c.wakeScheduler()
 		} // end -- if (cronTimeEntries exists check)
+		pEntry.StocksModuleRuleList = append(pEntry.StocksModuleRuleList, stocksModuleRule)
+		c.ruleIndex[stocksModuleRule] = cronTimeUTC
+		if isPaused {
+			pEntry.PausedStocksModuleRuleList = append(pEntry.PausedStocksModuleRuleList, stocksModuleRule)
+		}
+	}
+	return
+}
+
+// check whether the entry fires at the same time of the day and timezone as the given cron-time (of any date)
+func isSameDailySchedule(pEntry *StructCronEntry, cronTimeUTC time.Time, cronDisplayTime string) bool {
+	entryUTCTime := pEntry.UTCTime.In(time.UTC)
+	cronTimeUTC = cronTimeUTC.In(time.UTC)
+	if entryUTCTime.Hour() != cronTimeUTC.Hour() || entryUTCTime.Minute() != cronTimeUTC.Minute() ||
+		entryUTCTime.Second() != cronTimeUTC.Second() {
+		return false
+	}
+	dEntryDisplayTime, err := time.Parse(util.CommonDateFormat, pEntry.DisplayName)
+	dCronDisplayTime, err2 := time.Parse(util.CommonDateFormat, cronDisplayTime)
+	if err != nil || err2 != nil {
+		return false
+	}
+	_, entryOffset := dEntryDisplayTime.Zone()
+	_, cronOffset := dCronDisplayTime.Zone()
+	return entryOffset == cronOffset
+}
+
+// method to remove the given stocksModuleRule from the cron schedules.
+// If the cron-time entry has no more rules after the removal, the entry itself would be removed as well
+func (c *StructCron) RemoveTimeCron(stocksModuleRule string) (removed bool, err error) {
+	if util.IsEmptyString(stocksModuleRule) {
+		err = errors.New("exception! stockModuleRule is a MUST parameter for removing a time-cron entry")
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	entryKey, pEntry := c.findCronEntryByRule(stocksModuleRule)
+	if pEntry != nil {
+		c.removeRuleFromCronEntry(entryKey, stocksModuleRule)
+		removed = true
+	}
+	return
+}
+
+// method to pause the given stocksModuleRule; the rule stays scheduled but would not be crawled until resumed
+func (c *StructCron) PauseTimeCron(stocksModuleRule string) (found bool, err error) {
+	if util.IsEmptyString(stocksModuleRule) {
+		err = errors.New("exception! stockModuleRule is a MUST parameter for pausing a time-cron entry")
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	_, pEntry := c.findCronEntryByRule(stocksModuleRule)
+	if pEntry != nil {
+		found = true
+		if !pEntry.isRulePaused(stocksModuleRule) {
+			pEntry.PausedStocksModuleRuleList = append(pEntry.PausedStocksModuleRuleList, stocksModuleRule)
+		}
+	}
+	return
+}
+
+// method to resume a paused stocksModuleRule
+func (c *StructCron) ResumeTimeCron(stocksModuleRule string) (found bool, err error) {
+	if util.IsEmptyString(stocksModuleRule) {
+		err = errors.New("exception! stockModuleRule is a MUST parameter for resuming a time-cron entry")
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	_, pEntry := c.findCronEntryByRule(stocksModuleRule)
+	if pEntry != nil {
+		found = true
+		pEntry.PausedStocksModuleRuleList = removeStringFromSlice(pEntry.PausedStocksModuleRuleList, stocksModuleRule)
+	}
+	return
+}
+
+// return a copy of the cron-time entry holding the given stocksModuleRule
+func (c *StructCron) GetTimeCronByRule(stocksModuleRule string) (entry StructCronEntry, found bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	_, pEntry := c.findCronEntryByRule(stocksModuleRule)
+	if pEntry != nil {
+		entry = pEntry.copy()
+		found = true
+	}
+	return
+}
+
+// return a snapshot (copies) of all cron-time entries keyed by the UTC time
+func (c *StructCron) ListTimeCron() (entries map[string]StructCronEntry) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	entries = make(map[string]StructCronEntry)
+	for key, pEntry := range c.cronTimeEntries {
+		entries[key] = pEntry.copy()
+	}
+	return
+}
+
+// find the cron-time entry (plus its key) holding the given stocksModuleRule; nil if not scheduled.
+// Caller MUST hold the lock
+func (c *StructCron) findCronEntryByRule(stocksModuleRule string) (entryKey string, pEntry *StructCronEntry) {
+	entryKey, found := c.ruleIndex[stocksModuleRule]
+	if found {
+		pEntry = c.cronTimeEntries[entryKey]
+	}
+	return
+}
+
+// remove the stocksModuleRule from the entry; the entry is dropped once it has no more rules.
+// Caller MUST hold the lock
+func (c *StructCron) removeRuleFromCronEntry(entryKey, stocksModuleRule string) {
+	pEntry := c.cronTimeEntries[entryKey]
+	if pEntry == nil {
+		return
+	}
+	pEntry.StocksModuleRuleList = removeStringFromSlice(pEntry.StocksModuleRuleList, stocksModuleRule)
+	pEntry.PausedStocksModuleRuleList = removeStringFromSlice(pEntry.PausedStocksModuleRuleList, stocksModuleRule)
+	delete(c.ruleIndex, stocksModuleRule)
+	if len(pEntry.StocksModuleRuleList) == 0 {
+		delete(c.cronTimeEntries, entryKey)
+		c.entryHeap.remove(pEntry)
+	}
+}
+
+// wake up the scheduler loop (if running) to re-check the next fire time; never blocks
+func (c *StructCron) wakeScheduler() {
+	select {
+	case c.wakeChannel <- true:
+	default:
+	}
+}
+
+// return a new slice without the given value
+func removeStringFromSlice(values []string, value string) (result []string) {
+	result = make([]string, 0)
+	for _, v := range values {
+		if strings.Compare(v, value) != 0 {
+			result = append(result, v)
+		}
 	}
 	return
 }
@@ -145,6 +463,13 @@ func (c *StructCron) CreateWebservice() *restful.WebService {
 	// routes under "cron" endpoint (API)
 	pWs.Route(pWs.POST("upsert").To(c.upsertTimeCronAPI))
 	pWs.Route(pWs.GET("list").To(c.listTimeCronAPI))
+	pWs.Route(pWs.GET("history").To(c.listCronHistoryAPI))
+	pWs.Route(pWs.GET("spool").To(c.getSpoolAPI))
+	pWs.Route(pWs.POST("spool/replay").To(c.replaySpoolAPI))
+	pWs.Route(pWs.DELETE("spool").To(c.purgeSpoolAPI))
+	pWs.Route(pWs.DELETE("{rule}").To(c.removeTimeCronAPI))
+	pWs.Route(pWs.POST("{rule}/pause").To(c.pauseTimeCronAPI))
+	pWs.Route(pWs.POST("{rule}/resume").To(c.resumeTimeCronAPI))
 
 	return pWs
 }
@@ -231,10 +556,69 @@ hour24 (default 0), min (default 0), sec (default 0), timezone (default "+00:00"
 			}
 		}
 	}
-	err = pRes.WriteAsJson(*pRO)
+	c.writeCommonResponse("upsertTimeCronAPI", pRes, pRO)
+}
+
+// remove the stock-module-rule given by path parameter "rule" from the cron schedules
+func (c *StructCron) removeTimeCronAPI(pReq *restful.Request, pRes *restful.Response) {
+	var pRO *util.StructCommonResponse
+
+	stockModuleRule := pReq.PathParameter("rule")
+	removed, err := c.RemoveTimeCron(stockModuleRule)
+	if err != nil {
+		pRO = util.NewStructCommonResponse(http.StatusBadRequest, err.Error())
+	} else if !removed {
+		pRO = util.NewStructCommonResponse(http.StatusNotFound, fmt.Sprintf(
+			"no time-cron entry found, stockModuleRule => %v", stockModuleRule))
+	} else {
+		pRO = util.NewStructCommonResponse(http.StatusOK, fmt.Sprintf(
+			"time-cron entry has been removed, stockModuleRule => %v", stockModuleRule))
+	}
+	c.writeCommonResponse("removeTimeCronAPI", pRes, pRO)
+}
+
+// pause the stock-module-rule given by path parameter "rule"
+func (c *StructCron) pauseTimeCronAPI(pReq *restful.Request, pRes *restful.Response) {
+	var pRO *util.StructCommonResponse
+
+	stockModuleRule := pReq.PathParameter("rule")
+	found, err := c.PauseTimeCron(stockModuleRule)
+	if err != nil {
+		pRO = util.NewStructCommonResponse(http.StatusBadRequest, err.Error())
+	} else if !found {
+		pRO = util.NewStructCommonResponse(http.StatusNotFound, fmt.Sprintf(
+			"no time-cron entry found, stockModuleRule => %v", stockModuleRule))
+	} else {
+		pRO = util.NewStructCommonResponse(http.StatusOK, fmt.Sprintf(
+			"time-cron entry has been paused, stockModuleRule => %v", stockModuleRule))
+	}
+	c.writeCommonResponse("pauseTimeCronAPI", pRes, pRO)
+}
+
+// resume the stock-module-rule given by path parameter "rule"
+func (c *StructCron) resumeTimeCronAPI(pReq *restful.Request, pRes *restful.Response) {
+	var pRO *util.StructCommonResponse
+
+	stockModuleRule := pReq.PathParameter("rule")
+	found, err := c.ResumeTimeCron(stockModuleRule)
+	if err != nil {
+		pRO = util.NewStructCommonResponse(http.StatusBadRequest, err.Error())
+	} else if !found {
+		pRO = util.NewStructCommonResponse(http.StatusNotFound, fmt.Sprintf(
+			"no time-cron entry found, stockModuleRule => %v", stockModuleRule))
+	} else {
+		pRO = util.NewStructCommonResponse(http.StatusOK, fmt.Sprintf(
+			"time-cron entry has been resumed, stockModuleRule => %v", stockModuleRule))
+	}
+	c.writeCommonResponse("resumeTimeCronAPI", pRes, pRO)
+}
+
+// write the common-response back to the client; the http status is the same as the response-code
+func (c *StructCron) writeCommonResponse(funcName string, pRes *restful.Response, pRO *util.StructCommonResponse) {
+	err := pRes.WriteHeaderAndJson(pRO.ResponseCode, *pRO, restful.MIME_JSON)
 	if err != nil {
 		// just log and continue to serve (sometimes it is a disconnection which could be re-covered)
-		c.logError("upsertTimeCronAPI", err.Error())
+		c.logError(funcName, err.Error())
 	}
 }
 
@@ -244,93 +628,382 @@ func (c *StructCron) listTimeCronAPI(pReq *restful.Request, pRes *restful.Respon
 	// tencent := cfg.Rules.Get("700_tencent", "url").String("no_idea")
 	// fmt.Printf("%v - %v\n", reflect.TypeOf(tencent), tencent)
 
-	err := pRes.WriteAsJson(c.cronTimeEntries)
+	err := pRes.WriteAsJson(c.ListTimeCron())
 	if err != nil {
 		// just log and continue to serve (sometimes it is a disconnection which could be re-covered)
 		c.logError("listTimeCronAPI", err.Error())
 	}
 }
 
+// list the job-run history; optional query parameters =>
+// rule (stock-module-rule), from and to (date in the format of 2019-07-03T16:10:00+08:00)
+func (c *StructCron) listCronHistoryAPI(pReq *restful.Request, pRes *restful.Response) {
+	stockModuleRule := pReq.QueryParameter("rule")
+	from, err := c.parseHistoryDateParam(pReq.QueryParameter("from"))
+	if err != nil {
+		c.writeCommonResponse("listCronHistoryAPI", pRes, util.NewStructCommonResponse(http.StatusBadRequest, err.Error()))
+		return
+	}
+	to, err := c.parseHistoryDateParam(pReq.QueryParameter("to"))
+	if err != nil {
+		c.writeCommonResponse("listCronHistoryAPI", pRes, util.NewStructCommonResponse(http.StatusBadRequest, err.Error()))
+		return
+	}
+	err = pRes.WriteAsJson(c.GetHistory(stockModuleRule, from, to))
+	if err != nil {
+		// just log and continue to serve (sometimes it is a disconnection which could be re-covered)
+		c.logError("listCronHistoryAPI", err.Error())
+	}
+}
+
+// return the store spool's status and entries; optional query parameter => store (store key)
+func (c *StructCron) getSpoolAPI(pReq *restful.Request, pRes *restful.Response) {
+	storeKey := pReq.QueryParameter("store")
+	err := pRes.WriteAsJson(StructCronSpoolView{
+		Status:  c.GetSpoolStatus(),
+		Entries: c.ListSpool(storeKey),
+	})
+	if err != nil {
+		// just log and continue to serve (sometimes it is a disconnection which could be re-covered)
+		c.logError("getSpoolAPI", err.Error())
+	}
+}
+
+// replay ALL the spooled store writes immediately (regardless of their backoff)
+func (c *StructCron) replaySpoolAPI(pReq *restful.Request, pRes *restful.Response) {
+	result, err := c.ReplaySpool(true)
+	if err != nil {
+		c.writeCommonResponse("replaySpoolAPI", pRes, util.NewStructCommonResponse(http.StatusInternalServerError, err.Error()))
+		return
+	}
+	err = pRes.WriteAsJson(result)
+	if err != nil {
+		// just log and continue to serve (sometimes it is a disconnection which could be re-covered)
+		c.logError("replaySpoolAPI", err.Error())
+	}
+}
+
+// purge the spooled store writes without retrying; optional query parameter => store (store key, empty means all)
+func (c *StructCron) purgeSpoolAPI(pReq *restful.Request, pRes *restful.Response) {
+	purged, err := c.PurgeSpool(pReq.QueryParameter("store"))
+	if err != nil {
+		c.writeCommonResponse("purgeSpoolAPI", pRes, util.NewStructCommonResponse(http.StatusInternalServerError, err.Error()))
+		return
+	}
+	c.writeCommonResponse("purgeSpoolAPI", pRes, util.NewStructCommonResponse(http.StatusOK, fmt.Sprintf("%v spooled write(s) purged", purged)))
+}
+
+// structure returned by the spool API
+type StructCronSpoolView struct {
+	Status  store.StructStoreSpoolStatus
+	Entries []store.StructStoreSpoolEntry
+}
+
+// return the depth and timings of the store spool
+func (c *StructCron) GetSpoolStatus() (status store.StructStoreSpoolStatus) {
+	return c.pSpool.GetStatus()
+}
+
+// return the spooled store writes of the store key (empty means all stores)
+func (c *StructCron) ListSpool(storeKey string) (entries []store.StructStoreSpoolEntry) {
+	return c.pSpool.List(storeKey)
+}
+
+// retry the spooled store writes; only those due are retried unless force is set
+func (c *StructCron) ReplaySpool(force bool) (result store.StructStoreSpoolReplayResult, err error) {
+	return c.pSpool.Replay(c.resolveStore, force)
+}
+
+// remove the spooled store writes of the store key (empty means all stores) without retrying
+func (c *StructCron) PurgeSpool(storeKey string) (purged int, err error) {
+	return c.pSpool.Purge(storeKey)
+}
+
+// resolve the store key of a spooled write into the store instance
+func (c *StructCron) resolveStore(storeKey string) (iStore store.IStore, err error) {
+	if c.pCfg == nil || c.pCfg.AppConfig == nil {
+		err = errors.New(fmt.Sprintf("no config available to resolve the store => %v", storeKey))
+		return
+	}
+	return store.GetStoreByKey(storeKey, c.pCfg.AppConfig, nil)
+}
+
+// return the job-run records of the stock-module-rule (empty means all) started within [from, to]
+func (c *StructCron) GetHistory(stockModuleRule string, from, to time.Time) (records []StructCronJobRecord) {
+	return c.pHistory.Query(stockModuleRule, from, to)
+}
+
+// parse the date query parameter; empty value means no bound (zero time)
+func (c *StructCron) parseHistoryDateParam(value string) (date time.Time, err error) {
+	if util.IsEmptyString(value) {
+		return
+	}
+	date, err = time.Parse(util.CommonDateFormat, value)
+	if err != nil {
+		err = errors.New(fmt.Sprintf("invalid date [%v], expected format is [2019-07-03T16:10:00+08:00]", value))
+	}
+	return
+}
+
 
 // * ******************************* *
 // * non web-service related methods *
 // * ******************************* *
 
-// start the cron ticker loop if it was not started yet
+// start the cron scheduler loop if it was not started yet.
+// The loop sleeps until the earliest fire time in the heap; any schedule change wakes it up to re-check
 func (c *StructCron) RunCron() (err error)  {
-	// only start the tick loop if not yet running
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	// only start the loop if not yet running
 	if !c.isCronTickRunning {
 		c.isCronTickRunning = true
-
-		// per minute ticker... and start running ticks at once
-		c.pTickerCron = time.NewTicker(time.Minute)
+		c.stopChannel = make(chan bool)
 		// start a routine
-		go func() {
-			for currentTime := range c.pTickerCron.C {
-				// check if the current-time matches any of the cron-time entries
-				// currentTimeUTC := currentTime.In(time.UTC).Format(util.CommonDateFormat)
-				// fmt.Println(currentTimeUTC)
-				currentTimeUTC := currentTime.In(time.UTC)
-				for entryKey, cronTimeEntry := range c.cronTimeEntries {
-					if !cronTimeEntry.isJobRunning {
-						if currentTimeUTC.Equal(cronTimeEntry.UTCTime) || currentTimeUTC.After(cronTimeEntry.UTCTime) {
-							cronTimeEntry.isJobRunning = true
-							for _, stockModuleKey := range cronTimeEntry.StocksModuleRuleList {
-								// TODO might need to run in parallel?? though in this case not that important
-								// use a factory method to return a crawler instance suitable for the crawl (with caching)
-								iCrawler := crawler.GetCrawler(stockModuleKey, c.pCfg.ModuleConfigs)
-								storeList, err2 := c.getStoreList(stockModuleKey)
-								err2 = iCrawler.Crawl(stockModuleKey, storeList)
-								if err2 != nil {
-									err = err2
-									return
-								}
-							} // end -- for (all stock module involved run)
-							// update the cron-time entries to tomorrow
-							tmrCronEntry := c.cronTimeEntries[entryKey]
-							delete(c.cronTimeEntries, entryKey)
-
-							tmrCronEntry.UTCTime = tmrCronEntry.UTCTime.Add(time.Hour * 24)
-							tmrCronEntry.isJobRunning = false
-							dTmrTime, _ := time.Parse(util.CommonDateFormat, tmrCronEntry.DisplayName)
-							tmrCronEntry.DisplayName = dTmrTime.Add(time.Hour * 24).Format(util.CommonDateFormat)
-
-							tomorrowKey := tmrCronEntry.UTCTime.Format(util.CommonDateFormat)
-							c.cronTimeEntries[tomorrowKey] = tmrCronEntry
-						}
-					} // end -- if (job running)??
-				}
+		go c.schedulerLoop(c.stopChannel)
+		go c.spoolLoop(c.stopChannel)
+	}
+	return
+}
+
+// retry the due spooled store writes periodically until stopped
+func (c *StructCron) spoolLoop(stopChannel chan bool) {
+	interval := c.getSpoolRetryInterval()
+	for {
+		select {
+		case <-stopChannel:
+			return
+		case <-c.getClock().After(interval):
+		}
+		result, err := c.ReplaySpool(false)
+		if err != nil {
+			c.logError("spoolLoop", fmt.Sprintf("could not update the store spool => %v", err))
+		} else if result.Failed > 0 {
+			c.logError("spoolLoop", fmt.Sprintf("%v of %v spooled write(s) failed again, %v remaining",
+				result.Failed, result.Attempted, result.Remaining))
+		}
+	}
+}
+
+func (c *StructCron) schedulerLoop(stopChannel chan bool) {
+	for {
+		clock := c.getClock()
+		c.RunDueTimeCrons(clock.Now())
+
+		// sleep until the next fire time (or a while if nothing is scheduled)
+		sleepDuration := time.Hour
+		c.lock.Lock()
+		pNext := c.entryHeap.peek()
+		if pNext != nil {
+			sleepDuration = pNext.UTCTime.Sub(clock.Now())
+		}
+		c.lock.Unlock()
+		if sleepDuration < 0 {
+			sleepDuration = 0
+		}
+
+		select {
+		case <-stopChannel:
+			return
+		case <-c.wakeChannel:
+		case <-clock.After(sleepDuration):
+		}
+	}
+}
+
+// return the clock in use (thread-safe)
+func (c *StructCron) getClock() (clock util.IClock) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.clock
+}
+
+// run the cron-time entries which are due at the given current-time;
+// each due entry is moved to its next schedule afterwards
+func (c *StructCron) RunDueTimeCrons(currentTime time.Time) {
+	currentTimeUTC := currentTime.In(time.UTC)
+	for {
+		// pop the next due entry (if any) and take a snapshot of its rules
+		c.lock.Lock()
+		pEntry := c.entryHeap.peek()
+		if pEntry == nil || pEntry.UTCTime.After(currentTimeUTC) {
+			c.lock.Unlock()
+			return
+		}
+		heap.Pop(&c.entryHeap)
+		pEntry.isJobRunning = true
+		entry := pEntry.copy()
+		c.lock.Unlock()
+
+		// the display-name keeps the timezone of the schedule (needed for weekend / holiday checks)
+		dDisplayTime, _ := time.Parse(util.CommonDateFormat, entry.DisplayName)
+		// the latest schedule not after the current-time (could be days ago after a downtime)
+		dueTime := entry.UTCTime
+		for !dueTime.Add(time.Hour * 24).After(currentTimeUTC) {
+			dueTime = dueTime.Add(time.Hour * 24)
+		}
+		for _, stockModuleKey := range entry.StocksModuleRuleList {
+			// paused rules are skipped until resumed
+			if entry.isRulePaused(stockModuleKey) {
+				continue
 			}
-		}()
+			// TODO might need to run in parallel?? though in this case not that important
+			// a failed job is recorded in the history and would not stop the other jobs
+			c.runDueCrawlJob(stockModuleKey, dueTime, dDisplayTime.Location(), currentTimeUTC)
+		} // end -- for (all stock module involved run)
+
+		// update the cron-time entry to the next schedule (tomorrow)
+		c.lock.Lock()
+		c.rescheduleCronEntry(pEntry, dueTime.Add(time.Hour * 24), dDisplayTime)
+		c.lock.Unlock()
+	}
+}
+
+// move the (popped) entry to the next fire time and push it back to the heap; rules moved or removed
+// while the job was running are respected. Caller MUST hold the lock
+func (c *StructCron) rescheduleCronEntry(pEntry *StructCronEntry, nextUTCTime time.Time, dDisplayTime time.Time) {
+	pEntry.isJobRunning = false
+	entryKey := pEntry.UTCTime.Format(util.CommonDateFormat)
+	if c.cronTimeEntries[entryKey] != pEntry {
+		// all rules were removed / moved during the job-run
+		return
+	}
+	delete(c.cronTimeEntries, entryKey)
+
+	daysToNext := nextUTCTime.Sub(pEntry.UTCTime)
+	pEntry.UTCTime = nextUTCTime
+	pEntry.DisplayName = dDisplayTime.Add(daysToNext).Format(util.CommonDateFormat)
+	nextKey := nextUTCTime.Format(util.CommonDateFormat)
+
+	if pExisting := c.cronTimeEntries[nextKey]; pExisting != nil {
+		// a rule was scheduled at the next fire time during the job-run; merge into the existing entry
+		for _, rule := range pEntry.StocksModuleRuleList {
+			pExisting.StocksModuleRuleList = append(pExisting.StocksModuleRuleList, rule)
+			c.ruleIndex[rule] = nextKey
+		}
+		pExisting.PausedStocksModuleRuleList = append(pExisting.PausedStocksModuleRuleList, pEntry.PausedStocksModuleRuleList...)
+		return
+	}
+	c.cronTimeEntries[nextKey] = pEntry
+	for _, rule := range pEntry.StocksModuleRuleList {
+		c.ruleIndex[rule] = nextKey
+	}
+	heap.Push(&c.entryHeap, pEntry)
+}
+
+// run the crawler job for the given stock-module-rule and record the outcome in the history
+func (c *StructCron) runCrawlJob(stockModuleKey string, scheduledTime time.Time) (record StructCronJobRecord) {
+	record.StocksModuleRule = stockModuleKey
+	record.ScheduledTime = scheduledTime
+	record.StartTime = c.getClock().Now()
+	record.Outcome = CronJobOutcomeSuccess
+
+	// use a factory method to return a crawler instance suitable for the crawl (with caching)
+	iCrawler := crawler.GetCrawler(stockModuleKey, c.getModuleConfigs(), c.getClock())
+	storeList, storeKeys, err := c.getStoreList(stockModuleKey)
+	record.Stores = make([]string, 0)
+	// failed writes are spooled and retried later; the other stores are still written
+	spoolingStores := make([]*store.StructSpoolingStore, len(storeList))
+	for i := range storeList {
+		spoolingStores[i] = store.NewStructSpoolingStore(storeList[i], storeKeys[i], c.pSpool)
+		storeList[i] = spoolingStores[i]
+	}
+	if iCrawler == nil {
+		err = errors.New(fmt.Sprintf("no crawler available for %v", stockModuleKey))
+	} else {
+		record.Crawler = strings.TrimPrefix(fmt.Sprintf("%T", iCrawler), "*")
+		if err == nil {
+			err = iCrawler.Crawl(stockModuleKey, storeList)
+		}
+	}
+	// ONLY the stores which accepted the record
+	for _, pSpoolingStore := range spoolingStores {
+		if pSpoolingStore.GetPersistedCount() > 0 {
+			record.Stores = append(record.Stores, pSpoolingStore.GetStoreKey())
+		}
 	}
+	if err != nil {
+		record.Outcome = CronJobOutcomeFailure
+		record.ErrorMessage = err.Error()
+		c.logError("runCrawlJob", fmt.Sprintf("%v => %v", stockModuleKey, err))
+	}
+	record.EndTime = c.getClock().Now()
+	record.DurationMillis = record.EndTime.Sub(record.StartTime).Nanoseconds() / int64(time.Millisecond)
+
+	c.appendHistory(record)
 	return
 }
 
-func (c *StructCron) getStoreList(stockModuleKey string) (storeList []store.IStore, err error) {
+// append the record to the job-run history; failure is logged but not returned
+func (c *StructCron) appendHistory(record StructCronJobRecord) {
+	err := c.pHistory.Append(record)
+	if err != nil {
+		c.logError("appendHistory", fmt.Sprintf("could not record the job-run history => %v", err))
+	}
+}
+
+func (c *StructCron) getStoreList(stockModuleKey string) (storeList []store.IStore, storeKeys []string, err error) {
 	// stockModuleKey => stock_aastocks.939_construction_bank_cn
 	storeList = make([]store.IStore, 0)
+	storeKeys = make([]string, 0)
 
-	// need filestore???
-	fRepo := c.pCfg.AppConfig.Get(common.ConfigKeyStoreFile, common.ConfigKeyRepo).String("")
-	if !util.IsEmptyString(fRepo) {
-		filepath := fmt.Sprintf("%v.%v", common.ConfigKeyStoreFile, stockModuleKey)
-		iStore, err2 := store.GetStoreByKey(filepath, c.pCfg.AppConfig, nil)
+	if c.pCfg == nil || c.pCfg.AppConfig == nil {
+		return
+	}
+	for _, storeKey := range getConfiguredStoreKeys(c.pCfg.AppConfig, stockModuleKey) {
+		iStore, err2 := store.GetStoreByKey(storeKey, c.pCfg.AppConfig, nil)
 		if err2 != nil {
 			err = err2
 			return
 		}
 		storeList = append(storeList, iStore)
+		storeKeys = append(storeKeys, storeKey)
 	}
-	// need datastore???
-	// TODO: tbd
+	return
+}
 
+// return the keys of the stores configured in the app.toml for the stock module key
+// (e.g. stock_aastocks.939_construction_bank_cn => filestore.stock_aastocks.939_construction_bank_cn)
+func getConfiguredStoreKeys(appConfig config2.Config, stockModuleKey string) (storeKeys []string) {
+	storeKeys = make([]string, 0)
+	// need filestore???
+	fRepo := appConfig.Get(common.ConfigKeyStoreFile, common.ConfigKeyRepo).String("")
+	if !util.IsEmptyString(fRepo) {
+		storeKeys = append(storeKeys, fmt.Sprintf("%v.%v", common.ConfigKeyStoreFile, stockModuleKey))
+	}
+	// need datastore???
+	dType := appConfig.Get(common.ConfigKeyStoreData, common.ConfigKeyStoreDataType).String("")
+	dHosts := appConfig.Get(common.ConfigKeyStoreData, common.ConfigKeyStoreDataHosts).StringSlice(nil)
+	if !util.IsEmptyString(dType) || len(dHosts) > 0 {
+		storeKeys = append(storeKeys, fmt.Sprintf("%v.%v", common.ConfigKeyStoreData, stockModuleKey))
+	}
+	// need sqlitestore???
+	sPath := appConfig.Get(common.ConfigKeyStoreSqlite, common.ConfigKeyStorePath).String("")
+	if !util.IsEmptyString(sPath) {
+		storeKeys = append(storeKeys, fmt.Sprintf("%v.%v", common.ConfigKeyStoreSqlite, stockModuleKey))
+	}
+	// need boltstore???
+	bPath := appConfig.Get(common.ConfigKeyStoreBolt, common.ConfigKeyStorePath).String("")
+	if !util.IsEmptyString(bPath) {
+		storeKeys = append(storeKeys, fmt.Sprintf("%v.%v", common.ConfigKeyStoreBolt, stockModuleKey))
+	}
+	// need influxstore???
+	iUrl := appConfig.Get(common.ConfigKeyStoreInflux, common.ConfigKeyStoreInfluxUrl).String("")
+	if !util.IsEmptyString(iUrl) {
+		storeKeys = append(storeKeys, fmt.Sprintf("%v.%v", common.ConfigKeyStoreInflux, stockModuleKey))
+	}
 	return
 }
 
-// stop the running cron ticker loop
+// stop the running cron scheduler loop
 func (c *StructCron) StopCron() (err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
 	if c.isCronTickRunning {
-		c.pTickerCron.Stop()
+		close(c.stopChannel)
+		c.isCronTickRunning = false
 	}
 	return
 }
@@ -0,0 +1,500 @@
+/*
+ *  Copyright Project - Stockbinator, Author - quoeamaster, (C) 2019
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+package webservice
+
+import (
+	"Stockbinator/common"
+	"Stockbinator/config"
+	"Stockbinator/store"
+	"Stockbinator/util"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/daviddengcn/go-colortext"
+	"github.com/daviddengcn/go-colortext/fmt"
+	"github.com/emicklei/go-restful"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const moduleWSStore = "storeService"
+
+// webservice managing the stores (e.g. copying the records from one store to another)
+type StructStoreService struct {
+	// the config information for the stores
+	pCfg *config.StructConfig
+	// migration id -> migration started through the service
+	migrations map[string]*store.StructStoreMigration
+	// migration ids in the order started
+	migrationIds []string
+	// id of the next migration
+	nextMigrationId int
+	// retention runs (the latest last, at most common.StoreRetentionHistorySize)
+	retentionRuns []store.StructRetentionRun
+	// a retention run at a time
+	retentionLock sync.Mutex
+	isRetentionRunning bool
+	stopChannel chan bool
+	clock util.IClock
+
+	lock sync.Mutex
+}
+
+// structure returned by the migration API
+type StructStoreMigrationView struct {
+	Id       string
+	Progress store.StructStoreMigrationProgress
+}
+
+// creation method for StructStoreService
+func NewStructStoreService(pCfg *config.StructConfig) (pService *StructStoreService) {
+	pService = new(StructStoreService)
+	pService.pCfg = pCfg
+	pService.migrations = make(map[string]*store.StructStoreMigration)
+	pService.migrationIds = make([]string, 0)
+	pService.nextMigrationId = 1
+	pService.retentionRuns = make([]store.StructRetentionRun, 0)
+	pService.clock = util.GetClock()
+	return
+}
+
+// set the clock of the retention job (e.g. util.StructFakeClock in tests)
+func (s *StructStoreService) SetClock(clock util.IClock) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.clock = util.GetClock(clock)
+}
+
+func (s *StructStoreService) getClock() util.IClock {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.clock
+}
+
+func (s *StructStoreService) CreateWebservice() *restful.WebService {
+	pWs := new(restful.WebService)
+	pWs.Path("/stores").
+		Consumes(restful.MIME_JSON).
+		Produces(restful.MIME_JSON)
+	// routes under "stores" endpoint (API)
+	// NOTE: a full scan of every store in use per call (the counts are not cached), hence not meant for frequent polling
+	pWs.Route(pWs.GET("").To(s.listStoreStatsAPI))
+	pWs.Route(pWs.POST("migration").To(s.startMigrationAPI))
+	pWs.Route(pWs.GET("migration").To(s.listMigrationAPI))
+	pWs.Route(pWs.GET("migration/{id}").To(s.getMigrationAPI))
+	pWs.Route(pWs.GET("export").Produces("text/csv").To(s.exportAPI))
+	pWs.Route(pWs.GET("retention").To(s.listRetentionAPI))
+	pWs.Route(pWs.POST("retention").To(s.runRetentionAPI))
+
+	return pWs
+}
+
+// start a migration in the background; the body is a store.StructStoreMigrationRequest, e.g.
+// {"Source": "filestore", "Target": "sqlitestore", "Module": "stock_aastocks", "Symbols": ["700_tencent"],
+// "From": "2019-07-01T00:00:00+08:00"}; all the symbols of the module are migrated if none given
+func (s *StructStoreService) startMigrationAPI(pReq *restful.Request, pRes *restful.Response) {
+	defer func() {
+		pReq.Request.Body.Close()
+	}()
+	request := store.StructStoreMigrationRequest{}
+	err := json.NewDecoder(pReq.Request.Body).Decode(&request)
+	if err != nil {
+		s.writeCommonResponse("startMigrationAPI", pRes, util.NewStructCommonResponse(http.StatusBadRequest,
+			fmt.Sprintf("invalid migration request => %v", err)))
+		return
+	}
+	id, pMigration, err := s.StartMigration(request)
+	if err != nil {
+		s.writeCommonResponse("startMigrationAPI", pRes, util.NewStructCommonResponse(http.StatusBadRequest, err.Error()))
+		return
+	}
+	err = pRes.WriteHeaderAndJson(http.StatusAccepted, StructStoreMigrationView{ Id: id, Progress: pMigration.GetProgress() }, restful.MIME_JSON)
+	if err != nil {
+		// just log and continue to serve (sometimes it is a disconnection which could be re-covered)
+		s.logError("startMigrationAPI", err.Error())
+	}
+}
+
+// list the migrations started (with progress)
+func (s *StructStoreService) listMigrationAPI(pReq *restful.Request, pRes *restful.Response) {
+	err := pRes.WriteAsJson(s.ListMigrations())
+	if err != nil {
+		// just log and continue to serve (sometimes it is a disconnection which could be re-covered)
+		s.logError("listMigrationAPI", err.Error())
+	}
+}
+
+// return the progress of the migration given by path parameter "id"
+func (s *StructStoreService) getMigrationAPI(pReq *restful.Request, pRes *restful.Response) {
+	id := pReq.PathParameter("id")
+	s.lock.Lock()
+	pMigration := s.migrations[id]
+	s.lock.Unlock()
+	if pMigration == nil {
+		s.writeCommonResponse("getMigrationAPI", pRes, util.NewStructCommonResponse(http.StatusNotFound,
+			fmt.Sprintf("no migration found, id => %v", id)))
+		return
+	}
+	err := pRes.WriteAsJson(StructStoreMigrationView{ Id: id, Progress: pMigration.GetProgress() })
+	if err != nil {
+		// just log and continue to serve (sometimes it is a disconnection which could be re-covered)
+		s.logError("getMigrationAPI", err.Error())
+	}
+}
+
+// export the records of a store as csv (columns based on the module's schema); query parameters =>
+// store (store key, e.g. sqlitestore.stock_aastocks.700_tencent), optional from and to (date in the format of 2019-07-03T16:10:00+08:00)
+func (s *StructStoreService) exportAPI(pReq *restful.Request, pRes *restful.Response) {
+	storeKey := pReq.QueryParameter("store")
+	from, err := parseStoreDateParam(pReq.QueryParameter("from"))
+	if err == nil {
+		var to time.Time
+		to, err = parseStoreDateParam(pReq.QueryParameter("to"))
+		if err == nil {
+			err = s.prepareExport(storeKey, from, to, pRes)
+		}
+	}
+	if err != nil {
+		s.writeCommonResponse("exportAPI", pRes, util.NewStructCommonResponse(http.StatusBadRequest, err.Error()))
+	}
+}
+
+// resolve the store and its schema, then stream the records; errors before the first byte written are returned
+func (s *StructStoreService) prepareExport(storeKey string, from, to time.Time, pRes *restful.Response) (err error) {
+	iStore, pSchema, err := s.GetStoreWithSchema(storeKey)
+	if err != nil {
+		return
+	}
+	_, iterator, err := iStore.Iterate(store.PredicateByTrxDateRange(from, to))
+	if err != nil {
+		return
+	}
+	defer func() {
+		_ = iterator.Close()
+	}()
+	pRes.AddHeader("Content-Type", "text/csv")
+	pRes.WriteHeader(http.StatusOK)
+	_, err2 := store.ExportRecordsAsCsv(pRes, iterator, pSchema)
+	if err2 != nil {
+		// the status is already sent; just log
+		s.logError("exportAPI", fmt.Sprintf("%v => %v", storeKey, err2))
+	}
+	return
+}
+
+// list the stores in use (ordered by the store key) with their record counts, first and last trx_date
+// per symbol and the latest failed write; a store stopped growing shows an old LastTrxDate.
+// Every record of every store is read on each call, hence the cost grows with the stored data
+func (s *StructStoreService) listStoreStatsAPI(pReq *restful.Request, pRes *restful.Response) {
+	err := pRes.WriteAsJson(s.ListStoreStats())
+	if err != nil {
+		// just log and continue to serve (sometimes it is a disconnection which could be re-covered)
+		s.logError("listStoreStatsAPI", err.Error())
+	}
+}
+
+// list the retention runs (the latest last) with the records removed per store
+func (s *StructStoreService) listRetentionAPI(pReq *restful.Request, pRes *restful.Response) {
+	err := pRes.WriteAsJson(s.ListRetentionRuns())
+	if err != nil {
+		// just log and continue to serve (sometimes it is a disconnection which could be re-covered)
+		s.logError("listRetentionAPI", err.Error())
+	}
+}
+
+// enforce the retention rules now; returns the run
+func (s *StructStoreService) runRetentionAPI(pReq *restful.Request, pRes *restful.Response) {
+	err := pRes.WriteAsJson(s.RunRetention())
+	if err != nil {
+		// just log and continue to serve (sometimes it is a disconnection which could be re-covered)
+		s.logError("runRetentionAPI", err.Error())
+	}
+}
+
+func (s *StructStoreService) writeCommonResponse(funcName string, pRes *restful.Response, pRO *util.StructCommonResponse) {
+	err := pRes.WriteHeaderAndJson(pRO.ResponseCode, *pRO, restful.MIME_JSON)
+	if err != nil {
+		// just log and continue to serve (sometimes it is a disconnection which could be re-covered)
+		s.logError(funcName, err.Error())
+	}
+}
+
+
+// * ******************************* *
+// * non web-service related methods *
+// * ******************************* *
+
+// start the migration in the background; a migration of the same source, target and module
+// which is still running is rejected
+func (s *StructStoreService) StartMigration(request store.StructStoreMigrationRequest) (id string, pMigration *store.StructStoreMigration, err error) {
+	pMigration, err = s.NewMigration(request)
+	if err != nil {
+		return
+	}
+	s.lock.Lock()
+	for _, existingId := range s.migrationIds {
+		progress := s.migrations[existingId].GetProgress()
+		if isSameMigrationScope(progress.Request, request) &&
+			(progress.Status == store.MigrationStatusPending || progress.Status == store.MigrationStatusRunning) {
+			s.lock.Unlock()
+			err = errors.New(fmt.Sprintf("migration [%v] of the same stores is still running", existingId))
+			return
+		}
+	}
+	id = fmt.Sprintf("%v", s.nextMigrationId)
+	s.nextMigrationId++
+	s.migrations[id] = pMigration
+	s.migrationIds = append(s.migrationIds, id)
+	s.lock.Unlock()
+
+	go func() {
+		_, err2 := pMigration.Run()
+		if err2 != nil {
+			s.logError("StartMigration", fmt.Sprintf("migration [%v] failed => %v", id, err2))
+		}
+	}()
+	return
+}
+
+// return the migrations started (in the order started)
+func (s *StructStoreService) ListMigrations() (views []StructStoreMigrationView) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	views = make([]StructStoreMigrationView, 0, len(s.migrationIds))
+	for _, id := range s.migrationIds {
+		views = append(views, StructStoreMigrationView{ Id: id, Progress: s.migrations[id].GetProgress() })
+	}
+	return
+}
+
+// create a migration for the request; all the symbols of the module (based on its rules) are migrated if none given.
+// The checkpoint lives under [filestore] repo, hence an interrupted migration continues when requested again
+func (s *StructStoreService) NewMigration(request store.StructStoreMigrationRequest) (pMigration *store.StructStoreMigration, err error) {
+	if len(request.Symbols) == 0 {
+		request.Symbols = s.getModuleSymbols(request.Module)
+	}
+	return store.NewStructStoreMigration(request, s.getMigrationCheckpointFilepath(request), s.resolveStore)
+}
+
+// the symbols of the module's rules, sorted
+func (s *StructStoreService) getModuleSymbols(module string) (symbols []string) {
+	symbols = make([]string, 0)
+	if s.pCfg == nil {
+		return
+	}
+	moduleConfig, found := s.pCfg.ModuleConfigs[module]
+	if !found || moduleConfig.Rules == nil {
+		return
+	}
+	for symbol := range moduleConfig.Rules.Map() {
+		symbols = append(symbols, symbol)
+	}
+	sort.Strings(symbols)
+	return
+}
+
+// checkpoint file of the migration, e.g. {repo}migration.filestore.sqlitestore.stock_aastocks;
+// empty (no resumability) if [filestore] repo is not available
+func (s *StructStoreService) getMigrationCheckpointFilepath(request store.StructStoreMigrationRequest) (filepath string) {
+	if s.pCfg == nil || s.pCfg.AppConfig == nil {
+		return
+	}
+	repo := s.pCfg.AppConfig.Get(common.ConfigKeyStoreFile, common.ConfigKeyRepo).String("")
+	if util.IsEmptyString(repo) {
+		return
+	}
+	repo, err := util.ReplaceEnvVarInPath(repo)
+	if err != nil {
+		s.logError("getMigrationCheckpointFilepath", err.Error())
+		return
+	}
+	filepath = fmt.Sprintf("%v%v.%v.%v.%v", repo, common.StoreMigrationCheckpointPrefix,
+		request.Source, request.Target, request.Module)
+	return
+}
+
+// resolve the store key ({store_type}.{stock_module}.{symbol}) into the store instance plus the module's schema (nil if not declared)
+func (s *StructStoreService) GetStoreWithSchema(storeKey string) (iStore store.IStore, pSchema *store.StructStoreSchema, err error) {
+	parts := strings.Split(storeKey, ".")
+	if len(parts) != 3 {
+		err = errors.New(fmt.Sprintf("invalid store key [%v], expected [{store_type}.{stock_module}.{symbol}]", storeKey))
+		return
+	}
+	iStore, err = s.resolveStore(storeKey)
+	if err != nil {
+		return
+	}
+	pSchema, err = store.GetSchemaFromConfig(s.pCfg.AppConfig, parts[1])
+	return
+}
+
+// parse the date query parameter; empty value means no bound (zero time)
+func parseStoreDateParam(value string) (date time.Time, err error) {
+	if util.IsEmptyString(value) {
+		return
+	}
+	date, err = time.Parse(util.CommonDateFormat, value)
+	if err != nil {
+		err = errors.New(fmt.Sprintf("invalid date [%v], expected format is [2019-07-03T16:10:00+08:00]", value))
+	}
+	return
+}
+
+// start enforcing the retention rules periodically ([retention] interval) if not yet started
+func (s *StructStoreService) StartRetention() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.isRetentionRunning {
+		s.isRetentionRunning = true
+		s.stopChannel = make(chan bool)
+		go s.retentionLoop(s.stopChannel, s.getRetentionInterval())
+	}
+}
+
+// stop the periodic retention runs
+func (s *StructStoreService) StopRetention() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.isRetentionRunning {
+		close(s.stopChannel)
+		s.isRetentionRunning = false
+	}
+}
+
+func (s *StructStoreService) retentionLoop(stopChannel chan bool, interval time.Duration) {
+	for {
+		select {
+		case <-stopChannel:
+			return
+		case <-s.getClock().After(interval):
+		}
+		run := s.RunRetention()
+		if run.Failed > 0 {
+			s.logError("retentionLoop", fmt.Sprintf("retention failed on %v store(s), %v record(s) removed", run.Failed, run.Removed))
+		}
+	}
+}
+
+// how often the retention rules are enforced ([retention] interval)
+func (s *StructStoreService) getRetentionInterval() (interval time.Duration) {
+	interval = time.Second * common.StoreRetentionDefaultIntervalSeconds
+	if s.pCfg != nil && s.pCfg.AppConfig != nil {
+		interval = s.pCfg.AppConfig.Get(common.ConfigKeyRetention, common.ConfigKeyRetentionInterval).Duration(interval)
+	}
+	if interval <= 0 {
+		interval = time.Second * common.StoreRetentionDefaultIntervalSeconds
+	}
+	return
+}
+
+// enforce the retention rules on the configured stores of every symbol of the stock modules; stores whose
+// records are kept forever are not visited. The run is kept for the report (see ListRetentionRuns)
+func (s *StructStoreService) RunRetention() (run store.StructRetentionRun) {
+	s.retentionLock.Lock()
+	defer s.retentionLock.Unlock()
+
+	clock := s.getClock()
+	run.StartTime = clock.Now()
+	run.Stores = make([]store.StructRetentionResult, 0)
+	if s.pCfg != nil && s.pCfg.AppConfig != nil {
+		modules := make([]string, 0, len(s.pCfg.ModuleConfigs))
+		for module := range s.pCfg.ModuleConfigs {
+			modules = append(modules, module)
+		}
+		sort.Strings(modules)
+		for _, module := range modules {
+			for _, symbol := range s.getModuleSymbols(module) {
+				for _, storeKey := range getConfiguredStoreKeys(s.pCfg.AppConfig, fmt.Sprintf("%v.%v", module, symbol)) {
+					storeType := strings.Split(storeKey, ".")[0]
+					keepDays := store.GetRetentionDaysFromConfig(s.pCfg.AppConfig, storeType, module)
+					if keepDays == 0 {
+						continue
+					}
+					result := store.StructRetentionResult{ StoreKey: storeKey, KeepDays: keepDays }
+					iStore, err := s.resolveStore(storeKey)
+					if err != nil {
+						result.Error = err.Error()
+					} else {
+						result = store.ApplyRetention(iStore, storeKey, symbol, keepDays, run.StartTime)
+					}
+					run.Removed += result.Removed
+					if !util.IsEmptyString(result.Error) {
+						run.Failed++
+					}
+					run.Stores = append(run.Stores, result)
+				}
+			}
+		}
+	}
+	run.EndTime = clock.Now()
+
+	s.lock.Lock()
+	s.retentionRuns = append(s.retentionRuns, run)
+	if len(s.retentionRuns) > common.StoreRetentionHistorySize {
+		s.retentionRuns = s.retentionRuns[len(s.retentionRuns)-common.StoreRetentionHistorySize:]
+	}
+	s.lock.Unlock()
+	return
+}
+
+// return the retention runs (the latest last)
+func (s *StructStoreService) ListRetentionRuns() (runs []store.StructRetentionRun) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	runs = make([]store.StructRetentionRun, len(s.retentionRuns))
+	copy(runs, s.retentionRuns)
+	return
+}
+
+// return the statistics of the stores created so far (the store cache of store.GetStoreByKey),
+// ordered by the store key; the stores are scanned in full (nothing cached between calls)
+func (s *StructStoreService) ListStoreStats() (statsList []store.StructStoreStats) {
+	stores := store.GetCachedStores()
+	storeKeys := make([]string, 0, len(stores))
+	for storeKey := range stores {
+		storeKeys = append(storeKeys, storeKey)
+	}
+	sort.Strings(storeKeys)
+	statsList = make([]store.StructStoreStats, 0, len(storeKeys))
+	for _, storeKey := range storeKeys {
+		statsList = append(statsList, store.GetStoreStats(storeKey, stores[storeKey]))
+	}
+	return
+}
+
+// resolve the store key into the store instance
+func (s *StructStoreService) resolveStore(storeKey string) (iStore store.IStore, err error) {
+	if s.pCfg == nil || s.pCfg.AppConfig == nil {
+		err = errors.New(fmt.Sprintf("no config available to resolve the store => %v", storeKey))
+		return
+	}
+	return store.GetStoreByKey(storeKey, s.pCfg.AppConfig, nil)
+}
+
+func isSameMigrationScope(request, otherRequest store.StructStoreMigrationRequest) bool {
+	return strings.Compare(request.Source, otherRequest.Source) == 0 &&
+		strings.Compare(request.Target, otherRequest.Target) == 0 &&
+		strings.Compare(request.Module, otherRequest.Module) == 0
+}
+
+func (s *StructStoreService) logError(funcName string, msg string) {
+	ctfmt.Print(ct.Red, true, fmt.Sprintf("[%v%v] ", moduleWSStore, funcName))
+	ctfmt.Println(ct.White, true, msg)
+}